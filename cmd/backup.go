@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+)
+
+var backupCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to, _ := cmd.Flags().GetString("to")
+		incremental, _ := cmd.Flags().GetBool("incremental")
+		db, err := internal.OpenBitCaskStore(dataDir)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		report, err := db.Backup(to, incremental)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("backed up %d segments into %s, %d copied (%d bytes)\n",
+			len(report.Manifest.Segments), to, report.Copied, report.Bytes)
+		return nil
+	},
+	Use:   "backup --to <dir|file.tar>",
+	Short: "Take a consistent snapshot of the store",
+	Long: `Take a consistent snapshot of the store.
+
+The command opens the data folder itself, so it only works while no server
+holds the store. A running server started with --backup-dir takes backups
+through POST /backup?to=<dir|file.tar>[&incremental=true] instead.`,
+}
+
+var restoreCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		manifest, err := internal.Restore(from, dataDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %d segments into %s\n", len(manifest.Segments), dataDir)
+		return nil
+	},
+	Use:   "restore --from <dir|file.tar>",
+	Short: "Populate an empty data folder from a backup",
+}
+
+func init() {
+	backupCommand.Flags().String("to", "", "backup folder or .tar archive")
+	backupCommand.Flags().Bool("incremental", false, "only copy segments missing from the previous backup")
+	backupCommand.MarkFlagRequired("to")
+	restoreCommand.Flags().String("from", "", "backup folder or .tar archive")
+	restoreCommand.MarkFlagRequired("from")
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+)
+
+var compactCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		now, _ := cmd.Flags().GetBool("now")
+		rate, _ := cmd.Flags().GetInt64("rate")
+		windows, err := timeWindows(cmd)
+		if err != nil {
+			return err
+		}
+		if !now && len(windows) == 0 {
+			return fmt.Errorf("either run with --now or give a --window to wait for")
+		}
+		if !now {
+			waitForWindow(windows)
+		}
+		// the value logs are only collected by stores separating their
+		// values, and compacting writes nothing else, so any store is opened
+		// as one
+		db, err := internal.OpenBitCaskStore(dataDir, internal.WithValueLog(),
+			internal.WithCompactionThrottle(internal.NewCompactionThrottle(rate, 0)))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		info, err := db.Compact(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %d of %d segments, reclaiming %d bytes in %v\n",
+			len(info.Deleted), info.Candidates, info.ReclaimedBytes, info.Duration)
+		return nil
+	},
+	Use:   "compact [--now] [--window <HH:MM-HH:MM>] [--rate <bytes/s>]",
+	Short: "Reclaim the space of the unused segments and value logs",
+}
+
+// timeWindows parses the --window flags of cmd
+func timeWindows(cmd *cobra.Command) ([]internal.TimeWindow, error) {
+	flags, _ := cmd.Flags().GetStringSlice("window")
+	windows := make([]internal.TimeWindow, 0, len(flags))
+	for _, flag := range flags {
+		window, err := internal.ParseTimeWindow(flag)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// waitForWindow returns once the local time falls within one of windows
+func waitForWindow(windows []internal.TimeWindow) {
+	for {
+		for _, window := range windows {
+			if window.Contains(time.Now()) {
+				return
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+func init() {
+	compactCommand.Flags().Bool("now", false, "compact right away rather than within the next window")
+	compactCommand.Flags().StringSlice("window", nil, "daily window of local time to compact in, such as 22:00-06:00")
+	compactCommand.Flags().Int64("rate", 0, "limit the compaction IO to this many bytes per second, 0 for no limit")
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+)
+
+var exportCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		output, _ := cmd.Flags().GetString("output")
+		db, err := internal.OpenBitCaskStore(dataDir)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		var w io.Writer = os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		exported, err := internal.Export(db, w, internal.ExportFormat(format))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d records\n", exported)
+		return nil
+	},
+	Use:   "export [--format jsonl|csv] [--output <file>]",
+	Short: "Dump every key of the store into a portable format",
+}
+
+var importCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		if format == "" {
+			format = strings.TrimPrefix(filepath.Ext(args[0]), ".")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		db, err := internal.OpenBitCaskStore(dataDir)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		report, err := internal.Import(db, f, internal.ExportFormat(format))
+		if report != nil {
+			for _, lineErr := range report.Errors {
+				fmt.Fprintln(os.Stderr, lineErr.Error())
+			}
+			fmt.Printf("imported %d records, %d failed\n", report.Imported, report.Failed)
+		}
+		return err
+	},
+	Args:  cobra.ExactArgs(1),
+	Use:   "import <file> [--format jsonl|csv]",
+	Short: "Bulk load records exported by the export command",
+}
+
+func init() {
+	exportCommand.Flags().String("format", string(internal.FormatJSONLines), "jsonl or csv")
+	exportCommand.Flags().StringP("output", "o", "", "file to write to instead of stdout")
+	importCommand.Flags().String("format", "", "jsonl or csv, guessed from the file extension by default")
+}
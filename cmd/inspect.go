@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+	"pingcap.com/kvs/internal/segments/encoding"
+)
+
+var dumpCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		preview, _ := cmd.Flags().GetInt("preview")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "OFFSET\tSIZE\tFLAGS\tKEYSPACE\tKEY\tVALUE")
+		err := internal.DumpSegment(args[0], func(dumped internal.DumpedRecord) error {
+			if dumped.Err != nil {
+				_, err := fmt.Fprintf(w, "%d\t-\tdamaged\t-\t-\t%v\n", dumped.Offset, dumped.Err)
+				return err
+			}
+			record := dumped.Record
+			var flags []string
+			if record.Tombstone() {
+				flags = append(flags, "tombstone")
+			}
+			if record.Flags&encoding.FlagCompressed != 0 {
+				flags = append(flags, "compressed")
+			}
+			if record.Blob() {
+				flags = append(flags, "blob")
+			}
+			if record.ValuePointer() {
+				flags = append(flags, "value-pointer")
+			}
+			if record.ExpiresAt != 0 {
+				flags = append(flags, "expires="+time.Unix(0, record.ExpiresAt).UTC().Format(time.RFC3339))
+			}
+			if len(flags) == 0 {
+				flags = append(flags, "-")
+			}
+			value := fmt.Sprintf("%d bytes", len(record.Value))
+			if preview > 0 && len(record.Value) > 0 {
+				shown := record.Value
+				if len(shown) > preview {
+					shown = shown[:preview]
+				}
+				value += " " + strconv.Quote(string(shown))
+			}
+			_, err := fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%s\t%s\n", dumped.Offset, record.Size, strings.Join(flags, ","),
+				record.Keyspace, strconv.Quote(string(record.Key)), value)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	},
+	Args:  cobra.ExactArgs(1),
+	Use:   "dump <segment file>",
+	Short: "Print every record of a segment file",
+}
+
+var statsCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		top, _ := cmd.Flags().GetInt("top")
+		stats, err := internal.CollectStats(dataDir, top)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SEGMENT\tRECORDS\tTOMBSTONES\tBYTES\tLIVE\tDEAD")
+		for _, segment := range stats.Segments {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", segment.File, segment.Records, segment.Tombstones,
+				segment.Bytes, segment.LiveBytes, segment.DeadBytes())
+		}
+		for _, valueLog := range stats.ValueLogs {
+			fmt.Fprintf(w, "%s\t%d\t-\t%d\t%d\t%d\n", valueLog.File, valueLog.Records,
+				valueLog.Bytes, valueLog.LiveBytes, valueLog.DeadBytes())
+		}
+		if stats.BlobBytes > 0 {
+			fmt.Fprintf(w, "blobs\t-\t-\t%d\t%d\t%d\n", stats.BlobBytes, stats.LiveBlobBytes, stats.BlobBytes-stats.LiveBlobBytes)
+		}
+		fmt.Fprintf(w, "total\t%d keys\t\t%d\t%d\t%d\n", stats.Keys, stats.Bytes, stats.LiveBytes, stats.Bytes-stats.LiveBytes)
+		if len(stats.LargestKeys) > 0 {
+			fmt.Fprintln(w, "\nKEYSPACE\tKEY\tSEGMENT\tSIZE")
+			for _, key := range stats.LargestKeys {
+				keyspace := key.Keyspace
+				if keyspace == "" {
+					keyspace = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", keyspace, strconv.Quote(key.Key), key.FileID, key.Size)
+			}
+		}
+		return w.Flush()
+	},
+	Use:   "stats [--top N]",
+	Short: "Summarise live and dead bytes per segment, value log and blobs without opening the store",
+}
+
+func init() {
+	dumpCommand.Flags().Int("preview", 32, "number of value bytes to print, 0 to only print lengths")
+	statsCommand.Flags().Int("top", 10, "number of largest keys to list")
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+)
+
+var reshardCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shards, _ := cmd.Flags().GetInt("shards")
+		moved, err := internal.Reshard(dataDir, shards)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("resharded %s into %d shards, %d keys moved\n", dataDir, shards, moved)
+		return nil
+	},
+	Use:   "reshard --shards <N>",
+	Short: "Spread the keys of a sharded store over a new number of shards",
+}
+
+func init() {
+	reshardCommand.Flags().Int("shards", 0, "target number of shards")
+	reshardCommand.MarkFlagRequired("shards")
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var dataDir string
+
 var rootCommand = &cobra.Command{
 	Use:   "kvs [options] [commands]",
 	Short: "Operates over a KV store",
@@ -21,6 +23,17 @@ func init() {
 	rootCommand.AddCommand(getCommand)
 	rootCommand.AddCommand(setCommand)
 	rootCommand.AddCommand(rmCommand)
+	rootCommand.AddCommand(reshardCommand)
+	rootCommand.AddCommand(backupCommand)
+	rootCommand.AddCommand(restoreCommand)
+	rootCommand.AddCommand(exportCommand)
+	rootCommand.AddCommand(importCommand)
+	rootCommand.AddCommand(verifyCommand)
+	rootCommand.AddCommand(compactCommand)
+	rootCommand.AddCommand(dumpCommand)
+	rootCommand.AddCommand(statsCommand)
+	rootCommand.AddCommand(serveCommand)
+	rootCommand.PersistentFlags().StringVar(&dataDir, "data-dir", ".", "folder holding the store data")
 	rootCommand.Flags().BoolVarP(&verbose, "version", "V", false, "version")
 }
 
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+	"pingcap.com/kvs/internal/metrics"
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/server"
+)
+
+var serveCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		addr, _ := cmd.Flags().GetString("addr")
+		diskIndex, _ := cmd.Flags().GetBool("disk-index")
+		compactKeyDir, _ := cmd.Flags().GetBool("compact-keydir")
+		maxMapped, _ := cmd.Flags().GetInt("max-mapped-segments")
+		maxKeySize, _ := cmd.Flags().GetInt("max-key-size")
+		maxValueSize, _ := cmd.Flags().GetInt64("max-value-size")
+		blobThreshold, _ := cmd.Flags().GetInt64("blob-threshold")
+		valueLog, _ := cmd.Flags().GetBool("value-log")
+		preallocate, _ := cmd.Flags().GetBool("preallocate")
+		syncWrites, _ := cmd.Flags().GetBool("sync-writes")
+		rotateAfter, _ := cmd.Flags().GetDuration("rotate-after")
+		rotateRecords, _ := cmd.Flags().GetInt64("rotate-records")
+		compactionRate, _ := cmd.Flags().GetInt64("compaction-rate")
+		backupDir, _ := cmd.Flags().GetString("backup-dir")
+		compactionWindows, err := timeWindows(cmd)
+		if err != nil {
+			return err
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGoCollector())
+		registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		engineMetrics, err := metrics.NewPrometheus(registry)
+		if err != nil {
+			return err
+		}
+
+		opts := []internal.Option{internal.WithMetrics(engineMetrics)}
+		if diskIndex {
+			opts = append(opts, internal.WithDiskIndex())
+		}
+		if compactKeyDir {
+			opts = append(opts, internal.WithCompactKeyDir())
+		}
+		if maxMapped > 0 {
+			opts = append(opts, internal.WithMaxMappedSegments(maxMapped))
+		}
+		if valueLog {
+			opts = append(opts, internal.WithValueLog())
+		}
+		if preallocate {
+			opts = append(opts, internal.WithPreallocation())
+		}
+		if syncWrites {
+			opts = append(opts, internal.WithSyncWrites())
+		}
+		if rotateAfter > 0 || rotateRecords > 0 {
+			policies := []internal.RotationPolicy{internal.SizeRotation(segments.MaxSegmentSizeBytes)}
+			if rotateAfter > 0 {
+				policies = append(policies, internal.AgeRotation(rotateAfter))
+			}
+			if rotateRecords > 0 {
+				policies = append(policies, internal.CountRotation(rotateRecords))
+			}
+			opts = append(opts, internal.WithRotationPolicy(internal.AnyRotation(policies...)))
+		}
+		if compactionRate > 0 || len(compactionWindows) > 0 {
+			throttle := internal.NewCompactionThrottle(compactionRate, 0, compactionWindows...)
+			opts = append(opts, internal.WithCompactionThrottle(throttle))
+		}
+		opts = append(opts,
+			internal.WithMaxKeySize(maxKeySize),
+			internal.WithMaxValueSize(maxValueSize),
+			internal.WithBlobThreshold(blobThreshold))
+		db, err := internal.OpenBitCaskStore(dataDir, opts...)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		srv := server.New(db)
+		srv.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		if backupDir != "" {
+			srv.ServeBackups(backupDir)
+		}
+		httpServer := &http.Server{Addr: addr, Handler: srv}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			httpServer.Shutdown(context.Background())
+		}()
+
+		logrus.Infof("serving %s on %s", dataDir, addr)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+	Use:   "serve [--addr <host:port>] [--disk-index] [--compact-keydir] [--max-mapped-segments <n>] [--max-key-size <bytes>] [--max-value-size <bytes>] [--blob-threshold <bytes>] [--value-log] [--preallocate] [--sync-writes] [--rotate-after <duration>] [--rotate-records <n>] [--compaction-rate <bytes/s>] [--window <HH:MM-HH:MM>] [--backup-dir <dir>]",
+	Short: "Serve the store over HTTP along with its metrics",
+}
+
+func init() {
+	serveCommand.Flags().String("addr", ":8080", "address to listen on")
+	serveCommand.Flags().Bool("disk-index", false, "keep only the keys of the active segment in memory")
+	serveCommand.Flags().Bool("compact-keydir", false, "pack the keydir to reduce its memory and GC cost")
+	serveCommand.Flags().Int("max-mapped-segments", 0, "keep at most this many sealed segments mapped, 0 for no limit")
+	serveCommand.Flags().Int("max-key-size", 64*1024, "reject keys longer than this many bytes, 0 for no limit")
+	serveCommand.Flags().Int64("max-value-size", 0, "reject values larger than this many bytes, 0 for no limit")
+	serveCommand.Flags().Int64("blob-threshold", 256*1024, "store values of at least this many bytes in blob files, 0 to keep them in the log")
+	serveCommand.Flags().Bool("value-log", false, "keep the values apart from the keys in value log files")
+	serveCommand.Flags().Bool("preallocate", false, "preallocate the active segment to its maximum size")
+	serveCommand.Flags().Bool("sync-writes", false, "sync every write to disk before acknowledging it")
+	serveCommand.Flags().Duration("rotate-after", 0, "seal the active segment once its first record is this old, 0 to only rotate by size")
+	serveCommand.Flags().Int64("rotate-records", 0, "seal the active segment once it holds this many records, 0 to only rotate by size")
+	serveCommand.Flags().Int64("compaction-rate", 0, "limit the compaction IO to this many bytes per second, 0 for no limit")
+	serveCommand.Flags().StringSlice("window", nil, "daily window of local time to compact in, such as 22:00-06:00")
+	serveCommand.Flags().String("backup-dir", "", "folder to take backups into through POST /backup, empty to disable them")
+}
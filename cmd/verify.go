@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"pingcap.com/kvs/internal"
+)
+
+var verifyCommand = &cobra.Command{
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repair, _ := cmd.Flags().GetBool("repair")
+		verify := internal.Verify
+		if repair {
+			verify = internal.Repair
+		}
+		report, err := verify(dataDir)
+		if err != nil {
+			return err
+		}
+		for _, segment := range report.Segments {
+			fmt.Printf("%s: %d records, %d/%d valid bytes\n", segment.File, segment.Records, segment.ValidBytes, segment.Size)
+		}
+		for _, issue := range report.Issues {
+			fmt.Println(issue)
+		}
+		switch {
+		case report.OK():
+			fmt.Println("no issues found")
+		case repair:
+			fmt.Printf("repaired %d files\n", report.Repaired)
+		default:
+			return fmt.Errorf("found %d issues, run with --repair to salvage valid records", len(report.Issues))
+		}
+		return nil
+	},
+	Use:   "verify [--repair]",
+	Short: "Check the segments of a data folder for corruption",
+}
+
+func init() {
+	verifyCommand.Flags().Bool("repair", false, "salvage valid records into new segments")
+}
@@ -3,8 +3,8 @@ module pingcap.com/kvs
 go 1.15
 
 require (
-	github.com/sirupsen/logrus v1.2.0
+	github.com/prometheus/client_golang v1.12.2
+	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v1.1.1
-	github.com/stretchr/testify v1.3.0
-	golang.org/x/exp v0.0.0-20191030013958-a1ab85dbe136
+	github.com/stretchr/testify v1.4.0
 )
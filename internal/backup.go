@@ -0,0 +1,762 @@
+package internal
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	backupManifestFilename = "backup.json"
+	backupManifestVersion  = 1
+	backupArchiveExt       = ".tar"
+	backupStagingFmt       = ".backup_%d"
+	backupStagingGlob      = ".backup_*"
+)
+
+// ErrIncrementalArchive is returned when an incremental backup is requested
+// into an archive
+var ErrIncrementalArchive = errors.New("error due to incremental backup requested into an archive")
+
+var (
+	errRestoreTargetNotEmpty = errors.New("error restoring into a non empty data folder")
+	errInvalidBackupManifest = errors.New("error due to invalid backup manifest")
+	errBackupChecksum        = errors.New("error due to backup segment checksum mismatch")
+)
+
+// Backuper is implemented by the stores that can back themselves up while
+// they serve requests
+type Backuper interface {
+	Backup(dst string, incremental bool) (*BackupReport, error)
+}
+
+// BackupManifest describes the segments making up a backup
+type BackupManifest struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Segments  []BackupSegment `json:"segments"`
+	// Blobs are the blob files referenced from the segments, along with the
+	// ID of their segment
+	Blobs []BackupSegment `json:"blobs,omitempty"`
+	// Indexes are the hint and bloom filter files of the segments, along
+	// with the ID of their segment
+	Indexes []BackupSegment `json:"indexes,omitempty"`
+	// ValueLogs are the value log files of stores separating their values
+	ValueLogs []BackupSegment `json:"value_logs,omitempty"`
+	// Keyspaces is the keyspace catalog, missing for stores without keyspaces
+	Keyspaces *KeyspaceCatalog `json:"keyspaces,omitempty"`
+}
+
+// BackupSegment is a sealed segment file included in a backup
+type BackupSegment struct {
+	ID     int    `json:"id"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupReport summarises a backup run
+type BackupReport struct {
+	Manifest *BackupManifest
+	// Copied is the number of segments written by this run
+	Copied int
+	// Bytes is the number of segment bytes written by this run
+	Bytes int64
+}
+
+// Backup takes a consistent snapshot of the open store into dst, which is
+// either a folder or, when it ends in .tar, an archive file of the OS.
+// Incremental backups into a folder only copy the segments missing from the
+// previous one. The snapshot is made of hard links in the filesystem of the
+// store.
+func (bcs *BitCaskStore) Backup(dst string, incremental bool) (*BackupReport, error) {
+	archive := strings.HasSuffix(dst, backupArchiveExt)
+	if archive && incremental {
+		return nil, ErrIncrementalArchive
+	}
+	staging, err := bcs.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer vfs.RemoveAll(bcs.fs, staging)
+
+	if archive {
+		return backupToArchive(bcs.fs, staging, dst)
+	}
+	return backupToFolder(bcs.fs, staging, dst, incremental)
+}
+
+// snapshot seals the active segment and hard links every sealed segment, its
+// index, its blobs and the value log files into a staging folder, so they
+// survive the cleaner while they are copied. The keyspace catalog is staged
+// along with them. The cleaner and the value log collection are paused
+// meanwhile, so that no segment holding a tombstone is dropped before the
+// records it removes are linked.
+func (bcs *BitCaskStore) snapshot() (string, error) {
+	resume := bcs.logCleaner.Pause()
+	defer resume()
+	bcs.collecting.Lock()
+	defer bcs.collecting.Unlock()
+	bcs.mutex.Lock()
+	defer bcs.mutex.Unlock()
+	// snapshots are taken one at a time, so the first free name is theirs
+	var staging string
+	for i := 1; staging == "" || vfs.Exists(bcs.fs, staging); i++ {
+		staging = filepath.Join(bcs.basePath, fmt.Sprintf(backupStagingFmt, i))
+	}
+	if err := bcs.fs.MkdirAll(staging, 0755); err != nil {
+		return "", fmt.Errorf("error creating backup staging folder: %w", err)
+	}
+	sealed, err := bcs.logStore.Seal()
+	if err != nil {
+		vfs.RemoveAll(bcs.fs, staging)
+		return "", fmt.Errorf("error sealing active segment: %w", err)
+	}
+	ids := make([]int, 0, len(sealed))
+	for id := range sealed {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	link := func(path string) error {
+		if err := bcs.fs.Link(path, filepath.Join(staging, filepath.Base(path))); err != nil {
+			vfs.RemoveAll(bcs.fs, staging)
+			return fmt.Errorf("error linking %s into staging folder: %w", filepath.Base(path), err)
+		}
+		return nil
+	}
+	for _, id := range ids {
+		if err := link(sealed[id]); err != nil {
+			return "", err
+		}
+		// segments sealed before indexes were introduced may have none
+		for _, f := range []string{segments.HintPath(sealed[id]), segments.BloomPath(sealed[id])} {
+			if !vfs.Exists(bcs.fs, f) {
+				continue
+			}
+			if err := link(f); err != nil {
+				return "", err
+			}
+		}
+	}
+	blobs, err := blobFiles(bcs.fs, bcs.basePath)
+	if err != nil {
+		vfs.RemoveAll(bcs.fs, staging)
+		return "", err
+	}
+	for _, id := range ids {
+		for _, path := range blobs[id] {
+			if err := link(path); err != nil {
+				return "", err
+			}
+		}
+	}
+	valueLogs, err := valueLogFiles(bcs.fs, bcs.basePath)
+	if err != nil {
+		vfs.RemoveAll(bcs.fs, staging)
+		return "", err
+	}
+	for _, path := range valueLogs {
+		if err := link(path); err != nil {
+			return "", err
+		}
+	}
+	if len(bcs.catalog.Keyspaces) > 0 || bcs.catalog.NextID > defaultKeyspaceID+1 {
+		if err := writeKeyspaceCatalog(bcs.fs, staging, bcs.catalog); err != nil {
+			vfs.RemoveAll(bcs.fs, staging)
+			return "", err
+		}
+	}
+	return staging, nil
+}
+
+// removeBackupStaging removes the staging folders left by the backups
+// interrupted by a crash, whose links would keep the space of the segments
+// dropped since
+func removeBackupStaging(fs vfs.FS, path string) error {
+	leftovers, err := vfs.Glob(fs, filepath.Join(path, backupStagingGlob))
+	if err != nil {
+		return err
+	}
+	for _, staging := range leftovers {
+		if err := vfs.RemoveAll(fs, staging); err != nil {
+			return fmt.Errorf("error removing backup staging folder: %w", err)
+		}
+	}
+	return nil
+}
+
+// stagedCatalog returns the keyspace catalog of the staging folder, if any
+func stagedCatalog(fs vfs.FS, staging string) (*KeyspaceCatalog, error) {
+	if !vfs.Exists(fs, filepath.Join(staging, keyspaceCatalogFilename)) {
+		return nil, nil
+	}
+	return readKeyspaceCatalog(fs, staging)
+}
+
+// stagedSegments lists the segment files of folder sorted by ID
+func stagedSegments(fs vfs.FS, folder string) ([]BackupSegment, error) {
+	files, err := vfs.Glob(fs, filepath.Join(folder, segmentFilenameGlob))
+	if err != nil {
+		return nil, err
+	}
+	staged := make([]BackupSegment, 0, len(files))
+	for _, f := range files {
+		info, err := fs.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		staged = append(staged, BackupSegment{
+			ID:   segments.SegmentID(f, false),
+			File: filepath.Base(f),
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(staged, func(i, j int) bool { return staged[i].ID < staged[j].ID })
+	return staged, nil
+}
+
+// stagedIndexes lists the hint and bloom filter files of the staged segments
+// found in folder, sorted by segment ID
+func stagedIndexes(fs vfs.FS, folder string, staged []BackupSegment) ([]BackupSegment, error) {
+	var indexes []BackupSegment
+	for _, segment := range staged {
+		path := filepath.Join(folder, segment.File)
+		for _, f := range []string{segments.HintPath(path), segments.BloomPath(path)} {
+			info, err := fs.Stat(f)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, BackupSegment{ID: segment.ID, File: filepath.Base(f), Size: info.Size()})
+		}
+	}
+	return indexes, nil
+}
+
+// stagedValueLogs lists the value log files of folder sorted by ID
+func stagedValueLogs(fs vfs.FS, folder string) ([]BackupSegment, error) {
+	files, err := valueLogFiles(fs, folder)
+	if err != nil {
+		return nil, err
+	}
+	var staged []BackupSegment
+	for id, f := range files {
+		info, err := fs.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		staged = append(staged, BackupSegment{ID: id, File: filepath.Base(f), Size: info.Size()})
+	}
+	sort.Slice(staged, func(i, j int) bool { return staged[i].ID < staged[j].ID })
+	return staged, nil
+}
+
+// stagedBlobs lists the blob files of folder sorted by segment ID and name
+func stagedBlobs(fs vfs.FS, folder string) ([]BackupSegment, error) {
+	blobs, err := blobFiles(fs, folder)
+	if err != nil {
+		return nil, err
+	}
+	var staged []BackupSegment
+	for id, files := range blobs {
+		for _, f := range files {
+			info, err := fs.Stat(f)
+			if err != nil {
+				return nil, err
+			}
+			staged = append(staged, BackupSegment{ID: id, File: filepath.Base(f), Size: info.Size()})
+		}
+	}
+	sort.Slice(staged, func(i, j int) bool {
+		return staged[i].ID < staged[j].ID || staged[i].ID == staged[j].ID && staged[i].File < staged[j].File
+	})
+	return staged, nil
+}
+
+func backupToFolder(fs vfs.FS, staging, dst string, incremental bool) (*BackupReport, error) {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, fmt.Errorf("error creating backup folder: %w", err)
+	}
+	previous, err := readBackupManifest(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	reusable := make(map[string]BackupSegment)
+	if previous != nil {
+		for _, segment := range previous.files() {
+			reusable[segment.File] = segment
+		}
+	}
+
+	staged, err := stagedSegments(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := stagedIndexes(fs, staging, staged)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := stagedBlobs(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	valueLogs, err := stagedValueLogs(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := stagedCatalog(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	report := &BackupReport{
+		Manifest: &BackupManifest{
+			Version:   backupManifestVersion,
+			CreatedAt: time.Now().UTC(),
+			Keyspaces: catalog,
+		},
+	}
+	backup := func(files []BackupSegment) ([]BackupSegment, error) {
+		backedUp := make([]BackupSegment, 0, len(files))
+		for _, file := range files {
+			// sealed segments, their indexes and blobs are immutable, so the
+			// same name and size is the same file
+			if prev, ok := reusable[file.File]; incremental && ok && prev.ID == file.ID && prev.Size == file.Size {
+				backedUp = append(backedUp, prev)
+				delete(reusable, file.File)
+				continue
+			}
+			sum, err := linkOrCopyFile(fs, filepath.Join(staging, file.File), filepath.Join(dst, file.File))
+			if err != nil {
+				return nil, err
+			}
+			file.SHA256 = sum
+			backedUp = append(backedUp, file)
+			report.Copied++
+			report.Bytes += file.Size
+			delete(reusable, file.File)
+		}
+		return backedUp, nil
+	}
+	if report.Manifest.Segments, err = backup(staged); err != nil {
+		return nil, err
+	}
+	if len(indexes) > 0 {
+		if report.Manifest.Indexes, err = backup(indexes); err != nil {
+			return nil, err
+		}
+	}
+	if len(blobs) > 0 {
+		if report.Manifest.Blobs, err = backup(blobs); err != nil {
+			return nil, err
+		}
+	}
+	if len(valueLogs) > 0 {
+		if report.Manifest.ValueLogs, err = backup(valueLogs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeBackupManifest(dst, report.Manifest); err != nil {
+		return nil, err
+	}
+	// segments and blobs reclaimed since the previous backup are not needed anymore
+	for _, stale := range reusable {
+		if err := os.Remove(filepath.Join(dst, stale.File)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing stale backup segment: %w", err)
+		}
+	}
+	return report, nil
+}
+
+func backupToArchive(fs vfs.FS, staging, dst string) (*BackupReport, error) {
+	staged, err := stagedSegments(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := stagedIndexes(fs, staging, staged)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := stagedBlobs(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	valueLogs, err := stagedValueLogs(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := stagedCatalog(fs, staging)
+	if err != nil {
+		return nil, err
+	}
+	report := &BackupReport{
+		Manifest: &BackupManifest{
+			Version:   backupManifestVersion,
+			CreatedAt: time.Now().UTC(),
+			Segments:  staged,
+			Indexes:   indexes,
+			Blobs:     blobs,
+			ValueLogs: valueLogs,
+			Keyspaces: catalog,
+		},
+	}
+	// checksums go first so restore can validate while extracting
+	for _, files := range [][]BackupSegment{staged, indexes, blobs, valueLogs} {
+		for i := range files {
+			if files[i].SHA256, err = checksumFile(fs, filepath.Join(staging, files[i].File)); err != nil {
+				return nil, err
+			}
+			report.Bytes += files[i].Size
+		}
+		report.Copied += len(files)
+	}
+
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("error creating backup archive: %w", err)
+	}
+	defer os.Remove(tmp)
+	if err := writeBackupArchive(f, fs, staging, report.Manifest); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return nil, fmt.Errorf("error moving backup archive into place: %w", err)
+	}
+	return report, nil
+}
+
+func writeBackupArchive(w io.Writer, fs vfs.FS, staging string, manifest *BackupManifest) error {
+	tw := tar.NewWriter(w)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    backupManifestFilename,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return fmt.Errorf("error writing backup archive: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("error writing backup archive: %w", err)
+	}
+	for _, segment := range manifest.files() {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    segment.File,
+			Mode:    0644,
+			Size:    segment.Size,
+			ModTime: manifest.CreatedAt,
+		}); err != nil {
+			return fmt.Errorf("error writing backup archive: %w", err)
+		}
+		f, err := vfs.Open(fs, filepath.Join(staging, segment.File))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error writing backup archive: %w", err)
+		}
+	}
+	return tw.Close()
+}
+
+// Restore validates the backup at src, a folder or a .tar archive, and
+// populates dataDir with its segments. dataDir must be empty or missing.
+func Restore(src, dataDir string) (*BackupManifest, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating data folder: %w", err)
+	}
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return nil, errRestoreTargetNotEmpty
+	}
+	if strings.HasSuffix(src, backupArchiveExt) {
+		return restoreFromArchive(src, dataDir)
+	}
+	return restoreFromFolder(src, dataDir)
+}
+
+func restoreFromFolder(src, dataDir string) (*BackupManifest, error) {
+	manifest, err := readBackupManifest(src)
+	if err != nil {
+		return nil, err
+	}
+	files := manifest.files()
+	for _, segment := range files {
+		sum, err := checksumFile(vfs.Default, filepath.Join(src, segment.File))
+		if err != nil {
+			return nil, err
+		}
+		if sum != segment.SHA256 {
+			return nil, fmt.Errorf("%w: %s", errBackupChecksum, segment.File)
+		}
+	}
+	if err := validateIndexes(manifest, src); err != nil {
+		return nil, err
+	}
+	for _, segment := range files {
+		if _, err := copyFile(vfs.Default, filepath.Join(src, segment.File), filepath.Join(dataDir, segment.File)); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, restoreCatalog(manifest, dataDir)
+}
+
+func restoreFromArchive(src, dataDir string) (*BackupManifest, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("error opening backup archive: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	header, err := tr.Next()
+	if err != nil || header.Name != backupManifestFilename {
+		return nil, fmt.Errorf("%w: archive does not start with %s", errInvalidBackupManifest, backupManifestFilename)
+	}
+	var manifest BackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidBackupManifest, err)
+	}
+	if err := validateBackupManifest(&manifest); err != nil {
+		return nil, err
+	}
+	files := manifest.files()
+	expected := make(map[string]BackupSegment, len(files))
+	for _, segment := range files {
+		expected[segment.File] = segment
+	}
+
+	// segments are only moved into the data folder once all of them are valid
+	staging, err := ioutil.TempDir(dataDir, ".restore_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading backup archive: %w", err)
+		}
+		segment, ok := expected[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected file %s", errInvalidBackupManifest, header.Name)
+		}
+		sum, err := writeFile(tr, filepath.Join(staging, segment.File))
+		if err != nil {
+			return nil, err
+		}
+		if sum != segment.SHA256 {
+			return nil, fmt.Errorf("%w: %s", errBackupChecksum, segment.File)
+		}
+		delete(expected, header.Name)
+	}
+	if len(expected) > 0 {
+		return nil, fmt.Errorf("%w: %d files missing from archive", errInvalidBackupManifest, len(expected))
+	}
+	if err := validateIndexes(&manifest, staging); err != nil {
+		return nil, err
+	}
+	for _, segment := range files {
+		if err := os.Rename(filepath.Join(staging, segment.File), filepath.Join(dataDir, segment.File)); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, restoreCatalog(&manifest, dataDir)
+}
+
+// validateIndexes checks that the indexes of the backup found in folder load
+// and match their segment
+func validateIndexes(manifest *BackupManifest, folder string) error {
+	indexed := make(map[int]bool, len(manifest.Indexes))
+	for _, index := range manifest.Indexes {
+		indexed[index.ID] = true
+	}
+	for _, segment := range manifest.Segments {
+		if !indexed[segment.ID] {
+			continue
+		}
+		index, err := segments.OpenSegmentIndex(vfs.Default, filepath.Join(folder, segment.File), segment.ID)
+		if err != nil {
+			return fmt.Errorf("%w: index of %s: %v", errInvalidBackupManifest, segment.File, err)
+		}
+		index.Close()
+	}
+	return nil
+}
+
+// restoreCatalog writes the keyspace catalog of the backup, without which
+// the records of the keyspaces would be ignored
+func restoreCatalog(manifest *BackupManifest, dataDir string) error {
+	if manifest.Keyspaces == nil {
+		return nil
+	}
+	return writeKeyspaceCatalog(vfs.Default, dataDir, manifest.Keyspaces)
+}
+
+func readBackupManifest(folder string) (*BackupManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, backupManifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidBackupManifest, err)
+	}
+	if err := validateBackupManifest(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func writeBackupManifest(folder string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(folder, backupManifestFilename+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing backup manifest: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(folder, backupManifestFilename))
+}
+
+func validateBackupManifest(manifest *BackupManifest) error {
+	if manifest.Version != backupManifestVersion {
+		return fmt.Errorf("%w: unsupported version %d", errInvalidBackupManifest, manifest.Version)
+	}
+	seen := make(map[int]bool, len(manifest.Segments))
+	for _, segment := range manifest.Segments {
+		if ok, _ := filepath.Match(segmentFilenameGlob, segment.File); !ok || segment.File != filepath.Base(segment.File) {
+			return fmt.Errorf("%w: invalid segment file %q", errInvalidBackupManifest, segment.File)
+		}
+		if segments.SegmentID(segment.File, false) != segment.ID || seen[segment.ID] {
+			return fmt.Errorf("%w: invalid segment ID %d", errInvalidBackupManifest, segment.ID)
+		}
+		seen[segment.ID] = true
+	}
+	for _, blob := range manifest.Blobs {
+		var ref encoding.BlobRef
+		if _, err := fmt.Sscanf(blob.File, blobFilenameScanFmt, &ref.SegmentID, &ref.Seq); err != nil || blob.File != filepath.Base(blobPath("", ref)) {
+			return fmt.Errorf("%w: invalid blob file %q", errInvalidBackupManifest, blob.File)
+		}
+		if ref.SegmentID != blob.ID || !seen[blob.ID] {
+			return fmt.Errorf("%w: blob %s of unknown segment %d", errInvalidBackupManifest, blob.File, blob.ID)
+		}
+	}
+	for _, index := range manifest.Indexes {
+		segmentPath := fmt.Sprintf(segmentFilenameFmt, index.ID)
+		if index.File != segments.HintPath(segmentPath) && index.File != segments.BloomPath(segmentPath) {
+			return fmt.Errorf("%w: invalid index file %q", errInvalidBackupManifest, index.File)
+		}
+		if !seen[index.ID] {
+			return fmt.Errorf("%w: index %s of unknown segment %d", errInvalidBackupManifest, index.File, index.ID)
+		}
+	}
+	seenValueLogs := make(map[int]bool, len(manifest.ValueLogs))
+	for _, valueLog := range manifest.ValueLogs {
+		if valueLog.File != fmt.Sprintf(valueLogFilenameFmt, valueLog.ID) || seenValueLogs[valueLog.ID] {
+			return fmt.Errorf("%w: invalid value log file %q", errInvalidBackupManifest, valueLog.File)
+		}
+		seenValueLogs[valueLog.ID] = true
+	}
+	return nil
+}
+
+// files returns every file of the backup, segments first
+func (bm *BackupManifest) files() []BackupSegment {
+	files := make([]BackupSegment, 0, len(bm.Segments)+len(bm.Indexes)+len(bm.Blobs)+len(bm.ValueLogs))
+	files = append(files, bm.Segments...)
+	files = append(files, bm.Indexes...)
+	files = append(files, bm.Blobs...)
+	return append(files, bm.ValueLogs...)
+}
+
+// linkOrCopyFile hard links src of fs into dst of the OS, falling back to a
+// copy when both live in different filesystems, and returns the checksum of
+// the contents
+func linkOrCopyFile(fs vfs.FS, src, dst string) (string, error) {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if fs == vfs.Default {
+		if err := os.Link(src, dst); err == nil {
+			return checksumFile(vfs.Default, dst)
+		}
+	}
+	return copyFile(fs, src, dst)
+}
+
+// copyFile copies src of fs into dst of the OS
+func copyFile(fs vfs.FS, src, dst string) (string, error) {
+	f, err := vfs.Open(fs, src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return writeFile(f, dst)
+}
+
+// writeFile syncs the contents of r into dst and returns their checksum
+func writeFile(r io.Reader, dst string) (string, error) {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return "", fmt.Errorf("error copying %s: %w", dst, err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), f.Close()
+}
+
+func checksumFile(fs vfs.FS, path string) (string, error) {
+	f, err := vfs.Open(fs, path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
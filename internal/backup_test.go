@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+func populatedStore(t *testing.T, keys int) (*BitCaskStore, string) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	for i := 0; i < keys; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte(fmt.Sprintf("value %d", i))))
+	}
+	return db, path
+}
+
+func assertRestoredKeys(t *testing.T, path string, keys int) {
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Len(t, db.Keys(), keys)
+	for i := 0; i < keys; i++ {
+		value, ok, err := db.Get(strconv.Itoa(i))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("value %d", i), string(value))
+	}
+}
+
+func TestBackupToFolder(t *testing.T) {
+	db, path := populatedStore(t, 100)
+	defer os.RemoveAll(path)
+	dst, _ := ioutil.TempDir("/tmp", "backup_*")
+	defer os.RemoveAll(dst)
+
+	report, err := db.Backup(dst, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Manifest.Segments, 1)
+	// along with the hint and bloom filter files of the segment
+	assert.Len(t, report.Manifest.Indexes, 2)
+	assert.Equal(t, 3, report.Copied)
+
+	t.Run("incremental backup only copies new segments", func(t *testing.T) {
+		for i := 100; i < 150; i++ {
+			assert.NoError(t, db.Set(strconv.Itoa(i), []byte(fmt.Sprintf("value %d", i))))
+		}
+		report, err := db.Backup(dst, true)
+		assert.NoError(t, err)
+		assert.Len(t, report.Manifest.Segments, 2)
+		assert.Len(t, report.Manifest.Indexes, 4)
+		assert.Equal(t, 3, report.Copied)
+	})
+
+	t.Run("restore into a fresh folder", func(t *testing.T) {
+		restored, _ := ioutil.TempDir("/tmp", "restored_*")
+		defer os.RemoveAll(restored)
+		_, err := Restore(dst, restored)
+		assert.NoError(t, err)
+		for _, id := range []int{1, 2} {
+			segment := filepath.Join(restored, fmt.Sprintf(segmentFilenameFmt, id))
+			index, err := segments.OpenSegmentIndex(vfs.Default, segment, id)
+			assert.NoError(t, err)
+			index.Close()
+		}
+		assertRestoredKeys(t, restored, 150)
+	})
+
+	t.Run("refuse to restore an index not matching its segment", func(t *testing.T) {
+		manifest, err := readBackupManifest(dst)
+		assert.NoError(t, err)
+		// list the hint file of the second segment as the one of the first
+		tampered := filepath.Join(dst, "tampered")
+		assert.NoError(t, os.MkdirAll(tampered, 0755))
+		defer os.RemoveAll(tampered)
+		for _, file := range manifest.files() {
+			data, err := ioutil.ReadFile(filepath.Join(dst, file.File))
+			assert.NoError(t, err)
+			if file.File == "segment_00001.hint" {
+				data, err = ioutil.ReadFile(filepath.Join(dst, "segment_00002.hint"))
+				assert.NoError(t, err)
+				manifest.Indexes[0].SHA256, _ = checksumFile(vfs.Default, filepath.Join(dst, "segment_00002.hint"))
+				manifest.Indexes[0].Size = int64(len(data))
+			}
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(tampered, file.File), data, 0644))
+		}
+		assert.NoError(t, writeBackupManifest(tampered, manifest))
+
+		restored, _ := ioutil.TempDir("/tmp", "restored_*")
+		defer os.RemoveAll(restored)
+		_, err = Restore(tampered, restored)
+		assert.True(t, errors.Is(err, errInvalidBackupManifest))
+		files, _ := ioutil.ReadDir(restored)
+		assert.Empty(t, files)
+	})
+
+	t.Run("refuse to restore into a used folder", func(t *testing.T) {
+		_, err := Restore(dst, path)
+		assert.Error(t, err)
+	})
+
+	t.Run("refuse to restore a corrupted backup", func(t *testing.T) {
+		segment := filepath.Join(dst, report.Manifest.Segments[0].File)
+		// break the link with the live segment before corrupting it
+		data, err := ioutil.ReadFile(segment)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Remove(segment))
+		data[len(data)-1] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(segment, data, 0644))
+
+		restored, _ := ioutil.TempDir("/tmp", "restored_*")
+		defer os.RemoveAll(restored)
+		_, err = Restore(dst, restored)
+		assert.Error(t, err)
+		files, _ := ioutil.ReadDir(restored)
+		assert.Empty(t, files)
+	})
+	assert.NoError(t, db.Close())
+}
+
+func TestBackupToArchive(t *testing.T) {
+	db, path := populatedStore(t, 100)
+	defer os.RemoveAll(path)
+	dst, _ := ioutil.TempDir("/tmp", "backup_*")
+	defer os.RemoveAll(dst)
+	archive := filepath.Join(dst, "snapshot.tar")
+
+	_, err := db.Backup(archive, true)
+	assert.Error(t, err)
+	report, err := db.Backup(archive, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Manifest.Segments, 1)
+	// writes after the snapshot are not part of it
+	assert.NoError(t, db.Set("100", []byte("value 100")))
+	assert.NoError(t, db.Close())
+
+	restored, _ := ioutil.TempDir("/tmp", "restored_*")
+	defer os.RemoveAll(restored)
+	_, err = Restore(archive, restored)
+	assert.NoError(t, err)
+	assertRestoredKeys(t, restored, 100)
+}
+
+func TestBackupKeyspaces(t *testing.T) {
+	db, path := populatedStore(t, 10)
+	defer os.RemoveAll(path)
+	sessions, err := db.Keyspace("sessions", WithCompression(DeflateCompression))
+	assert.NoError(t, err)
+	assert.NoError(t, sessions.Set("0", []byte("session 0")))
+	dst, _ := ioutil.TempDir("/tmp", "backup_*")
+	defer os.RemoveAll(dst)
+	archive := filepath.Join(dst, "snapshot.tar")
+	report, err := db.Backup(archive, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Manifest.Keyspaces.Keyspaces, 1)
+	assert.NoError(t, db.Close())
+
+	restored, _ := ioutil.TempDir("/tmp", "restored_*")
+	defer os.RemoveAll(restored)
+	_, err = Restore(archive, restored)
+	assert.NoError(t, err)
+	assertRestoredKeys(t, restored, 10)
+	db, err = OpenBitCaskStore(restored)
+	assert.NoError(t, err)
+	defer db.Close()
+	sessions, err = db.Keyspace("sessions")
+	assert.NoError(t, err)
+	assert.Equal(t, DeflateCompression, sessions.Options().Compression)
+	value, ok, err := sessions.Get("0")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "session 0", string(value))
+}
+
+func TestBackupFromStoreFS(t *testing.T) {
+	fs := vfs.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/data", 0755))
+	// the staging folder of a backup interrupted by a crash
+	assert.NoError(t, fs.MkdirAll("/data/.backup_1", 0755))
+	f, err := vfs.Create(fs, "/data/.backup_1/segment_00001.dat")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	db, err := OpenBitCaskStore("/data", WithFS(fs))
+	assert.NoError(t, err)
+	assert.False(t, vfs.Exists(fs, "/data/.backup_1"))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte(fmt.Sprintf("value %d", i))))
+	}
+
+	dst, _ := ioutil.TempDir("/tmp", "backup_*")
+	defer os.RemoveAll(dst)
+	report, err := db.Backup(dst, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Manifest.Segments, 1)
+	staging, err := vfs.Glob(fs, filepath.Join("/data", backupStagingGlob))
+	assert.NoError(t, err)
+	assert.Empty(t, staging)
+	assert.NoError(t, db.Close())
+
+	restored, _ := ioutil.TempDir("/tmp", "restored_*")
+	defer os.RemoveAll(restored)
+	_, err = Restore(dst, restored)
+	assert.NoError(t, err)
+	assertRestoredKeys(t, restored, 10)
+}
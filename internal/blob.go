@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	// blobs are named after the segment referencing them, which they are
+	// deleted along with
+	blobFilenameFmt  = "blob_%05d_%d.dat"
+	blobFilenameGlob = "blob_*.dat"
+	// the padding is only a minimum width when formatting
+	blobFilenameScanFmt = "blob_%d_%d.dat"
+	// blobs are staged in temporary files until referenced from the log
+	blobStagingPrefix = ".blob_"
+
+	defaultMaxKeySize    = 64 * 1024
+	defaultBlobThreshold = segments.MaxSegmentSizeBytes / 4
+)
+
+var (
+	errValueSizeMismatch = errors.New("error due to value not matching its size")
+	errBlobChecksum      = errors.New("error due to blob checksum mismatch")
+)
+
+// KeyTooLargeError is returned when writing a key longer than the maximum
+// key size of the store
+type KeyTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *KeyTooLargeError) Error() string {
+	return fmt.Sprintf("error due to key of %d bytes over the maximum of %d", e.Size, e.Max)
+}
+
+// ValueTooLargeError is returned when writing a value larger than the
+// maximum value size of the store
+type ValueTooLargeError struct {
+	Size int64
+	Max  int64
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("error due to value of %d bytes over the maximum of %d", e.Size, e.Max)
+}
+
+func blobPath(folder string, ref encoding.BlobRef) string {
+	return filepath.Join(folder, fmt.Sprintf(blobFilenameFmt, ref.SegmentID, ref.Seq))
+}
+
+// blobFiles returns the blob files of folder by the ID of their segment,
+// ignoring the files named otherwise
+func blobFiles(fs vfs.FS, folder string) (map[int][]string, error) {
+	files, err := vfs.Glob(fs, filepath.Join(folder, blobFilenameGlob))
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(map[int][]string)
+	for _, f := range files {
+		var ref encoding.BlobRef
+		name := filepath.Base(f)
+		if _, err := fmt.Sscanf(name, blobFilenameScanFmt, &ref.SegmentID, &ref.Seq); err != nil {
+			continue
+		}
+		if name == filepath.Base(blobPath(folder, ref)) {
+			blobs[ref.SegmentID] = append(blobs[ref.SegmentID], f)
+		}
+	}
+	return blobs, nil
+}
+
+// removeSegmentBlobs deletes the blobs referenced from segment id and
+// returns the number of bytes reclaimed. Open readers keep reading them.
+func removeSegmentBlobs(fs vfs.FS, folder string, id int) (int64, error) {
+	blobs, err := blobFiles(fs, folder)
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	for _, f := range blobs[id] {
+		if info, err := fs.Stat(f); err == nil {
+			reclaimed += info.Size()
+		}
+		if err := fs.Remove(f); err != nil && !os.IsNotExist(err) {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// stagedBlob is a value written to a temporary file of the data folder,
+// waiting for the record referencing it
+type stagedBlob struct {
+	fs       vfs.FS
+	path     string
+	size     int64
+	checksum uint32
+}
+
+// stageBlob syncs the size bytes of r into a temporary file of folder,
+// failing when r holds fewer or more bytes
+func stageBlob(fs vfs.FS, folder string, r io.Reader, size int64) (*stagedBlob, error) {
+	f, err := fs.TempFile(folder, blobStagingPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error staging blob: %w", err)
+	}
+	blob := &stagedBlob{fs: fs, path: f.Name(), size: size}
+	h := encoding.NewBlobHash()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, size+1))
+	if err == nil && n != size {
+		err = fmt.Errorf("%w: read %d bytes, expected %d", errValueSizeMismatch, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		blob.discard()
+		return nil, err
+	}
+	blob.checksum = h.Sum32()
+	return blob, nil
+}
+
+// discard deletes the blob unless it was moved into the store
+func (sb *stagedBlob) discard() {
+	sb.fs.Remove(sb.path)
+}
+
+// blobReader streams the value of a blob, checking its size and checksum
+// once the end is reached
+type blobReader struct {
+	f    vfs.File
+	ref  encoding.BlobRef
+	hash hash.Hash32
+	read int64
+}
+
+// openBlob opens the blob referenced by record
+func openBlob(fs vfs.FS, folder string, record *encoding.Record) (*blobReader, error) {
+	ref, err := encoding.DecodeBlobRef(record.Value)
+	if err != nil {
+		return nil, fmt.Errorf("error reading value of %q: %w", record.Key, err)
+	}
+	f, err := vfs.Open(fs, blobPath(folder, ref))
+	if err != nil {
+		return nil, fmt.Errorf("error opening blob of %q: %w", record.Key, err)
+	}
+	return &blobReader{f: f, ref: ref, hash: encoding.NewBlobHash()}, nil
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	n, err := br.f.Read(p)
+	br.hash.Write(p[:n])
+	br.read += int64(n)
+	if err == io.EOF && (br.read != br.ref.Size || br.hash.Sum32() != br.ref.Checksum) {
+		return n, fmt.Errorf("%w: %s", errBlobChecksum, filepath.Base(br.f.Name()))
+	}
+	return n, err
+}
+
+func (br *blobReader) Close() error {
+	return br.f.Close()
+}
+
+// readBlob reads the whole value of an open blob and closes it
+func readBlob(br *blobReader) ([]byte, error) {
+	defer br.Close()
+	// room for the read hitting the end, so the buffer does not grow
+	buffer := bytes.NewBuffer(make([]byte, 0, br.ref.Size+bytes.MinRead))
+	if _, err := buffer.ReadFrom(br); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// readValue reads the size bytes of r, failing when r holds fewer or more
+func readValue(r io.Reader, size int64) ([]byte, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(value)) != size {
+		return nil, fmt.Errorf("%w: read %d bytes, expected %d", errValueSizeMismatch, len(value), size)
+	}
+	return value, nil
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/segments"
+)
+
+func TestSizeLimits(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithMaxKeySize(8), WithMaxValueSize(16))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var keyErr *KeyTooLargeError
+	assert.True(t, errors.As(db.Set("a long key", []byte("value")), &keyErr))
+	assert.Equal(t, 10, keyErr.Size)
+	var valueErr *ValueTooLargeError
+	assert.True(t, errors.As(db.SetReader("key", strings.NewReader("a value over the limit"), 22), &valueErr))
+	assert.Equal(t, int64(16), valueErr.Max)
+	assert.True(t, errors.As(db.SetMany([]KeyValue{{Key: "key", Value: make([]byte, 17)}}), &valueErr))
+
+	// the reader must hold exactly the given size
+	err = db.SetReader("key", strings.NewReader("short"), 8)
+	assert.True(t, errors.Is(err, errValueSizeMismatch))
+	err = db.SetReader("key", strings.NewReader("too long"), 4)
+	assert.True(t, errors.Is(err, errValueSizeMismatch))
+	assert.Empty(t, db.Keys())
+
+	assert.NoError(t, db.SetReader("key", strings.NewReader("value"), 5))
+	value, ok, err := db.Get("key")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestBlobValues(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+
+	large := make([]byte, 3*segments.MaxSegmentSizeBytes)
+	rand.Read(large)
+	assert.NoError(t, db.SetReader("large", bytes.NewReader(large), int64(len(large))))
+	assert.NoError(t, db.Set("small", []byte("value")))
+	assert.NoError(t, db.SetMany([]KeyValue{{Key: "bulk", Value: large[:defaultBlobThreshold]}}))
+
+	blobs, _ := filepath.Glob(filepath.Join(path, blobFilenameGlob))
+	assert.Len(t, blobs, 2)
+	info, err := os.Stat(filepath.Join(path, activeSegmentFilename))
+	assert.NoError(t, err)
+	assert.True(t, info.Size() < 1024)
+
+	assertValue := func(t *testing.T, db *BitCaskStore, key string, expected []byte) {
+		r, ok, err := db.GetReader(key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		streamed, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.True(t, bytes.Equal(expected, streamed))
+
+		value, ok, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.True(t, bytes.Equal(expected, value))
+		ok, err = db.View(key, func(value []byte) error {
+			assert.True(t, bytes.Equal(expected, value))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		values, _, err := db.MultiGet([]string{key})
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(expected, values[0]))
+	}
+	assertValue(t, db, "large", large)
+	assertValue(t, db, "small", []byte("value"))
+	assertValue(t, db, "bulk", large[:defaultBlobThreshold])
+
+	t.Run("backup and restore carry the blobs", func(t *testing.T) {
+		backups, _ := ioutil.TempDir("/tmp", "backup_*")
+		defer os.RemoveAll(backups)
+		for _, dst := range []string{"folder", "archive.tar"} {
+			dst = filepath.Join(backups, dst)
+			report, err := db.Backup(dst, false)
+			assert.NoError(t, err)
+			assert.Len(t, report.Manifest.Blobs, 2)
+			restored, _ := ioutil.TempDir("/tmp", "restored_*")
+			_, err = Restore(dst, restored)
+			assert.NoError(t, err)
+			restoredDB, err := OpenBitCaskStore(restored)
+			assert.NoError(t, err)
+			assertValue(t, restoredDB, "large", large)
+			assert.NoError(t, restoredDB.Close())
+			os.RemoveAll(restored)
+		}
+	})
+
+	t.Run("blobs are deleted along with their segment", func(t *testing.T) {
+		assert.NoError(t, db.Set("large", []byte("overwritten")))
+		assert.NoError(t, db.Set("bulk", []byte("overwritten")))
+		assert.NoError(t, db.Remove("small"))
+		_, err := db.logStore.Seal()
+		assert.NoError(t, err)
+		cleaner := NewLogCleanerWithPolicy(path, db.logStore, db.keyDirs, CleanNonUsed, newOptions(nil))
+		info, err := cleaner.Compact(context.Background())
+		assert.NoError(t, err)
+		assert.NotEmpty(t, info.Deleted)
+		blobs, _ := filepath.Glob(filepath.Join(path, blobFilenameGlob))
+		assert.Empty(t, blobs)
+	})
+
+	t.Run("reopen drops the blobs left by a crash", func(t *testing.T) {
+		assert.NoError(t, db.SetReader("large", bytes.NewReader(large), int64(len(large))))
+		assert.NoError(t, db.Close())
+		staged := filepath.Join(path, blobStagingPrefix+"123")
+		assert.NoError(t, ioutil.WriteFile(staged, large, 0644))
+		dropped := filepath.Join(path, "blob_00001_0.dat")
+		assert.NoError(t, ioutil.WriteFile(dropped, large, 0644))
+
+		db, err = OpenBitCaskStore(path)
+		assert.NoError(t, err)
+		for _, f := range []string{staged, dropped} {
+			_, err := os.Stat(f)
+			assert.True(t, os.IsNotExist(err))
+		}
+		assertValue(t, db, "large", large)
+	})
+
+	t.Run("corrupt blob", func(t *testing.T) {
+		blobs, _ := filepath.Glob(filepath.Join(path, blobFilenameGlob))
+		assert.Len(t, blobs, 1)
+		data, _ := ioutil.ReadFile(blobs[0])
+		data[len(data)/2] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(blobs[0], data, 0644))
+		_, _, err := db.Get("large")
+		assert.True(t, errors.Is(err, errBlobChecksum))
+	})
+	assert.NoError(t, db.Close())
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	stressWriters      = 8
+	stressReaders      = 8
+	stressKeysByWriter = 16
+	stressOps          = 300
+)
+
+// stressValue encodes the key and version of a value, padded so the store
+// rotates its segments every few dozen writes
+func stressValue(key string, version int) []byte {
+	header := fmt.Sprintf("%s:%d:", key, version)
+	return append([]byte(header), bytes.Repeat([]byte{0xb}, 16*1024)...)
+}
+
+func parseStressValue(t *testing.T, key string, value []byte) int {
+	parts := strings.SplitN(string(value[:bytes.IndexByte(value, 0xb)]), ":", 3)
+	assert.Len(t, parts, 3)
+	assert.Equal(t, key, parts[0], "value of another key")
+	version, err := strconv.Atoi(parts[1])
+	assert.NoError(t, err)
+	return version
+}
+
+// TestConcurrentOperations runs mixed operations from many goroutines along
+// with the cleaner. Every key has a single writer bumping its version, even
+// across removals, so a linearizable store shows each writer its own last
+// write, and never shows a reader a version older than one it already saw.
+func TestConcurrentOperations(t *testing.T) {
+	modes := map[string][]Option{
+		"in-memory":  nil,
+		"compact":    {WithCompactKeyDir()},
+		"disk-index": {WithDiskIndex()},
+	}
+	for name, opts := range modes {
+		t.Run(name, func(t *testing.T) {
+			path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+			defer os.RemoveAll(path)
+			db, err := OpenBitCaskStore(path, opts...)
+			assert.NoError(t, err)
+			cleaner := NewLogCleanerWithPolicy(path, db.logStore, db.keyDirs, CleanNonUsed, newOptions(opts))
+
+			done := make(chan struct{})
+			var background sync.WaitGroup
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						_, err := cleaner.Compact(context.Background())
+						assert.NoError(t, err)
+					}
+				}
+			}()
+
+			var wg sync.WaitGroup
+			for w := 0; w < stressWriters; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(int64(w)))
+					// versions of the live keys, counters survive removals
+					versions := make(map[string]int)
+					counters := make(map[string]int)
+					for i := 0; i < stressOps; i++ {
+						key := fmt.Sprintf("w%d-k%d", w, rnd.Intn(stressKeysByWriter))
+						switch op := rnd.Intn(10); {
+						case op < 6:
+							counters[key]++
+							versions[key] = counters[key]
+							assert.NoError(t, db.Set(key, stressValue(key, versions[key])))
+						case op < 7:
+							var pairs []KeyValue
+							for j := 0; j < 4; j++ {
+								k := fmt.Sprintf("w%d-k%d", w, rnd.Intn(stressKeysByWriter))
+								counters[k]++
+								versions[k] = counters[k]
+								pairs = append(pairs, KeyValue{Key: k, Value: stressValue(k, versions[k])})
+							}
+							assert.NoError(t, db.SetMany(pairs))
+						case op < 8:
+							_, live := versions[key]
+							err := db.Remove(key)
+							if live {
+								assert.NoError(t, err)
+								delete(versions, key)
+							} else {
+								assert.Equal(t, ErrDeletingNonExistingKey, err)
+							}
+						default:
+							value, ok, err := db.Get(key)
+							assert.NoError(t, err)
+							expected, live := versions[key]
+							assert.Equal(t, live, ok, key)
+							if ok {
+								assert.Equal(t, expected, parseStressValue(t, key, value))
+							}
+						}
+					}
+				}(w)
+			}
+			for r := 0; r < stressReaders; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					rnd := rand.New(rand.NewSource(int64(100 + r)))
+					seen := make(map[string]int)
+					for i := 0; i < stressOps; i++ {
+						if i%50 == 0 {
+							db.Keys()
+						}
+						key := fmt.Sprintf("w%d-k%d", rnd.Intn(stressWriters), rnd.Intn(stressKeysByWriter))
+						value, ok, err := db.Get(key)
+						assert.NoError(t, err)
+						if !ok {
+							continue
+						}
+						version := parseStressValue(t, key, value)
+						if version < seen[key] {
+							t.Errorf("%s went back from version %d to %d", key, seen[key], version)
+						}
+						seen[key] = version
+					}
+				}(r)
+			}
+			wg.Wait()
+			close(done)
+			background.Wait()
+
+			keys := db.Keys()
+			assert.NoError(t, db.Close())
+			// the cleaner never dropped a live record
+			db, err = OpenBitCaskStore(path, opts...)
+			assert.NoError(t, err)
+			assert.Equal(t, keys, db.Keys())
+			for _, k := range keys {
+				value, ok, err := db.Get(k)
+				assert.NoError(t, err)
+				assert.True(t, ok)
+				parseStressValue(t, k, value)
+			}
+			assert.NoError(t, db.Close())
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+// crashKeyspace holds half of the keys of the crash workload, the other half
+// living in the default keyspace
+const crashKeyspace = "sessions"
+
+// crashWrite is a write of the crash workload, a nil value removing the key
+type crashWrite struct {
+	keyspace string
+	key      string
+	value    []byte
+	// started and acked are the numbers of filesystem changes made when the
+	// write was issued and acknowledged
+	started int
+	acked   int
+}
+
+// id tells apart the keys of the workload by keyspace
+func (w crashWrite) id() string {
+	return w.keyspace + "/" + w.key
+}
+
+// runCrashWorkload runs a seeded sequence of writes, rotations and
+// compactions against a store syncing every write, recording the changes
+// made to its filesystem
+func runCrashWorkload(t *testing.T, seed int64, opts []Option) (*vfs.CrashFS, []crashWrite) {
+	fs := vfs.NewCrashFS(vfs.NewMemFS())
+	assert.NoError(t, fs.MkdirAll("/data", 0755))
+	assert.NoError(t, fs.SyncDir("/"))
+	db, err := OpenBitCaskStore("/data", append(opts, WithFS(fs))...)
+	if !assert.NoError(t, err) {
+		return fs, nil
+	}
+	sessions, err := db.Keyspace(crashKeyspace)
+	if !assert.NoError(t, err) {
+		return fs, nil
+	}
+	r := rand.New(rand.NewSource(seed))
+	var writes []crashWrite
+	live := make(map[string]bool)
+	for i := 0; i < 60; i++ {
+		n := r.Intn(10)
+		write := crashWrite{key: fmt.Sprintf("key-%d", n), started: fs.Changes()}
+		ks := db.defaultKeyspace
+		if n >= 5 {
+			write.keyspace, ks = crashKeyspace, sessions
+		}
+		id := write.id()
+		switch p := r.Intn(10); {
+		case p < 6:
+			write.value = bytes.Repeat([]byte{byte('a' + i%26)}, 1+r.Intn(100))
+			assert.NoError(t, ks.Set(write.key, write.value))
+			live[id] = true
+		case p < 8:
+			if !live[id] {
+				continue
+			}
+			assert.NoError(t, ks.Remove(write.key))
+			delete(live, id)
+		case p < 9:
+			assert.NoError(t, db.Rotate())
+			continue
+		default:
+			_, err := db.Compact(context.Background())
+			assert.NoError(t, err)
+			continue
+		}
+		write.acked = fs.Changes()
+		writes = append(writes, write)
+	}
+	assert.NoError(t, db.Close())
+	return fs, writes
+}
+
+// checkCrashes reopens the store left by a crash after every change made
+// since the folder was created, checking that it holds every acknowledged
+// write. The write in flight during the crash may or may not be there.
+func checkCrashes(t *testing.T, fs *vfs.CrashFS, writes []crashWrite, opts []Option) {
+	for n := 1; n <= fs.Changes(); n++ {
+		crashed, err := fs.CrashAt(n)
+		if !assert.NoError(t, err) {
+			return
+		}
+		// before the folder is durable there is no store to recover
+		if !vfs.Exists(crashed, "/data") {
+			continue
+		}
+		expected := make(map[string]crashWrite)
+		inFlight := make(map[string][]byte)
+		for _, write := range writes {
+			if write.acked <= n {
+				expected[write.id()] = write
+			} else if write.started < n {
+				inFlight[write.id()] = write.value
+			}
+		}
+		db, err := OpenBitCaskStore("/data", append(opts, WithFS(crashed))...)
+		if !assert.NoError(t, err, "crash after %s", fs.Describe(n-1)) {
+			return
+		}
+		for id, want := range expected {
+			ks := db.defaultKeyspace
+			if want.keyspace != "" {
+				ks, err = db.Keyspace(want.keyspace)
+				assert.NoError(t, err)
+			}
+			value, ok, err := ks.Get(want.key)
+			assert.NoError(t, err)
+			if flight, ok := inFlight[id]; ok && bytes.Equal(value, flight) {
+				continue
+			}
+			if want.value == nil {
+				assert.False(t, ok, "crash after %s: %s removed", fs.Describe(n-1), id)
+			} else {
+				assert.Equal(t, string(want.value), string(value), "crash after %s: %s", fs.Describe(n-1), id)
+			}
+		}
+		// the recovered store takes writes again
+		assert.NoError(t, db.Set("after-crash", []byte("ok")))
+		assert.NoError(t, db.Close())
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	// recoveries log every truncated tail
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	configs := map[string][]Option{
+		"log":          nil,
+		"blobs":        {WithBlobThreshold(64)},
+		"value log":    {WithValueLog()},
+		"preallocated": {WithPreallocation()},
+	}
+	for name, config := range configs {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			opts := append([]Option{
+				WithSyncWrites(),
+				WithRotationPolicy(CountRotation(8)),
+				WithClock(newManualClock(time.Now())),
+				WithLogger(logger),
+			}, config...)
+			for seed := int64(1); seed <= 3; seed++ {
+				fs, writes := runCrashWorkload(t, seed, opts)
+				checkCrashes(t, fs, writes, opts)
+				if t.Failed() {
+					t.Logf("seed %d", seed)
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"time"
+)
+
+// Logger is the logging interface used by the storage engine. It is
+// satisfied by logrus loggers.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// RotateInfo describes an active segment that has been sealed
+type RotateInfo struct {
+	SegmentID int
+	Path      string
+	Size      int64
+}
+
+// CompactionInfo describes a log cleaner run. Only the fields known when the
+// run starts are set for OnCompactionStart.
+type CompactionInfo struct {
+	// Started is when the run started, according to the store clock
+	Started time.Time
+	// Candidates is the number of sealed segments considered
+	Candidates     int
+	Deleted        []int
+	ReclaimedBytes int64
+	Duration       time.Duration
+	Err            error
+}
+
+// SegmentDeletedInfo describes a segment file removed from the data folder
+type SegmentDeletedInfo struct {
+	SegmentID int
+	Path      string
+	Size      int64
+}
+
+// RecoveryTruncateInfo describes the damaged tail dropped from the active
+// segment while opening a store
+type RecoveryTruncateInfo struct {
+	Path string
+	// Offset is the end of the last valid record, where the file was cut
+	Offset int64
+	// Dropped is the number of bytes removed
+	Dropped int64
+	Err     error
+}
+
+// EventListener is notified of the engine activity. Every callback is
+// optional, and they are called synchronously so they must not block.
+type EventListener struct {
+	OnRotate           func(RotateInfo)
+	OnCompactionStart  func(CompactionInfo)
+	OnCompactionEnd    func(CompactionInfo)
+	OnSegmentDeleted   func(SegmentDeletedInfo)
+	OnRecoveryTruncate func(RecoveryTruncateInfo)
+	// OnBackgroundError reports failures of background tasks, which have no
+	// caller to return them to
+	OnBackgroundError func(error)
+}
+
+func (el EventListener) rotate(info RotateInfo) {
+	if el.OnRotate != nil {
+		el.OnRotate(info)
+	}
+}
+
+func (el EventListener) compactionStart(info CompactionInfo) {
+	if el.OnCompactionStart != nil {
+		el.OnCompactionStart(info)
+	}
+}
+
+func (el EventListener) compactionEnd(info CompactionInfo) {
+	if el.OnCompactionEnd != nil {
+		el.OnCompactionEnd(info)
+	}
+}
+
+func (el EventListener) segmentDeleted(info SegmentDeletedInfo) {
+	if el.OnSegmentDeleted != nil {
+		el.OnSegmentDeleted(info)
+	}
+}
+
+func (el EventListener) recoveryTruncate(info RecoveryTruncateInfo) {
+	if el.OnRecoveryTruncate != nil {
+		el.OnRecoveryTruncate(info)
+	}
+}
+
+func (el EventListener) backgroundError(err error) {
+	if el.OnBackgroundError != nil {
+		el.OnBackgroundError(err)
+	}
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+)
+
+func TestRecoveryTruncateEvent(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Set("2", []byte("peanuts")))
+	assert.NoError(t, db.Close())
+
+	// simulate a crash in the middle of appending a record
+	active := filepath.Join(path, activeSegmentFilename)
+	data, err := ioutil.ReadFile(active)
+	assert.NoError(t, err)
+	valid := int64(len(data))
+	assert.NoError(t, ioutil.WriteFile(active, append(data, data[:10]...), 0644))
+
+	var truncated []RecoveryTruncateInfo
+	logs := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetOutput(logs)
+	db, err = OpenBitCaskStore(path, WithLogger(logger), WithEventListener(EventListener{
+		OnRecoveryTruncate: func(info RecoveryTruncateInfo) {
+			truncated = append(truncated, info)
+		},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, []RecoveryTruncateInfo{{Path: active, Offset: valid, Dropped: 10}}, truncated)
+	assert.Contains(t, logs.String(), "dropped 10 bytes")
+	assert.NoError(t, db.Set("3", []byte("peas")))
+	assert.NoError(t, db.Close())
+
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, db.Keys())
+	assert.NoError(t, db.Close())
+}
+
+func TestRecoveryIgnoresRecordsInValues(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Close())
+
+	// a crash in the middle of appending a value holding a legacy record
+	// and a whole record, which do not follow the torn one
+	legacy := make([]byte, 16)
+	binary.BigEndian.PutUint32(legacy, 0xc0ff33)
+	binary.BigEndian.PutUint32(legacy[4:], 1)
+	var embedded, torn bytes.Buffer
+	_, err = encoding.NewBitCaskEncoder(&embedded).Write([]byte("4"), []byte("pecans"))
+	assert.NoError(t, err)
+	value := append(append(append(legacy, '5'), embedded.Bytes()...), "almonds"...)
+	_, err = encoding.NewBitCaskEncoder(&torn).Write([]byte("3"), value)
+	assert.NoError(t, err)
+	active := filepath.Join(path, activeSegmentFilename)
+	data, err := ioutil.ReadFile(active)
+	assert.NoError(t, err)
+	tail := torn.Bytes()[:torn.Len()-3]
+	assert.NoError(t, ioutil.WriteFile(active, append(data, tail...), 0644))
+
+	var truncated []RecoveryTruncateInfo
+	db, err = OpenBitCaskStore(path, WithEventListener(EventListener{
+		OnRecoveryTruncate: func(info RecoveryTruncateInfo) {
+			truncated = append(truncated, info)
+		},
+	}))
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, []RecoveryTruncateInfo{{Path: active, Offset: int64(len(data)), Dropped: int64(len(tail))}}, truncated)
+	assert.Equal(t, []string{"1"}, db.Keys())
+}
+
+func TestRecoveryKeepsRecordsAfterCorruption(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithSyncWrites())
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Set("2", []byte("peanuts")))
+	assert.NoError(t, db.Set("3", []byte("pecans")))
+	assert.NoError(t, db.Close())
+
+	// flip a byte in the value of the first record, past its 21 bytes
+	// header and 1 byte key
+	active := filepath.Join(path, activeSegmentFilename)
+	data, err := ioutil.ReadFile(active)
+	assert.NoError(t, err)
+	data[21+1+2] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(active, data, 0644))
+
+	truncated := false
+	_, err = OpenBitCaskStore(path, WithEventListener(EventListener{
+		OnRecoveryTruncate: func(RecoveryTruncateInfo) { truncated = true },
+	}))
+	var corrupt *segments.CorruptRecordError
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Contains(t, err.Error(), "kvs verify --repair")
+	assert.False(t, truncated)
+	kept, err := ioutil.ReadFile(active)
+	assert.NoError(t, err)
+	assert.Equal(t, data, kept)
+
+	_, err = Repair(path)
+	assert.NoError(t, err)
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, []string{"2", "3"}, db.Keys())
+}
+
+func TestRecoveryWithDamagedLength(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithSyncWrites())
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Set("2", []byte("peanuts")))
+	assert.NoError(t, db.Set("3", []byte("pecans")))
+	assert.NoError(t, db.Close())
+
+	// flip the high byte of the value length of the second record, which
+	// follows the 29 bytes of the first one and starts 13 bytes into its header
+	active := filepath.Join(path, activeSegmentFilename)
+	data, err := ioutil.ReadFile(active)
+	assert.NoError(t, err)
+	data[29+13] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(active, data, 0644))
+
+	_, err = OpenBitCaskStore(path)
+	var corrupt *segments.CorruptRecordError
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, int64(29), corrupt.Offset)
+	assert.Contains(t, err.Error(), "kvs verify --repair")
+}
+
+func TestCleanerEvents(t *testing.T) {
+	path := existingDataFolderWithSegments(t, 3)
+	defer os.RemoveAll(path)
+	lbs, err := NewLogBasedStorage(path)
+	assert.NoError(t, err)
+	kdt, err := lbs.BuildKeyDirTable()
+	assert.NoError(t, err)
+	// leave the second segment without live keys
+	var unused []string
+	kdt.ForEach(func(k string, entry segments.KeyDirEntry) bool {
+		if entry.FileID == 2 {
+			unused = append(unused, k)
+		}
+		return true
+	})
+	for _, k := range unused {
+		kdt.Delete(k)
+	}
+
+	var started, ended []CompactionInfo
+	var deleted []SegmentDeletedInfo
+	options := newOptions([]Option{WithEventListener(EventListener{
+		OnCompactionStart: func(info CompactionInfo) { started = append(started, info) },
+		OnCompactionEnd:   func(info CompactionInfo) { ended = append(ended, info) },
+		OnSegmentDeleted:  func(info SegmentDeletedInfo) { deleted = append(deleted, info) },
+		OnBackgroundError: func(err error) { assert.NoError(t, err) },
+	})})
+	cleaner := NewLogCleanerWithPolicy(path, lbs, defaultKeyDirs(kdt), CleanNonUsed, options)
+	info, err := cleaner.Compact(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, info.Deleted)
+
+	assert.Len(t, started, 1)
+	assert.Equal(t, 3, started[0].Candidates)
+	assert.Len(t, ended, 1)
+	assert.Equal(t, []int{2}, ended[0].Deleted)
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, 2, deleted[0].SegmentID)
+	assert.Equal(t, ended[0].ReclaimedBytes, deleted[0].Size)
+	_, err = os.Stat(deleted[0].Path)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, lbs.Close())
+}
+
+func TestRotateEvent(t *testing.T) {
+	basePath := emptyDataFolder(t)
+	defer os.RemoveAll(basePath)
+	var rotated []RotateInfo
+	lbs, err := NewLogBasedStorage(basePath, WithEventListener(EventListener{
+		OnRotate: func(info RotateInfo) { rotated = append(rotated, info) },
+	}))
+	assert.NoError(t, err)
+	kdt := make(segments.KeyDirTable)
+	value := bytes.Repeat([]byte{0xb}, 64*1024)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, lbs.Append([]byte("mykey"), value, kdt))
+	}
+	assert.Len(t, rotated, 1)
+	assert.Equal(t, 1, rotated[0].SegmentID)
+	assert.Equal(t, filepath.Join(basePath, "segment_00001.dat"), rotated[0].Path)
+	assert.True(t, rotated[0].Size > segments.MaxSegmentSizeBytes)
+	assert.NoError(t, lbs.Close())
+}
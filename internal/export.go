@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	FormatJSONLines ExportFormat = "jsonl"
+	FormatCSV       ExportFormat = "csv"
+
+	base64Encoding  = "base64"
+	importBatchSize = 1024
+)
+
+var (
+	errUnknownFormat   = errors.New("error due to unknown export format")
+	errUnknownEncoding = errors.New("error due to unknown record encoding")
+	errEmptyKey        = errors.New("error due to empty key")
+)
+
+var csvHeader = []string{"key", "value", "encoding"}
+
+// ExportFormat is a portable representation of the store contents
+type ExportFormat string
+
+// exportRecord is a single key value pair. Keys and values that are not valid
+// UTF-8 are base64 encoded and flagged in Encoding.
+type exportRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ImportReport summarises an import run
+type ImportReport struct {
+	Imported int
+	Failed   int
+	Errors   []ImportError
+}
+
+// ImportError is a record of the input that could not be imported. For CSV
+// input Line is the record number, counting the header as the first one.
+type ImportError struct {
+	Line int
+	Err  error
+}
+
+func (ie ImportError) Error() string {
+	return fmt.Sprintf("line %d: %v", ie.Line, ie.Err)
+}
+
+// sizeChecker is implemented by the stores bounding the size of the keys and
+// values written to them
+type sizeChecker interface {
+	checkSize(key string, size int64) error
+}
+
+func newExportRecord(key string, value []byte) exportRecord {
+	if utf8.ValidString(key) && utf8.Valid(value) {
+		return exportRecord{Key: key, Value: string(value)}
+	}
+	return exportRecord{
+		Key:      base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:    base64.StdEncoding.EncodeToString(value),
+		Encoding: base64Encoding,
+	}
+}
+
+func (er exportRecord) decode() (KeyValue, error) {
+	var kv KeyValue
+	switch er.Encoding {
+	case "":
+		kv = KeyValue{Key: er.Key, Value: []byte(er.Value)}
+	case base64Encoding:
+		key, err := base64.StdEncoding.DecodeString(er.Key)
+		if err != nil {
+			return kv, fmt.Errorf("error decoding key: %w", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(er.Value)
+		if err != nil {
+			return kv, fmt.Errorf("error decoding value: %w", err)
+		}
+		kv = KeyValue{Key: string(key), Value: value}
+	default:
+		return kv, fmt.Errorf("%w: %q", errUnknownEncoding, er.Encoding)
+	}
+	if kv.Key == "" {
+		return kv, errEmptyKey
+	}
+	return kv, nil
+}
+
+// Export writes every live key of store to w, returning the number of records
+func Export(store Iterable, w io.Writer, format ExportFormat) (int, error) {
+	var exported int
+	switch format {
+	case FormatJSONLines:
+		bw := bufio.NewWriter(w)
+		encoder := json.NewEncoder(bw)
+		encoder.SetEscapeHTML(false)
+		err := store.ForEach(func(key string, value []byte) error {
+			exported++
+			return encoder.Encode(newExportRecord(key, value))
+		})
+		if err != nil {
+			return exported, fmt.Errorf("error exporting records: %w", err)
+		}
+		return exported, bw.Flush()
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		err := store.ForEach(func(key string, value []byte) error {
+			record := newExportRecord(key, value)
+			exported++
+			return cw.Write([]string{record.Key, record.Value, record.Encoding})
+		})
+		if err != nil {
+			return exported, fmt.Errorf("error exporting records: %w", err)
+		}
+		cw.Flush()
+		return exported, cw.Error()
+	default:
+		return 0, fmt.Errorf("%w: %q", errUnknownFormat, format)
+	}
+}
+
+// Import loads the records read from r into store. Malformed records and
+// records over the size limits of the store are reported per line and
+// skipped, while storage errors abort the import.
+// Stores implementing BulkLoader are loaded in batches.
+func Import(store KVStore, r io.Reader, format ExportFormat) (*ImportReport, error) {
+	report := &ImportReport{}
+	batch := make([]KeyValue, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if loader, ok := store.(BulkLoader); ok {
+			if err := loader.SetMany(batch); err != nil {
+				return err
+			}
+		} else {
+			for _, kv := range batch {
+				if err := store.Set(kv.Key, kv.Value); err != nil {
+					return err
+				}
+			}
+		}
+		report.Imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	add := func(line int, record exportRecord, err error) error {
+		var kv KeyValue
+		if err == nil {
+			kv, err = record.decode()
+		}
+		// checked here rather than failing the whole batch
+		if checker, ok := store.(sizeChecker); ok && err == nil {
+			err = checker.checkSize(kv.Key, int64(len(kv.Value)))
+		}
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, ImportError{Line: line, Err: err})
+			return nil
+		}
+		batch = append(batch, kv)
+		if len(batch) == importBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	var err error
+	switch format {
+	case FormatJSONLines:
+		err = readJSONLines(r, add)
+	case FormatCSV:
+		err = readCSV(r, add)
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownFormat, format)
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, flush()
+}
+
+func readJSONLines(r io.Reader, add func(int, exportRecord, error) error) error {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading line %d: %w", line, err)
+		}
+		if len(data) > 0 && !isBlank(data) {
+			var record exportRecord
+			decodeErr := json.Unmarshal(data, &record)
+			if addErr := add(line, record, decodeErr); addErr != nil {
+				return addErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func readCSV(r io.Reader, add func(int, exportRecord, error) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading csv header: %w", err)
+	}
+	if len(header) < 2 || header[0] != csvHeader[0] || header[1] != csvHeader[1] {
+		return fmt.Errorf("error due to unexpected csv header %v", header)
+	}
+	for line := 2; ; line++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var record exportRecord
+		switch {
+		case err != nil:
+			if _, ok := err.(*csv.ParseError); !ok {
+				return fmt.Errorf("error reading line %d: %w", line, err)
+			}
+		case len(fields) < 2 || len(fields) > 3:
+			err = fmt.Errorf("error due to %d fields, expected 2 or 3", len(fields))
+		default:
+			record = exportRecord{Key: fields[0], Value: fields[1]}
+			if len(fields) == 3 {
+				record.Encoding = fields[2]
+			}
+		}
+		if addErr := add(line, record, err); addErr != nil {
+			return addErr
+		}
+	}
+}
+
+func isBlank(data []byte) bool {
+	for _, b := range data {
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return false
+		}
+	}
+	return true
+}
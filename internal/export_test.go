@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportRoundtrip(t *testing.T) {
+	for _, format := range []ExportFormat{FormatJSONLines, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			src, _ := ioutil.TempDir("/tmp", "kvstore_*")
+			defer os.RemoveAll(src)
+			dst, _ := ioutil.TempDir("/tmp", "kvstore_*")
+			defer os.RemoveAll(dst)
+
+			db, err := OpenBitCaskStore(src)
+			assert.NoError(t, err)
+			assert.NoError(t, db.Set("coffee", []byte("geisha")))
+			assert.NoError(t, db.Set("multi\nline", []byte("a,\"quoted\"\nvalue")))
+			assert.NoError(t, db.Set("binary", []byte{0xff, 0x00, 0xfe}))
+
+			var buffer bytes.Buffer
+			exported, err := Export(db, &buffer, format)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, exported)
+			assert.NoError(t, db.Close())
+
+			db, err = OpenBitCaskStore(dst)
+			assert.NoError(t, err)
+			report, err := Import(db, &buffer, format)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, report.Imported)
+			assert.Equal(t, 0, report.Failed)
+
+			value, ok, err := db.Get("binary")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, []byte{0xff, 0x00, 0xfe}, value)
+			value, _, _ = db.Get("multi\nline")
+			assert.Equal(t, "a,\"quoted\"\nvalue", string(value))
+			assert.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestImportReportsBadLines(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	input := strings.Join([]string{
+		`{"key":"1","value":"walnuts"}`,
+		`{"key":"2","value":`,
+		``,
+		`{"key":"3","value":"!!","encoding":"base64"}`,
+		`{"key":"","value":"peas"}`,
+		`{"key":"NQ==","value":"cGVhbnV0cw==","encoding":"base64"}`,
+	}, "\n")
+	report, err := Import(db, strings.NewReader(input), FormatJSONLines)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 3, report.Failed)
+	lines := make([]int, 0, len(report.Errors))
+	for _, lineErr := range report.Errors {
+		lines = append(lines, lineErr.Line)
+	}
+	assert.Equal(t, []int{2, 4, 5}, lines)
+
+	value, ok, err := db.Get("5")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "peanuts", string(value))
+}
+
+func TestImportReportsOversizedRecords(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithMaxValueSize(8))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	input := strings.Join([]string{
+		`{"key":"1","value":"walnuts"}`,
+		`{"key":"2","value":"macadamias"}`,
+		`{"key":"3","value":"pecans"}`,
+	}, "\n")
+	report, err := Import(db, strings.NewReader(input), FormatJSONLines)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 2, report.Errors[0].Line)
+	var tooLarge *ValueTooLargeError
+	assert.True(t, errors.As(report.Errors[0].Err, &tooLarge))
+	assert.Equal(t, []string{"1", "3"}, db.Keys())
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const (
+	virtualNodesPerShard = 128
+)
+
+// hashRing maps keys to shards using consistent hashing so that changing the
+// number of shards only moves the keys owned by the added or removed shards
+type hashRing struct {
+	points []uint64
+	owners map[uint64]int
+}
+
+func newHashRing(shards int) *hashRing {
+	ring := &hashRing{
+		points: make([]uint64, 0, shards*virtualNodesPerShard),
+		owners: make(map[uint64]int, shards*virtualNodesPerShard),
+	}
+	for shard := 0; shard < shards; shard++ {
+		for vnode := 0; vnode < virtualNodesPerShard; vnode++ {
+			point := hashKey("shard-" + strconv.Itoa(shard) + "-" + strconv.Itoa(vnode))
+			// on the unlikely collision the lowest shard keeps the point
+			if _, ok := ring.owners[point]; ok {
+				continue
+			}
+			ring.owners[point] = shard
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Locate returns the shard owning key
+func (r *hashRing) Locate(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
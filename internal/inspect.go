@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+// DumpedRecord is a record of a segment file along with its location. Err is
+// set for damaged records, in which case Record is nil.
+type DumpedRecord struct {
+	Offset int64
+	Record *encoding.Record
+	Err    error
+}
+
+// SegmentStats summarises the contents of a segment file
+type SegmentStats struct {
+	File       string
+	ID         int
+	Records    int
+	Tombstones int
+	Bytes      int64
+	// LiveBytes is held by the records the keydir points to
+	LiveBytes int64
+}
+
+// DeadBytes is held by overwritten records, tombstones and damaged data
+func (ss SegmentStats) DeadBytes() int64 {
+	return ss.Bytes - ss.LiveBytes
+}
+
+// KeyStats locates the live record of a key
+type KeyStats struct {
+	// Keyspace is the name of the keyspace of the key, empty for the default one
+	Keyspace string
+	Key      string
+	FileID   int
+	// Size counts the value stored in a blob or value log along with the record
+	Size int64
+}
+
+// StoreStats summarises the contents of a data folder. Bytes and LiveBytes
+// count the values stored in blob and value log files too.
+type StoreStats struct {
+	Segments []SegmentStats
+	// ValueLogs holds the values of the records flagged as value pointers,
+	// live when such a live record points to them
+	ValueLogs     []SegmentStats
+	BlobBytes     int64
+	LiveBlobBytes int64
+	Keys          int
+	Bytes         int64
+	LiveBytes     int64
+	LargestKeys   []KeyStats
+}
+
+// DumpSegment calls fn with every record of the segment file in log order
+func DumpSegment(path string, fn func(DumpedRecord) error) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading segment %s: %w", path, err)
+	}
+	var fnErr error
+	walkSegment(data, func(offset int64, record *encoding.Record, err error) {
+		if fnErr == nil {
+			fnErr = fn(DumpedRecord{Offset: offset, Record: record, Err: err})
+		}
+	})
+	return fnErr
+}
+
+// CollectStats rebuilds the keydir of the data folder without opening the
+// store, and reports the live and dead bytes of every segment along with
+// the largest live records. Records of dropped keyspaces are dead.
+func CollectStats(dataDir string, largest int) (*StoreStats, error) {
+	files, activeID, err := classifySegmentFiles(dataDir, &VerifyReport{})
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := readKeyspaceCatalog(vfs.Default, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	keyspaces := map[uint32]string{defaultKeyspaceID: ""}
+	for _, descriptor := range catalog.Keyspaces {
+		keyspaces[descriptor.ID] = descriptor.Name
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, activeSegmentFilename)); err == nil {
+		files = append(files, filepath.Join(dataDir, activeSegmentFilename))
+	}
+
+	stats := &StoreStats{Segments: make([]SegmentStats, 0, len(files))}
+	bySegment := make(map[int]*SegmentStats, len(files))
+	kdt := make(segments.KeyDirTable)
+	// values stored apart from the records of the keys, by qualified key
+	blobs := make(map[string]encoding.BlobRef)
+	pointers := make(map[string]segments.KeyDirEntry)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading segment %s: %w", f, err)
+		}
+		if filepath.Base(f) == activeSegmentFilename {
+			data = segments.TrimPreallocated(data)
+		}
+		segment := SegmentStats{
+			File:  filepath.Base(f),
+			ID:    segments.SegmentID(f, false),
+			Bytes: int64(len(data)),
+		}
+		if filepath.Base(f) == activeSegmentFilename {
+			segment.ID = activeID
+		}
+		walkSegment(data, func(offset int64, record *encoding.Record, err error) {
+			if err != nil {
+				return
+			}
+			segment.Records++
+			if record.Tombstone() {
+				segment.Tombstones++
+			}
+			if _, ok := keyspaces[record.Keyspace]; !ok {
+				return
+			}
+			key := string(segments.QualifiedKey(record.Keyspace, record.Key))
+			delete(blobs, key)
+			delete(pointers, key)
+			if record.Tombstone() {
+				delete(kdt, key)
+				return
+			}
+			kdt[key] = segments.NewKeyDirEntry(segment.ID, offset, record.Size)
+			if record.Blob() {
+				if ref, err := encoding.DecodeBlobRef(record.Value); err == nil {
+					blobs[key] = ref
+				}
+			} else if record.ValuePointer() {
+				if entry, err := segments.DecodeKeyDirEntry(record.Value); err == nil {
+					pointers[key] = entry
+				}
+			}
+		})
+		stats.Segments = append(stats.Segments, segment)
+		stats.Bytes += segment.Bytes
+	}
+	for i := range stats.Segments {
+		bySegment[stats.Segments[i].ID] = &stats.Segments[i]
+	}
+	byValueLog, err := collectValueLogStats(dataDir, stats)
+	if err != nil {
+		return nil, err
+	}
+	blobsBySegment, err := blobFiles(vfs.Default, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, files := range blobsBySegment {
+		for _, f := range files {
+			info, err := os.Stat(f)
+			if err != nil {
+				return nil, err
+			}
+			stats.BlobBytes += info.Size()
+		}
+	}
+	stats.Bytes += stats.BlobBytes
+
+	keys := make([]KeyStats, 0, len(kdt))
+	for k, entry := range kdt {
+		bySegment[entry.FileID].LiveBytes += entry.Size
+		stats.LiveBytes += entry.Size
+		size := entry.Size
+		if ref, ok := blobs[k]; ok {
+			stats.LiveBlobBytes += ref.Size
+			stats.LiveBytes += ref.Size
+			size += ref.Size
+		} else if pointer, ok := pointers[k]; ok {
+			if valueLog, ok := byValueLog[pointer.FileID]; ok {
+				valueLog.LiveBytes += pointer.Size
+				stats.LiveBytes += pointer.Size
+			}
+			size += pointer.Size
+		}
+		keyspace, key := splitQualifiedKey(k)
+		keys = append(keys, KeyStats{Keyspace: keyspaces[keyspace], Key: key, FileID: entry.FileID, Size: size})
+	}
+	stats.Keys = len(kdt)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Size != keys[j].Size {
+			return keys[i].Size > keys[j].Size
+		}
+		if keys[i].Keyspace != keys[j].Keyspace {
+			return keys[i].Keyspace < keys[j].Keyspace
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > largest {
+		keys = keys[:largest]
+	}
+	stats.LargestKeys = keys
+	return stats, nil
+}
+
+// collectValueLogStats adds the value log files of dataDir to stats,
+// returning them by ID
+func collectValueLogStats(dataDir string, stats *StoreStats) (map[int]*SegmentStats, error) {
+	m, _, err := readManifest(vfs.Default, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := valueLogFiles(vfs.Default, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(files)+1)
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if active := filepath.Join(dataDir, activeValueLogFilename); vfs.Exists(vfs.Default, active) {
+		files[m.activeValueLog] = active
+		ids = append(ids, m.activeValueLog)
+	}
+	for _, id := range ids {
+		data, err := ioutil.ReadFile(files[id])
+		if err != nil {
+			return nil, fmt.Errorf("error reading value log %s: %w", files[id], err)
+		}
+		if filepath.Base(files[id]) == activeValueLogFilename {
+			data = segments.TrimPreallocated(data)
+		}
+		valueLog := SegmentStats{File: filepath.Base(files[id]), ID: id, Bytes: int64(len(data))}
+		walkSegment(data, func(offset int64, record *encoding.Record, err error) {
+			if err == nil {
+				valueLog.Records++
+			}
+		})
+		stats.ValueLogs = append(stats.ValueLogs, valueLog)
+		stats.Bytes += valueLog.Bytes
+	}
+	byID := make(map[int]*SegmentStats, len(stats.ValueLogs))
+	for i := range stats.ValueLogs {
+		byID[stats.ValueLogs[i].ID] = &stats.ValueLogs[i]
+	}
+	return byID, nil
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpSegment(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Remove("1"))
+	assert.NoError(t, db.Close())
+
+	var dumped []DumpedRecord
+	assert.NoError(t, DumpSegment(filepath.Join(path, activeSegmentFilename), func(record DumpedRecord) error {
+		dumped = append(dumped, record)
+		return nil
+	}))
+	assert.Len(t, dumped, 2)
+	assert.Equal(t, int64(0), dumped[0].Offset)
+	assert.Equal(t, "walnuts", string(dumped[0].Record.Value))
+	assert.Equal(t, dumped[0].Record.Size, dumped[1].Offset)
+	assert.True(t, dumped[1].Record.Tombstone())
+}
+
+func TestCollectStats(t *testing.T) {
+	path := existingDataFolderWithSegments(t, 2)
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	// overwrite every key of the first segment and remove one of the second
+	for i := 10; i < 20; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte("x")))
+	}
+	assert.NoError(t, db.Remove("25"))
+	assert.NoError(t, db.Set("largest", make([]byte, 1024)))
+	assert.NoError(t, db.Close())
+
+	stats, err := CollectStats(path, 1)
+	assert.NoError(t, err)
+	assert.Len(t, stats.Segments, 3)
+	assert.Equal(t, 20, stats.Keys)
+	assert.Equal(t, int64(0), stats.Segments[0].LiveBytes)
+	assert.Equal(t, stats.Segments[1].Bytes/10*9, stats.Segments[1].LiveBytes)
+	assert.Equal(t, 1, stats.Segments[2].Tombstones)
+	assert.Equal(t, stats.LiveBytes, stats.Segments[1].LiveBytes+stats.Segments[2].LiveBytes)
+	assert.Equal(t, "largest", stats.LargestKeys[0].Key)
+	assert.Len(t, stats.LargestKeys, 1)
+}
+
+func TestCollectStatsOfValuesApart(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithValueLog(), WithBlobThreshold(1024))
+	assert.NoError(t, err)
+	// the first value of a is overwritten with one of the same size, and
+	// the blob of c is left behind by its removal
+	assert.NoError(t, db.Set("a", make([]byte, 100)))
+	assert.NoError(t, db.Set("a", make([]byte, 100)))
+	assert.NoError(t, db.Set("b", make([]byte, 2048)))
+	assert.NoError(t, db.Set("c", make([]byte, 2048)))
+	assert.NoError(t, db.Remove("c"))
+	assert.NoError(t, db.Close())
+
+	stats, err := CollectStats(path, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Keys)
+	assert.Len(t, stats.ValueLogs, 1)
+	assert.Equal(t, 2, stats.ValueLogs[0].Records)
+	assert.Equal(t, stats.ValueLogs[0].Bytes/2, stats.ValueLogs[0].LiveBytes)
+	assert.Equal(t, int64(4096), stats.BlobBytes)
+	assert.Equal(t, int64(2048), stats.LiveBlobBytes)
+	assert.Equal(t, stats.Segments[0].Bytes+stats.ValueLogs[0].Bytes+stats.BlobBytes, stats.Bytes)
+	assert.Equal(t, stats.Segments[0].LiveBytes+stats.ValueLogs[0].LiveBytes+stats.LiveBlobBytes, stats.LiveBytes)
+	assert.Equal(t, "b", stats.LargestKeys[0].Key)
+	assert.True(t, stats.LargestKeys[0].Size > 2048)
+}
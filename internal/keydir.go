@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"pingcap.com/kvs/internal/segments"
+)
+
+const keyDirStripes = 64
+
+// stripedKeyDir splits the keydir in stripes guarded by their own lock, so
+// reads only wait for writes of keys sharing their stripe. Writers hold the
+// stripe of their key for the whole append, which makes every single key
+// operation linearizable. Locks are always taken in this order: keydir
+// stripes, by ascending index, then the store write lock, then the storage
+// lock.
+type stripedKeyDir struct {
+	stripes [keyDirStripes]keyDirStripe
+	size    int64
+}
+
+type keyDirStripe struct {
+	sync.RWMutex
+	kdt segments.KeyDir
+}
+
+func newStripedKeyDir(newKeyDir func() segments.KeyDir) *stripedKeyDir {
+	skd := &stripedKeyDir{}
+	for i := range skd.stripes {
+		skd.stripes[i].kdt = newKeyDir()
+	}
+	return skd
+}
+
+// stripeOf hashes key with FNV-1a
+func stripeOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % keyDirStripes)
+}
+
+// view runs fn with the stripe of key locked for reading
+func (skd *stripedKeyDir) view(key string, fn func(kdt segments.KeyDir) error) error {
+	s := &skd.stripes[stripeOf(key)]
+	s.RLock()
+	defer s.RUnlock()
+	return fn(s.kdt)
+}
+
+// viewMany runs fn with the stripes of every key locked for reading. fn
+// receives the stripe of each key.
+func (skd *stripedKeyDir) viewMany(keys []string, fn func(stripe func(key string) segments.KeyDir) error) error {
+	for _, i := range stripesOf(keys) {
+		skd.stripes[i].RLock()
+		defer skd.stripes[i].RUnlock()
+	}
+	return fn(func(key string) segments.KeyDir {
+		return skd.stripes[stripeOf(key)].kdt
+	})
+}
+
+// update runs fn with the stripe of key locked for writing
+func (skd *stripedKeyDir) update(key string, fn func(kdt segments.KeyDir) error) error {
+	s := &skd.stripes[stripeOf(key)]
+	s.Lock()
+	defer s.Unlock()
+	size := s.kdt.Len()
+	defer func() { atomic.AddInt64(&skd.size, int64(s.kdt.Len()-size)) }()
+	return fn(s.kdt)
+}
+
+// updateMany runs fn with the stripes of every key locked for writing. fn
+// receives the stripe of each key.
+func (skd *stripedKeyDir) updateMany(keys []string, fn func(stripe func(key string) segments.KeyDir) error) error {
+	order := stripesOf(keys)
+	locked := make(map[int]int, len(order))
+	for _, i := range order {
+		skd.stripes[i].Lock()
+		locked[i] = skd.stripes[i].kdt.Len()
+	}
+	defer func() {
+		for _, i := range order {
+			atomic.AddInt64(&skd.size, int64(skd.stripes[i].kdt.Len()-locked[i]))
+			skd.stripes[i].Unlock()
+		}
+	}()
+	return fn(func(key string) segments.KeyDir {
+		return skd.stripes[stripeOf(key)].kdt
+	})
+}
+
+// stripesOf returns the distinct stripes of keys in ascending order
+func stripesOf(keys []string) []int {
+	var used [keyDirStripes]bool
+	for _, k := range keys {
+		used[stripeOf(k)] = true
+	}
+	var order []int
+	for i, ok := range used {
+		if ok {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// evict removes the entries matched by fn, one stripe at a time
+func (skd *stripedKeyDir) evict(fn func(entry segments.KeyDirEntry) bool) {
+	for i := range skd.stripes {
+		s := &skd.stripes[i]
+		s.Lock()
+		var evicted []string
+		s.kdt.ForEach(func(k string, entry segments.KeyDirEntry) bool {
+			if fn(entry) {
+				evicted = append(evicted, k)
+			}
+			return true
+		})
+		for _, k := range evicted {
+			s.kdt.Delete(k)
+		}
+		atomic.AddInt64(&skd.size, -int64(len(evicted)))
+		s.Unlock()
+	}
+}
+
+func (skd *stripedKeyDir) Get(key string) (entry segments.KeyDirEntry, ok bool) {
+	skd.view(key, func(kdt segments.KeyDir) error {
+		entry, ok = kdt.Get(key)
+		return nil
+	})
+	return entry, ok
+}
+
+func (skd *stripedKeyDir) Put(key string, entry segments.KeyDirEntry) {
+	skd.update(key, func(kdt segments.KeyDir) error {
+		kdt.Put(key, entry)
+		return nil
+	})
+}
+
+func (skd *stripedKeyDir) Delete(key string) {
+	skd.update(key, func(kdt segments.KeyDir) error {
+		kdt.Delete(key)
+		return nil
+	})
+}
+
+func (skd *stripedKeyDir) Len() int {
+	return int(atomic.LoadInt64(&skd.size))
+}
+
+// ForEach calls fn for every key, holding the read lock of one stripe at a
+// time, so fn must not access the keydir
+func (skd *stripedKeyDir) ForEach(fn func(key string, entry segments.KeyDirEntry) bool) {
+	for i := range skd.stripes {
+		s := &skd.stripes[i]
+		s.RLock()
+		done := false
+		s.kdt.ForEach(func(k string, entry segments.KeyDirEntry) bool {
+			done = !fn(k, entry)
+			return !done
+		})
+		s.RUnlock()
+		if done {
+			return
+		}
+	}
+}
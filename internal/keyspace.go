@@ -0,0 +1,669 @@
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"pingcap.com/kvs/internal/metrics"
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	keyspaceCatalogFilename = "keyspaces.json"
+	// defaultKeyspaceID holds the keys of the store itself, its records keep
+	// the header without keyspace
+	defaultKeyspaceID uint32 = 0
+)
+
+var (
+	errInvalidKeyspaceName = errors.New("error due to invalid keyspace name")
+	errUnknownKeyspace     = errors.New("error dropping a keyspace not present in the database")
+	errKeyspaceDropped     = errors.New("error using a dropped keyspace")
+	errUnknownCompression  = errors.New("error due to unknown compression")
+)
+
+// Compression is the codec applied to the values written to a keyspace
+type Compression string
+
+const (
+	NoCompression      Compression = ""
+	DeflateCompression Compression = "deflate"
+)
+
+// KeyspaceOptions tune the writes to a keyspace
+type KeyspaceOptions struct {
+	// TTL is the lifetime of the values written to the keyspace, 0 meaning
+	// they never expire
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Compression applies to the values written to the keyspace
+	Compression Compression `json:"compression,omitempty"`
+}
+
+// KeyspaceOption sets one of the KeyspaceOptions
+type KeyspaceOption func(*KeyspaceOptions)
+
+// WithTTL makes the values written to the keyspace expire after ttl
+func WithTTL(ttl time.Duration) KeyspaceOption {
+	return func(o *KeyspaceOptions) {
+		o.TTL = ttl
+	}
+}
+
+// WithCompression compresses the values written to the keyspace
+func WithCompression(c Compression) KeyspaceOption {
+	return func(o *KeyspaceOptions) {
+		o.Compression = c
+	}
+}
+
+// KeyspaceDescriptor is a keyspace known to the catalog
+type KeyspaceDescriptor struct {
+	Name    string          `json:"name"`
+	ID      uint32          `json:"id"`
+	Options KeyspaceOptions `json:"options"`
+}
+
+// KeyspaceCatalog maps the keyspace names to the IDs stored in the records.
+// IDs are never reused, so the records of a dropped keyspace, which stay
+// around until the cleaner reclaims their segments, are simply ignored.
+type KeyspaceCatalog struct {
+	NextID    uint32               `json:"next_id"`
+	Keyspaces []KeyspaceDescriptor `json:"keyspaces"`
+}
+
+func readKeyspaceCatalog(fs vfs.FS, folder string) (*KeyspaceCatalog, error) {
+	data, err := vfs.ReadFile(fs, filepath.Join(folder, keyspaceCatalogFilename))
+	if os.IsNotExist(err) {
+		return &KeyspaceCatalog{NextID: defaultKeyspaceID + 1}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyspace catalog: %w", err)
+	}
+	var catalog KeyspaceCatalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("error decoding keyspace catalog: %w", err)
+	}
+	return &catalog, nil
+}
+
+// writeKeyspaceCatalog replaces the catalog of folder, syncing it before the
+// rename so a crash leaves either version in place
+func writeKeyspaceCatalog(fs vfs.FS, folder string, catalog *KeyspaceCatalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(folder, keyspaceCatalogFilename+".tmp")
+	f, err := vfs.Create(fs, tmp)
+	if err != nil {
+		return fmt.Errorf("error writing keyspace catalog: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("error writing keyspace catalog: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, filepath.Join(folder, keyspaceCatalogFilename)); err != nil {
+		return err
+	}
+	return fs.SyncDir(folder)
+}
+
+// Keyspace is a named set of keys sharing the log of a store, with its own
+// keydir and options. Expired values read as missing, and are removed when
+// read, overwritten or removed.
+type Keyspace struct {
+	store  *BitCaskStore
+	id     uint32
+	name   string
+	keyDir *stripedKeyDir
+	// options holds the KeyspaceOptions
+	options atomic.Value
+	dropped int32
+}
+
+func newKeyspace(store *BitCaskStore, descriptor KeyspaceDescriptor, keyDir *stripedKeyDir) *Keyspace {
+	ks := &Keyspace{
+		store:  store,
+		id:     descriptor.ID,
+		name:   descriptor.Name,
+		keyDir: keyDir,
+	}
+	ks.options.Store(descriptor.Options)
+	return ks
+}
+
+// Name returns the name of the keyspace, empty for the default keyspace
+func (ks *Keyspace) Name() string {
+	return ks.name
+}
+
+// Options returns the options of the keyspace
+func (ks *Keyspace) Options() KeyspaceOptions {
+	return ks.options.Load().(KeyspaceOptions)
+}
+
+func (ks *Keyspace) isDropped() bool {
+	return atomic.LoadInt32(&ks.dropped) != 0
+}
+
+// checkSize checks the limits of the store of the keyspace
+func (ks *Keyspace) checkSize(key string, size int64) error {
+	return ks.store.checkSize(key, size)
+}
+
+// newHeader checks the sizes of a write and returns its record, without
+// the value
+func (ks *Keyspace) newHeader(key string, size int64) (*encoding.Record, error) {
+	if err := ks.store.checkSize(key, size); err != nil {
+		return nil, err
+	}
+	record := &encoding.Record{Keyspace: ks.id, Key: []byte(key)}
+	if ttl := ks.Options().TTL; ttl > 0 {
+		record.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	return record, nil
+}
+
+// newRecord applies the options of the keyspace to a value being written
+func (ks *Keyspace) newRecord(key string, value []byte) (*encoding.Record, error) {
+	record, err := ks.newHeader(key, int64(len(value)))
+	if err != nil {
+		return nil, err
+	}
+	record.Value = value
+	switch compression := ks.Options().Compression; compression {
+	case NoCompression:
+	case DeflateCompression:
+		var buffer bytes.Buffer
+		w, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		record.Value = buffer.Bytes()
+		record.Flags |= encoding.FlagCompressed
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownCompression, compression)
+	}
+	return record, nil
+}
+
+// recordValue returns the value of record as it was written, given it is
+// not stored in a blob
+func recordValue(record *encoding.Record) ([]byte, error) {
+	if record.Flags&encoding.FlagCompressed == 0 {
+		return record.Value, nil
+	}
+	r := flate.NewReader(bytes.NewReader(record.Value))
+	defer r.Close()
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing value of %q: %w", record.Key, err)
+	}
+	return value, nil
+}
+
+// Set the value of a string key to a string
+func (ks *Keyspace) Set(key string, value []byte) (err error) {
+	defer ks.store.observe(metrics.OpSet, time.Now(), &err)
+	if ks.store.isBlob(int64(len(value))) {
+		return ks.setBlob(key, bytes.NewReader(value), int64(len(value)))
+	}
+	record, err := ks.newRecord(key, value)
+	if err != nil {
+		return err
+	}
+	return ks.write(key, record, nil)
+}
+
+// SetReader sets key to the size bytes read from r. Values over the blob
+// threshold are streamed to a blob file, never held in memory.
+func (ks *Keyspace) SetReader(key string, r io.Reader, size int64) (err error) {
+	defer ks.store.observe(metrics.OpSet, time.Now(), &err)
+	if ks.store.isBlob(size) {
+		return ks.setBlob(key, r, size)
+	}
+	if err := ks.store.checkSize(key, size); err != nil {
+		return err
+	}
+	value, err := readValue(r, size)
+	if err != nil {
+		return err
+	}
+	record, err := ks.newRecord(key, value)
+	if err != nil {
+		return err
+	}
+	return ks.write(key, record, nil)
+}
+
+// setBlob stages the value read from r in a blob file, uncompressed, before
+// taking the locks to append the record referencing it
+func (ks *Keyspace) setBlob(key string, r io.Reader, size int64) error {
+	record, err := ks.newHeader(key, size)
+	if err != nil {
+		return err
+	}
+	blob, err := stageBlob(ks.store.fs, ks.store.basePath, r, size)
+	if err != nil {
+		return err
+	}
+	defer blob.discard()
+	return ks.write(key, record, blob)
+}
+
+// write appends record, along with the blob holding its value if any
+func (ks *Keyspace) write(key string, record *encoding.Record, blob *stagedBlob) error {
+	err := ks.keyDir.update(key, func(kdt segments.KeyDir) error {
+		return ks.store.appendTo(ks, func() error {
+			return ks.store.append(record, blob, kdt)
+		})
+	})
+	ks.store.afterWrite()
+	return err
+}
+
+// SetMany appends every pair under a single acquisition of the locks
+func (ks *Keyspace) SetMany(pairs []KeyValue) error {
+	keys := make([]string, len(pairs))
+	records := make([]*encoding.Record, len(pairs))
+	blobs := make([]*stagedBlob, len(pairs))
+	defer func() {
+		for _, blob := range blobs {
+			if blob != nil {
+				blob.discard()
+			}
+		}
+	}()
+	for i, kv := range pairs {
+		keys[i] = kv.Key
+		size := int64(len(kv.Value))
+		if !ks.store.isBlob(size) {
+			record, err := ks.newRecord(kv.Key, kv.Value)
+			if err != nil {
+				return err
+			}
+			records[i] = record
+			continue
+		}
+		record, err := ks.newHeader(kv.Key, size)
+		if err != nil {
+			return err
+		}
+		if blobs[i], err = stageBlob(ks.store.fs, ks.store.basePath, bytes.NewReader(kv.Value), size); err != nil {
+			return err
+		}
+		records[i] = record
+	}
+	err := ks.keyDir.updateMany(keys, func(stripe func(key string) segments.KeyDir) error {
+		return ks.store.appendTo(ks, func() error {
+			for i, record := range records {
+				start := time.Now()
+				err := ks.store.append(record, blobs[i], stripe(string(record.Key)))
+				ks.store.metrics.ObserveOperation(metrics.OpSet, time.Since(start), err)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	ks.store.afterWrite()
+	return err
+}
+
+// Get the string value of the a string key. If the key does not exist, return nil.
+func (ks *Keyspace) Get(key string) (value []byte, exists bool, err error) {
+	defer ks.store.observe(metrics.OpGet, time.Now(), &err)
+	if ks.isDropped() {
+		return nil, false, errKeyspaceDropped
+	}
+	var expired *segments.KeyDirEntry
+	var blob *blobReader
+	// the stripe is held while reading so the record cannot be superseded
+	// and cleaned in the meantime. Blobs are only opened, the open file
+	// staying readable once cleaned.
+	err = ks.keyDir.view(key, func(kdt segments.KeyDir) error {
+		entry, ok := ks.lookup(kdt, key)
+		if !ok {
+			return nil
+		}
+		record, err := ks.store.logStore.ReadRecord(entry)
+		if err != nil {
+			return err
+		}
+		if record.Expired(time.Now().UnixNano()) {
+			expired = &entry
+			return nil
+		}
+		if record, err = ks.store.resolveValue(record); err != nil {
+			return err
+		}
+		if record.Blob() {
+			blob, err = openBlob(ks.store.fs, ks.store.basePath, record)
+		} else {
+			value, err = recordValue(record)
+		}
+		exists = err == nil
+		return err
+	})
+	if expired != nil {
+		ks.removeExpired(key, *expired)
+	}
+	if blob != nil {
+		if value, err = readBlob(blob); err != nil {
+			return nil, false, err
+		}
+	}
+	return value, exists, err
+}
+
+// GetReader returns a reader of the value of key, which the caller must
+// close, and reports whether key exists. The values stored in blob files
+// are streamed from them, checking their checksum once read to the end.
+func (ks *Keyspace) GetReader(key string) (rc io.ReadCloser, exists bool, err error) {
+	defer ks.store.observe(metrics.OpGet, time.Now(), &err)
+	if ks.isDropped() {
+		return nil, false, errKeyspaceDropped
+	}
+	var expired *segments.KeyDirEntry
+	err = ks.keyDir.view(key, func(kdt segments.KeyDir) error {
+		entry, ok := ks.lookup(kdt, key)
+		if !ok {
+			return nil
+		}
+		record, err := ks.store.logStore.ReadRecord(entry)
+		if err != nil {
+			return err
+		}
+		if record.Expired(time.Now().UnixNano()) {
+			expired = &entry
+			return nil
+		}
+		if record, err = ks.store.resolveValue(record); err != nil {
+			return err
+		}
+		if record.Blob() {
+			rc, err = openBlob(ks.store.fs, ks.store.basePath, record)
+		} else {
+			var value []byte
+			value, err = recordValue(record)
+			rc = ioutil.NopCloser(bytes.NewReader(value))
+		}
+		exists = err == nil
+		return err
+	})
+	if expired != nil {
+		ks.removeExpired(key, *expired)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return rc, exists, nil
+}
+
+// View calls fn with the value of key without copying it out of the sealed
+// segments. The value is only valid during the call and must not be
+// modified. fn is not called when key does not exist. Values stored in blob
+// files are read in memory first.
+func (ks *Keyspace) View(key string, fn func(value []byte) error) (exists bool, err error) {
+	defer ks.store.observe(metrics.OpView, time.Now(), &err)
+	if ks.isDropped() {
+		return false, errKeyspaceDropped
+	}
+	var record *encoding.Record
+	var entry segments.KeyDirEntry
+	var blob *blobReader
+	release := func() {}
+	// the segment reference, rather than the stripe, keeps the record
+	// readable while fn runs
+	err = ks.keyDir.view(key, func(kdt segments.KeyDir) error {
+		var ok bool
+		if entry, ok = ks.lookup(kdt, key); !ok {
+			return nil
+		}
+		var err error
+		if record, release, err = ks.store.logStore.ViewRecord(entry); err != nil {
+			return err
+		}
+		if record.Expired(time.Now().UnixNano()) {
+			return nil
+		}
+		// values of the value log are copied, their file may be collected
+		// once the stripe is released
+		if record, err = ks.store.resolveValue(record); err == nil && record.Blob() {
+			blob, err = openBlob(ks.store.fs, ks.store.basePath, record)
+		}
+		if err != nil {
+			release()
+			record = nil
+		}
+		return err
+	})
+	if err != nil || record == nil {
+		return false, err
+	}
+	defer release()
+	if record.Expired(time.Now().UnixNano()) {
+		if blob != nil {
+			blob.Close()
+		}
+		ks.removeExpired(key, entry)
+		return false, nil
+	}
+	var value []byte
+	if blob != nil {
+		value, err = readBlob(blob)
+	} else {
+		value, err = recordValue(record)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, fn(value)
+}
+
+// MultiGet returns the values of keys in the same order, along with whether
+// each key exists. The records are read sorted by segment and offset.
+func (ks *Keyspace) MultiGet(keys []string) (values [][]byte, exists []bool, err error) {
+	defer ks.store.observe(metrics.OpMultiGet, time.Now(), &err)
+	if ks.isDropped() {
+		return nil, nil, errKeyspaceDropped
+	}
+	values = make([][]byte, len(keys))
+	exists = make([]bool, len(keys))
+	expired := make(map[string]segments.KeyDirEntry)
+	err = ks.keyDir.viewMany(keys, func(stripe func(key string) segments.KeyDir) error {
+		var found []int
+		var entries []segments.KeyDirEntry
+		for i, key := range keys {
+			if entry, ok := ks.lookup(stripe(key), key); ok {
+				found = append(found, i)
+				entries = append(entries, entry)
+			}
+		}
+		records, err := ks.store.logStore.ReadRecords(entries)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixNano()
+		for j, record := range records {
+			i := found[j]
+			if record.Expired(now) {
+				expired[keys[i]] = entries[j]
+				continue
+			}
+			if record, err = ks.store.resolveValue(record); err != nil {
+				return err
+			}
+			if record.Blob() {
+				var blob *blobReader
+				if blob, err = openBlob(ks.store.fs, ks.store.basePath, record); err == nil {
+					values[i], err = readBlob(blob)
+				}
+			} else {
+				values[i], err = recordValue(record)
+			}
+			if err != nil {
+				return err
+			}
+			exists[i] = true
+		}
+		return nil
+	})
+	for key, entry := range expired {
+		ks.removeExpired(key, entry)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, exists, nil
+}
+
+// lookup locates the live record of key, given the keydir stripe of key
+func (ks *Keyspace) lookup(kdt segments.KeyDir, key string) (segments.KeyDirEntry, bool) {
+	if entry, ok := kdt.Get(key); ok || !ks.store.diskIndex {
+		return entry, ok
+	}
+	return ks.store.logStore.Lookup(ks.id, []byte(key))
+}
+
+// removeExpired appends a tombstone for key unless its expired record, found
+// at entry, was superseded in the meantime. Failures are left to the next read.
+func (ks *Keyspace) removeExpired(key string, entry segments.KeyDirEntry) {
+	ks.keyDir.update(key, func(kdt segments.KeyDir) error {
+		if current, ok := ks.lookup(kdt, key); !ok || current != entry {
+			return nil
+		}
+		tombstone := &encoding.Record{Keyspace: ks.id, Key: []byte(key), Flags: encoding.FlagTombstone}
+		return ks.store.appendTo(ks, func() error {
+			return ks.store.append(tombstone, nil, kdt)
+		})
+	})
+	ks.store.afterWrite()
+}
+
+// Remove a given key
+func (ks *Keyspace) Remove(key string) (err error) {
+	defer ks.store.observe(metrics.OpRemove, time.Now(), &err)
+	err = ks.keyDir.update(key, func(kdt segments.KeyDir) error {
+		if _, ok := ks.lookup(kdt, key); !ok {
+			return ErrDeletingNonExistingKey
+		}
+		tombstone := &encoding.Record{Keyspace: ks.id, Key: []byte(key), Flags: encoding.FlagTombstone}
+		return ks.store.appendTo(ks, func() error {
+			return ks.store.append(tombstone, nil, kdt)
+		})
+	})
+	ks.store.afterWrite()
+	return err
+}
+
+// Keys returns a snapshot of the live keys in ascending order. Keyspaces
+// with a TTL read the record of every key to skip the expired ones.
+func (ks *Keyspace) Keys() []string {
+	if ks.isDropped() {
+		return nil
+	}
+	keys := ks.store.logStore.LiveKeys(ks.id, ks.keyDir)
+	if ks.Options().TTL > 0 {
+		now := time.Now().UnixNano()
+		live := keys[:0]
+		for _, k := range keys {
+			if !ks.expired(k, now) {
+				live = append(live, k)
+			}
+		}
+		keys = live
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expired tells whether the live record of key expired at now
+func (ks *Keyspace) expired(key string, now int64) (expired bool) {
+	ks.keyDir.view(key, func(kdt segments.KeyDir) error {
+		if entry, ok := ks.lookup(kdt, key); ok {
+			record, err := ks.store.logStore.ReadRecord(entry)
+			expired = err == nil && record.Expired(now)
+		}
+		return nil
+	})
+	return expired
+}
+
+// ForEach calls fn for every live key in ascending order. Keys removed after
+// the iteration started are skipped.
+func (ks *Keyspace) ForEach(fn func(key string, value []byte) error) error {
+	for _, k := range ks.Keys() {
+		value, ok, err := ks.Get(k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(k, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch notifies the changes of the keys starting with prefix from now on
+func (ks *Keyspace) Watch(prefix string) *Watcher {
+	ks.store.mutex.Lock()
+	defer ks.store.mutex.Unlock()
+	w := ks.store.watchers.watch(ks.id, prefix)
+	ks.startWatch(w, nil)
+	return w
+}
+
+// WatchFrom replays the changes of the keys starting with prefix found in
+// the log from position from, before notifying the new ones. The zero
+// position replays the whole log still on disk.
+func (ks *Keyspace) WatchFrom(prefix string, from LogPosition) (*Watcher, error) {
+	// no write gets in between the end of the history and the first live
+	// change
+	ks.store.mutex.Lock()
+	defer ks.store.mutex.Unlock()
+	history, err := ks.store.logStore.ReadLog(from)
+	if err != nil {
+		return nil, err
+	}
+	w := ks.store.watchers.watch(ks.id, prefix)
+	ks.startWatch(w, history)
+	return w, nil
+}
+
+func (ks *Keyspace) startWatch(w *Watcher, history *logReader) {
+	if ks.isDropped() {
+		w.fail(errKeyspaceDropped)
+	}
+	go w.run(history)
+}
+
+// Close does nothing, the keyspace is closed along with its store
+func (ks *Keyspace) Close() error {
+	return nil
+}
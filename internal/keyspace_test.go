@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/segments/encoding"
+)
+
+func TestKeyspaces(t *testing.T) {
+	modes := map[string][]Option{
+		"in-memory":  nil,
+		"disk-index": {WithDiskIndex()},
+	}
+	for name, opts := range modes {
+		t.Run(name, func(t *testing.T) {
+			path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+			defer os.RemoveAll(path)
+			db, err := OpenBitCaskStore(path, opts...)
+			assert.NoError(t, err)
+			sessions, err := db.Keyspace("sessions")
+			assert.NoError(t, err)
+			users, err := db.Keyspace("users")
+			assert.NoError(t, err)
+
+			// the same keys in every keyspace, spread over a few segments
+			value := bytes.Repeat([]byte{0xb}, 64*1024)
+			for i := 0; i < 20; i++ {
+				k := strconv.Itoa(i)
+				assert.NoError(t, db.Set(k, append([]byte("default-"), value...)))
+				assert.NoError(t, sessions.Set(k, append([]byte("sessions-"), value...)))
+				assert.NoError(t, users.Set(k, append([]byte("users-"), value...)))
+			}
+			assert.NoError(t, sessions.Remove("3"))
+			assert.Equal(t, ErrDeletingNonExistingKey, sessions.Remove("3"))
+
+			check := func(db *BitCaskStore) {
+				sessions, err := db.Keyspace("sessions")
+				assert.NoError(t, err)
+				users, err := db.Keyspace("users")
+				assert.NoError(t, err)
+				for store, prefix := range map[*Keyspace]string{db.defaultKeyspace: "default-", sessions: "sessions-", users: "users-"} {
+					for i := 0; i < 20; i++ {
+						v, ok, err := store.Get(strconv.Itoa(i))
+						assert.NoError(t, err)
+						if store == sessions && i == 3 {
+							assert.False(t, ok)
+							continue
+						}
+						assert.True(t, ok)
+						assert.True(t, bytes.HasPrefix(v, []byte(prefix)), prefix)
+					}
+				}
+				assert.Len(t, db.Keys(), 20)
+				assert.Len(t, sessions.Keys(), 19)
+				assert.Equal(t, []string{"sessions", "users"}, db.Keyspaces())
+			}
+			check(db)
+			assert.NoError(t, db.Close())
+
+			db, err = OpenBitCaskStore(path, opts...)
+			assert.NoError(t, err)
+			check(db)
+			assert.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestKeyspaceOptions(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	_, err = db.Keyspace("")
+	assert.Equal(t, errInvalidKeyspaceName, err)
+	_, err = db.Keyspace("blobs", WithCompression("lz4"))
+	assert.Error(t, err)
+
+	blobs, err := db.Keyspace("blobs", WithCompression(DeflateCompression))
+	assert.NoError(t, err)
+	value := bytes.Repeat([]byte("arabica"), 1024)
+	assert.NoError(t, blobs.Set("1", value))
+	v, ok, err := blobs.Get("1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, value, v)
+
+	sessions, err := db.Keyspace("sessions", WithTTL(50*time.Millisecond))
+	assert.NoError(t, err)
+	assert.NoError(t, sessions.Set("token", []byte("secret")))
+	_, ok, err = sessions.Get("token")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(t, sessions.Keys())
+	_, ok, err = sessions.Get("token")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	// the expired value was removed when read
+	assert.Equal(t, 0, sessions.keyDir.Len())
+	assert.NoError(t, db.Close())
+
+	// records hold their keyspace, expiry and flags
+	var records []*encoding.Record
+	assert.NoError(t, DumpSegment(filepath.Join(path, activeSegmentFilename), func(dumped DumpedRecord) error {
+		records = append(records, dumped.Record)
+		return nil
+	}))
+	assert.Len(t, records, 3)
+	assert.Equal(t, encoding.FlagCompressed, records[0].Flags)
+	assert.True(t, len(records[0].Value) < len(value))
+	assert.NotEqual(t, records[0].Keyspace, records[1].Keyspace)
+	assert.NotZero(t, records[1].ExpiresAt)
+	assert.True(t, records[2].Tombstone())
+
+	// options are kept across restarts
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	sessions, err = db.Keyspace("sessions")
+	assert.NoError(t, err)
+	assert.Equal(t, 50*time.Millisecond, sessions.Options().TTL)
+	blobs, err = db.Keyspace("blobs")
+	assert.NoError(t, err)
+	v, ok, err = blobs.Get("1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, value, v)
+	assert.NoError(t, db.Close())
+}
+
+func TestDropKeyspace(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	sessions, err := db.Keyspace("sessions")
+	assert.NoError(t, err)
+	value := bytes.Repeat([]byte{0xb}, 64*1024)
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, sessions.Set(strconv.Itoa(i), value))
+	}
+	assert.NoError(t, db.Set("kept", []byte("value")))
+
+	assert.NoError(t, db.DropKeyspace("sessions"))
+	assert.Equal(t, errUnknownKeyspace, db.DropKeyspace("sessions"))
+	assert.Equal(t, errKeyspaceDropped, sessions.Set("0", value))
+	_, _, err = sessions.Get("0")
+	assert.Equal(t, errKeyspaceDropped, err)
+	assert.Empty(t, db.Keyspaces())
+
+	// every sealed segment only held records of the dropped keyspace
+	sealed, _ := filepath.Glob(filepath.Join(path, segmentFilenameGlob))
+	cleaner := NewLogCleanerWithPolicy(path, db.logStore, db.keyDirs, CleanNonUsed, newOptions(nil))
+	info, err := cleaner.Compact(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, info.Deleted, len(sealed))
+	sealed, _ = filepath.Glob(filepath.Join(path, segmentFilenameGlob))
+	assert.Empty(t, sealed)
+
+	// a keyspace created under the same name starts empty
+	sessions, err = db.Keyspace("sessions")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions.Keys())
+	assert.NoError(t, db.Close())
+
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	sessions, err = db.Keyspace("sessions")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions.Keys())
+	assert.Equal(t, []string{"kept"}, db.Keys())
+	assert.NoError(t, db.Close())
+}
@@ -5,10 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"pingcap.com/kvs/internal/metrics"
 	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 const (
@@ -16,8 +22,10 @@ const (
 )
 
 var (
-	errInvalidKey             = errors.New("error due to invalid key")
-	errDeletingNonExistingKey = errors.New("error removing a key not present in the database")
+	errInvalidKey = errors.New("error due to invalid key")
+	// ErrDeletingNonExistingKey is returned by Remove when the key is missing
+	ErrDeletingNonExistingKey = errors.New("error removing a key not present in the database")
+	errLockingFolder          = errors.New("error locking folder for kv store")
 )
 
 type KVStore interface {
@@ -33,84 +41,467 @@ type KVStore interface {
 	Remove(key string) error
 }
 
+// KeyValue is a key along with its value
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// BulkLoader stores can apply many writes at once, taking their locks once
+type BulkLoader interface {
+	SetMany(pairs []KeyValue) error
+}
+
+// BatchReader stores can read many keys at once
+type BatchReader interface {
+	// MultiGet returns the values of keys in the same order, along with
+	// whether each key exists
+	MultiGet(keys []string) ([][]byte, []bool, error)
+}
+
+// Viewer stores can lend their values without copying them
+type Viewer interface {
+	// View calls fn with the value of key, only valid during the call, and
+	// reports whether key exists
+	View(key string, fn func(value []byte) error) (bool, error)
+}
+
+// Streamer stores can stream values too large to be held in memory
+type Streamer interface {
+	// SetReader sets key to the size bytes read from r
+	SetReader(key string, r io.Reader, size int64) error
+
+	// GetReader returns a reader of the value of key, which the caller must
+	// close, and reports whether key exists
+	GetReader(key string) (io.ReadCloser, bool, error)
+}
+
+// Iterable stores can enumerate their live keys
+type Iterable interface {
+	// Keys returns a snapshot of the live keys in ascending order
+	Keys() []string
+
+	// ForEach calls fn for every live key in ascending order, stopping at the
+	// first error returned by fn
+	ForEach(fn func(key string, value []byte) error) error
+}
+
 type BitCaskStore struct {
-	logStore         LogStorage
-	basePath         string
-	lockFile         *os.File
-	hashTable        segments.KeyDirTable
-	logCleanerCancel context.CancelFunc
-	mutex            *sync.RWMutex
+	logStore LogStorage
+	fs       vfs.FS
+	basePath string
+	lockFile io.Closer
+	// stopBackground stops the background tasks besides the log cleaner,
+	// which background waits for
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
+	clock          Clock
+	// mutex serialises the appends to the log and the changes to the
+	// keyspace catalog, and is taken after the keydir stripes of the written
+	// keys
+	mutex   *sync.RWMutex
+	metrics metrics.Metrics
+	// diskIndex stores only keep the keys of the active segment in the keydirs
+	diskIndex         bool
+	evictedGeneration uint64
+	evicting          int32
+	defaultKeyspace   *Keyspace
+	catalog           *KeyspaceCatalog
+	// keyspacesMutex guards keyspaces, and is taken after mutex
+	keyspacesMutex sync.RWMutex
+	keyspaces      map[uint32]*Keyspace
+	watchers       *watchHub
+	maxKeySize     int
+	maxValueSize   int64
+	blobThreshold  int64
+	// valueLog stores write their values to the value log
+	valueLog bool
+	logger   Logger
+	events   EventListener
+	// logCleaner deletes the unused segments, paced by throttle along with
+	// the value log collection
+	logCleaner LogCleaner
+	throttle   *CompactionThrottle
+	// collecting serialises the value log collections, and is taken before
+	// mutex
+	collecting sync.Mutex
 }
 
-func OpenBitCaskStore(path string) (*BitCaskStore, error) {
-	// Try to lock the folder
-	lockFile, err := os.OpenFile(fmt.Sprintf("%s/%s", path, lockFilename), os.O_RDONLY|os.O_CREATE, 0)
+// lockDirectory takes an exclusive advisory lock on path that is held until
+// the returned lock is closed
+func lockDirectory(fs vfs.FS, path string) (io.Closer, error) {
+	lockFile, err := fs.Lock(filepath.Join(path, lockFilename))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errLockingFolder, err)
+	}
+	return lockFile, nil
+}
 
+func OpenBitCaskStore(path string, opts ...Option) (*BitCaskStore, error) {
+	options := newOptions(opts)
+	// Try to lock the folder
+	lockFile, err := lockDirectory(options.FS, path)
 	if err != nil {
-		return nil, errors.New("error locking folder for kv store")
+		return nil, err
+	}
+	if err := removeBackupStaging(options.FS, path); err != nil {
+		lockFile.Close()
+		return nil, err
 	}
 
-	logStore, err := NewLogBasedStorage(path)
+	logStore, err := NewLogBasedStorage(path, opts...)
 	if err != nil {
+		lockFile.Close()
 		return nil, err
 	}
 
-	hashTable, err := logStore.BuildKeyDirTable()
+	catalog, err := readKeyspaceCatalog(options.FS, path)
 	if err != nil {
+		logStore.Close()
+		lockFile.Close()
 		return nil, err
 	}
-	mutex := sync.RWMutex{}
-	logCleaner := NewLogCleanerWithPolicy(path, &mutex, hashTable, CleanNonUsed)
-	ctx, cancelCleaner := context.WithCancel(context.Background())
-	logCleaner.Clean(&ctx)
-	return &BitCaskStore{
-		basePath:         path,
-		logStore:         logStore,
-		lockFile:         lockFile,
-		hashTable:        *hashTable,
-		logCleanerCancel: cancelCleaner,
-		mutex:            &mutex,
-	}, nil
+	ids := []uint32{defaultKeyspaceID}
+	for _, descriptor := range catalog.Keyspaces {
+		ids = append(ids, descriptor.ID)
+	}
+	keyDirs, err := logStore.BuildKeyDirs(ids)
+	if err != nil {
+		logStore.Close()
+		lockFile.Close()
+		return nil, err
+	}
+	bcs := &BitCaskStore{
+		basePath:  path,
+		fs:        options.FS,
+		logStore:  logStore,
+		lockFile:  lockFile,
+		mutex:     &sync.RWMutex{},
+		metrics:   options.Metrics,
+		diskIndex: options.DiskIndex,
+		catalog:   catalog,
+		keyspaces: make(map[uint32]*Keyspace, len(ids)),
+		watchers:  newWatchHub(),
+
+		maxKeySize:    options.MaxKeySize,
+		maxValueSize:  options.MaxValueSize,
+		blobThreshold: options.BlobThreshold,
+		valueLog:      options.ValueLog,
+		logger:        options.Logger,
+		events:        options.Events,
+		throttle:      options.CompactionThrottle,
+		clock:         options.Clock,
+	}
+	bcs.defaultKeyspace = newKeyspace(bcs, KeyspaceDescriptor{ID: defaultKeyspaceID}, keyDirs[defaultKeyspaceID])
+	bcs.keyspaces[defaultKeyspaceID] = bcs.defaultKeyspace
+	for _, descriptor := range catalog.Keyspaces {
+		bcs.keyspaces[descriptor.ID] = newKeyspace(bcs, descriptor, keyDirs[descriptor.ID])
+	}
+	options.Metrics.SetKeyDirSize(bcs.keyDirSize())
+	bcs.logCleaner = NewLogCleanerWithPolicy(path, logStore, bcs.keyDirs, CleanNonUsed, options)
+	bcs.logCleaner.Start(context.Background())
+	ctx, stop := context.WithCancel(context.Background())
+	bcs.stopBackground = stop
+	// tickers are created up front, so ticks right after opening are not missed
+	if options.ValueLog {
+		ticker := bcs.clock.NewTicker(cleaningInterval)
+		bcs.runInBackground(func() { bcs.collectValueLogs(ctx, ticker) })
+	}
+	if options.RotationPolicy != nil {
+		ticker := bcs.clock.NewTicker(rotationCheckInterval)
+		bcs.runInBackground(func() { bcs.rotateWhenDue(ctx.Done(), ticker) })
+	}
+	return bcs, nil
 }
 
-// Set the value of a string key to a string
-func (bcs *BitCaskStore) Set(key string, value []byte) (err error) {
-	// coarse grained mutex to update hashtable and storage
+func (bcs *BitCaskStore) runInBackground(fn func()) {
+	bcs.background.Add(1)
+	go func() {
+		defer bcs.background.Done()
+		fn()
+	}()
+}
+
+// Keyspace returns the keyspace called name, creating it when missing. The
+// given options are applied over the current ones and kept across restarts.
+func (bcs *BitCaskStore) Keyspace(name string, opts ...KeyspaceOption) (*Keyspace, error) {
+	if name == "" {
+		return nil, errInvalidKeyspaceName
+	}
 	bcs.mutex.Lock()
-	err = bcs.logStore.Append([]byte(key), value, &bcs.hashTable)
-	bcs.mutex.Unlock()
-	return err
+	defer bcs.mutex.Unlock()
+	catalog := &KeyspaceCatalog{
+		NextID:    bcs.catalog.NextID,
+		Keyspaces: append([]KeyspaceDescriptor{}, bcs.catalog.Keyspaces...),
+	}
+	var descriptor *KeyspaceDescriptor
+	for i := range catalog.Keyspaces {
+		if catalog.Keyspaces[i].Name == name {
+			descriptor = &catalog.Keyspaces[i]
+		}
+	}
+	if descriptor != nil && len(opts) == 0 {
+		return bcs.keyspace(descriptor.ID), nil
+	}
+	created := descriptor == nil
+	if created {
+		catalog.Keyspaces = append(catalog.Keyspaces, KeyspaceDescriptor{Name: name, ID: catalog.NextID})
+		catalog.NextID++
+		descriptor = &catalog.Keyspaces[len(catalog.Keyspaces)-1]
+	}
+	for _, opt := range opts {
+		opt(&descriptor.Options)
+	}
+	switch descriptor.Options.Compression {
+	case NoCompression, DeflateCompression:
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownCompression, descriptor.Options.Compression)
+	}
+	// the keyspace only gets records once the catalog knows about it
+	if err := writeKeyspaceCatalog(bcs.fs, bcs.basePath, catalog); err != nil {
+		return nil, err
+	}
+	bcs.catalog = catalog
+	if !created {
+		ks := bcs.keyspace(descriptor.ID)
+		ks.options.Store(descriptor.Options)
+		return ks, nil
+	}
+	ks := newKeyspace(bcs, *descriptor, bcs.logStore.NewKeyDir())
+	bcs.keyspacesMutex.Lock()
+	bcs.keyspaces[ks.id] = ks
+	bcs.keyspacesMutex.Unlock()
+	return ks, nil
 }
 
-// Get the string value of the a string key. If the key does not exist, return nil.
-func (bcs *BitCaskStore) Get(key string) (value []byte, exists bool, err error) {
-	if entry, ok := bcs.hashTable[key]; ok {
-		value, err = bcs.logStore.ReadKeyDirEntry(entry)
-		return value, ok, err
+// DropKeyspace forgets the keyspace called name along with its keys. Its
+// records are left for the cleaner to reclaim.
+func (bcs *BitCaskStore) DropKeyspace(name string) error {
+	bcs.mutex.Lock()
+	defer bcs.mutex.Unlock()
+	catalog := &KeyspaceCatalog{NextID: bcs.catalog.NextID}
+	var dropped *Keyspace
+	for _, descriptor := range bcs.catalog.Keyspaces {
+		if descriptor.Name == name {
+			dropped = bcs.keyspace(descriptor.ID)
+			continue
+		}
+		catalog.Keyspaces = append(catalog.Keyspaces, descriptor)
+	}
+	if dropped == nil {
+		return errUnknownKeyspace
+	}
+	if err := writeKeyspaceCatalog(bcs.fs, bcs.basePath, catalog); err != nil {
+		return err
 	}
-	return nil, false, nil
+	bcs.catalog = catalog
+	// writes check the flag under mutex, so none gets in after the drop
+	atomic.StoreInt32(&dropped.dropped, 1)
+	bcs.keyspacesMutex.Lock()
+	delete(bcs.keyspaces, dropped.id)
+	bcs.keyspacesMutex.Unlock()
+	bcs.watchers.closeAll(dropped.id, false, errKeyspaceDropped)
+	bcs.metrics.SetKeyDirSize(bcs.keyDirSize())
+	return nil
 }
 
-// Remove a given key
-func (bcs *BitCaskStore) Remove(key string) error {
-	if _, ok := bcs.hashTable[key]; ok {
-		bcs.mutex.Lock()
-		if err := bcs.logStore.Append([]byte(key), []byte{}, &bcs.hashTable); err != nil {
+// Keyspaces returns the names of the keyspaces in ascending order
+func (bcs *BitCaskStore) Keyspaces() []string {
+	bcs.mutex.RLock()
+	defer bcs.mutex.RUnlock()
+	names := make([]string, 0, len(bcs.catalog.Keyspaces))
+	for _, descriptor := range bcs.catalog.Keyspaces {
+		names = append(names, descriptor.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (bcs *BitCaskStore) keyspace(id uint32) *Keyspace {
+	bcs.keyspacesMutex.RLock()
+	defer bcs.keyspacesMutex.RUnlock()
+	return bcs.keyspaces[id]
+}
+
+// keyDirs resolves the keydir of the keyspaces for the storage
+func (bcs *BitCaskStore) keyDirs(keyspace uint32) segments.KeyDir {
+	if ks := bcs.keyspace(keyspace); ks != nil {
+		return ks.keyDir
+	}
+	return nil
+}
+
+// liveKeyspaces returns a snapshot of the keyspaces
+func (bcs *BitCaskStore) liveKeyspaces() []*Keyspace {
+	bcs.keyspacesMutex.RLock()
+	defer bcs.keyspacesMutex.RUnlock()
+	keyspaces := make([]*Keyspace, 0, len(bcs.keyspaces))
+	for _, ks := range bcs.keyspaces {
+		keyspaces = append(keyspaces, ks)
+	}
+	return keyspaces
+}
+
+func (bcs *BitCaskStore) keyDirSize() int {
+	size := 0
+	for _, ks := range bcs.liveKeyspaces() {
+		size += ks.keyDir.Len()
+	}
+	return size
+}
+
+// appendTo runs fn, which appends records of ks, under the log lock
+func (bcs *BitCaskStore) appendTo(ks *Keyspace, fn func() error) error {
+	bcs.mutex.Lock()
+	defer bcs.mutex.Unlock()
+	if ks.isDropped() {
+		return errKeyspaceDropped
+	}
+	return fn()
+}
+
+// append writes record to the log, along with the blob holding its value
+// if any, and notifies the watchers, with the log lock held
+func (bcs *BitCaskStore) append(record *encoding.Record, blob *stagedBlob, kdt segments.KeyDir) error {
+	var entry segments.KeyDirEntry
+	var err error
+	if bcs.valueLog && blob == nil && !record.Tombstone() {
+		if record, err = bcs.separateValue(record); err != nil {
 			return err
 		}
-		delete(bcs.hashTable, key)
-		bcs.mutex.Unlock()
-		return nil
 	}
-	return errDeletingNonExistingKey
+	if blob != nil {
+		entry, err = bcs.logStore.AppendBlob(record, blob, kdt)
+	} else {
+		entry, err = bcs.logStore.AppendRecord(record, kdt)
+	}
+	if err != nil {
+		return err
+	}
+	bcs.watchers.publish(record, entry)
+	return nil
+}
+
+// checkSize fails the writes of keys or values over the configured limits
+func (bcs *BitCaskStore) checkSize(key string, size int64) error {
+	if bcs.maxKeySize > 0 && len(key) > bcs.maxKeySize {
+		return &KeyTooLargeError{Size: len(key), Max: bcs.maxKeySize}
+	}
+	if size < 0 {
+		return fmt.Errorf("%w: negative size %d", errValueSizeMismatch, size)
+	}
+	if bcs.maxValueSize > 0 && size > bcs.maxValueSize {
+		return &ValueTooLargeError{Size: size, Max: bcs.maxValueSize}
+	}
+	return nil
+}
+
+// isBlob tells whether a value of size bytes goes to a blob file
+func (bcs *BitCaskStore) isBlob(size int64) bool {
+	return bcs.blobThreshold > 0 && size >= bcs.blobThreshold
+}
+
+// Set the value of a string key to a string
+func (bcs *BitCaskStore) Set(key string, value []byte) error {
+	return bcs.defaultKeyspace.Set(key, value)
+}
+
+// SetReader sets key to the size bytes read from r
+func (bcs *BitCaskStore) SetReader(key string, r io.Reader, size int64) error {
+	return bcs.defaultKeyspace.SetReader(key, r, size)
+}
+
+// observe reports the latency and outcome of an operation started at start
+func (bcs *BitCaskStore) observe(op string, start time.Time, err *error) {
+	bcs.metrics.ObserveOperation(op, time.Since(start), *err)
+}
+
+// afterWrite refreshes the keydir size and, for disk index stores, drops
+// the keys sealed in an indexed segment since the last write
+func (bcs *BitCaskStore) afterWrite() {
+	bcs.metrics.SetKeyDirSize(bcs.keyDirSize())
+	if !bcs.diskIndex || bcs.logStore.IndexGeneration() == atomic.LoadUint64(&bcs.evictedGeneration) {
+		return
+	}
+	// a single writer evicts at a time, the others go on
+	if !atomic.CompareAndSwapInt32(&bcs.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&bcs.evicting, 0)
+	indexed, generation := bcs.logStore.IndexedSegments()
+	for _, ks := range bcs.liveKeyspaces() {
+		ks.keyDir.evict(func(entry segments.KeyDirEntry) bool {
+			return indexed[entry.FileID]
+		})
+	}
+	atomic.StoreUint64(&bcs.evictedGeneration, generation)
+	bcs.metrics.SetKeyDirSize(bcs.keyDirSize())
+}
+
+// SetMany appends every pair under a single acquisition of the locks
+func (bcs *BitCaskStore) SetMany(pairs []KeyValue) error {
+	return bcs.defaultKeyspace.SetMany(pairs)
+}
+
+// Get the string value of the a string key. If the key does not exist, return nil.
+func (bcs *BitCaskStore) Get(key string) ([]byte, bool, error) {
+	return bcs.defaultKeyspace.Get(key)
+}
+
+// GetReader returns a reader of the value of key, which the caller must
+// close, and reports whether key exists
+func (bcs *BitCaskStore) GetReader(key string) (io.ReadCloser, bool, error) {
+	return bcs.defaultKeyspace.GetReader(key)
+}
+
+// View calls fn with the value of key, only valid during the call, and
+// reports whether key exists
+func (bcs *BitCaskStore) View(key string, fn func(value []byte) error) (bool, error) {
+	return bcs.defaultKeyspace.View(key, fn)
+}
+
+// MultiGet returns the values of keys in the same order, along with whether
+// each key exists
+func (bcs *BitCaskStore) MultiGet(keys []string) ([][]byte, []bool, error) {
+	return bcs.defaultKeyspace.MultiGet(keys)
+}
+
+// Remove a given key
+func (bcs *BitCaskStore) Remove(key string) error {
+	return bcs.defaultKeyspace.Remove(key)
+}
+
+// Watch notifies the changes of the keys starting with prefix from now on
+func (bcs *BitCaskStore) Watch(prefix string) *Watcher {
+	return bcs.defaultKeyspace.Watch(prefix)
+}
+
+// WatchFrom replays the changes of the keys starting with prefix found in
+// the log from position from, before notifying the new ones
+func (bcs *BitCaskStore) WatchFrom(prefix string, from LogPosition) (*Watcher, error) {
+	return bcs.defaultKeyspace.WatchFrom(prefix, from)
+}
+
+// Keys returns a snapshot of the live keys in ascending order
+func (bcs *BitCaskStore) Keys() []string {
+	return bcs.defaultKeyspace.Keys()
+}
+
+// ForEach calls fn for every live key in ascending order. Keys removed after
+// the iteration started are skipped.
+func (bcs *BitCaskStore) ForEach(fn func(key string, value []byte) error) error {
+	return bcs.defaultKeyspace.ForEach(fn)
 }
 
 func (bcs *BitCaskStore) Close() error {
-	// release lock
-	if err := bcs.lockFile.Close(); err != nil {
+	// the background tasks in progress are done before the storage closes
+	bcs.logCleaner.Stop()
+	bcs.stopBackground()
+	bcs.background.Wait()
+	bcs.watchers.closeAll(defaultKeyspaceID, true, errStoreClosed)
+	if err := bcs.logStore.Close(); err != nil {
 		return err
 	}
-	bcs.logCleanerCancel()
-	bcs.logStore.Close()
-	return nil
+	// release lock once every segment is synced
+	return bcs.lockFile.Close()
 }
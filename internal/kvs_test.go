@@ -5,10 +5,14 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/metrics"
+	"pingcap.com/kvs/internal/segments"
 )
 
 func TestOpenStore(t *testing.T) {
@@ -41,7 +45,7 @@ func TestRemoveNonExistentKey(t *testing.T) {
 	db, err := OpenBitCaskStore(path)
 	assert.NoError(t, err)
 
-	assert.Error(t, db.Remove("noname"), errDeletingNonExistingKey)
+	assert.Error(t, db.Remove("noname"), ErrDeletingNonExistingKey)
 }
 
 func TestGetStoredKey(t *testing.T) {
@@ -106,6 +110,63 @@ func BenchmarkWriting(b *testing.B) {
 	b.StopTimer()
 }
 
+func BenchmarkSyncedWriting(b *testing.B) {
+	for name, opts := range map[string][]Option{
+		"append":      {WithSyncWrites()},
+		"preallocate": {WithSyncWrites(), WithPreallocation()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+			defer os.RemoveAll(path)
+			db, err := OpenBitCaskStore(path, opts...)
+			assert.NoError(b, err)
+			defer db.Close()
+
+			value := bytes.Repeat([]byte{0xa}, 512)
+			b.ResetTimer()
+			b.SetBytes(512)
+			for i := 0; i < b.N; i++ {
+				db.Set(strconv.Itoa(i), value)
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+func TestPreallocatedStore(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithPreallocation(), WithSyncWrites())
+	assert.NoError(t, err)
+	value := bytes.Repeat([]byte{0xa}, 8192)
+	// enough to seal a segment
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), value))
+	}
+	assert.NoError(t, db.Close())
+	info, err := os.Stat(filepath.Join(path, activeSegmentFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(segments.MaxSegmentSizeBytes), info.Size())
+
+	report, err := Verify(path)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Issues)
+
+	// opening without preallocation appends after the last record
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("last", []byte("value")))
+	assert.NoError(t, db.Close())
+	db, err = OpenBitCaskStore(path, WithPreallocation())
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Len(t, db.Keys(), 201)
+	v, ok, err := db.Get("last")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value", string(v))
+}
+
 func BenchmarkSequentialReading(b *testing.B) {
 	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
 	defer os.RemoveAll(path)
@@ -143,6 +204,7 @@ func BenchmarkRandomReading(b *testing.B) {
 	})
 
 	b.SetBytes(8192)
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -150,3 +212,321 @@ func BenchmarkRandomReading(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func BenchmarkRandomViewing(b *testing.B) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(b, err)
+	value := bytes.Repeat([]byte{0xa}, 8192)
+	precomputed := make([]string, b.N)
+	for i := 0; i < b.N; i++ {
+		db.Set(strconv.Itoa(i), value)
+		precomputed[i] = strconv.Itoa(i)
+	}
+	rand.Shuffle(b.N, func(i int, j int) {
+		precomputed[i], precomputed[j] = precomputed[j], precomputed[i]
+	})
+	// read the sealed segments only
+	db.logStore.Seal()
+
+	b.SetBytes(8192)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var read int
+	for i := 0; i < b.N; i++ {
+		db.View(precomputed[i], func(value []byte) error {
+			read += len(value)
+			return nil
+		})
+	}
+	b.StopTimer()
+}
+
+func TestMultiGet(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// spread the keys over a few segments, in reverse order of their writes
+	value := bytes.Repeat([]byte{0xa}, 64*1024)
+	keys := []string{"missing"}
+	for i := 40; i >= 0; i-- {
+		assert.NoError(t, db.Set(strconv.Itoa(i), append([]byte(strconv.Itoa(i)), value...)))
+		keys = append(keys, strconv.Itoa(i))
+	}
+	assert.NoError(t, db.Set("empty", nil))
+	assert.NoError(t, db.Remove("7"))
+	keys = append(keys, "empty", "3")
+
+	values, exists, err := db.MultiGet(keys)
+	assert.NoError(t, err)
+	assert.Len(t, values, len(keys))
+	for i, key := range keys {
+		v, ok, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, ok, exists[i], key)
+		assert.Equal(t, v, values[i], key)
+	}
+	assert.False(t, exists[0])
+	assert.True(t, exists[len(keys)-2])
+
+	values, exists, err = db.MultiGet(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+	assert.Empty(t, exists)
+}
+
+func TestView(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte{0xa}, 64*1024)
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), append([]byte(strconv.Itoa(i)), value...)))
+	}
+	for _, key := range []string{"0", "39"} {
+		exists, err := db.View(key, func(v []byte) error {
+			assert.Equal(t, append([]byte(key), value...), v)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+	exists, err := db.View("missing", func(v []byte) error {
+		t.Fatal("viewing a missing key")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// a segment dropped by the cleaner stays mapped until the view is done
+	entry, _ := db.defaultKeyspace.keyDir.Get("0")
+	_, err = db.View("0", func(v []byte) error {
+		assert.NoError(t, db.logStore.DropSegments([]int{entry.FileID}))
+		assert.Equal(t, byte('0'), v[0])
+		return errInvalidKey
+	})
+	assert.Equal(t, errInvalidKey, err)
+	_, err = db.View("0", func(v []byte) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestMaxMappedSegments(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithMaxMappedSegments(2))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte{0xa}, 64*1024)
+	for i := 0; i < 80; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), value))
+	}
+	storage := db.logStore.(*logBasedStorage)
+	assert.True(t, len(storage.sealedIDs) > 2)
+	for i := 0; i < 80; i++ {
+		v, ok, err := db.Get(strconv.Itoa(i))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, value, v)
+	}
+	assert.Equal(t, 2, storage.mappings.Mapped())
+}
+
+func benchmarkBatchReading(b *testing.B, read func(db *BitCaskStore, keys []string)) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(b, err)
+	defer db.Close()
+	const batch = 100
+	value := bytes.Repeat([]byte{0xa}, 1024)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		db.Set(keys[i], value)
+	}
+	batches := make([][]string, b.N)
+	for i := range batches {
+		batches[i] = make([]string, batch)
+		for j := range batches[i] {
+			batches[i][j] = keys[rand.Intn(len(keys))]
+		}
+	}
+
+	b.SetBytes(batch * 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		read(db, batches[i])
+	}
+	b.StopTimer()
+}
+
+func BenchmarkBatchReadingGet(b *testing.B) {
+	benchmarkBatchReading(b, func(db *BitCaskStore, keys []string) {
+		for _, key := range keys {
+			db.Get(key)
+		}
+	})
+}
+
+func BenchmarkBatchReadingMultiGet(b *testing.B) {
+	benchmarkBatchReading(b, func(db *BitCaskStore, keys []string) {
+		db.MultiGet(keys)
+	})
+}
+
+func TestReopenStore(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Set("2", []byte("peanuts")))
+	assert.NoError(t, db.Remove("1"))
+	assert.NoError(t, db.Close())
+
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	_, ok, err := db.Get("1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, db.Set("3", []byte("peas")))
+	value, ok, err := db.Get("2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "peanuts", string(value))
+	assert.Equal(t, []string{"2", "3"}, db.Keys())
+	assert.NoError(t, db.Close())
+}
+
+func TestStoreMetrics(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+
+	registry := prometheus.NewRegistry()
+	m, err := metrics.NewPrometheus(registry)
+	assert.NoError(t, err)
+	db, err := OpenBitCaskStore(path, WithMetrics(m))
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+	assert.NoError(t, db.Set("2", []byte("peanuts")))
+	db.Get("1")
+	assert.NoError(t, db.Remove("1"))
+	assert.Error(t, db.Remove("1"))
+	_, err = db.Backup(path+"_backup", false)
+	assert.NoError(t, err)
+	defer os.RemoveAll(path + "_backup")
+	assert.NoError(t, db.Close())
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			name := family.GetName()
+			for _, label := range metric.Label {
+				name += "," + label.GetValue()
+			}
+			switch {
+			case metric.Counter != nil:
+				values[name] = metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				values[name] = metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				values[name] = float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	assert.Equal(t, float64(2), values["kvs_operations_total,set,ok"])
+	assert.Equal(t, float64(1), values["kvs_operations_total,get,ok"])
+	assert.Equal(t, float64(1), values["kvs_operations_total,remove,ok"])
+	assert.Equal(t, float64(1), values["kvs_operations_total,remove,error"])
+	assert.Equal(t, float64(1), values["kvs_keydir_keys"])
+	assert.Equal(t, float64(1), values["kvs_segment_rotations_total"])
+	assert.Equal(t, float64(2), values["kvs_open_segments"])
+	assert.True(t, values["kvs_appended_bytes_total"] > 0)
+	assert.True(t, values["kvs_fsync_duration_seconds"] >= 2)
+}
+
+func TestDiskIndexStore(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithDiskIndex())
+	assert.NoError(t, err)
+	value := bytes.Repeat([]byte{0xb}, 64*1024)
+	expected := make(map[string][]byte)
+	for i := 0; i < 60; i++ {
+		k := strconv.Itoa(i % 40)
+		v := append([]byte(strconv.Itoa(i)), value...)
+		assert.NoError(t, db.Set(k, v))
+		expected[k] = v
+	}
+	for i := 0; i < 40; i += 3 {
+		assert.NoError(t, db.Remove(strconv.Itoa(i)))
+		delete(expected, strconv.Itoa(i))
+	}
+	// only the keys of the active segment are held in memory
+	assert.True(t, db.defaultKeyspace.keyDir.Len() < len(expected))
+	assert.Error(t, db.Remove("0"), ErrDeletingNonExistingKey)
+
+	check := func(db *BitCaskStore) {
+		for i := 0; i < 40; i++ {
+			k := strconv.Itoa(i)
+			v, ok, err := db.Get(k)
+			assert.NoError(t, err)
+			assert.Equal(t, expected[k] != nil, ok, k)
+			assert.Equal(t, expected[k], v, k)
+		}
+		assert.Len(t, db.Keys(), len(expected))
+	}
+	check(db)
+	assert.NoError(t, db.Close())
+
+	db, err = OpenBitCaskStore(path, WithDiskIndex())
+	assert.NoError(t, err)
+	check(db)
+	assert.NoError(t, db.Close())
+
+	// the keydir of the in-memory mode is rebuilt from the hint files
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	check(db)
+	assert.NoError(t, db.Close())
+}
+
+func TestCompactKeyDirStore(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithCompactKeyDir())
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte(strconv.Itoa(i*2))))
+	}
+	assert.NoError(t, db.Remove("7"))
+	assert.NoError(t, db.Close())
+
+	db, err = OpenBitCaskStore(path, WithCompactKeyDir())
+	assert.NoError(t, err)
+	assert.Len(t, db.Keys(), 99)
+	value, ok, err := db.Get("42")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "84", string(value))
+	_, ok, err = db.Get("7")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, db.Close())
+}
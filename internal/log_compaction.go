@@ -2,13 +2,14 @@ package internal
 
 import (
 	"context"
-	"os"
+	"fmt"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"pingcap.com/kvs/internal/metrics"
 	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 const (
@@ -22,22 +23,55 @@ const (
 type Policy byte
 
 type LogCleaner interface {
-	Clean(*context.Context)
+	// Start runs the cleaner every cleaning interval within the compaction
+	// windows, until ctx is done or Stop is called
+	Start(ctx context.Context)
+	// Stop ends the periodic runs, waiting for the one in progress, which is
+	// cancelled
+	Stop()
+	// Compact runs the cleaner right away, whatever the compaction windows,
+	// and returns what it reclaimed once done
+	Compact(ctx context.Context) (CompactionInfo, error)
+	// LastRun returns the outcome of the latest run, if any
+	LastRun() (CompactionInfo, bool)
+	// Pause waits for the run in progress and holds off the next ones until
+	// resume is called
+	Pause() (resume func())
 }
 
 type simpleLogCleaner struct {
+	fs       vfs.FS
 	basePath string
-	kdt      *segments.KeyDirTable
-	mutex    *sync.RWMutex
+	storage  LogStorage
+	keyDirs  KeyDirs
+	metrics  metrics.Metrics
+	logger   Logger
+	events   EventListener
+	throttle *CompactionThrottle
+	clock    Clock
+	// running serialises the periodic and manual runs
+	running sync.Mutex
+	// lifecycle guards the periodic runs, stopped by cancel and done once
+	// their goroutine exits, and the outcome of the latest run
+	lifecycle sync.Mutex
+	cancel    context.CancelFunc
+	done      chan struct{}
+	lastRun   *CompactionInfo
 }
 
-func NewLogCleanerWithPolicy(basePath string, mutex *sync.RWMutex, kdt *segments.KeyDirTable, cleanPolicy Policy) LogCleaner {
+func NewLogCleanerWithPolicy(basePath string, storage LogStorage, keyDirs KeyDirs, cleanPolicy Policy, options *Options) LogCleaner {
 	switch cleanPolicy {
 	case CleanNonUsed:
 		return &simpleLogCleaner{
+			fs:       options.FS,
 			basePath: basePath,
-			kdt:      kdt,
-			mutex:    mutex,
+			storage:  storage,
+			keyDirs:  keyDirs,
+			metrics:  options.Metrics,
+			logger:   options.Logger,
+			events:   options.Events,
+			throttle: options.CompactionThrottle,
+			clock:    options.Clock,
 		}
 	default:
 		return nil
@@ -45,34 +79,160 @@ func NewLogCleanerWithPolicy(basePath string, mutex *sync.RWMutex, kdt *segments
 
 }
 
-func (slc *simpleLogCleaner) Clean(ctx *context.Context) {
+func (slc *simpleLogCleaner) Start(ctx context.Context) {
+	slc.lifecycle.Lock()
+	defer slc.lifecycle.Unlock()
+	if slc.cancel != nil {
+		return
+	}
+	ctx, slc.cancel = context.WithCancel(ctx)
+	done := make(chan struct{})
+	slc.done = done
+	// ticks right after Start are not missed
+	ticker := slc.clock.NewTicker(cleaningInterval)
 	go func() {
-		timerCh := time.Tick(cleaningInterval)
-		for range timerCh {
+		defer close(done)
+		defer ticker.Stop()
+		for {
 			select {
-			case <-timerCh:
-				slc.cleanUnusedFiles()
-			case <-(*ctx).Done():
-				logrus.Info("exiting logCleaner background goroutine")
+			case <-ticker.C():
+				// errors are reported by the run itself
+				if slc.throttle.inWindow(slc.clock.Now()) {
+					slc.Compact(ctx)
+				}
+			case <-ctx.Done():
+				slc.logger.Infof("exiting logCleaner background goroutine")
 				return
 			}
 		}
 	}()
 }
 
-func (slc *simpleLogCleaner) cleanUnusedFiles() {
-	files, _ := filepath.Glob(filepath.Join(slc.basePath, "segment_*.dat"))
+func (slc *simpleLogCleaner) Stop() {
+	slc.lifecycle.Lock()
+	cancel, done := slc.cancel, slc.done
+	slc.cancel, slc.done = nil, nil
+	slc.lifecycle.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (slc *simpleLogCleaner) LastRun() (CompactionInfo, bool) {
+	slc.lifecycle.Lock()
+	defer slc.lifecycle.Unlock()
+	if slc.lastRun == nil {
+		return CompactionInfo{}, false
+	}
+	return *slc.lastRun, true
+}
+
+func (slc *simpleLogCleaner) Pause() func() {
+	slc.running.Lock()
+	return slc.running.Unlock
+}
 
-	// :troll: :troll:
-	bloomFilter := make(map[int]bool, len(files))
-	slc.mutex.RLock()
-	for _, v := range *slc.kdt {
-		bloomFilter[v.FileID] = true
+func (slc *simpleLogCleaner) Compact(ctx context.Context) (CompactionInfo, error) {
+	slc.running.Lock()
+	defer slc.running.Unlock()
+	release, err := slc.throttle.acquire(ctx)
+	if err != nil {
+		return CompactionInfo{}, err
 	}
-	slc.mutex.RUnlock()
+	defer release()
+	info := slc.clean(ctx)
+	slc.lifecycle.Lock()
+	slc.lastRun = &info
+	slc.lifecycle.Unlock()
+	return info, info.Err
+}
+
+// clean deletes the sealed segments without live records. Unlinking reads
+// and writes nothing, so the deletions are not paced by the throttle.
+func (slc *simpleLogCleaner) clean(ctx context.Context) (info CompactionInfo) {
+	info.Started = slc.clock.Now()
+	files, err := vfs.Glob(slc.fs, filepath.Join(slc.basePath, segmentFilenameGlob))
+	info.Candidates = len(files)
+	slc.events.compactionStart(info)
+	defer func() {
+		info.Duration = slc.clock.Now().Sub(info.Started)
+		slc.metrics.ObserveCleanerRun(info.Duration, info.ReclaimedBytes)
+		slc.events.compactionEnd(info)
+	}()
+	if err != nil {
+		info.Err = err
+		slc.reportError(fmt.Errorf("error listing segments to clean: %w", err))
+		return
+	}
+
+	present := make(map[int]string, len(files))
 	for _, f := range files {
-		if _, ok := bloomFilter[segments.SegmentID(f, false)]; !ok {
-			os.Remove(f)
+		present[segments.SegmentID(f, false)] = f
+	}
+	var unused []int
+	for _, segmentID := range slc.storage.ReclaimableSegments(slc.keyDirs) {
+		if _, ok := present[segmentID]; ok {
+			unused = append(unused, segmentID)
 		}
 	}
+	if len(unused) == 0 {
+		return
+	}
+	sizes := make(map[int]int64, len(unused))
+	for _, segmentID := range unused {
+		if stat, err := slc.fs.Stat(present[segmentID]); err == nil {
+			sizes[segmentID] = stat.Size()
+		}
+	}
+	// the oldest segments go first, so that stopping halfway never leaves a
+	// record whose tombstone was deleted
+	for _, segmentID := range unused {
+		if err := ctx.Err(); err != nil {
+			info.Err = err
+			return
+		}
+		// the storage deletes the segment file once its readers are done
+		if err := slc.storage.DropSegments([]int{segmentID}); err != nil {
+			info.Err = err
+			slc.reportError(fmt.Errorf("error dropping unused segments: %w", err))
+			return
+		}
+		f := present[segmentID]
+		if err := segments.RemoveSegmentIndex(slc.fs, f); err != nil {
+			info.Err = err
+			slc.reportError(fmt.Errorf("error removing index of unused segment: %w", err))
+			continue
+		}
+		blobBytes, err := removeSegmentBlobs(slc.fs, slc.basePath, segmentID)
+		if err != nil {
+			info.Err = err
+			slc.reportError(fmt.Errorf("error removing blobs of unused segment: %w", err))
+			continue
+		}
+		info.Deleted = append(info.Deleted, segmentID)
+		info.ReclaimedBytes += sizes[segmentID] + blobBytes
+		slc.events.segmentDeleted(SegmentDeletedInfo{SegmentID: segmentID, Path: f, Size: sizes[segmentID]})
+		slc.logger.Debugf("removed unused segment %s", f)
+	}
+	return
+}
+
+// Compact cleans the log right away, whatever the compaction windows, then
+// collects the value log files of stores separating their values. It
+// returns once done, along with what was reclaimed.
+func (bcs *BitCaskStore) Compact(ctx context.Context) (CompactionInfo, error) {
+	info, err := bcs.logCleaner.Compact(ctx)
+	if err != nil || !bcs.valueLog {
+		return info, err
+	}
+	reclaimed, err := bcs.compactValueLogs(ctx, valueLogCollectRatio)
+	info.ReclaimedBytes += reclaimed
+	return info, err
+}
+
+func (slc *simpleLogCleaner) reportError(err error) {
+	slc.logger.Errorf("%v", err)
+	slc.events.backgroundError(err)
 }
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// manualClock only moves when advanced, firing the tickers that are due
+type manualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+type manualTicker struct {
+	clock    *manualClock
+	c        chan time.Time
+	stop     chan struct{}
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now}
+}
+
+func (mc *manualClock) Now() time.Time {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.now
+}
+
+func (mc *manualClock) NewTicker(d time.Duration) Ticker {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	ticker := &manualTicker{clock: mc, c: make(chan time.Time), stop: make(chan struct{}), interval: d, next: mc.now.Add(d)}
+	mc.tickers = append(mc.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock by d and returns once the tickers that are due
+// have delivered their tick, one per ticker. As their receivers only take a
+// tick when done with the previous one, a tick delivered also tells that the
+// previous one was handled.
+func (mc *manualClock) Advance(d time.Duration) {
+	mc.mutex.Lock()
+	mc.now = mc.now.Add(d)
+	now := mc.now
+	var due []*manualTicker
+	for _, ticker := range mc.tickers {
+		if ticker.stopped || now.Before(ticker.next) {
+			continue
+		}
+		due = append(due, ticker)
+		for !now.Before(ticker.next) {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+	mc.mutex.Unlock()
+	for _, ticker := range due {
+		select {
+		case ticker.c <- now:
+		case <-ticker.stop:
+		}
+	}
+}
+
+// awaitTickers returns once n tickers were created, so that advancing the
+// clock reaches the ones created by other goroutines
+func (mc *manualClock) awaitTickers(n int) {
+	for {
+		mc.mutex.Lock()
+		created := len(mc.tickers)
+		mc.mutex.Unlock()
+		if created >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (mt *manualTicker) C() <-chan time.Time {
+	return mt.c
+}
+
+func (mt *manualTicker) Stop() {
+	mt.clock.mutex.Lock()
+	defer mt.clock.mutex.Unlock()
+	if !mt.stopped {
+		mt.stopped = true
+		close(mt.stop)
+	}
+}
+
+func TestLogCleanerSchedule(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	clock := newManualClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local))
+	started := make(chan CompactionInfo, 10)
+	ended := make(chan CompactionInfo, 10)
+	window, _ := ParseTimeWindow("00:00-13:00")
+	throttle := NewCompactionThrottle(0, 0, window)
+	db, err := OpenBitCaskStore(path, WithClock(clock), WithCompactionThrottle(throttle),
+		WithEventListener(EventListener{
+			OnCompactionStart: func(info CompactionInfo) { started <- info },
+			OnCompactionEnd:   func(info CompactionInfo) { ended <- info },
+			OnBackgroundError: func(err error) { assert.NoError(t, err) },
+		}))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// segment 1 ends up without live records
+	for version := 0; version < 2; version++ {
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, db.Set(strconv.Itoa(i), []byte(strconv.Itoa(version))))
+		}
+		assert.NoError(t, db.Rotate())
+	}
+	_, ok := db.logCleaner.LastRun()
+	assert.False(t, ok)
+
+	var last CompactionInfo
+	t.Run("one run per tick", func(t *testing.T) {
+		clock.Advance(cleaningInterval)
+		info := <-ended
+		<-started
+		assert.Equal(t, []int{1}, info.Deleted)
+		assert.Equal(t, clock.Now(), info.Started)
+		// the clock stands still during the run
+		assert.Zero(t, info.Duration)
+		assert.NoError(t, info.Err)
+
+		clock.Advance(cleaningInterval)
+		last = <-ended
+		<-started
+		assert.Empty(t, last.Deleted)
+	})
+
+	t.Run("outside the windows", func(t *testing.T) {
+		clock.Advance(time.Hour)
+		// the next tick is only taken once the previous one was handled
+		clock.Advance(cleaningInterval)
+		assert.Empty(t, ended)
+		clock.Advance(23 * time.Hour)
+		last = <-ended
+		<-started
+	})
+
+	t.Run("stop and restart", func(t *testing.T) {
+		// stopping waits for the run in progress
+		db.logCleaner.Stop()
+		db.logCleaner.Stop()
+		info, ok := db.logCleaner.LastRun()
+		assert.True(t, ok)
+		assert.Equal(t, last.Started, info.Started)
+		clock.Advance(cleaningInterval)
+		assert.Empty(t, ended)
+		db.logCleaner.Start(context.Background())
+		clock.Advance(cleaningInterval)
+		<-ended
+		<-started
+	})
+}
+
+func TestLogCleanerStopCancelsRun(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	clock := newManualClock(time.Now())
+	// a single slot, and a rate too slow to ever move a value
+	throttle := NewCompactionThrottle(1, 1)
+	db, err := OpenBitCaskStore(path, WithClock(clock), WithCompactionThrottle(throttle))
+	assert.NoError(t, err)
+	for version := 0; version < 2; version++ {
+		assert.NoError(t, db.Set("key", []byte(strconv.Itoa(version))))
+		assert.NoError(t, db.Rotate())
+	}
+
+	release, err := throttle.acquire(context.Background())
+	assert.NoError(t, err)
+	clock.Advance(cleaningInterval)
+	// stop cancels the run waiting for the slot rather than waiting for it
+	db.logCleaner.Stop()
+	_, ok := db.logCleaner.LastRun()
+	assert.False(t, ok)
+	release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	info, err := db.logCleaner.Compact(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, info.Deleted)
+
+	// dropping segments reads and writes nothing, so the rate does not hold
+	// it back
+	info, err = db.logCleaner.Compact(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, info.Deleted)
+	assert.NoError(t, db.Close())
+}
+
+func TestLogCleanerPause(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithClock(newManualClock(time.Now())))
+	assert.NoError(t, err)
+	defer db.Close()
+	for version := 0; version < 2; version++ {
+		assert.NoError(t, db.Set("key", []byte(strconv.Itoa(version))))
+		assert.NoError(t, db.Rotate())
+	}
+
+	resume := db.logCleaner.Pause()
+	done := make(chan CompactionInfo)
+	go func() {
+		info, _ := db.Compact(context.Background())
+		done <- info
+	}()
+	select {
+	case <-done:
+		t.Fatal("compaction ran while the cleaner was paused")
+	default:
+	}
+	resume()
+	info := <-done
+	assert.Equal(t, []int{1}, info.Deleted)
+}
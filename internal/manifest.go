@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	manifestFilename = "MANIFEST"
+	// every manifest record starts with the checksum and length of its edit
+	manifestHeaderSize = 8
+)
+
+var (
+	errCorruptManifest = errors.New("error due to corrupt manifest")
+	errMissingSegment  = errors.New("error due to segment listed in the manifest missing")
+)
+
+// manifestEdit is a change to the segments of a store, applied atomically
+type manifestEdit struct {
+	Added   []int `json:"added,omitempty"`
+	Removed []int `json:"removed,omitempty"`
+	// Active is the ID of the new active segment, IDs below it are never
+	// allocated again
+	Active int `json:"active,omitempty"`
+	// the value log files are tracked the same way, in their own ID space
+	AddedValueLogs   []int `json:"added_vlogs,omitempty"`
+	RemovedValueLogs []int `json:"removed_vlogs,omitempty"`
+	ActiveValueLog   int   `json:"active_vlog,omitempty"`
+}
+
+// manifest is the append-only log of the edits to the live segments of a
+// store. It is read at open instead of listing the segment files, and
+// rewritten as a single edit holding the whole state.
+type manifest struct {
+	fs             vfs.FS
+	path           string
+	f              vfs.File
+	segments       map[int]bool
+	active         int
+	valueLogs      map[int]bool
+	activeValueLog int
+}
+
+// openManifest replays the manifest of folder, building it from the segment
+// files of stores created before it, and rewrites it in line with the folder
+func openManifest(fs vfs.FS, folder string, logger Logger) (*manifest, error) {
+	m, torn, err := readManifest(fs, folder)
+	if err != nil {
+		return nil, err
+	}
+	if torn >= 0 {
+		logger.Warnf("dropped torn manifest edit at offset %d", torn)
+	}
+	if err := m.reconcile(folder, logger); err != nil {
+		return nil, err
+	}
+	if err := m.rewrite(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readManifest replays the manifest of folder without modifying it. A torn
+// edit at the end, left by a crash while appending it, is dropped and its
+// offset returned, -1 otherwise.
+func readManifest(fs vfs.FS, folder string) (*manifest, int, error) {
+	m := &manifest{
+		fs:             fs,
+		path:           filepath.Join(folder, manifestFilename),
+		segments:       make(map[int]bool),
+		valueLogs:      make(map[int]bool),
+		activeValueLog: 1,
+	}
+	data, err := vfs.ReadFile(m.fs, m.path)
+	if os.IsNotExist(err) {
+		return m, -1, m.scan(folder)
+	}
+	if err != nil {
+		return nil, -1, fmt.Errorf("error reading manifest: %w", err)
+	}
+	for offset := 0; offset < len(data); {
+		edit, n, err := decodeManifestEdit(data[offset:])
+		if err != nil {
+			if offset+n < len(data) {
+				return nil, -1, fmt.Errorf("%w: edit at offset %d: %v", errCorruptManifest, offset, err)
+			}
+			return m, offset, nil
+		}
+		m.apply(edit)
+		offset += n
+	}
+	return m, -1, nil
+}
+
+// scan lists the sealed segments and value log files of folder, the active
+// ones following them
+func (m *manifest) scan(folder string) error {
+	present, err := segmentFiles(m.fs, folder)
+	if err != nil {
+		return err
+	}
+	m.active = 1
+	for id := range present {
+		m.segments[id] = true
+		if id >= m.active {
+			m.active = id + 1
+		}
+	}
+	valueLogs, err := valueLogFiles(m.fs, folder)
+	if err != nil {
+		return err
+	}
+	for id := range valueLogs {
+		m.valueLogs[id] = true
+		if id >= m.activeValueLog {
+			m.activeValueLog = id + 1
+		}
+	}
+	return nil
+}
+
+// segmentFiles returns the sealed segment files of folder by ID, ignoring
+// the files named otherwise
+func segmentFiles(fs vfs.FS, folder string) (map[int]string, error) {
+	return numberedFiles(fs, folder, segmentFilenameGlob, segmentFilenameFmt)
+}
+
+// valueLogFiles returns the sealed value log files of folder by ID
+func valueLogFiles(fs vfs.FS, folder string) (map[int]string, error) {
+	return numberedFiles(fs, folder, valueLogFilenameGlob, valueLogFilenameFmt)
+}
+
+func numberedFiles(fs vfs.FS, folder, glob, format string) (map[int]string, error) {
+	files, err := vfs.Glob(fs, filepath.Join(folder, glob))
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[int]string, len(files))
+	for _, f := range files {
+		var id int
+		// the padding is only a minimum width when formatting
+		if _, err := fmt.Sscanf(filepath.Base(f), strings.Replace(format, "%05d", "%d", 1), &id); err != nil {
+			continue
+		}
+		if id >= 0 && filepath.Base(f) == fmt.Sprintf(format, id) {
+			present[id] = f
+		}
+	}
+	return present, nil
+}
+
+// reconcile brings the manifest in line with the folder after a crash
+// between an edit and the change of the files it records
+func (m *manifest) reconcile(folder string, logger Logger) error {
+	present, err := segmentFiles(m.fs, folder)
+	if err != nil {
+		return err
+	}
+	// the active segment was sealed but the rotation not recorded
+	if _, ok := present[m.active]; ok {
+		m.apply(manifestEdit{Added: []int{m.active}, Active: m.active + 1})
+	}
+	for id, f := range present {
+		if m.segments[id] {
+			continue
+		}
+		if id > m.active {
+			return fmt.Errorf("%w: unknown segment %s", errCorruptManifest, f)
+		}
+		// the removal was recorded but the file not deleted yet
+		if err := m.fs.Remove(f); err != nil {
+			return err
+		}
+		if err := segments.RemoveSegmentIndex(m.fs, f); err != nil {
+			return err
+		}
+		logger.Infof("removed segment %s dropped from the manifest", f)
+	}
+	if err := m.reconcileBlobs(folder, logger); err != nil {
+		return err
+	}
+	if err := m.reconcileValueLogs(folder, logger); err != nil {
+		return err
+	}
+	for id := range m.segments {
+		if _, ok := present[id]; ok {
+			continue
+		}
+		// segments moved aside by Repair are forgotten
+		f := filepath.Join(folder, fmt.Sprintf(segmentFilenameFmt, id))
+		if !vfs.Exists(m.fs, f+corruptSuffix) && !vfs.Exists(m.fs, f+orphanedSuffix) {
+			return fmt.Errorf("%w: %s", errMissingSegment, filepath.Base(f))
+		}
+		logger.Warnf("dropped segment %s moved aside by repair from the manifest", f)
+		delete(m.segments, id)
+	}
+	return nil
+}
+
+// reconcileValueLogs is reconcile for the value log files, which repair
+// leaves alone
+func (m *manifest) reconcileValueLogs(folder string, logger Logger) error {
+	present, err := valueLogFiles(m.fs, folder)
+	if err != nil {
+		return err
+	}
+	if _, ok := present[m.activeValueLog]; ok {
+		m.apply(manifestEdit{AddedValueLogs: []int{m.activeValueLog}, ActiveValueLog: m.activeValueLog + 1})
+	}
+	for id, f := range present {
+		if m.valueLogs[id] {
+			continue
+		}
+		if id > m.activeValueLog {
+			return fmt.Errorf("%w: unknown value log %s", errCorruptManifest, f)
+		}
+		if err := m.fs.Remove(f); err != nil {
+			return err
+		}
+		logger.Infof("removed value log %s dropped from the manifest", f)
+	}
+	for id := range m.valueLogs {
+		if _, ok := present[id]; !ok {
+			return fmt.Errorf("%w: %s", errMissingSegment, fmt.Sprintf(valueLogFilenameFmt, id))
+		}
+	}
+	return nil
+}
+
+// reconcileBlobs deletes the blobs of the segments dropped from the
+// manifest, and the ones staged by writes interrupted by a crash
+func (m *manifest) reconcileBlobs(folder string, logger Logger) error {
+	blobs, err := blobFiles(m.fs, folder)
+	if err != nil {
+		return err
+	}
+	for id, files := range blobs {
+		if m.segments[id] || id == m.active {
+			continue
+		}
+		if id > m.active {
+			return fmt.Errorf("%w: blob %s of unknown segment", errCorruptManifest, files[0])
+		}
+		for _, f := range files {
+			if err := m.fs.Remove(f); err != nil {
+				return err
+			}
+		}
+		logger.Infof("removed %d blobs of segment %d dropped from the manifest", len(files), id)
+	}
+	staged, err := vfs.Glob(m.fs, filepath.Join(folder, blobStagingPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range staged {
+		// left alone once moved aside by repair
+		if strings.HasSuffix(f, orphanedSuffix) {
+			continue
+		}
+		if err := m.fs.Remove(f); err != nil {
+			return err
+		}
+		logger.Infof("removed blob %s staged before the crash", f)
+	}
+	return nil
+}
+
+func (m *manifest) apply(edit manifestEdit) {
+	for _, id := range edit.Added {
+		m.segments[id] = true
+	}
+	for _, id := range edit.Removed {
+		delete(m.segments, id)
+	}
+	if edit.Active > m.active {
+		m.active = edit.Active
+	}
+	for _, id := range edit.AddedValueLogs {
+		m.valueLogs[id] = true
+	}
+	for _, id := range edit.RemovedValueLogs {
+		delete(m.valueLogs, id)
+	}
+	if edit.ActiveValueLog > m.activeValueLog {
+		m.activeValueLog = edit.ActiveValueLog
+	}
+}
+
+// snapshot returns the state of the manifest as a single edit
+func (m *manifest) snapshot() manifestEdit {
+	edit := manifestEdit{Active: m.active, ActiveValueLog: m.activeValueLog}
+	for id := range m.segments {
+		edit.Added = append(edit.Added, id)
+	}
+	sort.Ints(edit.Added)
+	for id := range m.valueLogs {
+		edit.AddedValueLogs = append(edit.AddedValueLogs, id)
+	}
+	sort.Ints(edit.AddedValueLogs)
+	return edit
+}
+
+// rewrite replaces the manifest with its snapshot, syncing it before the
+// rename so a crash leaves either version in place
+func (m *manifest) rewrite() error {
+	tmp := m.path + ".tmp"
+	data, err := encodeManifestEdit(m.snapshot())
+	if err != nil {
+		return err
+	}
+	f, err := vfs.Create(m.fs, tmp)
+	if err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := m.fs.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	if err := m.fs.SyncDir(filepath.Dir(m.path)); err != nil {
+		return err
+	}
+	m.f, err = m.fs.OpenFile(m.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// append records edit, which takes effect once synced
+func (m *manifest) append(edit manifestEdit) error {
+	data, err := encodeManifestEdit(edit)
+	if err != nil {
+		return err
+	}
+	if _, err := m.f.Write(data); err != nil {
+		return fmt.Errorf("error appending to manifest: %w", err)
+	}
+	if err := m.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing manifest: %w", err)
+	}
+	m.apply(edit)
+	return nil
+}
+
+func (m *manifest) Close() error {
+	return m.f.Close()
+}
+
+func encodeManifestEdit(edit manifestEdit) ([]byte, error) {
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, manifestHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(data[4:], uint32(len(payload)))
+	copy(data[manifestHeaderSize:], payload)
+	return data, nil
+}
+
+// decodeManifestEdit decodes the edit at the start of data, returning the
+// size of its record, or as much of it as data holds
+func decodeManifestEdit(data []byte) (manifestEdit, int, error) {
+	var edit manifestEdit
+	if len(data) < manifestHeaderSize {
+		return edit, len(data), errors.New("truncated header")
+	}
+	n := manifestHeaderSize + int(binary.BigEndian.Uint32(data[4:]))
+	if len(data) < n {
+		return edit, len(data), errors.New("truncated edit")
+	}
+	payload := data[manifestHeaderSize:n]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data) {
+		return edit, n, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &edit); err != nil {
+		return edit, n, err
+	}
+	return edit, n, nil
+}
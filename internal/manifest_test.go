@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/segments"
+)
+
+// sealedSegments seals n segments of one record each into a new storage
+func sealedSegments(t *testing.T, n int) (string, *logBasedStorage) {
+	basePath := emptyDataFolder(t)
+	lbs, err := NewLogBasedStorage(basePath)
+	assert.NoError(t, err)
+	kdt := make(segments.KeyDirTable)
+	for i := 0; i < n; i++ {
+		assert.NoError(t, lbs.Append([]byte("key"), []byte(fmt.Sprintf("value %d", i)), kdt))
+		_, err := lbs.Seal()
+		assert.NoError(t, err)
+	}
+	return basePath, lbs
+}
+
+func TestManifestAllocatesUniqueIDs(t *testing.T) {
+	basePath, lbs := sealedSegments(t, 3)
+	defer os.RemoveAll(basePath)
+	assert.Equal(t, 4, lbs.currentSegment.ID())
+
+	// the newest segment is gone, its ID must not come back
+	assert.NoError(t, lbs.DropSegments([]int{2, 3}))
+	assert.NoError(t, lbs.Close())
+	lbs, err := NewLogBasedStorage(basePath)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, lbs.sealedIDs)
+	assert.Equal(t, 4, lbs.currentSegment.ID())
+	assert.NoError(t, lbs.Append([]byte("key"), []byte("value"), make(segments.KeyDirTable)))
+	sealed, err := lbs.Seal()
+	assert.NoError(t, err)
+	assert.Contains(t, sealed, 4)
+	assert.Equal(t, 5, lbs.currentSegment.ID())
+	assert.NoError(t, lbs.Close())
+}
+
+func TestManifestRecovery(t *testing.T) {
+	basePath, lbs := sealedSegments(t, 2)
+	defer os.RemoveAll(basePath)
+	assert.NoError(t, lbs.Append([]byte("key"), []byte("active"), make(segments.KeyDirTable)))
+	assert.NoError(t, lbs.Close())
+	manifestPath := filepath.Join(basePath, manifestFilename)
+
+	t.Run("drop a torn edit", func(t *testing.T) {
+		f, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		edit, _ := encodeManifestEdit(manifestEdit{Removed: []int{1}})
+		f.Write(edit[:len(edit)-2])
+		f.Close()
+		lbs, err := NewLogBasedStorage(basePath)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 2}, lbs.sealedIDs)
+		assert.NoError(t, lbs.Close())
+	})
+
+	t.Run("seal an active segment renamed before the crash", func(t *testing.T) {
+		assert.NoError(t, os.Rename(filepath.Join(basePath, activeSegmentFilename), filepath.Join(basePath, "segment_00003.dat")))
+		lbs, err := NewLogBasedStorage(basePath)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3}, lbs.sealedIDs)
+		assert.Equal(t, 4, lbs.currentSegment.ID())
+		kdt, err := lbs.BuildKeyDirTable()
+		assert.NoError(t, err)
+		entry, _ := kdt.Get("key")
+		value, err := lbs.ReadKeyDirEntry(entry)
+		assert.NoError(t, err)
+		assert.Equal(t, "active", string(value))
+		assert.NoError(t, lbs.Close())
+	})
+
+	t.Run("delete a segment removed before the crash", func(t *testing.T) {
+		data, err := ioutil.ReadFile(filepath.Join(basePath, "segment_00001.dat"))
+		assert.NoError(t, err)
+		lbs, err := NewLogBasedStorage(basePath)
+		assert.NoError(t, err)
+		assert.NoError(t, lbs.DropSegments([]int{1}))
+		assert.NoError(t, lbs.Close())
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(basePath, "segment_00001.dat"), data, 0644))
+		lbs, err = NewLogBasedStorage(basePath)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{2, 3}, lbs.sealedIDs)
+		_, err = os.Stat(filepath.Join(basePath, "segment_00001.dat"))
+		assert.True(t, os.IsNotExist(err))
+		assert.NoError(t, lbs.Close())
+	})
+
+	t.Run("refuse a missing segment", func(t *testing.T) {
+		path := filepath.Join(basePath, "segment_00002.dat")
+		assert.NoError(t, os.Rename(path, path+".bak"))
+		_, err := NewLogBasedStorage(basePath)
+		assert.True(t, errors.Is(err, errMissingSegment))
+
+		// unless repair moved it aside
+		assert.NoError(t, os.Rename(path+".bak", path+corruptSuffix))
+		lbs, err := NewLogBasedStorage(basePath)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{3}, lbs.sealedIDs)
+		assert.NoError(t, lbs.Close())
+	})
+
+	t.Run("refuse a corrupt edit", func(t *testing.T) {
+		data, err := ioutil.ReadFile(manifestPath)
+		assert.NoError(t, err)
+		edit, _ := encodeManifestEdit(manifestEdit{Active: 9})
+		data = append(data, edit...)
+		data[manifestHeaderSize] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(manifestPath, data, 0644))
+		_, err = NewLogBasedStorage(basePath)
+		assert.True(t, errors.Is(err, errCorruptManifest))
+	})
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"time"
+)
+
+const (
+	OpSet      = "set"
+	OpGet      = "get"
+	OpRemove   = "remove"
+	OpMultiGet = "multiget"
+	OpView     = "view"
+)
+
+// Metrics receives the measurements taken by the storage engine. It must be
+// safe for concurrent use.
+type Metrics interface {
+	// ObserveOperation records the latency and outcome of a store operation
+	ObserveOperation(op string, duration time.Duration, err error)
+	// AddBytesAppended records bytes written to the active segment
+	AddBytesAppended(n int64)
+	// IncSegmentRotations records the sealing of the active segment
+	IncSegmentRotations()
+	// ObserveFsync records the latency of flushing a segment to disk
+	ObserveFsync(duration time.Duration)
+	// ObserveCleanerRun records a log cleaner run and the bytes it reclaimed
+	ObserveCleanerRun(duration time.Duration, reclaimedBytes int64)
+	// SetKeyDirSize records the number of keys held by the keydir
+	SetKeyDirSize(keys int)
+	// SetOpenSegments records the number of open segments and how many of
+	// them are memory mapped
+	SetOpenSegments(open, mapped int)
+}
+
+// Nop discards every measurement
+type Nop struct{}
+
+func (Nop) ObserveOperation(string, time.Duration, error) {}
+func (Nop) AddBytesAppended(int64)                        {}
+func (Nop) IncSegmentRotations()                          {}
+func (Nop) ObserveFsync(time.Duration)                    {}
+func (Nop) ObserveCleanerRun(time.Duration, int64)        {}
+func (Nop) SetKeyDirSize(int)                             {}
+func (Nop) SetOpenSegments(int, int)                      {}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "kvs"
+
+// Prometheus exposes the storage engine measurements as Prometheus metrics
+type Prometheus struct {
+	operations       *prometheus.CounterVec
+	operationLatency *prometheus.HistogramVec
+	bytesAppended    prometheus.Counter
+	rotations        prometheus.Counter
+	fsyncLatency     prometheus.Histogram
+	cleanerRuns      prometheus.Counter
+	cleanerLatency   prometheus.Histogram
+	reclaimedBytes   prometheus.Counter
+	keyDirSize       prometheus.Gauge
+	openSegments     prometheus.Gauge
+	mappedSegments   prometheus.Gauge
+}
+
+// NewPrometheus creates the engine metrics and registers them in reg
+func NewPrometheus(reg prometheus.Registerer) (*Prometheus, error) {
+	p := &Prometheus{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Store operations by type and result.",
+		}, []string{"op", "result"}),
+		operationLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of store operations.",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 12),
+		}, []string{"op"}),
+		bytesAppended: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "appended_bytes_total",
+			Help:      "Bytes appended to the active segment.",
+		}),
+		rotations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "segment_rotations_total",
+			Help:      "Active segments sealed.",
+		}),
+		fsyncLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fsync_duration_seconds",
+			Help:      "Latency of flushing segments to disk.",
+			Buckets:   prometheus.ExponentialBuckets(1e-5, 4, 10),
+		}),
+		cleanerRuns: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleaner_runs_total",
+			Help:      "Log cleaner runs.",
+		}),
+		cleanerLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cleaner_run_duration_seconds",
+			Help:      "Duration of log cleaner runs.",
+			Buckets:   prometheus.ExponentialBuckets(1e-4, 4, 10),
+		}),
+		reclaimedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleaner_reclaimed_bytes_total",
+			Help:      "Bytes reclaimed by the log cleaner.",
+		}),
+		keyDirSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "keydir_keys",
+			Help:      "Keys held by the keydir.",
+		}),
+		openSegments: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "open_segments",
+			Help:      "Segments currently open, including the active one.",
+		}),
+		mappedSegments: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "mapped_segments",
+			Help:      "Sealed segments currently memory mapped.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{
+		p.operations, p.operationLatency, p.bytesAppended, p.rotations, p.fsyncLatency,
+		p.cleanerRuns, p.cleanerLatency, p.reclaimedBytes, p.keyDirSize, p.openSegments, p.mappedSegments,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Prometheus) ObserveOperation(op string, duration time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	p.operations.WithLabelValues(op, result).Inc()
+	p.operationLatency.WithLabelValues(op).Observe(duration.Seconds())
+}
+
+func (p *Prometheus) AddBytesAppended(n int64) {
+	p.bytesAppended.Add(float64(n))
+}
+
+func (p *Prometheus) IncSegmentRotations() {
+	p.rotations.Inc()
+}
+
+func (p *Prometheus) ObserveFsync(duration time.Duration) {
+	p.fsyncLatency.Observe(duration.Seconds())
+}
+
+func (p *Prometheus) ObserveCleanerRun(duration time.Duration, reclaimedBytes int64) {
+	p.cleanerRuns.Inc()
+	p.cleanerLatency.Observe(duration.Seconds())
+	p.reclaimedBytes.Add(float64(reclaimedBytes))
+}
+
+func (p *Prometheus) SetKeyDirSize(keys int) {
+	p.keyDirSize.Set(float64(keys))
+}
+
+func (p *Prometheus) SetOpenSegments(open, mapped int) {
+	p.openSegments.Set(float64(open))
+	p.mappedSegments.Set(float64(mapped))
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+var (
+	modelSeed = flag.Int64("model.seed", 0, "seed of the only model test sequence to run, 0 running the default seeds")
+	modelOps  = flag.Int("model.ops", 300, "number of operations of the model test sequences")
+)
+
+// modelSegmentSize seals the segments of the model tests after a few records,
+// so the sequences go through many rotations and cleaner runs
+const modelSegmentSize = 512
+
+type modelOpKind int
+
+const (
+	modelSet modelOpKind = iota
+	modelGet
+	modelRemove
+	modelReopen
+	modelRotate
+	modelCompact
+)
+
+// modelOp is an operation run against both the store and the model
+type modelOp struct {
+	kind  modelOpKind
+	key   string
+	value []byte
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case modelSet:
+		return fmt.Sprintf("Set(%q, %d bytes)", op.key, len(op.value))
+	case modelGet:
+		return fmt.Sprintf("Get(%q)", op.key)
+	case modelRemove:
+		return fmt.Sprintf("Remove(%q)", op.key)
+	case modelReopen:
+		return "Reopen()"
+	case modelRotate:
+		return "Rotate()"
+	default:
+		return "Compact()"
+	}
+}
+
+// generateModelOps returns n operations on a small set of keys, so that
+// most of them overwrite, remove or read keys written before
+func generateModelOps(r *rand.Rand, n int) []modelOp {
+	ops := make([]modelOp, n)
+	for i := range ops {
+		op := modelOp{key: fmt.Sprintf("key-%d", r.Intn(16))}
+		switch p := r.Intn(100); {
+		case p < 45:
+			op.kind = modelSet
+			op.value = make([]byte, r.Intn(200))
+			r.Read(op.value)
+		case p < 70:
+			op.kind = modelGet
+		case p < 85:
+			op.kind = modelRemove
+		case p < 90:
+			op.kind = modelReopen
+		case p < 95:
+			op.kind = modelRotate
+		default:
+			op.kind = modelCompact
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+// runModelOps runs ops against a store in memory and a map, returning the
+// first difference between them
+func runModelOps(ops []modelOp, opts []Option) error {
+	fs := vfs.NewMemFS()
+	if err := fs.MkdirAll("/data", 0755); err != nil {
+		return err
+	}
+	opts = append(opts[:len(opts):len(opts)], WithFS(fs))
+	db, err := OpenBitCaskStore("/data", opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if db != nil {
+			db.Close()
+		}
+	}()
+
+	model := make(map[string][]byte)
+	for i, op := range ops {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("op %d %s: %s", i, op, fmt.Sprintf(format, args...))
+		}
+		switch op.kind {
+		case modelSet:
+			if err := db.Set(op.key, op.value); err != nil {
+				return fail("%v", err)
+			}
+			model[op.key] = op.value
+		case modelGet:
+			value, ok, err := db.Get(op.key)
+			if err != nil {
+				return fail("%v", err)
+			}
+			expected, found := model[op.key]
+			if ok != found || !bytes.Equal(value, expected) {
+				return fail("got %d bytes (found %t), expected %d bytes (found %t)", len(value), ok, len(expected), found)
+			}
+		case modelRemove:
+			err := db.Remove(op.key)
+			if _, found := model[op.key]; !found {
+				if !errors.Is(err, ErrDeletingNonExistingKey) {
+					return fail("expected %v, got %v", ErrDeletingNonExistingKey, err)
+				}
+				continue
+			}
+			if err != nil {
+				return fail("%v", err)
+			}
+			delete(model, op.key)
+		case modelReopen:
+			err := db.Close()
+			db = nil
+			if err != nil {
+				return fail("%v", err)
+			}
+			if db, err = OpenBitCaskStore("/data", opts...); err != nil {
+				return fail("%v", err)
+			}
+		case modelRotate:
+			if err := db.Rotate(); err != nil {
+				return fail("%v", err)
+			}
+		case modelCompact:
+			if _, err := db.Compact(context.Background()); err != nil {
+				return fail("%v", err)
+			}
+		}
+		keys := make([]string, 0, len(model))
+		for key := range model {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if actual := db.Keys(); len(actual) != len(keys) || len(keys) > 0 && !reflect.DeepEqual(actual, keys) {
+			return fail("keys %v, expected %v", actual, keys)
+		}
+	}
+	return nil
+}
+
+// shrinkModelOps drops operations from a sequence failing run as long as it
+// keeps failing, first in large chunks then one by one
+func shrinkModelOps(ops []modelOp, run func([]modelOp) error) ([]modelOp, error) {
+	err := run(ops)
+	for chunk := len(ops) / 2; chunk > 0; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			candidate := append(append([]modelOp{}, ops[:start]...), ops[start+chunk:]...)
+			if candidateErr := run(candidate); candidateErr != nil {
+				ops, err = candidate, candidateErr
+				continue
+			}
+			start += chunk
+		}
+	}
+	return ops, err
+}
+
+func TestModel(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	configs := map[string][]Option{
+		"log":            nil,
+		"disk index":     {WithDiskIndex()},
+		"compact keydir": {WithCompactKeyDir()},
+		"blobs":          {WithBlobThreshold(100)},
+		"value log":      {WithValueLog()},
+	}
+	seeds := []int64{1, 2, 3, 4, 5, 6, 7, 8}
+	if *modelSeed != 0 {
+		seeds = []int64{*modelSeed}
+	}
+	for name, config := range configs {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			opts := append([]Option{
+				WithRotationPolicy(SizeRotation(modelSegmentSize)),
+				WithClock(newManualClock(time.Now())),
+				WithLogger(logger),
+			}, config...)
+			for _, seed := range seeds {
+				ops := generateModelOps(rand.New(rand.NewSource(seed)), *modelOps)
+				if err := runModelOps(ops, opts); err == nil {
+					continue
+				}
+				shrunk, err := shrinkModelOps(ops, func(ops []modelOp) error {
+					return runModelOps(ops, opts)
+				})
+				t.Errorf("seed %d (rerun with -model.seed=%d) fails after %d of %d operations: %v",
+					seed, seed, len(shrunk), len(ops), err)
+				for _, op := range shrunk {
+					t.Log(op)
+				}
+				return
+			}
+		})
+	}
+}
+
+func TestShrinkModelOps(t *testing.T) {
+	ops := generateModelOps(rand.New(rand.NewSource(1)), 100)
+	// a sequence failing when key-3 is removed after being set twice
+	failing := func(ops []modelOp) error {
+		sets := 0
+		for _, op := range ops {
+			if op.key != "key-3" {
+				continue
+			}
+			if op.kind == modelSet {
+				sets++
+			} else if op.kind == modelRemove && sets >= 2 {
+				return errors.New("removed")
+			}
+		}
+		return nil
+	}
+	assert.Error(t, failing(ops))
+	shrunk, err := shrinkModelOps(ops, failing)
+	assert.EqualError(t, err, "removed")
+	assert.Len(t, shrunk, 3, "shrunk to %v", shrunk)
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"github.com/sirupsen/logrus"
+	"pingcap.com/kvs/internal/metrics"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+// Options tune the behaviour of a store
+type Options struct {
+	Metrics metrics.Metrics
+	Logger  Logger
+	Events  EventListener
+	// DiskIndex keeps only the keys of the active segment in memory, looking
+	// up the rest in the on-disk indexes of the sealed segments
+	DiskIndex bool
+	// CompactKeyDir packs the keydir in a table the GC does not need to scan
+	CompactKeyDir bool
+	// MaxMappedSegments bounds the sealed segments mapped at once, unmapping
+	// the least recently read ones, 0 meaning no limit
+	MaxMappedSegments int
+	// MaxKeySize and MaxValueSize bound the writes, 0 meaning no limit
+	MaxKeySize   int
+	MaxValueSize int64
+	// ValueLog stores the values apart from the keys, in value log files
+	// collected on their own
+	ValueLog bool
+	// Preallocate reserves the size of a full segment for the active
+	// segment, which then grows neither block by block nor on every sync
+	Preallocate bool
+	// SyncWrites syncs every write to disk before acknowledging it
+	SyncWrites bool
+	// RotationPolicy decides when the active segment is sealed, nil sealing
+	// it once over segments.MaxSegmentSizeBytes
+	RotationPolicy RotationPolicy
+	// Clock drives the background tasks of the store and tells the age of the
+	// active segment to the rotation policy
+	Clock Clock
+	// FS holds the data folder of the store
+	FS vfs.FS
+	// CompactionThrottle paces the log cleaner and the value log collection,
+	// and may be shared by several stores
+	CompactionThrottle *CompactionThrottle
+	// BlobThreshold is the size from which values are stored in blob files
+	// rather than in the log, 0 keeping every value in the log
+	BlobThreshold int64
+}
+
+// Option sets one of the store Options
+type Option func(*Options)
+
+// WithMetrics reports the store measurements to m
+func WithMetrics(m metrics.Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = m
+	}
+}
+
+// WithLogger sends the engine logs to logger instead of the logrus standard logger
+func WithLogger(logger Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithEventListener notifies listener of the engine activity
+func WithEventListener(listener EventListener) Option {
+	return func(o *Options) {
+		o.Events = listener
+	}
+}
+
+// WithDiskIndex bounds the memory used by the keydir for stores holding more
+// keys than fit in RAM, at the cost of slower reads of sealed records
+func WithDiskIndex() Option {
+	return func(o *Options) {
+		o.DiskIndex = true
+	}
+}
+
+// WithCompactKeyDir trades some lookup speed for a keydir taking a fraction of
+// the memory of a regular map, with far shorter GC pauses on large stores
+func WithCompactKeyDir() Option {
+	return func(o *Options) {
+		o.CompactKeyDir = true
+	}
+}
+
+// WithMaxMappedSegments keeps at most n sealed segments mapped, for stores
+// with more segments than the address space or open files limit allow
+func WithMaxMappedSegments(n int) Option {
+	return func(o *Options) {
+		o.MaxMappedSegments = n
+	}
+}
+
+// WithMaxKeySize fails the writes of keys longer than n bytes with a
+// KeyTooLargeError
+func WithMaxKeySize(n int) Option {
+	return func(o *Options) {
+		o.MaxKeySize = n
+	}
+}
+
+// WithMaxValueSize fails the writes of values larger than n bytes with a
+// ValueTooLargeError
+func WithMaxValueSize(n int64) Option {
+	return func(o *Options) {
+		o.MaxValueSize = n
+	}
+}
+
+// WithBlobThreshold stores the values of at least n bytes in blob files, so
+// the segments keep their size whatever the size of the values
+func WithBlobThreshold(n int64) Option {
+	return func(o *Options) {
+		o.BlobThreshold = n
+	}
+}
+
+// WithValueLog keeps the log down to the keys and the location of their
+// values, written to value log files, so rewriting the log never copies the
+// values. Values already written stay where they are.
+func WithValueLog() Option {
+	return func(o *Options) {
+		o.ValueLog = true
+	}
+}
+
+// WithPreallocation preallocates the active segment to its maximum size
+func WithPreallocation() Option {
+	return func(o *Options) {
+		o.Preallocate = true
+	}
+}
+
+// WithSyncWrites makes every write durable before it returns
+func WithSyncWrites() Option {
+	return func(o *Options) {
+		o.SyncWrites = true
+	}
+}
+
+// WithRotationPolicy seals the active segment when policy says so, which is
+// also asked periodically so that a quiet store seals it too. Combine it
+// with SizeRotation through AnyRotation to keep bounding the segment size.
+func WithRotationPolicy(policy RotationPolicy) Option {
+	return func(o *Options) {
+		o.RotationPolicy = policy
+	}
+}
+
+// WithCompactionThrottle paces the compactions of the store with throttle
+func WithCompactionThrottle(throttle *CompactionThrottle) Option {
+	return func(o *Options) {
+		o.CompactionThrottle = throttle
+	}
+}
+
+// WithClock drives the background tasks and the rotation policy of the
+// store with clock
+func WithClock(clock Clock) Option {
+	return func(o *Options) {
+		o.Clock = clock
+	}
+}
+
+// WithFS opens the store in fs rather than in the filesystem of the OS
+func WithFS(fs vfs.FS) Option {
+	return func(o *Options) {
+		o.FS = fs
+	}
+}
+
+func newOptions(opts []Option) *Options {
+	options := &Options{
+		Metrics: metrics.Nop{},
+		Logger:  logrus.StandardLogger(),
+		Clock:   systemClock{},
+		FS:      vfs.Default,
+
+		MaxKeySize:    defaultMaxKeySize,
+		BlobThreshold: defaultBlobThreshold,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
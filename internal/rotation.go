@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// rotationCheckInterval is how often a quiet store asks its rotation
+	// policy whether to seal the active segment
+	rotationCheckInterval = time.Second
+)
+
+// ActiveSegment describes the active segment to a RotationPolicy
+type ActiveSegment struct {
+	Size    int64
+	Records int64
+	// Since is when the first record of the segment was appended, or when
+	// the store was opened if the segment already held records
+	Since time.Time
+}
+
+// RotationPolicy decides when the active segment is sealed. It is asked
+// before every append and periodically, but never about an empty segment.
+type RotationPolicy interface {
+	ShouldRotate(active ActiveSegment, now time.Time) bool
+}
+
+// RotationPolicyFunc adapts a function to a RotationPolicy
+type RotationPolicyFunc func(active ActiveSegment, now time.Time) bool
+
+func (f RotationPolicyFunc) ShouldRotate(active ActiveSegment, now time.Time) bool {
+	return f(active, now)
+}
+
+// SizeRotation seals the active segment once over maxBytes
+func SizeRotation(maxBytes int64) RotationPolicy {
+	return RotationPolicyFunc(func(active ActiveSegment, now time.Time) bool {
+		return active.Size > maxBytes
+	})
+}
+
+// AgeRotation seals the active segment once its first record is maxAge old
+func AgeRotation(maxAge time.Duration) RotationPolicy {
+	return RotationPolicyFunc(func(active ActiveSegment, now time.Time) bool {
+		return now.Sub(active.Since) >= maxAge
+	})
+}
+
+// CountRotation seals the active segment once it holds maxRecords records
+func CountRotation(maxRecords int64) RotationPolicy {
+	return RotationPolicyFunc(func(active ActiveSegment, now time.Time) bool {
+		return active.Records >= maxRecords
+	})
+}
+
+// AnyRotation seals the active segment as soon as one of policies says so
+func AnyRotation(policies ...RotationPolicy) RotationPolicy {
+	return RotationPolicyFunc(func(active ActiveSegment, now time.Time) bool {
+		for _, policy := range policies {
+			if policy.ShouldRotate(active, now) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Rotate seals the active segment unless it is empty, so its records can be
+// cleaned and backed up, and starts a new one
+func (bcs *BitCaskStore) Rotate() error {
+	bcs.mutex.Lock()
+	defer bcs.mutex.Unlock()
+	_, err := bcs.logStore.Rotate()
+	return err
+}
+
+// reportError reports a failure of a background task, which has no caller to
+// return it to
+func (bcs *BitCaskStore) reportError(err error) {
+	bcs.logger.Errorf("%v", err)
+	bcs.events.backgroundError(err)
+}
+
+// rotateWhenDue asks the rotation policy about the active segment on every
+// tick until done is closed, so a quiet store seals it too
+func (bcs *BitCaskStore) rotateWhenDue(done <-chan struct{}, ticker Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			bcs.mutex.Lock()
+			_, err := bcs.logStore.RotateIfDue()
+			bcs.mutex.Unlock()
+			if err != nil {
+				bcs.reportError(fmt.Errorf("error rotating active segment: %w", err))
+			}
+		case <-done:
+			return
+		}
+	}
+}
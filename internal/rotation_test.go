@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+func TestRotationPolicies(t *testing.T) {
+	now := time.Now()
+	active := ActiveSegment{Size: 100, Records: 3, Since: now.Add(-time.Minute)}
+	assert.True(t, SizeRotation(99).ShouldRotate(active, now))
+	assert.False(t, SizeRotation(100).ShouldRotate(active, now))
+	assert.True(t, CountRotation(3).ShouldRotate(active, now))
+	assert.False(t, CountRotation(4).ShouldRotate(active, now))
+	assert.True(t, AgeRotation(time.Minute).ShouldRotate(active, now))
+	assert.False(t, AgeRotation(time.Hour).ShouldRotate(active, now))
+	assert.True(t, AnyRotation(SizeRotation(1000), CountRotation(2)).ShouldRotate(active, now))
+	assert.False(t, AnyRotation(SizeRotation(1000), CountRotation(4)).ShouldRotate(active, now))
+	assert.False(t, AnyRotation().ShouldRotate(active, now))
+}
+
+func TestRotation(t *testing.T) {
+	sealedSegments := func(path string) []string {
+		files, _ := filepath.Glob(filepath.Join(path, segmentFilenameGlob))
+		return files
+	}
+
+	t.Run("count", func(t *testing.T) {
+		path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+		defer os.RemoveAll(path)
+		db, err := OpenBitCaskStore(path, WithRotationPolicy(CountRotation(3)))
+		assert.NoError(t, err)
+		defer db.Close()
+		for i := 0; i < 7; i++ {
+			assert.NoError(t, db.Set(strconv.Itoa(i), []byte("value")))
+		}
+		assert.Len(t, sealedSegments(path), 2)
+		assert.Equal(t, int64(1), db.logStore.(*logBasedStorage).currentSegment.Records())
+	})
+
+	t.Run("age", func(t *testing.T) {
+		path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+		defer os.RemoveAll(path)
+		clock := newManualClock(time.Now())
+		db, err := OpenBitCaskStore(path, WithRotationPolicy(AgeRotation(time.Minute)), WithClock(clock))
+		assert.NoError(t, err)
+		defer db.Close()
+
+		// empty segments are never sealed, and a tick is only taken once
+		// the previous one was handled
+		clock.Advance(time.Hour)
+		clock.Advance(rotationCheckInterval)
+		assert.Empty(t, sealedSegments(path))
+		assert.NoError(t, db.Set("key", []byte("value")))
+		clock.Advance(rotationCheckInterval)
+		clock.Advance(rotationCheckInterval)
+		assert.Empty(t, sealedSegments(path))
+		clock.Advance(time.Minute)
+		clock.Advance(rotationCheckInterval)
+		assert.Len(t, sealedSegments(path), 1)
+		value, ok, err := db.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value", string(value))
+	})
+
+	t.Run("background error", func(t *testing.T) {
+		fs := vfs.NewFaultFS(vfs.NewMemFS())
+		assert.NoError(t, fs.MkdirAll("/data", 0755))
+		clock := newManualClock(time.Now())
+		errs := make(chan error, 1)
+		db, err := OpenBitCaskStore("/data", WithFS(fs), WithClock(clock),
+			WithRotationPolicy(AgeRotation(time.Minute)),
+			WithEventListener(EventListener{OnBackgroundError: func(err error) { errs <- err }}))
+		assert.NoError(t, err)
+		defer db.Close()
+
+		assert.NoError(t, db.Set("key", []byte("value")))
+		fs.Inject(vfs.FailOn(vfs.OpRename, activeSegmentFilename, syscall.EIO))
+		clock.Advance(time.Minute)
+		assert.True(t, errors.Is(<-errs, syscall.EIO))
+		fs.Inject(nil)
+	})
+
+	t.Run("blob", func(t *testing.T) {
+		path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+		defer os.RemoveAll(path)
+		// only the second check is due, which used to come between naming
+		// the blob after the active segment and appending its record
+		checks := 0
+		policy := RotationPolicyFunc(func(ActiveSegment, time.Time) bool {
+			checks++
+			return checks == 2
+		})
+		db, err := OpenBitCaskStore(path, WithRotationPolicy(policy), WithBlobThreshold(16))
+		assert.NoError(t, err)
+		defer db.Close()
+		blob := bytes.Repeat([]byte("blob"), 16)
+		assert.NoError(t, db.Set("a", []byte("value")))
+		assert.NoError(t, db.Set("blob", blob))
+		assert.NoError(t, db.Set("a", []byte("other")))
+		assert.Equal(t, 2, checks)
+		_, err = db.Compact(context.Background())
+		assert.NoError(t, err)
+		value, ok, err := db.Get("blob")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, blob, value)
+	})
+
+	t.Run("explicit", func(t *testing.T) {
+		path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+		defer os.RemoveAll(path)
+		db, err := OpenBitCaskStore(path)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Rotate())
+		assert.Empty(t, sealedSegments(path))
+		assert.NoError(t, db.Set("key", []byte("value")))
+		assert.NoError(t, db.Rotate())
+		assert.Len(t, sealedSegments(path), 1)
+		assert.NoError(t, db.Close())
+
+		db, err = OpenBitCaskStore(path)
+		assert.NoError(t, err)
+		defer db.Close()
+		value, ok, err := db.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value", string(value))
+	})
+}
@@ -0,0 +1,110 @@
+package segments
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+const (
+	bloomMagicNumber = 0x6b766266
+	bloomBitsPerKey  = 10
+	// ln(2) * bits per key minimises the false positive rate, ~1% for 10 bits
+	bloomHashes     = 6
+	bloomHeaderSize = 4 + 1
+)
+
+var errCorruptIndexFile = errors.New("error due to corrupt index file")
+
+// BloomFilter answers whether a key may be part of a set, without false
+// negatives
+type BloomFilter struct {
+	bits   []byte
+	hashes uint8
+}
+
+// NewBloomFilter creates a filter sized for the given number of keys
+func NewBloomFilter(keys int) *BloomFilter {
+	nbits := keys * bloomBitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	return &BloomFilter{
+		bits:   make([]byte, (nbits+7)/8),
+		hashes: bloomHashes,
+	}
+}
+
+// Add inserts key in the filter
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	nbits := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < uint32(bf.hashes); i++ {
+		bit := (h1 + i*h2) % nbits
+		bf.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain tells whether key may have been added to the filter
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	nbits := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < uint32(bf.hashes); i++ {
+		bit := (h1 + i*h2) % nbits
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary encodes the filter along with a checksum
+func (bf *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, bloomHeaderSize, bloomHeaderSize+len(bf.bits)+crc32.Size)
+	binary.BigEndian.PutUint32(data, bloomMagicNumber)
+	data[4] = bf.hashes
+	data = append(data, bf.bits...)
+	return appendChecksum(data), nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary
+func (bf *BloomFilter) UnmarshalBinary(data []byte) error {
+	data, err := verifyChecksum(data)
+	if err != nil {
+		return err
+	}
+	if len(data) <= bloomHeaderSize || binary.BigEndian.Uint32(data) != bloomMagicNumber {
+		return errCorruptIndexFile
+	}
+	bf.hashes = data[4]
+	bf.bits = append([]byte{}, data[bloomHeaderSize:]...)
+	return nil
+}
+
+// bloomHash derives the two hashes combined to get every bit position
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// appendChecksum adds the checksum of data at its end
+func appendChecksum(data []byte) []byte {
+	crc := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(data))
+	return append(data, crc...)
+}
+
+// verifyChecksum returns data without its trailing checksum
+func verifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < crc32.Size {
+		return nil, errCorruptIndexFile
+	}
+	payload := data[:len(data)-crc32.Size]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[len(payload):]) {
+		return nil, errCorruptIndexFile
+	}
+	return payload, nil
+}
@@ -5,19 +5,90 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+
+	"pingcap.com/kvs/internal/vfs"
 )
 
 const (
-	magicSize   = 4
-	keySize     = 4
-	valueSize   = 8
-	magicNumber = 0xc0ff33
-	headerSize  = magicSize + keySize + valueSize
+	magicSize    = 4
+	checksumSize = 4
+	flagsSize    = 1
+	keySize      = 4
+	valueSize    = 8
+	// records written before checksums were introduced
+	legacyMagicNumber = 0xc0ff33
+	legacyHeaderSize  = magicSize + keySize + valueSize
+	magicNumber       = 0xc0ff34
+	headerSize        = magicSize + checksumSize + flagsSize + keySize + valueSize
+	// records of a named keyspace or with an expiry carry them after the flags
+	keyspaceSize        = 4
+	expirySize          = 8
+	extendedMagicNumber = 0xc0ff35
+	extendedHeaderSize  = headerSize + keyspaceSize + expirySize
+	// bodies up to this size are allocated at once when decoding
+	bodyChunkSize = 64 * 1024
+)
+
+// Flags describe how a record must be interpreted
+type Flags uint8
+
+const (
+	// FlagTombstone marks the removal of a key
+	FlagTombstone Flags = 1 << iota
+	// FlagCompressed marks a value compressed with DEFLATE
+	FlagCompressed
+	// FlagBlob marks a value stored in a blob file, the record holding its
+	// BlobRef
+	FlagBlob
+	// FlagValuePointer marks a value stored in the value log, the record
+	// holding the location of the value record
+	FlagValuePointer
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is a decoded log record
+type Record struct {
+	Key   []byte
+	Value []byte
+	Flags Flags
+	// Keyspace is the ID of the keyspace holding the key, 0 being the default
+	Keyspace uint32
+	// ExpiresAt is the Unix time in nanoseconds after which the record is
+	// ignored, 0 meaning never
+	ExpiresAt int64
+	// Size is the number of bytes the record takes on disk
+	Size int64
+}
+
+// Tombstone tells whether the record removes its key. Legacy records have
+// no flags and use an empty value instead.
+func (r *Record) Tombstone() bool {
+	return r.Flags&FlagTombstone != 0
+}
+
+// Blob tells whether the value of the record is stored in a blob file
+func (r *Record) Blob() bool {
+	return r.Flags&FlagBlob != 0
+}
+
+// ValuePointer tells whether the value of the record is stored in the value log
+func (r *Record) ValuePointer() bool {
+	return r.Flags&FlagValuePointer != 0
+}
+
+// Expired tells whether the record expired at the given Unix time in
+// nanoseconds
+func (r *Record) Expired(now int64) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= now
+}
+
 type BitCaskEncoder struct {
-	w *bufio.Writer
+	dst io.Writer
+	w   *bufio.Writer
 }
 
 type BitCaskDecoder struct {
@@ -26,12 +97,14 @@ type BitCaskDecoder struct {
 
 type BitCaskMmapDecoder struct {
 	BitCaskDecoder
+	fs   vfs.FS
 	data []byte
 }
 
 func NewBitCaskEncoder(w io.Writer) *BitCaskEncoder {
 	return &BitCaskEncoder{
-		w: bufio.NewWriterSize(w, 1024*1024),
+		dst: w,
+		w:   bufio.NewWriterSize(w, 1024*1024),
 	}
 }
 
@@ -42,15 +115,44 @@ func NewBitCaskDecoder(r io.Reader) *BitCaskDecoder {
 }
 
 func (bce *BitCaskEncoder) Write(key, value []byte) (int64, error) {
-	var written int
-	buffer := make([]byte, headerSize)
+	return bce.WriteRecord(&Record{Key: key, Value: value})
+}
 
-	// magic number
-	binary.BigEndian.PutUint32(buffer, uint32(magicNumber))
+// WriteTombstone appends a record removing key
+func (bce *BitCaskEncoder) WriteTombstone(key []byte) (int64, error) {
+	return bce.WriteRecord(&Record{Key: key, Flags: FlagTombstone})
+}
+
+// WriteRecord appends the key, value, flags, keyspace and expiry of record.
+// Records of the default keyspace without expiry keep the shorter header.
+func (bce *BitCaskEncoder) WriteRecord(record *Record) (n int64, err error) {
+	// a failed write drops the record, as the buffer would keep failing
+	defer func() {
+		if err != nil {
+			bce.w.Reset(bce.dst)
+		}
+	}()
+	var written int
+	key, value := record.Key, record.Value
+	var buffer []byte
+	if record.Keyspace == 0 && record.ExpiresAt == 0 {
+		buffer = make([]byte, headerSize)
+		binary.BigEndian.PutUint32(buffer, uint32(magicNumber))
+	} else {
+		buffer = make([]byte, extendedHeaderSize)
+		binary.BigEndian.PutUint32(buffer, uint32(extendedMagicNumber))
+		binary.BigEndian.PutUint32(buffer[magicSize+checksumSize+flagsSize:], record.Keyspace)
+		binary.BigEndian.PutUint64(buffer[magicSize+checksumSize+flagsSize+keyspaceSize:], uint64(record.ExpiresAt))
+	}
+	// flags
+	buffer[magicSize+checksumSize] = byte(record.Flags)
+	lengths := buffer[len(buffer)-keySize-valueSize:]
 	// key size
-	binary.BigEndian.PutUint32(buffer[magicSize:], uint32(len(key)))
+	binary.BigEndian.PutUint32(lengths, uint32(len(key)))
 	// value size
-	binary.BigEndian.PutUint64(buffer[magicSize+keySize:], uint64(len(value)))
+	binary.BigEndian.PutUint64(lengths[keySize:], uint64(len(value)))
+	// checksum of everything following it
+	binary.BigEndian.PutUint32(buffer[magicSize:], checksum(buffer[magicSize+checksumSize:], key, value))
 
 	// dump header to underlying writer
 	tmp, err := bce.w.Write(buffer)
@@ -75,37 +177,206 @@ func (bce *BitCaskEncoder) Write(key, value []byte) (int64, error) {
 	return int64(written), nil
 }
 
+func checksum(header, key, value []byte) uint32 {
+	crc := crc32.Update(0, crcTable, header)
+	crc = crc32.Update(crc, crcTable, key)
+	return crc32.Update(crc, crcTable, value)
+}
+
 func (bce *BitCaskDecoder) ReadNext() ([]byte, []byte, int64, error) {
-	headerBuffer := make([]byte, headerSize)
-	if _, err := io.ReadFull(bce.r, headerBuffer); err != nil {
+	record, err := bce.ReadRecord()
+	if err != nil {
 		return nil, nil, -1, err
 	}
-	recordMagicNumber := binary.BigEndian.Uint32(headerBuffer[:magicSize])
-	if recordMagicNumber != uint32(magicNumber) {
-		return nil, nil, -1, errInvalidMagicNumber
+	return record.Key, record.Value, record.Size, nil
+}
+
+// ReadRecord decodes the next record. It returns io.EOF when there are no
+// more records and io.ErrUnexpectedEOF when the last one is truncated.
+func (bce *BitCaskDecoder) ReadRecord() (*Record, error) {
+	headerBuffer := make([]byte, extendedHeaderSize)
+	if _, err := io.ReadFull(bce.r, headerBuffer[:magicSize]); err != nil {
+		return nil, err
+	}
+	size, err := recordHeaderSize(headerBuffer)
+	if err != nil {
+		return nil, err
+	}
+	headerBuffer = headerBuffer[:size]
+	if _, err := io.ReadFull(bce.r, headerBuffer[magicSize:]); err != nil {
+		return nil, truncated(err)
 	}
 
-	recordKeyLen := binary.BigEndian.Uint32(headerBuffer[magicSize : magicSize+keySize])
-	recordValueLen := binary.BigEndian.Uint64(headerBuffer[magicSize+keySize:])
-	keyValueBuffer := make([]byte, uint64(recordKeyLen)+recordValueLen)
-	if _, err := io.ReadFull(bce.r, keyValueBuffer); err != nil {
-		return nil, nil, -1, err
+	recordKeyLen, recordValueLen := recordLengths(headerBuffer)
+	keyValueBuffer, err := readBody(bce.r, uint64(recordKeyLen)+recordValueLen)
+	if err != nil {
+		return nil, err
+	}
+	return newRecord(headerBuffer, keyValueBuffer[:recordKeyLen], keyValueBuffer[recordKeyLen:])
+}
+
+// readBody reads the n bytes of key and value following a header. The
+// lengths are not checksummed yet, so large bodies are buffered as they are
+// read rather than allocated upfront: a damaged length ends with
+// io.ErrUnexpectedEOF once the medium runs out.
+func readBody(r io.Reader, n uint64) ([]byte, error) {
+	if n <= bodyChunkSize {
+		buffer := make([]byte, n)
+		if _, err := io.ReadFull(r, buffer); err != nil {
+			return nil, truncated(err)
+		}
+		return buffer, nil
+	}
+	if n > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var buffer bytes.Buffer
+	if _, err := io.CopyN(&buffer, r, int64(n)); err != nil {
+		return nil, truncated(err)
 	}
-	bytesRead := int64(len(headerBuffer) + len(keyValueBuffer))
-	return keyValueBuffer[:recordKeyLen], keyValueBuffer[recordKeyLen:], bytesRead, nil
+	return buffer.Bytes(), nil
 }
 
 func (bcd *BitCaskMmapDecoder) ReadAt(offset int64, size int64) ([]byte, []byte, error) {
+	record, err := bcd.ReadRecordAt(offset, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record.Key, record.Value, nil
+}
+
+// Bytes returns the mapped segment
+func (bcd *BitCaskMmapDecoder) Bytes() []byte {
+	return bcd.data
+}
+
+// ReadRecordAt decodes the record of the given size stored at offset
+func (bcd *BitCaskMmapDecoder) ReadRecordAt(offset int64, size int64) (*Record, error) {
+	if offset < 0 || size < magicSize || offset+size > int64(len(bcd.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
 	buffer := make([]byte, size)
-	reader := bytes.NewReader(bcd.data)
-	reader.ReadAt(buffer, offset)
-	recordMagicNumber := binary.BigEndian.Uint32(buffer[:magicSize])
-	if recordMagicNumber != uint32(magicNumber) {
-		return nil, nil, errInvalidMagicNumber
+	copy(buffer, bcd.data[offset:offset+size])
+	return DecodeRecord(buffer)
+}
+
+// ViewRecordAt decodes the record of the given size stored at offset without
+// copying it: its key and value point into the mapping, which must outlive
+// them, and must not be modified
+func (bcd *BitCaskMmapDecoder) ViewRecordAt(offset int64, size int64) (*Record, error) {
+	if offset < 0 || size < magicSize || offset+size > int64(len(bcd.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return DecodeRecord(bcd.data[offset : offset+size : offset+size])
+}
+
+// Close unmaps the segment
+func (bcd *BitCaskMmapDecoder) Close() error {
+	if bcd.data == nil {
+		return nil
+	}
+	err := bcd.fs.Munmap(bcd.data)
+	bcd.data = nil
+	return err
+}
+
+// DecodeRecord decodes the record held in buffer
+func DecodeRecord(buffer []byte) (*Record, error) {
+	if len(buffer) < magicSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size, err := recordHeaderSize(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if len(buffer) < size {
+		return nil, io.ErrUnexpectedEOF
 	}
-	recordKeyLen := binary.BigEndian.Uint32(buffer[magicSize : magicSize+keySize])
-	recordValueLen := binary.BigEndian.Uint64(buffer[magicSize+keySize:])
-	valueBaseOffset := headerSize + recordKeyLen
-	return buffer[headerSize : headerSize+recordKeyLen], buffer[valueBaseOffset : valueBaseOffset+uint32(recordValueLen)], nil
+	recordKeyLen, recordValueLen := recordLengths(buffer[:size])
+	if uint64(len(buffer)-size) < uint64(recordKeyLen)+recordValueLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	valueBaseOffset := uint64(size) + uint64(recordKeyLen)
+	return newRecord(buffer[:size], buffer[size:valueBaseOffset], buffer[valueBaseOffset:valueBaseOffset+recordValueLen])
+}
+
+// NextRecordOffset returns the first offset from start at which data holds a
+// decodable record, or len(data) when there is none. It allows resuming the
+// decoding after a damaged record. Legacy records have no checksum, so any
+// bytes could pass for one, and they are not resumed on.
+func NextRecordOffset(data []byte, start int64) int64 {
+	magics := make([][]byte, 0, 2)
+	for _, magic := range []uint32{magicNumber, extendedMagicNumber} {
+		buffer := make([]byte, magicSize)
+		binary.BigEndian.PutUint32(buffer, magic)
+		magics = append(magics, buffer)
+	}
+	for start < int64(len(data)) {
+		next := int64(-1)
+		for _, magic := range magics {
+			if i := bytes.Index(data[start:], magic); i >= 0 && (next < 0 || start+int64(i) < next) {
+				next = start + int64(i)
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if _, err := DecodeRecord(data[next:]); err == nil {
+			return next
+		}
+		start = next + 1
+	}
+	return int64(len(data))
+}
+
+// recordHeaderSize returns the header size for the record format identified
+// by the magic number at the start of buffer
+func recordHeaderSize(buffer []byte) (int, error) {
+	switch binary.BigEndian.Uint32(buffer[:magicSize]) {
+	case magicNumber:
+		return headerSize, nil
+	case extendedMagicNumber:
+		return extendedHeaderSize, nil
+	case legacyMagicNumber:
+		return legacyHeaderSize, nil
+	default:
+		return 0, ErrInvalidMagicNumber
+	}
+}
 
+func recordLengths(header []byte) (uint32, uint64) {
+	lengths := header[len(header)-keySize-valueSize:]
+	return binary.BigEndian.Uint32(lengths[:keySize]), binary.BigEndian.Uint64(lengths[keySize:])
+}
+
+func newRecord(header, key, value []byte) (*Record, error) {
+	record := &Record{
+		Key:   key,
+		Value: value,
+		Size:  int64(len(header) + len(key) + len(value)),
+	}
+	if len(header) == legacyHeaderSize {
+		if len(value) == 0 {
+			record.Flags = FlagTombstone
+		}
+		return record, nil
+	}
+	expected := binary.BigEndian.Uint32(header[magicSize:])
+	if checksum(header[magicSize+checksumSize:], key, value) != expected {
+		return nil, ErrChecksumMismatch
+	}
+	record.Flags = Flags(header[magicSize+checksumSize])
+	if len(header) == extendedHeaderSize {
+		record.Keyspace = binary.BigEndian.Uint32(header[magicSize+checksumSize+flagsSize:])
+		record.ExpiresAt = int64(binary.BigEndian.Uint64(header[magicSize+checksumSize+flagsSize+keyspaceSize:]))
+	}
+	return record, nil
+}
+
+// truncated reports a record cut short by the end of the medium
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
@@ -2,11 +2,14 @@ package encoding
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 	"io/ioutil"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 func TestRoundtrip(t *testing.T) {
@@ -89,7 +92,7 @@ func TestMMapRoundtrip(t *testing.T) {
 	}
 	f.Sync()
 	f.Close()
-	decoder := NewBitCaskMmapDecoder(f.Name())
+	decoder := NewBitCaskMmapDecoder(vfs.Default, f.Name())
 	for i, item := range data {
 		loc := recordsLocation[i]
 		key, value, err := decoder.ReadAt(loc.offset, loc.size)
@@ -102,3 +105,149 @@ func TestMMapRoundtrip(t *testing.T) {
 		t.Logf("reading key %s value %s", key, value)
 	}
 }
+
+func TestTombstoneRoundtrip(t *testing.T) {
+	memBuffer := bytes.NewBuffer([]byte{})
+	encoder := NewBitCaskEncoder(memBuffer)
+	_, err := encoder.Write([]byte("1"), []byte{})
+	assert.NoError(t, err)
+	_, err = encoder.WriteTombstone([]byte("1"))
+	assert.NoError(t, err)
+
+	decoder := NewBitCaskDecoder(memBuffer)
+	record, err := decoder.ReadRecord()
+	assert.NoError(t, err)
+	assert.False(t, record.Tombstone())
+	record, err = decoder.ReadRecord()
+	assert.NoError(t, err)
+	assert.True(t, record.Tombstone())
+	_, err = decoder.ReadRecord()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestKeyspaceRoundtrip(t *testing.T) {
+	memBuffer := bytes.NewBuffer([]byte{})
+	encoder := NewBitCaskEncoder(memBuffer)
+	written, err := encoder.WriteRecord(&Record{Key: []byte("1"), Value: []byte("geisha"), Keyspace: 7, ExpiresAt: 42, Flags: FlagCompressed})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(extendedHeaderSize+7), written)
+	written, err = encoder.WriteRecord(&Record{Key: []byte("1"), Value: []byte("bourbon")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(headerSize+8), written)
+
+	data := memBuffer.Bytes()
+	record, err := DecodeRecord(data)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), record.Keyspace)
+	assert.Equal(t, int64(42), record.ExpiresAt)
+	assert.Equal(t, FlagCompressed, record.Flags)
+	assert.True(t, record.Expired(42))
+	assert.False(t, record.Expired(41))
+	assert.Equal(t, int64(extendedHeaderSize+7), NextRecordOffset(data, 1))
+	record, err = DecodeRecord(data[extendedHeaderSize+7:])
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), record.Keyspace)
+	assert.False(t, record.Expired(42))
+
+	// the keyspace is covered by the checksum
+	data[magicSize+checksumSize+flagsSize+keyspaceSize-1] ^= 1
+	_, err = DecodeRecord(data)
+	assert.Equal(t, ErrChecksumMismatch, err)
+}
+
+func TestLegacyRecords(t *testing.T) {
+	legacy := func(key, value string) []byte {
+		buffer := make([]byte, legacyHeaderSize)
+		binary.BigEndian.PutUint32(buffer, legacyMagicNumber)
+		binary.BigEndian.PutUint32(buffer[magicSize:], uint32(len(key)))
+		binary.BigEndian.PutUint64(buffer[magicSize+keySize:], uint64(len(value)))
+		return append(append(buffer, key...), value...)
+	}
+	data := append(legacy("1", "geisha"), legacy("1", "")...)
+
+	decoder := NewBitCaskDecoder(bytes.NewReader(data))
+	record, err := decoder.ReadRecord()
+	assert.NoError(t, err)
+	assert.Equal(t, "geisha", string(record.Value))
+	assert.Equal(t, int64(legacyHeaderSize+7), record.Size)
+	record, err = decoder.ReadRecord()
+	assert.NoError(t, err)
+	assert.True(t, record.Tombstone())
+	// without a checksum, decoding does not resume on them
+	assert.Equal(t, int64(len(data)), NextRecordOffset(data, 0))
+}
+
+func TestCorruptedRecords(t *testing.T) {
+	memBuffer := bytes.NewBuffer([]byte{})
+	encoder := NewBitCaskEncoder(memBuffer)
+	first, _ := encoder.Write([]byte("1"), []byte("geisha"))
+	encoder.Write([]byte("2"), []byte("bourbon"))
+	data := memBuffer.Bytes()
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		corrupted := append([]byte{}, data...)
+		corrupted[first-1] ^= 0xff
+		_, err := DecodeRecord(corrupted)
+		assert.Equal(t, ErrChecksumMismatch, err)
+		assert.Equal(t, first, NextRecordOffset(corrupted, 1))
+	})
+
+	t.Run("invalid magic number", func(t *testing.T) {
+		corrupted := append([]byte{}, data...)
+		corrupted[0] = 0xff
+		_, err := NewBitCaskDecoder(bytes.NewReader(corrupted)).ReadRecord()
+		assert.Equal(t, ErrInvalidMagicNumber, err)
+	})
+
+	t.Run("truncated record", func(t *testing.T) {
+		decoder := NewBitCaskDecoder(bytes.NewReader(data[:len(data)-2]))
+		_, err := decoder.ReadRecord()
+		assert.NoError(t, err)
+		_, err = decoder.ReadRecord()
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+		assert.Equal(t, int64(len(data)-2), NextRecordOffset(data[:len(data)-2], first+1))
+	})
+
+	t.Run("damaged length", func(t *testing.T) {
+		// the value length of the second record ends its header
+		lengths := first + headerSize - valueSize
+		for _, length := range []uint64{binary.BigEndian.Uint64(data[lengths:]) ^ 0xff<<56, 1 << 40} {
+			corrupted := append([]byte{}, data...)
+			binary.BigEndian.PutUint64(corrupted[lengths:], length)
+			decoder := NewBitCaskDecoder(bytes.NewReader(corrupted))
+			_, err := decoder.ReadRecord()
+			assert.NoError(t, err)
+			_, err = decoder.ReadRecord()
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+		}
+	})
+}
+
+// failingWriter fails every write while fail is set
+type failingWriter struct {
+	bytes.Buffer
+	fail bool
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.fail {
+		return 0, errors.New("no space left")
+	}
+	return fw.Buffer.Write(p)
+}
+
+func TestEncoderAfterFailedWrite(t *testing.T) {
+	w := &failingWriter{fail: true}
+	encoder := NewBitCaskEncoder(w)
+	_, err := encoder.Write([]byte("1"), []byte("geisha"))
+	assert.Error(t, err)
+
+	// the failed record is dropped rather than failing the next ones
+	w.fail = false
+	_, err = encoder.Write([]byte("2"), []byte("bourbon"))
+	assert.NoError(t, err)
+	key, value, _, err := NewBitCaskDecoder(&w.Buffer).ReadNext()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), key)
+	assert.Equal(t, []byte("bourbon"), value)
+}
@@ -0,0 +1,53 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+)
+
+// blobRefSize is the size of an encoded BlobRef
+const blobRefSize = 8 + 8 + 8 + 4
+
+// ErrInvalidBlobRef is returned when the value of a blob record is not a BlobRef
+var ErrInvalidBlobRef = errors.New("error due to invalid blob reference")
+
+// BlobRef locates a value stored in a blob file. Blobs belong to the segment
+// active when they were written, and are named after it along with Seq,
+// unique within the segment.
+type BlobRef struct {
+	SegmentID int
+	Seq       int64
+	Size      int64
+	// Checksum is the CRC-32C of the value
+	Checksum uint32
+}
+
+// Encode returns the value of the record referencing the blob
+func (br BlobRef) Encode() []byte {
+	buffer := make([]byte, blobRefSize)
+	binary.BigEndian.PutUint64(buffer, uint64(br.SegmentID))
+	binary.BigEndian.PutUint64(buffer[8:], uint64(br.Seq))
+	binary.BigEndian.PutUint64(buffer[16:], uint64(br.Size))
+	binary.BigEndian.PutUint32(buffer[24:], br.Checksum)
+	return buffer
+}
+
+// DecodeBlobRef decodes the value of a record flagged with FlagBlob
+func DecodeBlobRef(value []byte) (BlobRef, error) {
+	if len(value) != blobRefSize {
+		return BlobRef{}, ErrInvalidBlobRef
+	}
+	return BlobRef{
+		SegmentID: int(binary.BigEndian.Uint64(value)),
+		Seq:       int64(binary.BigEndian.Uint64(value[8:])),
+		Size:      int64(binary.BigEndian.Uint64(value[16:])),
+		Checksum:  binary.BigEndian.Uint32(value[24:]),
+	}, nil
+}
+
+// NewBlobHash returns the hash computing BlobRef.Checksum
+func NewBlobHash() hash.Hash32 {
+	return crc32.New(crcTable)
+}
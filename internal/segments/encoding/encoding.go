@@ -5,16 +5,22 @@ import (
 )
 
 var (
-	errInvalidMagicNumber = errors.New("error due to unexpected record magic number")
-	errSerializingData    = errors.New("error serializing data to underlying medium")
+	// ErrInvalidMagicNumber is returned when a record does not start with a known magic number
+	ErrInvalidMagicNumber = errors.New("error due to unexpected record magic number")
+	// ErrChecksumMismatch is returned when a record does not match its checksum
+	ErrChecksumMismatch = errors.New("error due to record checksum mismatch")
+	errSerializingData  = errors.New("error serializing data to underlying medium")
 )
 
 type Serializable interface {
 	Write(key, value []byte) (int64, error)
+	WriteTombstone(key []byte) (int64, error)
+	WriteRecord(record *Record) (int64, error)
 }
 
 type Deserializable interface {
 	ReadNext() ([]byte, []byte, int64, error)
+	ReadRecord() (*Record, error)
 }
 
 type Serde interface {
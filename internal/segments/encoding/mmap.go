@@ -0,0 +1,32 @@
+package encoding
+
+import (
+	"bytes"
+
+	"pingcap.com/kvs/internal/vfs"
+)
+
+// NewBitCaskMmapDecoder maps the segment stored at filePath from fs, returning
+// nil when it cannot be mapped
+func NewBitCaskMmapDecoder(fs vfs.FS, filePath string) *BitCaskMmapDecoder {
+	f, err := vfs.Open(fs, filePath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	data, err := fs.Mmap(f, int(fi.Size()))
+	if err != nil {
+		return nil
+	}
+	return &BitCaskMmapDecoder{
+		fs:   fs,
+		data: data,
+		BitCaskDecoder: BitCaskDecoder{
+			r: bytes.NewReader(data),
+		},
+	}
+}
@@ -0,0 +1,293 @@
+package segments
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	// hint files written before keyspaces used 0x6b766869, they are rebuilt
+	hintMagicNumber = 0x6b766832
+	// magic, size of the indexed segment and number of entries
+	hintHeaderSize = 4 + 8 + 8
+	// flags, keyspace, key length, record offset and record size
+	hintEntryHeaderSize = 1 + 4 + 4 + 8 + 8
+	hintOffsetSize      = 8
+
+	hintFlagTombstone = 1
+
+	hintSuffix  = ".hint"
+	bloomSuffix = ".bloom"
+	tmpSuffix   = ".tmp"
+)
+
+// IndexEntry locates the latest record of a key within a sealed segment
+type IndexEntry struct {
+	Keyspace  uint32
+	Key       []byte
+	Offset    int64
+	Size      int64
+	Tombstone bool
+}
+
+// less tells whether the entry sorts before the given key
+func (e IndexEntry) less(keyspace uint32, key []byte) bool {
+	if e.Keyspace != keyspace {
+		return e.Keyspace < keyspace
+	}
+	return bytes.Compare(e.Key, key) < 0
+}
+
+// QualifiedKey prefixes key with its keyspace, so keys of distinct keyspaces
+// never collide
+func QualifiedKey(keyspace uint32, key []byte) []byte {
+	return append(appendUint32(make([]byte, 0, 4+len(key)), keyspace), key...)
+}
+
+// SegmentIndex is the on-disk index of a sealed segment. The hint file holds
+// the entries sorted by keyspace and key and is mapped in memory, so lookups only touch
+// the pages they need, while the bloom filter is kept in RAM to discard most
+// lookups of keys the segment does not hold.
+type SegmentIndex struct {
+	fs        vfs.FS
+	segmentID int
+	data      []byte
+	entries   int
+	offsets   []byte
+	bloom     *BloomFilter
+}
+
+// HintPath returns the hint file of the segment stored at segmentPath
+func HintPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, ".dat") + hintSuffix
+}
+
+// BloomPath returns the bloom filter file of the segment stored at segmentPath
+func BloomPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, ".dat") + bloomSuffix
+}
+
+// WriteSegmentIndex persists the hint and bloom filter files of the segment
+// stored at segmentPath in fs. Entries must be sorted by keyspace and key.
+func WriteSegmentIndex(fs vfs.FS, segmentPath string, segmentSize int64, entries []IndexEntry) error {
+	bloom := NewBloomFilter(len(entries))
+	hint := make([]byte, hintHeaderSize)
+	binary.BigEndian.PutUint32(hint, hintMagicNumber)
+	binary.BigEndian.PutUint64(hint[4:], uint64(segmentSize))
+	binary.BigEndian.PutUint64(hint[12:], uint64(len(entries)))
+	offsets := make([]byte, 0, len(entries)*hintOffsetSize)
+	for _, e := range entries {
+		bloom.Add(QualifiedKey(e.Keyspace, e.Key))
+		offsets = appendUint64(offsets, uint64(len(hint)))
+		var flags byte
+		if e.Tombstone {
+			flags |= hintFlagTombstone
+		}
+		hint = append(hint, flags)
+		hint = appendUint32(hint, e.Keyspace)
+		hint = appendUint32(hint, uint32(len(e.Key)))
+		hint = appendUint64(hint, uint64(e.Offset))
+		hint = appendUint64(hint, uint64(e.Size))
+		hint = append(hint, e.Key...)
+	}
+	hint = appendChecksum(append(hint, offsets...))
+
+	bloomData, err := bloom.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(fs, BloomPath(segmentPath), bloomData); err != nil {
+		return err
+	}
+	return writeFileAtomically(fs, HintPath(segmentPath), hint)
+}
+
+// OpenSegmentIndex loads the index of the sealed segment stored at
+// segmentPath in fs, failing when it is missing, damaged or out of date
+func OpenSegmentIndex(fs vfs.FS, segmentPath string, segmentID int) (*SegmentIndex, error) {
+	bloomData, err := vfs.ReadFile(fs, BloomPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	bloom := &BloomFilter{}
+	if err := bloom.UnmarshalBinary(bloomData); err != nil {
+		return nil, fmt.Errorf("error loading bloom filter of %s: %w", segmentPath, err)
+	}
+
+	segmentInfo, err := fs.Stat(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mapFile(fs, HintPath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseHint(data, segmentInfo.Size())
+	if err != nil {
+		fs.Munmap(data)
+		return nil, fmt.Errorf("error loading hint file of %s: %w", segmentPath, err)
+	}
+	index.fs = fs
+	index.segmentID = segmentID
+	index.bloom = bloom
+	return index, nil
+}
+
+func parseHint(data []byte, segmentSize int64) (*SegmentIndex, error) {
+	payload, err := verifyChecksum(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < hintHeaderSize || binary.BigEndian.Uint32(payload) != hintMagicNumber {
+		return nil, errCorruptIndexFile
+	}
+	// the segment was rewritten after the index was written
+	if int64(binary.BigEndian.Uint64(payload[4:])) != segmentSize {
+		return nil, errCorruptIndexFile
+	}
+	entries := binary.BigEndian.Uint64(payload[12:])
+	if entries > uint64(len(payload)-hintHeaderSize)/hintOffsetSize {
+		return nil, errCorruptIndexFile
+	}
+	return &SegmentIndex{
+		data:    payload,
+		entries: int(entries),
+		offsets: payload[len(payload)-int(entries)*hintOffsetSize:],
+	}, nil
+}
+
+// SegmentID returns the ID of the indexed segment
+func (si *SegmentIndex) SegmentID() int {
+	return si.segmentID
+}
+
+// Len returns the number of keys of the segment
+func (si *SegmentIndex) Len() int {
+	return si.entries
+}
+
+// Entry returns the i-th entry in keyspace and key order
+func (si *SegmentIndex) Entry(i int) IndexEntry {
+	offset := binary.BigEndian.Uint64(si.offsets[i*hintOffsetSize:])
+	header := si.data[offset : offset+hintEntryHeaderSize]
+	keyLen := binary.BigEndian.Uint32(header[5:])
+	key := si.data[offset+hintEntryHeaderSize : offset+hintEntryHeaderSize+uint64(keyLen)]
+	return IndexEntry{
+		Keyspace:  binary.BigEndian.Uint32(header[1:]),
+		Key:       key,
+		Offset:    int64(binary.BigEndian.Uint64(header[9:])),
+		Size:      int64(binary.BigEndian.Uint64(header[17:])),
+		Tombstone: header[0]&hintFlagTombstone != 0,
+	}
+}
+
+// MayContain tells whether the segment may hold a record of key within
+// keyspace, without touching the hint file
+func (si *SegmentIndex) MayContain(keyspace uint32, key []byte) bool {
+	return si.bloom.MayContain(QualifiedKey(keyspace, key))
+}
+
+// Lookup returns the latest record of key within keyspace in the segment.
+// The key of the returned entry points into the mapped hint file and must be
+// copied to be kept around.
+func (si *SegmentIndex) Lookup(keyspace uint32, key []byte) (IndexEntry, bool) {
+	if !si.MayContain(keyspace, key) {
+		return IndexEntry{}, false
+	}
+	lo, hi := 0, si.entries
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		entry := si.Entry(mid)
+		if entry.less(keyspace, key) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < si.entries {
+		if entry := si.Entry(lo); entry.Keyspace == keyspace && bytes.Equal(entry.Key, key) {
+			return entry, true
+		}
+	}
+	return IndexEntry{}, false
+}
+
+// ForEach calls fn with every entry in keyspace and key order, stopping at the first error
+func (si *SegmentIndex) ForEach(fn func(IndexEntry) error) error {
+	for i := 0; i < si.entries; i++ {
+		if err := fn(si.Entry(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close unmaps the hint file
+func (si *SegmentIndex) Close() error {
+	// data lost its trailing checksum, but the mapping starts at the same address
+	return si.fs.Munmap(si.data[:cap(si.data)])
+}
+
+// RemoveSegmentIndex deletes the hint and bloom filter files of a segment
+func RemoveSegmentIndex(fs vfs.FS, segmentPath string) error {
+	for _, path := range []string{HintPath(segmentPath), BloomPath(segmentPath)} {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapFile(fs vfs.FS, path string) ([]byte, error) {
+	f, err := vfs.Open(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, errCorruptIndexFile
+	}
+	return fs.Mmap(f, int(info.Size()))
+}
+
+// writeFileAtomically replaces path with data, so readers never see a
+// partially written file
+func writeFileAtomically(fs vfs.FS, path string, data []byte) error {
+	tmp := path + tmpSuffix
+	f, err := vfs.Create(fs, tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, path)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], v)
+	return append(b, buffer[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buffer [8]byte
+	binary.BigEndian.PutUint64(buffer[:], v)
+	return append(b, buffer[:]...)
+}
@@ -0,0 +1,99 @@
+package segments
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	data, err := bf.MarshalBinary()
+	assert.NoError(t, err)
+	loaded := &BloomFilter{}
+	assert.NoError(t, loaded.UnmarshalBinary(data))
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, loaded.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if loaded.MayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 300, "too many false positives: %d", falsePositives)
+
+	data[len(data)-1] ^= 0xff
+	assert.Error(t, loaded.UnmarshalBinary(data))
+}
+
+func TestSegmentIndex(t *testing.T) {
+	path := dummyLogSegment(t, map[string][]byte{
+		"1": []byte("coffee"),
+		"2": []byte("tea"),
+		"3": []byte("nuts"),
+	})
+	defer os.Remove(path)
+	active, err := NewLogSegment(vfs.Default, path, true)
+	assert.NoError(t, err)
+	_, err = active.ReadAll()
+	assert.NoError(t, err)
+	_, err = active.Write([]byte("2"), []byte("mate"))
+	assert.NoError(t, err)
+	assert.NoError(t, active.WriteTombstone([]byte("3")))
+	_, err = active.WriteRecord(&encoding.Record{Keyspace: 3, Key: []byte("2"), Value: []byte("tea")})
+	assert.NoError(t, err)
+	assert.NoError(t, active.Close())
+
+	ls, err := NewLogSegment(vfs.Default, path, false)
+	assert.NoError(t, err)
+	entries, err := ls.Index()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+	assert.NoError(t, WriteSegmentIndex(vfs.Default, path, ls.Size(), entries))
+	defer RemoveSegmentIndex(vfs.Default, path)
+
+	index, err := OpenSegmentIndex(vfs.Default, path, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, index.SegmentID())
+	assert.Equal(t, 4, index.Len())
+
+	e, ok := index.Lookup(0, []byte("2"))
+	assert.True(t, ok)
+	_, value, err := ls.ReadAt(e.Offset, e.Size)
+	assert.NoError(t, err)
+	assert.Equal(t, "mate", string(value))
+	e, ok = index.Lookup(0, []byte("3"))
+	assert.True(t, ok)
+	assert.True(t, e.Tombstone)
+	_, ok = index.Lookup(0, []byte("4"))
+	assert.False(t, ok)
+	e, ok = index.Lookup(3, []byte("2"))
+	assert.True(t, ok)
+	_, value, err = ls.ReadAt(e.Offset, e.Size)
+	assert.NoError(t, err)
+	assert.Equal(t, "tea", string(value))
+	_, ok = index.Lookup(3, []byte("1"))
+	assert.False(t, ok)
+
+	var keys []string
+	assert.NoError(t, index.ForEach(func(e IndexEntry) error {
+		keys = append(keys, string(e.Key))
+		return nil
+	}))
+	assert.Equal(t, []string{"1", "2", "3", "2"}, keys)
+	assert.NoError(t, index.Close())
+
+	// an index written for a different version of the segment is rejected
+	assert.NoError(t, os.Truncate(path, ls.Size()-1))
+	_, err = OpenSegmentIndex(vfs.Default, path, 7)
+	assert.Error(t, err)
+}
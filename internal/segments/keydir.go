@@ -1,11 +1,33 @@
 package segments
 
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// keyDirEntrySize is the size of an encoded KeyDirEntry
+const keyDirEntrySize = 8 + 8 + 8
+
+// ErrInvalidKeyDirEntry is returned when decoding a malformed KeyDirEntry
+var ErrInvalidKeyDirEntry = errors.New("error due to invalid keydir entry")
+
 type KeyDirEntry struct {
 	FileID int
 	Offset int64
 	Size   int64
 }
 
+// KeyDir maps every key to the location of its latest record
+type KeyDir interface {
+	Get(key string) (KeyDirEntry, bool)
+	Put(key string, entry KeyDirEntry)
+	Delete(key string)
+	Len() int
+	// ForEach calls fn for every key until fn returns false
+	ForEach(fn func(key string, entry KeyDirEntry) bool)
+}
+
 type KeyDirTable map[string]*KeyDirEntry
 
 func NewKeyDirEntry(fileID int, offset int64, size int64) *KeyDirEntry {
@@ -15,3 +37,245 @@ func NewKeyDirEntry(fileID int, offset int64, size int64) *KeyDirEntry {
 		Size:   size,
 	}
 }
+
+// Encode returns the entry as stored in the records pointing to another
+// record, such as the values of a value log
+func (e KeyDirEntry) Encode() []byte {
+	buffer := make([]byte, keyDirEntrySize)
+	binary.BigEndian.PutUint64(buffer, uint64(e.FileID))
+	binary.BigEndian.PutUint64(buffer[8:], uint64(e.Offset))
+	binary.BigEndian.PutUint64(buffer[16:], uint64(e.Size))
+	return buffer
+}
+
+// DecodeKeyDirEntry decodes an entry encoded by KeyDirEntry.Encode
+func DecodeKeyDirEntry(data []byte) (KeyDirEntry, error) {
+	if len(data) != keyDirEntrySize {
+		return KeyDirEntry{}, ErrInvalidKeyDirEntry
+	}
+	return KeyDirEntry{
+		FileID: int(binary.BigEndian.Uint64(data)),
+		Offset: int64(binary.BigEndian.Uint64(data[8:])),
+		Size:   int64(binary.BigEndian.Uint64(data[16:])),
+	}, nil
+}
+
+func (kdt KeyDirTable) Get(key string) (KeyDirEntry, bool) {
+	if entry, ok := kdt[key]; ok {
+		return *entry, true
+	}
+	return KeyDirEntry{}, false
+}
+
+func (kdt KeyDirTable) Put(key string, entry KeyDirEntry) {
+	kdt[key] = &entry
+}
+
+func (kdt KeyDirTable) Delete(key string) {
+	delete(kdt, key)
+}
+
+func (kdt KeyDirTable) Len() int {
+	return len(kdt)
+}
+
+func (kdt KeyDirTable) ForEach(fn func(key string, entry KeyDirEntry) bool) {
+	for k, entry := range kdt {
+		if !fn(k, *entry) {
+			return
+		}
+	}
+}
+
+const (
+	compactMinSlots = 16
+	// keys are referenced by a 40 bits arena offset and a 24 bits length
+	compactKeyLenBits = 24
+	compactMaxKeyLen  = 1<<compactKeyLenBits - 1
+	compactMaxArena   = 1 << (64 - compactKeyLenBits)
+)
+
+// compactSlot packs an entry of the CompactKeyDir. A zero hash marks an
+// empty slot.
+type compactSlot struct {
+	hash   uint32
+	fileID uint32
+	offset uint32
+	size   uint32
+	key    uint64
+}
+
+// CompactKeyDir is an open addressing table keeping every key in a single
+// arena and every entry in a packed slot, so it takes a fraction of the
+// memory of a KeyDirTable and holds no pointers for the GC to scan. Entries
+// not fitting in a slot are kept in a regular map.
+type CompactKeyDir struct {
+	slots []compactSlot
+	used  int
+	arena []byte
+	// garbage is the number of arena bytes held by deleted keys
+	garbage  int
+	overflow map[string]KeyDirEntry
+}
+
+func NewCompactKeyDir() *CompactKeyDir {
+	return &CompactKeyDir{
+		slots:    make([]compactSlot, compactMinSlots),
+		overflow: make(map[string]KeyDirEntry),
+	}
+}
+
+func (ckd *CompactKeyDir) Get(key string) (KeyDirEntry, bool) {
+	if i, ok := ckd.find(key, compactHash(key)); ok {
+		s := &ckd.slots[i]
+		return KeyDirEntry{FileID: int(s.fileID), Offset: int64(s.offset), Size: int64(s.size)}, true
+	}
+	if len(ckd.overflow) > 0 {
+		entry, ok := ckd.overflow[key]
+		return entry, ok
+	}
+	return KeyDirEntry{}, false
+}
+
+func (ckd *CompactKeyDir) Put(key string, entry KeyDirEntry) {
+	h := compactHash(key)
+	if !fitsSlot(key, entry) || int64(len(ckd.arena)+len(key)) > compactMaxArena {
+		ckd.deleteSlot(key, h)
+		ckd.overflow[key] = entry
+		return
+	}
+	if len(ckd.overflow) > 0 {
+		delete(ckd.overflow, key)
+	}
+	i, ok := ckd.find(key, h)
+	if !ok {
+		if (ckd.used+1)*4 > len(ckd.slots)*3 {
+			ckd.resize(len(ckd.slots) * 2)
+			i, _ = ckd.find(key, h)
+		}
+		ckd.slots[i] = compactSlot{
+			hash: h,
+			key:  uint64(len(ckd.arena))<<compactKeyLenBits | uint64(len(key)),
+		}
+		ckd.arena = append(ckd.arena, key...)
+		ckd.used++
+	}
+	s := &ckd.slots[i]
+	s.fileID, s.offset, s.size = uint32(entry.FileID), uint32(entry.Offset), uint32(entry.Size)
+}
+
+func (ckd *CompactKeyDir) Delete(key string) {
+	ckd.deleteSlot(key, compactHash(key))
+	if len(ckd.overflow) > 0 {
+		delete(ckd.overflow, key)
+	}
+}
+
+func (ckd *CompactKeyDir) Len() int {
+	return ckd.used + len(ckd.overflow)
+}
+
+func (ckd *CompactKeyDir) ForEach(fn func(key string, entry KeyDirEntry) bool) {
+	for i := range ckd.slots {
+		s := &ckd.slots[i]
+		if s.hash == 0 {
+			continue
+		}
+		entry := KeyDirEntry{FileID: int(s.fileID), Offset: int64(s.offset), Size: int64(s.size)}
+		if !fn(string(ckd.slotKey(s)), entry) {
+			return
+		}
+	}
+	for k, entry := range ckd.overflow {
+		if !fn(k, entry) {
+			return
+		}
+	}
+}
+
+// find returns the slot holding key, or the empty slot it would go to
+func (ckd *CompactKeyDir) find(key string, h uint32) (int, bool) {
+	mask := len(ckd.slots) - 1
+	for i := int(h) & mask; ; i = (i + 1) & mask {
+		s := &ckd.slots[i]
+		if s.hash == 0 {
+			return i, false
+		}
+		if s.hash == h && string(ckd.slotKey(s)) == key {
+			return i, true
+		}
+	}
+}
+
+// deleteSlot empties the slot of key, shifting back the entries that follow
+// it in its probe sequence so lookups never need tombstones
+func (ckd *CompactKeyDir) deleteSlot(key string, h uint32) {
+	i, ok := ckd.find(key, h)
+	if !ok {
+		return
+	}
+	ckd.garbage += int(ckd.slots[i].key & compactMaxKeyLen)
+	ckd.used--
+	mask := len(ckd.slots) - 1
+	for j := (i + 1) & mask; ckd.slots[j].hash != 0; j = (j + 1) & mask {
+		home := int(ckd.slots[j].hash) & mask
+		// the entry at j stays when its home lies cyclically in (i, j]
+		if (i < j && i < home && home <= j) || (j < i && (i < home || home <= j)) {
+			continue
+		}
+		ckd.slots[i] = ckd.slots[j]
+		i = j
+	}
+	ckd.slots[i] = compactSlot{}
+	if ckd.garbage > len(ckd.arena)/2 && ckd.garbage > 1<<20 {
+		ckd.resize(len(ckd.slots))
+	}
+}
+
+// resize rebuilds the table with the given number of slots, dropping the
+// keys deleted from the arena
+func (ckd *CompactKeyDir) resize(slots int) {
+	old, oldArena := ckd.slots, ckd.arena
+	ckd.slots = make([]compactSlot, slots)
+	ckd.arena = make([]byte, 0, len(oldArena)-ckd.garbage)
+	ckd.garbage = 0
+	mask := slots - 1
+	for _, s := range old {
+		if s.hash == 0 {
+			continue
+		}
+		key := oldArena[s.key>>compactKeyLenBits : (s.key>>compactKeyLenBits)+(s.key&compactMaxKeyLen)]
+		i := int(s.hash) & mask
+		for ckd.slots[i].hash != 0 {
+			i = (i + 1) & mask
+		}
+		s.key = uint64(len(ckd.arena))<<compactKeyLenBits | uint64(len(key))
+		ckd.arena = append(ckd.arena, key...)
+		ckd.slots[i] = s
+	}
+}
+
+func (ckd *CompactKeyDir) slotKey(s *compactSlot) []byte {
+	offset := s.key >> compactKeyLenBits
+	return ckd.arena[offset : offset+(s.key&compactMaxKeyLen)]
+}
+
+func fitsSlot(key string, entry KeyDirEntry) bool {
+	return len(key) <= compactMaxKeyLen &&
+		entry.FileID >= 0 && int64(entry.FileID) <= math.MaxUint32 &&
+		entry.Offset >= 0 && entry.Offset <= math.MaxUint32 &&
+		entry.Size >= 0 && entry.Size <= math.MaxUint32
+}
+
+// compactHash is FNV-1a, inlined to avoid allocating on every lookup
+func compactHash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	if h == 0 {
+		return 1
+	}
+	return h
+}
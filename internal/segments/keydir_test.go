@@ -0,0 +1,114 @@
+package segments
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactKeyDir(t *testing.T) {
+	ckd := NewCompactKeyDir()
+	model := make(map[string]KeyDirEntry)
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 200000; i++ {
+		k := strconv.Itoa(rnd.Intn(20000))
+		if rnd.Intn(3) == 0 {
+			ckd.Delete(k)
+			delete(model, k)
+			continue
+		}
+		entry := KeyDirEntry{FileID: rnd.Intn(100), Offset: rnd.Int63n(1 << 20), Size: rnd.Int63n(1 << 10)}
+		ckd.Put(k, entry)
+		model[k] = entry
+	}
+	// entries not fitting in a slot
+	long := strings.Repeat("k", compactMaxKeyLen+1)
+	ckd.Put(long, KeyDirEntry{FileID: 1})
+	model[long] = KeyDirEntry{FileID: 1}
+	ckd.Put("big", KeyDirEntry{FileID: 1, Offset: math.MaxUint32 + 1, Size: 10})
+	model["big"] = KeyDirEntry{FileID: 1, Offset: math.MaxUint32 + 1, Size: 10}
+
+	assert.Equal(t, len(model), ckd.Len())
+	for k, expected := range model {
+		entry, ok := ckd.Get(k)
+		assert.True(t, ok)
+		assert.Equal(t, expected, entry)
+	}
+	seen := 0
+	ckd.ForEach(func(k string, entry KeyDirEntry) bool {
+		assert.Equal(t, model[k], entry)
+		seen++
+		return true
+	})
+	assert.Equal(t, len(model), seen)
+	_, ok := ckd.Get("missing")
+	assert.False(t, ok)
+
+	// deleting most keys compacts the arena
+	for k := range model {
+		ckd.Delete(k)
+	}
+	assert.Equal(t, 0, ckd.Len())
+	assert.True(t, len(ckd.arena) < compactMaxKeyLen)
+}
+
+const keyDirBenchmarkKeys = 10000000
+
+// BenchmarkKeyDirMemory reports the memory taken by every key and the
+// duration of a full GC cycle with 10M keys held by each keydir
+func BenchmarkKeyDirMemory(b *testing.B) {
+	keyDirs := map[string]func() KeyDir{
+		"map":     func() KeyDir { return make(KeyDirTable) },
+		"compact": func() KeyDir { return NewCompactKeyDir() },
+	}
+	for name, newKeyDir := range keyDirs {
+		b.Run(name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				kdt := newKeyDir()
+				for i := 0; i < keyDirBenchmarkKeys; i++ {
+					kdt.Put("key_"+strconv.Itoa(i), KeyDirEntry{FileID: i % 1000, Offset: int64(i), Size: 100})
+				}
+				runtime.GC()
+				start := time.Now()
+				runtime.GC()
+				gc := time.Since(start)
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keyDirBenchmarkKeys, "bytes/key")
+				b.ReportMetric(float64(gc.Microseconds()), "µs/gc")
+				b.ReportMetric(float64(after.PauseNs[(after.NumGC+255)%256]), "ns/pause")
+				runtime.KeepAlive(kdt)
+			}
+		})
+	}
+}
+
+func BenchmarkKeyDirGet(b *testing.B) {
+	keyDirs := map[string]KeyDir{
+		"map":     make(KeyDirTable),
+		"compact": NewCompactKeyDir(),
+	}
+	for name, kdt := range keyDirs {
+		for i := 0; i < 1000000; i++ {
+			kdt.Put("key_"+strconv.Itoa(i), KeyDirEntry{FileID: 1, Offset: int64(i), Size: 100})
+		}
+		keys := make([]string, 1024)
+		for i := range keys {
+			keys[i] = "key_" + strconv.Itoa(rand.Intn(1000000))
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				kdt.Get(keys[n%len(keys)])
+			}
+		})
+	}
+}
@@ -5,120 +5,478 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 var (
 	regexpSegmentNameFormat = regexp.MustCompile(`segment_(\d{5}).dat`)
 	errNoActiveSegment      = errors.New("error rotating non active segment")
+	errSegmentClosed        = errors.New("error reading a closed segment")
 )
 
 const (
 	MaxSegmentSizeBytes = 1 * 1024 * 1024
 )
 
+// CorruptRecordError reports a record of a segment that could not be decoded
+type CorruptRecordError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
+
 type LogSegment struct {
+	fs vfs.FS
 	// read path
 	ra *encoding.BitCaskMmapDecoder
-	r  *os.File
+	r  vfs.File
 	// write path
-	fd      *os.File
+	fd      vfs.File
+	writer  *positionedWriter
 	encoder encoding.Serializable
+	// preallocated is the size reserved for the active segment, whose file
+	// is zero past its last record
+	preallocated int64
 	// other fields
 	path          string
 	segmentSize   int64
+	records       int64
 	segmentID     int
 	activeSegment bool
+	// syncObserver is notified of the latency of every fsync
+	syncObserver func(time.Duration)
+	// mutex guards the mapping of a sealed segment, which is held by every
+	// reader in refs. Idle mappings may be released to stay under budget, and
+	// are mapped again on the next read.
+	mutex      sync.Mutex
+	refs       int32
+	lastAccess uint64
+	budget     *MappingBudget
+	closed     bool
+	// removed segments delete their file once closed and unmapped
+	removed bool
 }
 
-func NewLogSegment(path string, active bool) (*LogSegment, error) {
-	var fd *os.File
-	var r *os.File
+// NewLogSegment opens the segment at path in fs, sealed segments staying
+// mapped until closed
+func NewLogSegment(fs vfs.FS, path string, active bool) (*LogSegment, error) {
+	return OpenLogSegment(fs, path, segmentID(fs, path, active), active, nil)
+}
+
+// OpenLogSegment opens the segment id stored at path in fs, sealed segments
+// sharing budget with the other segments
+func OpenLogSegment(fs vfs.FS, path string, id int, active bool, budget *MappingBudget) (*LogSegment, error) {
+	var fd vfs.File
+	var r vfs.File
 	var err error
 	var ra *encoding.BitCaskMmapDecoder
+	var size int64
 	if active {
-		fd, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
+		// records are written at the end of the last one rather than of the
+		// file, which may be preallocated
+		fd, err = fs.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0755)
 		if err != nil {
 			return nil, fmt.Errorf("error opening active segment for writing: %v", err)
 		}
-		r, err = os.Open(path)
+		r, err = vfs.Open(fs, path)
 		if err != nil {
+			fd.Close()
 			return nil, fmt.Errorf("error opening active segment for reading: %v", err)
 		}
+		info, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			r.Close()
+			return nil, fmt.Errorf("error opening active segment: %v", err)
+		}
+		size = info.Size()
 	} else {
-		ra = encoding.NewBitCaskMmapDecoder(path)
+		ra = encoding.NewBitCaskMmapDecoder(fs, path)
 		if ra == nil {
 			return nil, fmt.Errorf("error opening segment file: %v", err)
 		}
 	}
-	return &LogSegment{
+	writer := &positionedWriter{f: fd}
+	ls := &LogSegment{
+		fs:            fs,
 		ra:            ra,
 		path:          path,
 		fd:            fd,
+		writer:        writer,
 		r:             r,
 		activeSegment: active,
-		encoder:       encoding.NewBitCaskEncoder(fd),
-		segmentID:     SegmentID(path, active),
-	}, nil
+		encoder:       encoding.NewBitCaskEncoder(writer),
+		segmentID:     id,
+		segmentSize:   size,
+		budget:        budget,
+	}
+	if ra != nil {
+		ls.segmentSize = int64(len(ra.Bytes()))
+		unmapIdle(budget.track(ls))
+	} else if ls.segmentSize, err = ls.endOfRecords(size); err != nil {
+		fd.Close()
+		r.Close()
+		return nil, fmt.Errorf("error opening active segment: %v", err)
+	}
+	return ls, nil
+}
+
+// endOfRecords returns the end of the last record of the active segment of
+// size bytes, before the zeros left by preallocation, so that appending
+// right after opening does not leave them in between. Damaged records are
+// left for scan to report, the segment ending with the file until then.
+func (ls *LogSegment) endOfRecords(size int64) (int64, error) {
+	decoder := encoding.NewBitCaskDecoder(io.NewSectionReader(ls.r, 0, size))
+	var offset int64
+	for {
+		record, err := decoder.ReadRecord()
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			break
+		}
+		offset += record.Size
+	}
+	zeroed, err := ls.zeroedFrom(offset)
+	if err != nil {
+		return 0, err
+	}
+	if zeroed {
+		return offset, nil
+	}
+	return size, nil
 }
 
+// ReadAll returns the keydir of the default keyspace of the segment
 func (ls *LogSegment) ReadAll() (*KeyDirTable, error) {
+	kdir := make(KeyDirTable)
+	err := ls.Replay(func(keyspace uint32) KeyDir {
+		if keyspace != 0 {
+			return nil
+		}
+		return kdir
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kdir, nil
+}
+
+// Replay applies every record of the segment to the keydir of its keyspace
+// in log order, dropping the keys removed by tombstones. Records of the
+// keyspaces without keydir are skipped.
+func (ls *LogSegment) Replay(keyDirs func(keyspace uint32) KeyDir) error {
+	return ls.scan(func(offset int64, record *encoding.Record) {
+		kdir := keyDirs(record.Keyspace)
+		if kdir == nil {
+			return
+		}
+		if record.Tombstone() {
+			kdir.Delete(string(record.Key))
+		} else {
+			kdir.Put(string(record.Key), KeyDirEntry{FileID: ls.segmentID, Offset: offset, Size: record.Size})
+		}
+	})
+}
+
+// Index returns the latest record of every key of the segment, tombstones
+// included, sorted by keyspace and key
+func (ls *LogSegment) Index() ([]IndexEntry, error) {
+	latest := make(map[string]IndexEntry)
+	err := ls.scan(func(offset int64, record *encoding.Record) {
+		latest[string(QualifiedKey(record.Keyspace, record.Key))] = IndexEntry{
+			Keyspace:  record.Keyspace,
+			Key:       record.Key,
+			Offset:    offset,
+			Size:      record.Size,
+			Tombstone: record.Tombstone(),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]IndexEntry, 0, len(latest))
+	for _, e := range latest {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].less(entries[j].Keyspace, entries[j].Key)
+	})
+	return entries, nil
+}
+
+// scan calls fn with every record of the segment in log order. The active
+// segment ends with its last record when only zeros follow it.
+func (ls *LogSegment) scan(fn func(offset int64, record *encoding.Record)) error {
 	var decoder encoding.Deserializable
 
 	if ls.activeSegment {
-		decoder = encoding.NewBitCaskDecoder(ls.r)
+		decoder = encoding.NewBitCaskDecoder(io.NewSectionReader(ls.r, 0, math.MaxInt64))
 	} else {
-		decoder = ls.ra
+		if err := ls.Acquire(); err != nil {
+			return err
+		}
+		defer ls.Release()
+		decoder = encoding.NewBitCaskDecoder(bytes.NewReader(ls.ra.Bytes()))
 	}
-	var offset int64
-	kdir := make(KeyDirTable)
+	var offset, records int64
 	for {
-		key, _, bytesRead, err := decoder.ReadNext()
+		record, err := decoder.ReadRecord()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, fmt.Errorf("error reading segment record: %w", err)
+			if ls.activeSegment {
+				zeroed, zeroErr := ls.zeroedFrom(offset)
+				if zeroErr != nil {
+					return zeroErr
+				}
+				if zeroed {
+					break
+				}
+			}
+			return fmt.Errorf("error reading segment record: %w", &CorruptRecordError{Offset: offset, Err: err})
 		}
-		kdir[string(key)] = NewKeyDirEntry(ls.segmentID, offset, bytesRead)
-		offset += bytesRead
+		fn(offset, record)
+		offset += record.Size
+		records++
 	}
 	ls.segmentSize = offset
-	return &kdir, nil
+	ls.records = records
+	return nil
 }
 
-func (ls *LogSegment) ReadAt(offset, n int64) (key []byte, value []byte, err error) {
-	var decoder *encoding.BitCaskDecoder
-	if ls.activeSegment {
-		buffer := make([]byte, n)
-		if _, err := ls.r.ReadAt(buffer, offset); err != nil {
-			return nil, nil, err
+// zeroedFrom tells whether the active segment holds only zeros past offset
+func (ls *LogSegment) zeroedFrom(offset int64) (bool, error) {
+	r := io.NewSectionReader(ls.r, offset, math.MaxInt64)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buffer)
+		if !zeroed(buffer[:n]) {
+			return false, nil
 		}
-		decoder = encoding.NewBitCaskDecoder(bytes.NewReader(buffer))
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
 
-		key, value, _, err = decoder.ReadNext()
-	} else {
-		key, value, err = ls.ra.ReadAt(offset, n)
+func zeroed(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
 	}
+	return true
+}
+
+// TrimPreallocated returns data, the content of an active segment, without
+// the zeros left past its last record by preallocation
+func TrimPreallocated(data []byte) []byte {
+	var offset int64
+	for offset < int64(len(data)) {
+		record, err := encoding.DecodeRecord(data[offset:])
+		if err != nil {
+			break
+		}
+		offset += record.Size
+	}
+	if zeroed(data[offset:]) {
+		return data[:offset]
+	}
+	return data
+}
 
+func (ls *LogSegment) ReadAt(offset, n int64) (key []byte, value []byte, err error) {
+	record, err := ls.ReadRecordAt(offset, n)
 	if err != nil {
 		return nil, nil, err
 	}
+	return record.Key, record.Value, nil
+}
+
+// ReadRecordAt decodes the record of size n stored at offset
+func (ls *LogSegment) ReadRecordAt(offset, n int64) (*encoding.Record, error) {
+	if !ls.activeSegment {
+		var record *encoding.Record
+		err := ls.withMapping(func(ra *encoding.BitCaskMmapDecoder) (err error) {
+			record, err = ra.ReadRecordAt(offset, n)
+			return err
+		})
+		return record, err
+	}
+	buffer := make([]byte, n)
+	if _, err := ls.r.ReadAt(buffer, offset); err != nil {
+		return nil, err
+	}
+	return encoding.DecodeRecord(buffer)
+}
+
+// ViewRecordAt decodes the record of size n stored at offset. The key and
+// value of records of sealed segments point into the mapping, so the caller
+// must hold a reference, and must neither modify them nor use them once the
+// reference is released.
+func (ls *LogSegment) ViewRecordAt(offset, n int64) (*encoding.Record, error) {
+	if !ls.activeSegment {
+		return ls.ra.ViewRecordAt(offset, n)
+	}
+	return ls.ReadRecordAt(offset, n)
+}
+
+// Acquire takes a reference to the mapping of the sealed segment, mapping it
+// again if it was released to stay under budget. It fails once the segment
+// is closed.
+func (ls *LogSegment) Acquire() error {
+	ls.mutex.Lock()
+	if ls.closed {
+		ls.mutex.Unlock()
+		return errSegmentClosed
+	}
+	var idle []*LogSegment
+	if !ls.activeSegment && ls.ra == nil {
+		if ls.ra = encoding.NewBitCaskMmapDecoder(ls.fs, ls.path); ls.ra == nil {
+			ls.mutex.Unlock()
+			return fmt.Errorf("error mapping segment %s", ls.path)
+		}
+		idle = ls.budget.track(ls)
+	}
+	atomic.AddInt32(&ls.refs, 1)
+	atomic.StoreUint64(&ls.lastAccess, ls.budget.tick())
+	ls.mutex.Unlock()
+	unmapIdle(idle)
+	return nil
+}
+
+// Release drops a reference taken by Acquire, unmapping the closed segment
+// with the last one
+func (ls *LogSegment) Release() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	if atomic.AddInt32(&ls.refs, -1) > 0 || !ls.closed {
+		return nil
+	}
+	return ls.releaseLocked()
+}
+
+// withMapping runs fn holding a reference to the mapping of the segment
+func (ls *LogSegment) withMapping(fn func(ra *encoding.BitCaskMmapDecoder) error) (err error) {
+	if err := ls.Acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if releaseErr := ls.Release(); err == nil {
+			err = releaseErr
+		}
+	}()
+	return fn(ls.ra)
+}
 
-	return key, value, nil
+// releaseLocked unmaps the segment, and deletes the file of a closed removed
+// segment
+func (ls *LogSegment) releaseLocked() error {
+	if ls.ra != nil {
+		err := ls.ra.Close()
+		ls.ra = nil
+		ls.budget.untrack(ls)
+		if err != nil {
+			return fmt.Errorf("error unmapping segment %s: %w", ls.path, err)
+		}
+	}
+	if ls.closed && ls.removed {
+		ls.removed = false
+		if err := ls.fs.Remove(ls.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRecordsAt decodes the records located by entries, which must be sorted
+// by offset. Adjacent records are read at once into a shared buffer.
+func (ls *LogSegment) ReadRecordsAt(entries []KeyDirEntry) ([]*encoding.Record, error) {
+	records := make([]*encoding.Record, len(entries))
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[end].Offset <= entries[end-1].Offset+entries[end-1].Size {
+			end++
+		}
+		from := entries[start].Offset
+		to := from
+		for _, entry := range entries[start:end] {
+			if entry.Offset+entry.Size > to {
+				to = entry.Offset + entry.Size
+			}
+		}
+		buffer, err := ls.readRange(from, to-from)
+		if err != nil {
+			return nil, err
+		}
+		for i := start; i < end; i++ {
+			offset := entries[i].Offset - from
+			record, err := encoding.DecodeRecord(buffer[offset : offset+entries[i].Size])
+			if err != nil {
+				return nil, err
+			}
+			records[i] = record
+		}
+		start = end
+	}
+	return records, nil
+}
+
+// readRange returns a copy of the n bytes of the segment found at offset
+func (ls *LogSegment) readRange(offset, n int64) ([]byte, error) {
+	buffer := make([]byte, n)
+	if ls.activeSegment {
+		if _, err := ls.r.ReadAt(buffer, offset); err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	}
+	err := ls.withMapping(func(ra *encoding.BitCaskMmapDecoder) error {
+		data := ra.Bytes()
+		if offset < 0 || offset+n > int64(len(data)) {
+			return io.ErrUnexpectedEOF
+		}
+		copy(buffer, data[offset:offset+n])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
 }
 
 func SegmentID(path string, activeSegment bool) int {
+	return segmentID(vfs.Default, path, activeSegment)
+}
+
+func segmentID(fs vfs.FS, path string, activeSegment bool) int {
 	// for the active segment we calculate the next consecutive ID
 	// based on the datafiles present on the folder
 	if activeSegment {
 		basePath := filepath.Dir(path)
-		segments, err := filepath.Glob(fmt.Sprintf("%s/segment_*.dat", basePath))
+		segments, err := vfs.Glob(fs, fmt.Sprintf("%s/segment_*.dat", basePath))
 		if err != nil {
 			return -1
 		}
@@ -146,30 +504,128 @@ func SegmentID(path string, activeSegment bool) int {
 }
 
 func (ls *LogSegment) Write(key, value []byte) (*KeyDirEntry, error) {
+	return ls.WriteRecord(&encoding.Record{Key: key, Value: value})
+}
+
+// WriteTombstone appends a record removing key
+func (ls *LogSegment) WriteTombstone(key []byte) error {
+	_, err := ls.WriteRecord(&encoding.Record{Key: key, Flags: encoding.FlagTombstone})
+	return err
+}
+
+// WriteRecord appends record and returns its location
+func (ls *LogSegment) WriteRecord(record *encoding.Record) (*KeyDirEntry, error) {
 	offset := ls.segmentSize
-	readBytes, err := ls.encoder.Write(key, value)
+	ls.writer.offset = offset
+	written, err := ls.encoder.WriteRecord(record)
 	if err != nil {
 		return nil, fmt.Errorf("error appending to active segment: %w", err)
 	}
-	ls.segmentSize += readBytes
-	return NewKeyDirEntry(ls.segmentID, offset, readBytes), nil
+	ls.segmentSize += written
+	ls.records++
+	return NewKeyDirEntry(ls.segmentID, offset, written), nil
+}
+
+// Truncate drops every byte past offset from the active segment
+func (ls *LogSegment) Truncate(offset int64) error {
+	if !ls.activeSegment {
+		return errNoActiveSegment
+	}
+	if err := ls.fd.Truncate(offset); err != nil {
+		return fmt.Errorf("error truncating active segment: %w", err)
+	}
+	if ls.preallocated > offset {
+		if err := ls.fd.Allocate(ls.preallocated); err != nil {
+			return fmt.Errorf("error preallocating active segment: %w", err)
+		}
+	}
+	if err := ls.sync(); err != nil {
+		return fmt.Errorf("error syncing with disk: %w", err)
+	}
+	ls.segmentSize = offset
+	return nil
+}
+
+// Preallocate reserves size bytes for the active segment, so that appending
+// to it neither fragments the file nor changes its size. The file reads as
+// zeros past the last record, where scanning the segment stops.
+func (ls *LogSegment) Preallocate(size int64) error {
+	if !ls.activeSegment {
+		return errNoActiveSegment
+	}
+	if err := ls.fd.Allocate(size); err != nil {
+		return fmt.Errorf("error preallocating active segment: %w", err)
+	}
+	ls.preallocated = size
+	return nil
+}
+
+// ObserveSyncs calls fn with the latency of every fsync of the segment
+func (ls *LogSegment) ObserveSyncs(fn func(time.Duration)) {
+	ls.syncObserver = fn
+}
+
+// Sync flushes the writes to the active segment to disk
+func (ls *LogSegment) Sync() error {
+	if !ls.activeSegment {
+		return errNoActiveSegment
+	}
+	return ls.sync()
+}
+
+func (ls *LogSegment) sync() error {
+	start := time.Now()
+	err := ls.fd.Sync()
+	if ls.syncObserver != nil {
+		ls.syncObserver(time.Since(start))
+	}
+	return err
 }
 
 func (ls *LogSegment) Size() int64 {
 	return ls.segmentSize
 }
 
+// Records returns the number of records of the segment, known once it was
+// scanned or for the records written since it was created
+func (ls *LogSegment) Records() int64 {
+	return ls.records
+}
+
+// ID returns the segment ID, which the active segment keeps once sealed
+func (ls *LogSegment) ID() int {
+	return ls.segmentID
+}
+
+// Path returns the file currently backing the segment
+func (ls *LogSegment) Path() string {
+	return ls.path
+}
+
 func (ls *LogSegment) Rotate() (err error) {
+	return ls.RotateTo(filepath.Join(filepath.Dir(ls.path),
+		fmt.Sprintf("segment_%05d.dat", ls.segmentID)))
+}
 
+// RotateTo seals the active segment, moving it to newPath
+func (ls *LogSegment) RotateTo(newPath string) (err error) {
 	if !ls.activeSegment {
 		return errNoActiveSegment
 	}
-	newPath := filepath.Join(filepath.Dir(ls.path),
-		fmt.Sprintf("segment_%05d.dat", ls.segmentID))
 
 	ls.activeSegment = false
 
-	if err = ls.fd.Sync(); err != nil {
+	// sealed segments end with their last record
+	info, err := ls.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > ls.segmentSize {
+		if err = ls.fd.Truncate(ls.segmentSize); err != nil {
+			return err
+		}
+	}
+	if err = ls.sync(); err != nil {
 		return err
 	}
 	if err = ls.fd.Close(); err != nil {
@@ -178,21 +634,39 @@ func (ls *LogSegment) Rotate() (err error) {
 	if err = ls.r.Close(); err != nil {
 		return err
 	}
-	if err = os.Rename(ls.path, newPath); err != nil {
+	if err = ls.fs.Rename(ls.path, newPath); err != nil {
 		return err
 	}
+	ls.path = newPath
 
-	if ls.ra = encoding.NewBitCaskMmapDecoder(newPath); err != nil {
-		return err
+	ls.mutex.Lock()
+	if ls.ra = encoding.NewBitCaskMmapDecoder(ls.fs, newPath); ls.ra == nil {
+		ls.mutex.Unlock()
+		return fmt.Errorf("error mapping sealed segment %s", newPath)
 	}
+	idle := ls.budget.track(ls)
+	ls.mutex.Unlock()
+	unmapIdle(idle)
 
 	return nil
 }
 
+// positionedWriter writes at offset, moving it past the bytes written
+type positionedWriter struct {
+	f      vfs.File
+	offset int64
+}
+
+func (w *positionedWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
 func (ls *LogSegment) Close() error {
 	if ls.activeSegment {
 		// FSync to disk before closing
-		if err := ls.fd.Sync(); err != nil {
+		if err := ls.sync(); err != nil {
 			return fmt.Errorf("error syncing with disk: %w", err)
 		}
 		if err := ls.fd.Close(); err != nil {
@@ -201,6 +675,30 @@ func (ls *LogSegment) Close() error {
 		if err := ls.r.Close(); err != nil {
 			return fmt.Errorf("error closing read only fd: %w", err)
 		}
+		return nil
 	}
-	return nil
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	// the mapping stays until the readers holding it are done
+	if ls.closed {
+		return nil
+	}
+	ls.closed = true
+	if atomic.LoadInt32(&ls.refs) > 0 {
+		return nil
+	}
+	return ls.releaseLocked()
+}
+
+// Remove closes the sealed segment and deletes its file once no reader holds
+// its mapping anymore
+func (ls *LogSegment) Remove() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.closed = true
+	ls.removed = true
+	if atomic.LoadInt32(&ls.refs) > 0 {
+		return nil
+	}
+	return ls.releaseLocked()
 }
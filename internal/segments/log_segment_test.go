@@ -1,11 +1,16 @@
 package segments
 
 import (
+	"errors"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 func dummyLogSegment(t *testing.T, data map[string][]byte) string {
@@ -25,7 +30,7 @@ func TestReadAllSegment(t *testing.T) {
 		"2": []byte("tea"),
 		"3": []byte("nuts"),
 		"4": []byte("pastry")})
-	ls, err := NewLogSegment(tmpSegment, false)
+	ls, err := NewLogSegment(vfs.Default, tmpSegment, false)
 	assert.NoError(t, err)
 
 	kdt, err := ls.ReadAll()
@@ -41,7 +46,7 @@ func TestReadAtSegment(t *testing.T) {
 		"4": []byte("pastry"),
 	}
 	tmpSegment := dummyLogSegment(t, entryExpectedData)
-	ls, err := NewLogSegment(tmpSegment, false)
+	ls, err := NewLogSegment(vfs.Default, tmpSegment, false)
 	assert.NoError(t, err)
 	kdt, err := ls.ReadAll()
 	assert.NoError(t, err)
@@ -53,12 +58,100 @@ func TestReadAtSegment(t *testing.T) {
 	}
 }
 
+func TestReadRecordsAtSegment(t *testing.T) {
+	entryExpectedData := map[string][]byte{
+		"1": []byte("coffee"),
+		"2": []byte("tea"),
+		"3": []byte("nuts"),
+		"4": []byte("pastry"),
+	}
+	tmpSegment := dummyLogSegment(t, entryExpectedData)
+	for _, active := range []bool{false, true} {
+		ls, err := NewLogSegment(vfs.Default, tmpSegment, active)
+		assert.NoError(t, err)
+		kdt, err := ls.ReadAll()
+		assert.NoError(t, err)
+		// adjacent, repeated and distant records
+		keys := []string{"1", "2", "2", "4"}
+		entries := make([]KeyDirEntry, len(keys))
+		for i, k := range keys {
+			entries[i] = *(*kdt)[k]
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+		records, err := ls.ReadRecordsAt(entries)
+		assert.NoError(t, err)
+		for i, record := range records {
+			assert.Equal(t, entries[i].Size, record.Size)
+			assert.Equal(t, entryExpectedData[string(record.Key)], record.Value)
+		}
+		assert.NoError(t, ls.Close())
+	}
+}
+
+func TestSegmentReferences(t *testing.T) {
+	tmpSegment := dummyLogSegment(t, map[string][]byte{"1": []byte("coffee")})
+	ls, err := NewLogSegment(vfs.Default, tmpSegment, false)
+	assert.NoError(t, err)
+	kdt, err := ls.ReadAll()
+	assert.NoError(t, err)
+	entry := (*kdt)["1"]
+
+	assert.NoError(t, ls.Acquire())
+	record, err := ls.ViewRecordAt(entry.Offset, entry.Size)
+	assert.NoError(t, err)
+	// the reader keeps the mapping and the file past the removal
+	assert.NoError(t, ls.Remove())
+	assert.NoError(t, ls.Close())
+	assert.Equal(t, []byte("coffee"), record.Value)
+	assert.FileExists(t, tmpSegment)
+	assert.Equal(t, errSegmentClosed, ls.Acquire())
+	_, err = ls.ReadRecordAt(entry.Offset, entry.Size)
+	assert.Error(t, err)
+	assert.NoError(t, ls.Release())
+	assert.Nil(t, ls.ra)
+	_, err = os.Stat(tmpSegment)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMappingBudget(t *testing.T) {
+	budget := NewMappingBudget(2)
+	var opened []*LogSegment
+	var entries []KeyDirEntry
+	for i := 0; i < 3; i++ {
+		ls, err := OpenLogSegment(vfs.Default, dummyLogSegment(t, map[string][]byte{"1": []byte("coffee")}), i+1, false, budget)
+		assert.NoError(t, err)
+		kdt, err := ls.ReadAll()
+		assert.NoError(t, err)
+		opened = append(opened, ls)
+		entries = append(entries, *(*kdt)["1"])
+	}
+	// the first segment was the least recently read
+	assert.Equal(t, 2, budget.Mapped())
+	assert.Nil(t, opened[0].ra)
+
+	// a held segment is never unmapped
+	assert.NoError(t, opened[1].Acquire())
+	for _, i := range []int{0, 2, 0} {
+		_, value, err := opened[i].ReadAt(entries[i].Offset, entries[i].Size)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("coffee"), value)
+		assert.NotNil(t, opened[1].ra)
+	}
+	assert.Equal(t, 2, budget.Mapped())
+	assert.NoError(t, opened[1].Release())
+
+	for _, ls := range opened {
+		assert.NoError(t, ls.Remove())
+	}
+	assert.Equal(t, 0, budget.Mapped())
+}
+
 func TestAppendToSegment(t *testing.T) {
 	entryExpectedData := map[string][]byte{
 		"1": []byte("coffee"),
 	}
 	tmpSegment := dummyLogSegment(t, entryExpectedData)
-	ls, err := NewLogSegment(tmpSegment, true)
+	ls, err := NewLogSegment(vfs.Default, tmpSegment, true)
 	assert.NoError(t, err)
 	kdt, err := ls.ReadAll()
 	assert.NoError(t, err)
@@ -104,3 +197,84 @@ func TestSegmentID(t *testing.T) {
 		assert.Equal(t, item.expected, SegmentID(item.input, item.active))
 	}
 }
+
+func TestPreallocatedSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "segments_*")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "current.dat")
+	ls, err := NewLogSegment(vfs.Default, path, true)
+	assert.NoError(t, err)
+	assert.NoError(t, ls.Preallocate(MaxSegmentSizeBytes))
+	first, err := ls.Write([]byte("1"), []byte("coffee"))
+	assert.NoError(t, err)
+	// values ending with zeros stay whole
+	second, err := ls.Write([]byte("2"), []byte{0xa, 0, 0})
+	assert.NoError(t, err)
+	assert.NoError(t, ls.Close())
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(MaxSegmentSizeBytes), info.Size())
+
+	// the end of the last record is found again on open, before any scan
+	ls, err = NewLogSegment(vfs.Default, path, true)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Offset+second.Size, ls.Size())
+	kdt, err := ls.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyDirTable{"1": first, "2": second}, *kdt)
+	assert.Equal(t, second.Offset+second.Size, ls.Size())
+	third, err := ls.Write([]byte("3"), []byte("tea"))
+	assert.NoError(t, err)
+	assert.Equal(t, ls.Size()-third.Size, third.Offset)
+	_, v, err := ls.ReadAt(second.Offset, second.Size)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xa, 0, 0}, v)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ls.Size(), int64(len(TrimPreallocated(data))))
+
+	// sealing drops the preallocated tail
+	assert.NoError(t, ls.RotateTo(filepath.Join(dir, "segment_00001.dat")))
+	info, err = os.Stat(ls.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, ls.Size(), info.Size())
+	assert.NoError(t, ls.Close())
+}
+
+func TestPreallocatedSegmentTornWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("/tmp", "segments_*")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "current.dat")
+	ls, err := NewLogSegment(vfs.Default, path, true)
+	assert.NoError(t, err)
+	assert.NoError(t, ls.Preallocate(MaxSegmentSizeBytes))
+	entry, err := ls.Write([]byte("1"), []byte("coffee"))
+	assert.NoError(t, err)
+	assert.NoError(t, ls.Close())
+
+	// a partial record followed by zeros is not the end of the segment
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0755)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xc0, 0xff}, entry.Size)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	ls, err = NewLogSegment(vfs.Default, path, true)
+	assert.NoError(t, err)
+	_, err = ls.ReadAll()
+	var corrupt *CorruptRecordError
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, entry.Size, corrupt.Offset)
+
+	// truncating keeps the segment preallocated
+	assert.NoError(t, ls.Preallocate(MaxSegmentSizeBytes))
+	assert.NoError(t, ls.Truncate(corrupt.Offset))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(MaxSegmentSizeBytes), info.Size())
+	kdt, err := ls.ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, *kdt, 1)
+	assert.NoError(t, ls.Close())
+}
@@ -0,0 +1,93 @@
+package segments
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// MappingBudget bounds the number of sealed segments mapped at once. Once
+// over budget, mapping a segment unmaps the least recently used segments no
+// reader holds, which get mapped again on their next read.
+type MappingBudget struct {
+	mutex  sync.Mutex
+	max    int
+	mapped map[*LogSegment]struct{}
+	// clock orders the accesses to the segments
+	clock uint64
+}
+
+// NewMappingBudget allows max segments to be mapped at once, 0 meaning no limit
+func NewMappingBudget(max int) *MappingBudget {
+	return &MappingBudget{
+		max:    max,
+		mapped: make(map[*LogSegment]struct{}),
+	}
+}
+
+// Mapped returns the number of segments currently mapped
+func (mb *MappingBudget) Mapped() int {
+	if mb == nil {
+		return 0
+	}
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return len(mb.mapped)
+}
+
+func (mb *MappingBudget) tick() uint64 {
+	if mb == nil {
+		return 0
+	}
+	return atomic.AddUint64(&mb.clock, 1)
+}
+
+// track records the mapping of ls and returns the segments to unmap to get
+// back under budget. Segments call it holding their own lock, so the budget
+// never takes the lock of a segment.
+func (mb *MappingBudget) track(ls *LogSegment) []*LogSegment {
+	if mb == nil {
+		return nil
+	}
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	mb.mapped[ls] = struct{}{}
+	excess := len(mb.mapped) - mb.max
+	if mb.max <= 0 || excess <= 0 {
+		return nil
+	}
+	idle := make([]*LogSegment, 0, len(mb.mapped))
+	for s := range mb.mapped {
+		if s != ls && atomic.LoadInt32(&s.refs) == 0 {
+			idle = append(idle, s)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return atomic.LoadUint64(&idle[i].lastAccess) < atomic.LoadUint64(&idle[j].lastAccess)
+	})
+	if len(idle) > excess {
+		idle = idle[:excess]
+	}
+	return idle
+}
+
+func (mb *MappingBudget) untrack(ls *LogSegment) {
+	if mb == nil {
+		return
+	}
+	mb.mutex.Lock()
+	delete(mb.mapped, ls)
+	mb.mutex.Unlock()
+}
+
+// unmapIdle unmaps the given segments unless they got a reader meanwhile
+func unmapIdle(idle []*LogSegment) {
+	for _, ls := range idle {
+		ls.mutex.Lock()
+		if atomic.LoadInt32(&ls.refs) == 0 {
+			// a failed munmap leaks the mapping but does not affect reads
+			ls.releaseLocked()
+		}
+		ls.mutex.Unlock()
+	}
+}
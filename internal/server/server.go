@@ -0,0 +1,258 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"pingcap.com/kvs/internal"
+)
+
+const (
+	keysPrefix = "/keys/"
+	watchPath  = "/watch"
+	backupPath = "/backup"
+)
+
+// Server exposes a KVStore over HTTP:
+//
+//	GET    /keys/<key>  returns the value of key
+//	PUT    /keys/<key>  sets key to the request body
+//	DELETE /keys/<key>  removes key
+//	GET    /watch       streams the changes of the keys as JSON lines, for
+//	                    stores implementing internal.Watchable. The prefix
+//	                    parameter filters the keys, and from=<segment>:<offset>
+//	                    replays the changes following a log position.
+//	POST   /backup      backs the store up into the folder or .tar archive
+//	                    named by the to parameter within the backup folder,
+//	                    once enabled with ServeBackups. incremental=true only
+//	                    copies the segments missing from the previous backup.
+type Server struct {
+	store     internal.KVStore
+	mux       *http.ServeMux
+	backupDir string
+}
+
+func New(store internal.KVStore) *Server {
+	s := &Server{
+		store: store,
+		mux:   http.NewServeMux(),
+	}
+	s.mux.HandleFunc(keysPrefix, s.handleKey)
+	s.mux.HandleFunc(watchPath, s.handleWatch)
+	return s
+}
+
+// Handle registers an additional handler, e.g. for metrics
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeBackups enables the backups of the store into dir, for stores
+// implementing internal.Backuper
+func (s *Server) ServeBackups(dir string) {
+	s.backupDir = dir
+	s.mux.HandleFunc(backupPath, s.handleBackup)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPrefix)
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if streamer, ok := s.store.(internal.Streamer); ok {
+			s.streamValue(w, r, streamer, key)
+			return
+		}
+		value, ok, err := s.store.Get(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(value)
+	case http.MethodPut:
+		var err error
+		if streamer, ok := s.store.(internal.Streamer); ok && r.ContentLength >= 0 {
+			err = streamer.SetReader(key, r.Body, r.ContentLength)
+		} else {
+			var value []byte
+			if value, err = ioutil.ReadAll(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = s.store.Set(key, value)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), writeStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := s.store.Remove(key)
+		if errors.Is(err, internal.ErrDeletingNonExistingKey) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamValue copies the value of key to w without holding it in memory
+func (s *Server) streamValue(w http.ResponseWriter, r *http.Request, streamer internal.Streamer, key string) {
+	value, ok, err := streamer.GetReader(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	defer value.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// the status is sent by now, a failure midway cuts the response short
+	io.Copy(w, value)
+}
+
+// writeStatus maps the error of a write to its HTTP status
+func writeStatus(err error) int {
+	var keyTooLarge *internal.KeyTooLargeError
+	var valueTooLarge *internal.ValueTooLargeError
+	if errors.As(err, &keyTooLarge) || errors.As(err, &valueTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// changeEvent is the JSON form of an internal.ChangeEvent
+type changeEvent struct {
+	Key      string `json:"key"`
+	Op       string `json:"op"`
+	Segment  int    `json:"segment"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Position string `json:"position"`
+}
+
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := s.store.(internal.Watchable)
+	flusher, canFlush := w.(http.Flusher)
+	if !ok || !canFlush {
+		http.Error(w, "watch not supported", http.StatusNotImplemented)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	var watcher *internal.Watcher
+	if from := r.URL.Query().Get("from"); from != "" {
+		position, err := internal.ParseLogPosition(from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if watcher, err = store.WatchFrom(prefix, position); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+	} else {
+		watcher = store.Watch(prefix)
+	}
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-watcher.Events():
+			if !ok {
+				// the client resumes from the position of the last change
+				if err := watcher.Err(); err != nil {
+					encoder.Encode(map[string]string{"error": err.Error()})
+				}
+				return
+			}
+			err := encoder.Encode(changeEvent{
+				Key:      event.Key,
+				Op:       event.Op.String(),
+				Segment:  event.Location.FileID,
+				Offset:   event.Location.Offset,
+				Size:     event.Location.Size,
+				Position: event.Position.String(),
+			})
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// backupResponse is the JSON form of an internal.BackupReport
+type backupResponse struct {
+	Segments int   `json:"segments"`
+	Copied   int   `json:"copied"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := s.store.(internal.Backuper)
+	if !ok {
+		http.Error(w, "backup not supported", http.StatusNotImplemented)
+		return
+	}
+	// backups only go to the backup folder
+	name := r.URL.Query().Get("to")
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		http.Error(w, "invalid backup name", http.StatusBadRequest)
+		return
+	}
+	report, err := store.Backup(filepath.Join(s.backupDir, name), r.URL.Query().Get("incremental") == "true")
+	if errors.Is(err, internal.ErrIncrementalArchive) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backupResponse{
+		Segments: len(report.Manifest.Segments),
+		Copied:   report.Copied,
+		Bytes:    report.Bytes,
+	})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal"
+)
+
+func TestServer(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := internal.OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := httptest.NewServer(New(db))
+	defer srv.Close()
+
+	do := func(method, key, body string) (int, string) {
+		req, err := http.NewRequest(method, srv.URL+"/keys/"+key, strings.NewReader(body))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	status, _ := do(http.MethodGet, "coffee", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = do(http.MethodPut, "coffee", "geisha")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, body := do(http.MethodGet, "coffee", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "geisha", body)
+	status, _ = do(http.MethodDelete, "coffee", "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = do(http.MethodDelete, "coffee", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = do(http.MethodPost, "coffee", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	status, _ = do(http.MethodPut, strings.Repeat("coffee", 20000), "geisha")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
+
+// failingStore fails every removal
+type failingStore struct {
+	internal.KVStore
+}
+
+func (failingStore) Remove(string) error {
+	return errors.New("disk on fire")
+}
+
+func TestServerDeleteError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodDelete, "/keys/coffee", nil)
+	w := httptest.NewRecorder()
+	New(failingStore{}).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "disk on fire")
+}
+
+func TestServerBackup(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	backups, _ := ioutil.TempDir("/tmp", "backup_*")
+	defer os.RemoveAll(backups)
+	db, err := internal.OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Set("coffee", []byte("geisha")))
+	srv := New(db)
+
+	backup := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(method, "/backup?"+query, nil))
+		return w
+	}
+	// backups are disabled until given a folder
+	assert.Equal(t, http.StatusNotFound, backup(http.MethodPost, "to=daily").Code)
+	srv.ServeBackups(backups)
+	assert.Equal(t, http.StatusMethodNotAllowed, backup(http.MethodGet, "to=daily").Code)
+	assert.Equal(t, http.StatusBadRequest, backup(http.MethodPost, "to=../daily").Code)
+	assert.Equal(t, http.StatusBadRequest, backup(http.MethodPost, "to=daily.tar&incremental=true").Code)
+
+	w := backup(http.MethodPost, "to=daily")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report backupResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal(t, 1, report.Segments)
+	_, err = os.Stat(filepath.Join(backups, "daily", "backup.json"))
+	assert.NoError(t, err)
+}
+
+func TestServerWatch(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := internal.OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := httptest.NewServer(New(db))
+	defer srv.Close()
+
+	assert.NoError(t, db.Set("coffee/1", []byte("geisha")))
+	assert.NoError(t, db.Set("tea/1", []byte("sencha")))
+	resp, err := http.Get(srv.URL + "/watch?prefix=coffee/&from=0:0")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, db.Remove("coffee/1"))
+
+	decoder := json.NewDecoder(resp.Body)
+	var events []changeEvent
+	for len(events) < 2 {
+		var event changeEvent
+		assert.NoError(t, decoder.Decode(&event))
+		events = append(events, event)
+	}
+	assert.Equal(t, "coffee/1", events[0].Key)
+	assert.Equal(t, "set", events[0].Op)
+	assert.Equal(t, "remove", events[1].Op)
+
+	resp, err = http.Get(srv.URL + "/watch?from=bourbon")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Get(srv.URL + "/watch?from=42:0")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	shardsFilename    = "shards.json"
+	shardDirectoryFmt = "shard_%03d"
+)
+
+var (
+	errInvalidShardCount  = errors.New("error due to invalid number of shards")
+	errShardCountMismatch = errors.New("error opening store with a different number of shards, reshard it first")
+	errReshardInProgress  = errors.New("error opening store with an unfinished reshard, run reshard again")
+)
+
+// shardLayout is persisted in the base folder of a sharded store
+type shardLayout struct {
+	Shards int `json:"shards"`
+	// ReshardingTo is set while keys are being moved to a new shard count
+	ReshardingTo int `json:"resharding_to,omitempty"`
+}
+
+// ShardedStore spreads keys over several BitCaskStore instances, each one
+// with its own folder, lock and log cleaner, routing them by consistent hashing
+type ShardedStore struct {
+	basePath string
+	lockFile io.Closer
+	shards   []*BitCaskStore
+	ring     *hashRing
+}
+
+// OpenShardedStore opens the sharded store at path. When shards is 0 the
+// number of shards already persisted in path is used. Every shard is opened
+// with opts, its folder living in the FS of opts.
+func OpenShardedStore(path string, shards int, opts ...Option) (*ShardedStore, error) {
+	if shards < 0 {
+		return nil, errInvalidShardCount
+	}
+	fs := newOptions(opts).FS
+	lockFile, err := lockDirectory(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := readShardLayout(fs, path)
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	switch {
+	case layout.ReshardingTo != 0:
+		err = errReshardInProgress
+	case layout.Shards == 0 && shards == 0:
+		err = errInvalidShardCount
+	case layout.Shards == 0:
+		layout.Shards = shards
+		err = writeShardLayout(fs, path, layout)
+	case shards != 0 && layout.Shards != shards:
+		err = fmt.Errorf("%w: found %d, requested %d", errShardCountMismatch, layout.Shards, shards)
+	}
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	stores, err := openShards(fs, path, layout.Shards, opts)
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	return &ShardedStore{
+		basePath: path,
+		lockFile: lockFile,
+		shards:   stores,
+		ring:     newHashRing(layout.Shards),
+	}, nil
+}
+
+func openShards(fs vfs.FS, path string, shards int, opts []Option) ([]*BitCaskStore, error) {
+	stores := make([]*BitCaskStore, 0, shards)
+	for i := 0; i < shards; i++ {
+		store, err := openShard(fs, path, i, opts)
+		if err != nil {
+			closeShards(stores)
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+func openShard(fs vfs.FS, path string, shard int, opts []Option) (*BitCaskStore, error) {
+	shardPath := filepath.Join(path, fmt.Sprintf(shardDirectoryFmt, shard))
+	if err := fs.MkdirAll(shardPath, 0755); err != nil {
+		return nil, fmt.Errorf("error creating shard folder: %w", err)
+	}
+	return OpenBitCaskStore(shardPath, opts...)
+}
+
+func closeShards(stores []*BitCaskStore) error {
+	var firstErr error
+	for _, store := range stores {
+		if err := store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func readShardLayout(fs vfs.FS, path string) (shardLayout, error) {
+	var layout shardLayout
+	data, err := vfs.ReadFile(fs, filepath.Join(path, shardsFilename))
+	if os.IsNotExist(err) {
+		return layout, nil
+	}
+	if err != nil {
+		return layout, fmt.Errorf("error reading shard layout: %w", err)
+	}
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return layout, fmt.Errorf("error decoding shard layout: %w", err)
+	}
+	return layout, nil
+}
+
+// writeShardLayout replaces the layout file atomically
+func writeShardLayout(fs vfs.FS, path string, layout shardLayout) error {
+	data, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(path, shardsFilename+".tmp")
+	f, err := vfs.Create(fs, tmp)
+	if err != nil {
+		return fmt.Errorf("error writing shard layout: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("error writing shard layout: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, filepath.Join(path, shardsFilename)); err != nil {
+		return err
+	}
+	return fs.SyncDir(path)
+}
+
+func (ss *ShardedStore) shardFor(key string) *BitCaskStore {
+	return ss.shards[ss.ring.Locate(key)]
+}
+
+// Set the value of a string key to a string
+func (ss *ShardedStore) Set(key string, value []byte) error {
+	return ss.shardFor(key).Set(key, value)
+}
+
+// SetReader sets key to the size bytes read from r
+func (ss *ShardedStore) SetReader(key string, r io.Reader, size int64) error {
+	return ss.shardFor(key).SetReader(key, r, size)
+}
+
+// checkSize checks the limits of the shard holding key
+func (ss *ShardedStore) checkSize(key string, size int64) error {
+	return ss.shardFor(key).checkSize(key, size)
+}
+
+// SetMany groups pairs by shard and bulk loads each shard
+func (ss *ShardedStore) SetMany(pairs []KeyValue) error {
+	grouped := make([][]KeyValue, len(ss.shards))
+	for _, kv := range pairs {
+		shard := ss.ring.Locate(kv.Key)
+		grouped[shard] = append(grouped[shard], kv)
+	}
+	for i, group := range grouped {
+		if len(group) == 0 {
+			continue
+		}
+		if err := ss.shards[i].SetMany(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the string value of the a string key. If the key does not exist, return nil.
+func (ss *ShardedStore) Get(key string) ([]byte, bool, error) {
+	return ss.shardFor(key).Get(key)
+}
+
+// GetReader returns a reader of the value of key, which the caller must
+// close, and reports whether key exists
+func (ss *ShardedStore) GetReader(key string) (io.ReadCloser, bool, error) {
+	return ss.shardFor(key).GetReader(key)
+}
+
+// View calls fn with the value of key, only valid during the call, and
+// reports whether key exists
+func (ss *ShardedStore) View(key string, fn func(value []byte) error) (bool, error) {
+	return ss.shardFor(key).View(key, fn)
+}
+
+// MultiGet groups keys by shard and reads each shard at once
+func (ss *ShardedStore) MultiGet(keys []string) ([][]byte, []bool, error) {
+	grouped := make([][]int, len(ss.shards))
+	for i, key := range keys {
+		shard := ss.ring.Locate(key)
+		grouped[shard] = append(grouped[shard], i)
+	}
+	values := make([][]byte, len(keys))
+	exists := make([]bool, len(keys))
+	for shard, group := range grouped {
+		if len(group) == 0 {
+			continue
+		}
+		shardKeys := make([]string, len(group))
+		for j, i := range group {
+			shardKeys[j] = keys[i]
+		}
+		shardValues, shardExists, err := ss.shards[shard].MultiGet(shardKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, i := range group {
+			values[i], exists[i] = shardValues[j], shardExists[j]
+		}
+	}
+	return values, exists, nil
+}
+
+// Remove a given key
+func (ss *ShardedStore) Remove(key string) error {
+	return ss.shardFor(key).Remove(key)
+}
+
+// Keys returns a snapshot of the live keys of every shard in ascending order
+func (ss *ShardedStore) Keys() []string {
+	var keys []string
+	ss.mergeShards(func(key string, _ int) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys
+}
+
+// ForEach calls fn for every live key of every shard in ascending order
+func (ss *ShardedStore) ForEach(fn func(key string, value []byte) error) error {
+	return ss.mergeShards(func(key string, shard int) error {
+		value, ok, err := ss.shards[shard].Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+// mergeShards performs a k-way merge over the sorted keys of every shard
+func (ss *ShardedStore) mergeShards(fn func(key string, shard int) error) error {
+	cursors := make(shardCursors, 0, len(ss.shards))
+	for i, shard := range ss.shards {
+		if keys := shard.Keys(); len(keys) > 0 {
+			cursors = append(cursors, &shardCursor{shard: i, keys: keys})
+		}
+	}
+	heap.Init(&cursors)
+	for cursors.Len() > 0 {
+		cursor := cursors[0]
+		if err := fn(cursor.keys[cursor.pos], cursor.shard); err != nil {
+			return err
+		}
+		cursor.pos++
+		if cursor.pos == len(cursor.keys) {
+			heap.Pop(&cursors)
+		} else {
+			heap.Fix(&cursors, 0)
+		}
+	}
+	return nil
+}
+
+// Rotate seals the active segment of every shard holding records
+func (ss *ShardedStore) Rotate() error {
+	for _, shard := range ss.shards {
+		if err := shard.Rotate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact compacts the shards one after the other, returning what each one
+// reclaimed by shard, as segment IDs only make sense within their shard. It
+// stops at the first shard failing, whose result is the last one returned.
+func (ss *ShardedStore) Compact(ctx context.Context) ([]CompactionInfo, error) {
+	infos := make([]CompactionInfo, 0, len(ss.shards))
+	for _, shard := range ss.shards {
+		info, err := shard.Compact(ctx)
+		infos = append(infos, info)
+		if err != nil {
+			return infos, err
+		}
+	}
+	return infos, nil
+}
+
+func (ss *ShardedStore) Close() error {
+	err := closeShards(ss.shards)
+	if lockErr := ss.lockFile.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+type shardCursor struct {
+	shard int
+	keys  []string
+	pos   int
+}
+
+type shardCursors []*shardCursor
+
+func (sc shardCursors) Len() int { return len(sc) }
+func (sc shardCursors) Less(i, j int) bool {
+	return sc[i].keys[sc[i].pos] < sc[j].keys[sc[j].pos]
+}
+func (sc shardCursors) Swap(i, j int)       { sc[i], sc[j] = sc[j], sc[i] }
+func (sc *shardCursors) Push(x interface{}) { *sc = append(*sc, x.(*shardCursor)) }
+func (sc *shardCursors) Pop() interface{} {
+	old := *sc
+	n := len(old)
+	item := old[n-1]
+	*sc = old[:n-1]
+	return item
+}
+
+// Reshard moves the keys of the sharded store at path so they are spread over
+// the given number of shards, opening them with opts. The store must not be
+// open. An interrupted reshard leaves the store unusable until Reshard is run
+// again.
+func Reshard(path string, shards int, opts ...Option) (moved int, err error) {
+	if shards <= 0 {
+		return 0, errInvalidShardCount
+	}
+	fs := newOptions(opts).FS
+	lockFile, err := lockDirectory(fs, path)
+	if err != nil {
+		return 0, err
+	}
+	defer lockFile.Close()
+
+	layout, err := readShardLayout(fs, path)
+	if err != nil {
+		return 0, err
+	}
+	if layout.Shards == 0 {
+		return 0, fmt.Errorf("error resharding %s: not a sharded store", path)
+	}
+	if layout.Shards == shards && layout.ReshardingTo == 0 {
+		return 0, nil
+	}
+
+	// a resumed reshard may still have keys in any of the shards involved
+	existing := layout.Shards
+	if layout.ReshardingTo > existing {
+		existing = layout.ReshardingTo
+	}
+	if shards > existing {
+		existing = shards
+	}
+	layout.ReshardingTo = shards
+	if err := writeShardLayout(fs, path, layout); err != nil {
+		return 0, err
+	}
+
+	stores, err := openShards(fs, path, existing, opts)
+	if err != nil {
+		return 0, err
+	}
+	ring := newHashRing(shards)
+	for i, store := range stores {
+		for _, key := range store.Keys() {
+			target := ring.Locate(key)
+			if target == i {
+				continue
+			}
+			value, ok, err := store.Get(key)
+			if err != nil {
+				closeShards(stores)
+				return moved, err
+			}
+			if !ok {
+				continue
+			}
+			if err := stores[target].Set(key, value); err != nil {
+				closeShards(stores)
+				return moved, err
+			}
+			if err := store.Remove(key); err != nil {
+				closeShards(stores)
+				return moved, err
+			}
+			moved++
+		}
+	}
+	if err := closeShards(stores); err != nil {
+		return moved, err
+	}
+
+	for i := shards; i < existing; i++ {
+		if err := vfs.RemoveAll(fs, filepath.Join(path, fmt.Sprintf(shardDirectoryFmt, i))); err != nil {
+			return moved, fmt.Errorf("error removing drained shard: %w", err)
+		}
+	}
+	return moved, writeShardLayout(fs, path, shardLayout{Shards: shards})
+}
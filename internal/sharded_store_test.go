@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+func TestHashRingDistribution(t *testing.T) {
+	ring := newHashRing(4)
+	owned := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		owned[ring.Locate(strconv.Itoa(i))]++
+	}
+	assert.Len(t, owned, 4)
+	for shard, count := range owned {
+		assert.True(t, count > 1000, "shard %d owns only %d keys", shard, count)
+	}
+}
+
+func TestHashRingStability(t *testing.T) {
+	before := newHashRing(4)
+	after := newHashRing(5)
+	var moved int
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		if before.Locate(key) != after.Locate(key) {
+			moved++
+			// keys only move towards the new shard
+			assert.Equal(t, 4, after.Locate(key))
+		}
+	}
+	assert.True(t, moved < 4000, "too many keys moved: %d", moved)
+}
+
+func TestShardedStore(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+
+	db, err := OpenShardedStore(path, 4)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte(fmt.Sprintf("value %d", i))))
+	}
+	assert.NoError(t, db.Remove("42"))
+
+	_, ok, err := db.Get("42")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	value, ok, err := db.Get("7")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value 7", string(value))
+
+	t.Run("iterate every shard in order", func(t *testing.T) {
+		var keys []string
+		assert.NoError(t, db.ForEach(func(key string, value []byte) error {
+			assert.Equal(t, "value "+key, string(value))
+			keys = append(keys, key)
+			return nil
+		}))
+		assert.Len(t, keys, 99)
+		assert.True(t, sort.StringsAreSorted(keys))
+		assert.Equal(t, keys, db.Keys())
+	})
+
+	t.Run("read keys of every shard at once", func(t *testing.T) {
+		values, exists, err := db.MultiGet([]string{"7", "42", "99", "0"})
+		assert.NoError(t, err)
+		assert.Equal(t, []bool{true, false, true, true}, exists)
+		assert.Equal(t, "value 7", string(values[0]))
+		assert.Equal(t, "value 99", string(values[2]))
+		assert.Equal(t, "value 0", string(values[3]))
+	})
+
+	t.Run("refuse a different number of shards", func(t *testing.T) {
+		assert.NoError(t, db.Close())
+		_, err := OpenShardedStore(path, 8)
+		assert.Error(t, err)
+	})
+
+	t.Run("reopen with the persisted layout", func(t *testing.T) {
+		db, err := OpenShardedStore(path, 0)
+		assert.NoError(t, err)
+		assert.Len(t, db.Keys(), 99)
+		_, ok, _ := db.Get("42")
+		assert.False(t, ok)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestReshard(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+
+	db, err := OpenShardedStore(path, 2)
+	assert.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte(strconv.Itoa(i))))
+	}
+	assert.NoError(t, db.Close())
+
+	for _, shards := range []int{5, 3, 1} {
+		moved, err := Reshard(path, shards)
+		assert.NoError(t, err)
+		assert.True(t, moved > 0)
+
+		db, err := OpenShardedStore(path, shards)
+		assert.NoError(t, err)
+		assert.Len(t, db.Keys(), 500)
+		for i, shard := range db.shards {
+			for _, key := range shard.Keys() {
+				assert.Equal(t, i, db.ring.Locate(key))
+			}
+		}
+		value, ok, err := db.Get("123")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "123", string(value))
+		assert.NoError(t, db.Close())
+	}
+	_, err = os.Stat(fmt.Sprintf("%s/"+shardDirectoryFmt, path, 1))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShardedStoreOptions(t *testing.T) {
+	fs := vfs.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/data", 0755))
+	db, err := OpenShardedStore("/data", 2, WithFS(fs))
+	assert.NoError(t, err)
+	assert.True(t, vfs.Exists(fs, "/data/"+shardsFilename))
+	for version := 0; version < 2; version++ {
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, db.Set(strconv.Itoa(i), []byte(strconv.Itoa(version))))
+		}
+		assert.NoError(t, db.Rotate())
+	}
+	for shard := 0; shard < 2; shard++ {
+		assert.True(t, vfs.Exists(fs, fmt.Sprintf("/data/"+shardDirectoryFmt+"/segment_00002.dat", shard)))
+	}
+
+	t.Run("compaction results by shard", func(t *testing.T) {
+		infos, err := db.Compact(context.Background())
+		assert.NoError(t, err)
+		assert.Len(t, infos, 2)
+		for _, info := range infos {
+			assert.Equal(t, []int{1}, info.Deleted)
+			assert.True(t, info.ReclaimedBytes > 0)
+		}
+	})
+	assert.NoError(t, db.Close())
+
+	moved, err := Reshard("/data", 1, WithFS(fs))
+	assert.NoError(t, err)
+	assert.True(t, moved > 0)
+	assert.False(t, vfs.Exists(fs, fmt.Sprintf("/data/"+shardDirectoryFmt, 1)))
+	db, err = OpenShardedStore("/data", 0, WithFS(fs))
+	assert.NoError(t, err)
+	assert.Len(t, db.Keys(), 20)
+	assert.NoError(t, db.Close())
+}
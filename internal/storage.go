@@ -1,151 +1,938 @@
 package internal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 	"sort"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"pingcap.com/kvs/internal/metrics"
 	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 const (
 	activeSegmentFilename = "current_segment.dat"
 	segmentFilenameFmt    = "segment_%05d.dat"
+	segmentFilenameGlob   = "segment_*.dat"
 )
 
+var errUnknownSegment = errors.New("error reading unknown segment")
+
+// KeyDirs returns the keydir of a keyspace, or nil when the keyspace does not
+// exist, in which case its records are dead
+type KeyDirs func(keyspace uint32) segments.KeyDir
+
+// defaultKeyDirs only knows about the default keyspace
+func defaultKeyDirs(kdt segments.KeyDir) KeyDirs {
+	return func(keyspace uint32) segments.KeyDir {
+		if keyspace != defaultKeyspaceID {
+			return nil
+		}
+		return kdt
+	}
+}
+
 type LogStorage interface {
-	BuildKeyDirTable() (*segments.KeyDirTable, error)
-	ReadKeyDirEntry(entry *segments.KeyDirEntry) ([]byte, error)
-	Append(key []byte, value []byte, kdt *segments.KeyDirTable) error
+	// BuildKeyDirTable builds the keydir of the default keyspace
+	BuildKeyDirTable() (*stripedKeyDir, error)
+	// BuildKeyDirs builds the keydir of every given keyspace, skipping the
+	// records of the others
+	BuildKeyDirs(keyspaces []uint32) (map[uint32]*stripedKeyDir, error)
+	// NewKeyDir returns an empty keydir of the configured kind
+	NewKeyDir() *stripedKeyDir
+	ReadKeyDirEntry(entry segments.KeyDirEntry) ([]byte, error)
+	// ReadRecord decodes the record located by entry
+	ReadRecord(entry segments.KeyDirEntry) (*encoding.Record, error)
+	// ViewRecord decodes the record located by entry without copying it out
+	// of a sealed segment, whose mapping is kept until release is called
+	ViewRecord(entry segments.KeyDirEntry) (record *encoding.Record, release func(), err error)
+	// ReadRecords decodes the records located by entries, returned in the
+	// same order, reading each segment once in ascending offsets
+	ReadRecords(entries []segments.KeyDirEntry) ([]*encoding.Record, error)
+	Append(key []byte, value []byte, kdt segments.KeyDir) error
+	AppendTombstone(key []byte, kdt segments.KeyDir) error
+	// AppendRecord appends record, updates kdt, the keydir of its keyspace,
+	// and returns the location of the record
+	AppendRecord(record *encoding.Record, kdt segments.KeyDir) (segments.KeyDirEntry, error)
+	// AppendBlob moves the staged blob into the store and appends record,
+	// setting its value to the reference to the blob
+	AppendBlob(record *encoding.Record, blob *stagedBlob, kdt segments.KeyDir) (segments.KeyDirEntry, error)
+	// AppendValue appends the value record of a key/value separated write to
+	// the value log and returns its location
+	AppendValue(record *encoding.Record) (segments.KeyDirEntry, error)
+	// ReadValue decodes the value record located by entry
+	ReadValue(entry segments.KeyDirEntry) (*encoding.Record, error)
+	// SealedValueLogs returns the IDs and sizes of the sealed value log files
+	SealedValueLogs() ([]int, map[int]int64)
+	// ValueLogIndex returns the latest value record of every key of a sealed
+	// value log file
+	ValueLogIndex(id int) ([]segments.IndexEntry, error)
+	// DropValueLogs forgets the given sealed value log files
+	DropValueLogs(ids []int) error
+	// Sync makes the writes to the active segment and value log durable
+	Sync() error
+	// ReadLog returns a reader of the records from position from up to the
+	// current end of the log
+	ReadLog(from LogPosition) (*logReader, error)
+	Seal() (map[int]string, error)
+	// Rotate seals the active segment unless it is empty, and RotateIfDue
+	// only when the rotation policy says so. Both tell whether they did.
+	Rotate() (bool, error)
+	RotateIfDue() (bool, error)
+	// Lookup finds key of keyspace in the indexes of the sealed segments, for
+	// stores keeping only the keys of the active segment in memory
+	Lookup(keyspace uint32, key []byte) (segments.KeyDirEntry, bool)
+	// LiveKeys returns every live key of keyspace, given its keydir
+	LiveKeys(keyspace uint32, kdt segments.KeyDir) []string
+	// ReclaimableSegments returns the sealed segments that can be deleted
+	// without losing any live record or resurrecting any removed key
+	ReclaimableSegments(keyDirs KeyDirs) []int
+	// DropSegments forgets the given sealed segments, whose files are deleted
+	// once no reader holds them anymore
+	DropSegments(ids []int) error
+	// IndexedSegments returns the sealed segments whose index is loaded,
+	// along with the generation returned by IndexGeneration
+	IndexedSegments() (map[int]bool, uint64)
+	// IndexGeneration changes every time a sealed segment gets its index
+	IndexGeneration() uint64
 	Close() error
 }
 
+// logBasedStorage expects its writes to be serialised by the caller. Its own
+// lock guards the segments, indexes and tombstones against concurrent reads.
 type logBasedStorage struct {
+	mutex          sync.RWMutex
 	dataFiles      map[int]*segments.LogSegment
 	currentSegment *segments.LogSegment
-	basePath       string
-	threshold      int
+	// mappings bounds the sealed segments mapped at once
+	mappings *segments.MappingBudget
+	// manifest records the live segments and allocates their IDs
+	manifest *manifest
+	// value log files of the stores separating the values from the keys
+	valueLogs      map[int]*segments.LogSegment
+	activeValueLog *segments.LogSegment
+	// indexes of the sealed segments, whose IDs are kept in ascending order
+	indexes   map[int]*segments.SegmentIndex
+	sealedIDs []int
+	// diskIndex keeps only the keys of the active segment in the keydir,
+	// along with the keys removed since it was opened
+	diskIndex     bool
+	compactKeyDir bool
+	// preallocate reserves the size of a full segment for the active files,
+	// and syncWrites syncs them after every append
+	preallocate bool
+	syncWrites  bool
+	// rotation decides when the active segment is sealed, activeSince being
+	// when it got its first record according to clock
+	rotation    RotationPolicy
+	activeSince time.Time
+	clock       Clock
+	tombstones  map[string]struct{}
+	generation  uint64
+	fs          vfs.FS
+	basePath    string
+	threshold   int
+	metrics     metrics.Metrics
+	logger      Logger
+	events      EventListener
 }
 
-func NewLogBasedStorage(path string) (*logBasedStorage, error) {
-	var currentSegment *segments.LogSegment
+func NewLogBasedStorage(path string, opts ...Option) (_ *logBasedStorage, err error) {
+	options := newOptions(opts)
+	rotation := options.RotationPolicy
+	if rotation == nil {
+		rotation = SizeRotation(segments.MaxSegmentSizeBytes)
+	}
+	if _, err := options.FS.ReadDir(path); err != nil {
+		return nil, fmt.Errorf("error opening keydir folder: %v", err)
+	}
 
-	files, err := ioutil.ReadDir(path)
+	manifest, err := openManifest(options.FS, path, options.Logger)
 	if err != nil {
-		return nil, fmt.Errorf("error opening keydir folder: %v", err)
+		return nil, err
 	}
+	lbs := &logBasedStorage{
+		dataFiles:     make(map[int]*segments.LogSegment, len(manifest.segments)),
+		mappings:      segments.NewMappingBudget(options.MaxMappedSegments),
+		manifest:      manifest,
+		indexes:       make(map[int]*segments.SegmentIndex, len(manifest.segments)),
+		valueLogs:     make(map[int]*segments.LogSegment, len(manifest.valueLogs)),
+		diskIndex:     options.DiskIndex,
+		compactKeyDir: options.CompactKeyDir,
+		preallocate:   options.Preallocate,
+		syncWrites:    options.SyncWrites,
+		rotation:      rotation,
+		clock:         options.Clock,
+		tombstones:    make(map[string]struct{}),
+		fs:            options.FS,
+		basePath:      path,
+		metrics:       options.Metrics,
+		logger:        options.Logger,
+		events:        options.Events,
+	}
+	// whatever was opened is closed when a later step fails
+	defer func() {
+		if err != nil {
+			lbs.Close()
+		}
+	}()
+	for id := range manifest.segments {
+		fullPath := filepath.Join(path, fmt.Sprintf(segmentFilenameFmt, id))
+		segment, err := segments.OpenLogSegment(options.FS, fullPath, id, false, lbs.mappings)
+		if err != nil {
+			return nil, fmt.Errorf("error creating log segment for %s: %v", path, err)
+		}
+		lbs.dataFiles[id] = segment
+		lbs.sealedIDs = append(lbs.sealedIDs, id)
+	}
+	sort.Ints(lbs.sealedIDs)
+	for _, id := range lbs.sealedIDs {
+		index, err := lbs.openIndex(id, lbs.dataFiles[id])
+		if err != nil {
+			return nil, err
+		}
+		lbs.indexes[id] = index
+	}
+	if err := lbs.openActiveSegment(); err != nil {
+		return nil, err
+	}
+	if err := lbs.openValueLogs(); err != nil {
+		return nil, err
+	}
+	return lbs, nil
+}
 
-	var active bool
-	dataFiles := make(map[int]*segments.LogSegment, len(files))
-	for _, f := range files {
-		if !f.IsDir() && !strings.Contains(f.Name(), lockFilename) {
-			if f.Name() == activeSegmentFilename {
-				active = true
-			}
-			fullPath := filepath.Join(path, f.Name())
-			segment, err := segments.NewLogSegment(fullPath, active)
-			if err != nil {
-				return nil, fmt.Errorf("error creating log segment for %s: %v", path, err)
-			}
-			segmentID := segments.SegmentID(fullPath, active)
-			dataFiles[segmentID] = segment
+// openIndex opens the index of a sealed segment, writing it first when it is
+// missing or out of date
+func (lbs *logBasedStorage) openIndex(id int, segment *segments.LogSegment) (*segments.SegmentIndex, error) {
+	index, err := segments.OpenSegmentIndex(lbs.fs, segment.Path(), id)
+	if err == nil {
+		return index, nil
+	}
+	entries, err := segment.Index()
+	if err != nil {
+		return nil, fmt.Errorf("error indexing segment %s: %w", segment.Path(), err)
+	}
+	if err := segments.WriteSegmentIndex(lbs.fs, segment.Path(), segment.Size(), entries); err != nil {
+		return nil, fmt.Errorf("error writing index of segment %s: %w", segment.Path(), err)
+	}
+	return segments.OpenSegmentIndex(lbs.fs, segment.Path(), id)
+}
+
+func (lbs *logBasedStorage) openActiveSegment() error {
+	fullPath := filepath.Join(lbs.basePath, activeSegmentFilename)
+	active, err := segments.OpenLogSegment(lbs.fs, fullPath, lbs.manifest.active, true, lbs.mappings)
+	if err != nil {
+		return fmt.Errorf("error opening active segment: %v", err)
+	}
+	if lbs.preallocate {
+		if err := active.Preallocate(segments.MaxSegmentSizeBytes); err != nil {
+			active.Close()
+			return err
 		}
 	}
+	// the records synced to a new segment are lost along with its file
+	// unless the folder is synced too
+	if err := lbs.fs.SyncDir(lbs.basePath); err != nil {
+		active.Close()
+		return err
+	}
+	active.ObserveSyncs(lbs.metrics.ObserveFsync)
+	lbs.currentSegment = active
+	lbs.activeSince = lbs.clock.Now()
+	lbs.metrics.SetOpenSegments(len(lbs.dataFiles)+1, lbs.mappings.Mapped())
+	return nil
+}
 
-	// No active segment exists
-	if len(dataFiles) == 0 || !active {
-		fullPath := filepath.Join(path, activeSegmentFilename)
-		currentSegment, err = segments.NewLogSegment(fullPath, true)
-		if err != nil {
-			return nil, fmt.Errorf("error opening active segment: %v", err)
+func (lbs *logBasedStorage) BuildKeyDirTable() (*stripedKeyDir, error) {
+	kdts, err := lbs.BuildKeyDirs([]uint32{defaultKeyspaceID})
+	if err != nil {
+		return nil, err
+	}
+	return kdts[defaultKeyspaceID], nil
+}
+
+func (lbs *logBasedStorage) BuildKeyDirs(keyspaces []uint32) (map[uint32]*stripedKeyDir, error) {
+	kdts := make(map[uint32]*stripedKeyDir, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		kdts[keyspace] = lbs.NewKeyDir()
+	}
+	keyDirs := func(keyspace uint32) segments.KeyDir {
+		if kdt, ok := kdts[keyspace]; ok {
+			return kdt
+		}
+		return nil
+	}
+	if !lbs.diskIndex {
+		// hint files hold the latest record of every key of their segment,
+		// so replaying them in segment order rebuilds the keydir
+		for _, id := range lbs.sealedIDs {
+			lbs.indexes[id].ForEach(func(e segments.IndexEntry) error {
+				kdt := keyDirs(e.Keyspace)
+				if kdt == nil {
+					return nil
+				}
+				if e.Tombstone {
+					kdt.Delete(string(e.Key))
+				} else {
+					kdt.Put(string(e.Key), segments.KeyDirEntry{FileID: id, Offset: e.Offset, Size: e.Size})
+				}
+				return nil
+			})
+		}
+	}
+	// the active segment holds the most recent records
+	if err := lbs.replayActiveSegment(keyDirs); err != nil {
+		if err := lbs.recoverActiveSegment(err); err != nil {
+			return nil, fmt.Errorf("error building key dir table: %w", err)
+		}
+		// replay the records kept by the recovery
+		if err := lbs.replayActiveSegment(keyDirs); err != nil {
+			return nil, fmt.Errorf("error building key dir table: %w", err)
 		}
 	}
-	return &logBasedStorage{
-		dataFiles:      dataFiles,
-		currentSegment: currentSegment,
-		basePath:       path,
-	}, nil
+	return kdts, nil
+}
+
+func (lbs *logBasedStorage) NewKeyDir() *stripedKeyDir {
+	return newStripedKeyDir(func() segments.KeyDir {
+		if lbs.compactKeyDir {
+			return segments.NewCompactKeyDir()
+		}
+		return make(segments.KeyDirTable)
+	})
 }
 
-func mergeTables(kdtSrc, kdtTgt segments.KeyDirTable) *segments.KeyDirTable {
-	if kdtSrc == nil {
-		return &kdtTgt
+// replayActiveSegment applies the records of the active segment to the
+// keydirs. With a disk index the removed keys are remembered, as they may
+// still be found in the indexes of the sealed segments.
+func (lbs *logBasedStorage) replayActiveSegment(keyDirs KeyDirs) error {
+	if !lbs.diskIndex {
+		return lbs.currentSegment.Replay(keyDirs)
 	}
-	if kdtTgt == nil {
-		return &kdtSrc
+	entries, err := lbs.currentSegment.Index()
+	if err != nil {
+		return err
 	}
-	for k, v := range kdtSrc {
-		kdtTgt[k] = v
+	id := lbs.currentSegment.ID()
+	for _, e := range entries {
+		kdt := keyDirs(e.Keyspace)
+		if kdt == nil {
+			continue
+		}
+		if e.Tombstone {
+			lbs.tombstones[string(segments.QualifiedKey(e.Keyspace, e.Key))] = struct{}{}
+		} else {
+			kdt.Put(string(e.Key), segments.KeyDirEntry{FileID: id, Offset: e.Offset, Size: e.Size})
+		}
 	}
-	return &kdtTgt
+	return nil
 }
 
-func (lbs *logBasedStorage) BuildKeyDirTable() (*segments.KeyDirTable, error) {
+// recoverActiveSegment drops the damaged tail left in the active segment by
+// a crash in the middle of a write. The records before it are kept. A damaged
+// record followed by valid ones is not a torn write, and is left to repair.
+func (lbs *logBasedStorage) recoverActiveSegment(replayErr error) error {
+	var corrupt *segments.CorruptRecordError
+	if !errors.As(replayErr, &corrupt) {
+		return replayErr
+	}
+	path := lbs.currentSegment.Path()
+	data, err := vfs.ReadFile(lbs.fs, path)
+	if err != nil {
+		return err
+	}
+	if !tornTail(data, corrupt.Offset) {
+		return fmt.Errorf("%w: valid records follow it in %s, run kvs verify --repair", corrupt, path)
+	}
+	err = lbs.currentSegment.Truncate(corrupt.Offset)
+	lbs.events.recoveryTruncate(RecoveryTruncateInfo{
+		Path:    path,
+		Offset:  corrupt.Offset,
+		Dropped: int64(len(data)) - corrupt.Offset,
+		Err:     err,
+	})
+	if err != nil {
+		return err
+	}
+	lbs.logger.Warnf("dropped %d bytes from %s after %v", int64(len(data))-corrupt.Offset, path, corrupt)
+	return nil
+}
 
-	keys := make([]int, 0, len(lbs.dataFiles))
-	for k := range lbs.dataFiles {
-		keys = append(keys, k)
+// tornTail tells whether the damaged record at offset ends data, as left by
+// a crash in the middle of a write, rather than being followed by records
+// decoding one after the other up to the end of data. Bytes of values that
+// happen to look like a record are not followed by such records.
+func tornTail(data []byte, offset int64) bool {
+	next := encoding.NextRecordOffset(data, offset+1)
+	for next < int64(len(data)) {
+		if decodesToEnd(data, next) {
+			return false
+		}
+		next = encoding.NextRecordOffset(data, next+1)
 	}
-	sort.Ints(keys)
+	return true
+}
 
-	kdt := make(segments.KeyDirTable)
-	for _, k := range keys {
-		kdtTmp, err := lbs.dataFiles[k].ReadAll()
+// decodesToEnd tells whether data holds records from offset to its end, or
+// to the zeros preallocated after its last record
+func decodesToEnd(data []byte, offset int64) bool {
+	for offset < int64(len(data)) {
+		record, err := encoding.DecodeRecord(data[offset:])
 		if err != nil {
-			return nil, fmt.Errorf("error building key dir table: %w", err)
+			return len(bytes.TrimRight(data[offset:], "\x00")) == 0
 		}
-		kdt = *mergeTables(*kdtTmp, kdt)
+		offset += record.Size
 	}
+	return true
+}
 
-	return &kdt, nil
+func (lbs *logBasedStorage) ReadKeyDirEntry(entry segments.KeyDirEntry) ([]byte, error) {
+	record, err := lbs.ReadRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
 }
 
-func (lbs *logBasedStorage) ReadKeyDirEntry(entry *segments.KeyDirEntry) (value []byte, err error) {
+func (lbs *logBasedStorage) ReadRecord(entry segments.KeyDirEntry) (*encoding.Record, error) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
 	if segment, ok := lbs.dataFiles[entry.FileID]; ok {
-		_, value, err = segment.ReadAt(entry.Offset, entry.Size)
-	} else {
-		_, value, err = lbs.currentSegment.ReadAt(entry.Offset, entry.Size)
+		return segment.ReadRecordAt(entry.Offset, entry.Size)
+	} else if entry.FileID == lbs.currentSegment.ID() {
+		return lbs.currentSegment.ReadRecordAt(entry.Offset, entry.Size)
 	}
+	return nil, fmt.Errorf("%w: %d", errUnknownSegment, entry.FileID)
+}
 
-	return value, err
+func (lbs *logBasedStorage) ViewRecord(entry segments.KeyDirEntry) (*encoding.Record, func(), error) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	segment, ok := lbs.dataFiles[entry.FileID]
+	if !ok {
+		if entry.FileID != lbs.currentSegment.ID() {
+			return nil, nil, fmt.Errorf("%w: %d", errUnknownSegment, entry.FileID)
+		}
+		// records of the active segment are copied, it has no mapping
+		record, err := lbs.currentSegment.ReadRecordAt(entry.Offset, entry.Size)
+		return record, func() {}, err
+	}
+	if err := segment.Acquire(); err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		if err := segment.Release(); err != nil {
+			lbs.logger.Errorf("error unmapping segment %d: %v", entry.FileID, err)
+		}
+	}
+	record, err := segment.ViewRecordAt(entry.Offset, entry.Size)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return record, release, nil
 }
 
-func (lbs *logBasedStorage) Append(key []byte, value []byte, kdt *segments.KeyDirTable) error {
-	if lbs.currentSegment.Size() > segments.MaxSegmentSizeBytes {
-		if err := lbs.rotateSegments(); err != nil {
-			return err
+func (lbs *logBasedStorage) ReadRecords(entries []segments.KeyDirEntry) ([]*encoding.Record, error) {
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := entries[order[i]], entries[order[j]]
+		return a.FileID < b.FileID || a.FileID == b.FileID && a.Offset < b.Offset
+	})
+	records := make([]*encoding.Record, len(entries))
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	for start := 0; start < len(order); {
+		fileID := entries[order[start]].FileID
+		end := start
+		for end < len(order) && entries[order[end]].FileID == fileID {
+			end++
+		}
+		segment, ok := lbs.dataFiles[fileID]
+		if !ok && fileID == lbs.currentSegment.ID() {
+			segment, ok = lbs.currentSegment, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", errUnknownSegment, fileID)
+		}
+		group := make([]segments.KeyDirEntry, end-start)
+		for i, j := range order[start:end] {
+			group[i] = entries[j]
+		}
+		read, err := segment.ReadRecordsAt(group)
+		if err != nil {
+			return nil, err
+		}
+		for i, j := range order[start:end] {
+			records[j] = read[i]
+		}
+		start = end
+	}
+	return records, nil
+}
+
+func (lbs *logBasedStorage) Append(key []byte, value []byte, kdt segments.KeyDir) error {
+	_, err := lbs.AppendRecord(&encoding.Record{Key: key, Value: value}, kdt)
+	return err
+}
+
+func (lbs *logBasedStorage) AppendTombstone(key []byte, kdt segments.KeyDir) error {
+	_, err := lbs.AppendRecord(&encoding.Record{Key: key, Flags: encoding.FlagTombstone}, kdt)
+	return err
+}
+
+func (lbs *logBasedStorage) Rotate() (bool, error) {
+	if lbs.currentSegment.Size() == 0 {
+		return false, nil
+	}
+	return true, lbs.rotateSegments()
+}
+
+func (lbs *logBasedStorage) RotateIfDue() (bool, error) {
+	active := ActiveSegment{
+		Size:    lbs.currentSegment.Size(),
+		Records: lbs.currentSegment.Records(),
+		Since:   lbs.activeSince,
+	}
+	if active.Size == 0 || !lbs.rotation.ShouldRotate(active, lbs.clock.Now()) {
+		return false, nil
+	}
+	return true, lbs.rotateSegments()
+}
+
+func (lbs *logBasedStorage) AppendRecord(record *encoding.Record, kdt segments.KeyDir) (segments.KeyDirEntry, error) {
+	if _, err := lbs.RotateIfDue(); err != nil {
+		return segments.KeyDirEntry{}, err
+	}
+	return lbs.appendRecord(record, kdt)
+}
+
+// appendRecord appends record to the active segment without rotating it
+func (lbs *logBasedStorage) appendRecord(record *encoding.Record, kdt segments.KeyDir) (segments.KeyDirEntry, error) {
+	kde, err := lbs.currentSegment.WriteRecord(record)
+	if err != nil {
+		return segments.KeyDirEntry{}, err
+	}
+	if lbs.currentSegment.Records() == 1 {
+		lbs.activeSince = lbs.clock.Now()
+	}
+	if lbs.syncWrites {
+		if err := lbs.currentSegment.Sync(); err != nil {
+			return segments.KeyDirEntry{}, fmt.Errorf("error syncing active segment: %w", err)
+		}
+	}
+	lbs.metrics.AddBytesAppended(kde.Size)
+	key := string(record.Key)
+	if record.Tombstone() {
+		kdt.Delete(key)
+		if lbs.diskIndex {
+			lbs.mutex.Lock()
+			lbs.tombstones[string(segments.QualifiedKey(record.Keyspace, record.Key))] = struct{}{}
+			lbs.mutex.Unlock()
 		}
+		return *kde, nil
+	}
+	kdt.Put(key, *kde)
+	lbs.mutex.Lock()
+	if len(lbs.tombstones) > 0 {
+		delete(lbs.tombstones, string(segments.QualifiedKey(record.Keyspace, record.Key)))
+	}
+	lbs.mutex.Unlock()
+	return *kde, nil
+}
+
+func (lbs *logBasedStorage) AppendBlob(record *encoding.Record, blob *stagedBlob, kdt segments.KeyDir) (segments.KeyDirEntry, error) {
+	// the blob belongs to the segment the record is appended to, named
+	// after the offset of the record, so the segment is not rotated between
+	// naming the blob and appending the record
+	if _, err := lbs.RotateIfDue(); err != nil {
+		return segments.KeyDirEntry{}, err
 	}
-	kde, err := lbs.currentSegment.Write(key, value)
+	ref := encoding.BlobRef{
+		SegmentID: lbs.currentSegment.ID(),
+		Seq:       lbs.currentSegment.Size(),
+		Size:      blob.size,
+		Checksum:  blob.checksum,
+	}
+	path := blobPath(lbs.basePath, ref)
+	if err := lbs.fs.Rename(blob.path, path); err != nil {
+		return segments.KeyDirEntry{}, fmt.Errorf("error moving blob into place: %w", err)
+	}
+	if err := lbs.fs.SyncDir(lbs.basePath); err != nil {
+		lbs.fs.Remove(path)
+		return segments.KeyDirEntry{}, err
+	}
+	record.Value = ref.Encode()
+	record.Flags |= encoding.FlagBlob
+	entry, err := lbs.appendRecord(record, kdt)
 	if err != nil {
+		lbs.fs.Remove(path)
+	}
+	return entry, err
+}
+
+func (lbs *logBasedStorage) rotateSegments() (err error) {
+	lbs.mutex.Lock()
+	sealed := lbs.currentSegment
+	if err := sealed.Rotate(); err != nil {
+		lbs.mutex.Unlock()
 		return err
 	}
-	(*kdt)[string(key)] = kde
+	segmentID := sealed.ID()
+	if err := lbs.fs.SyncDir(lbs.basePath); err != nil {
+		lbs.mutex.Unlock()
+		return err
+	}
+	// a crash before the edit is recorded is reconciled on the next open
+	if err := lbs.manifest.append(manifestEdit{Added: []int{segmentID}, Active: segmentID + 1}); err != nil {
+		lbs.mutex.Unlock()
+		return err
+	}
+	lbs.dataFiles[segmentID] = sealed
+	lbs.sealedIDs = append(lbs.sealedIDs, segmentID)
+	err = lbs.openActiveSegment()
+	lbs.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	lbs.metrics.IncSegmentRotations()
+	lbs.events.rotate(RotateInfo{
+		SegmentID: segmentID,
+		Path:      sealed.Path(),
+		Size:      sealed.Size(),
+	})
+	lbs.logger.Debugf("sealed active segment into %s", sealed.Path())
+
+	// the segment is durable by now, so a missing index only costs memory:
+	// its keys stay in the keydir and the index is written on the next open
+	index, err := lbs.openIndex(segmentID, sealed)
+	if err != nil {
+		lbs.logger.Errorf("%v", err)
+		lbs.events.backgroundError(err)
+		return nil
+	}
+	lbs.mutex.Lock()
+	lbs.indexes[segmentID] = index
+	// the sealed index now holds the tombstones of the segment
+	lbs.tombstones = make(map[string]struct{})
+	atomic.AddUint64(&lbs.generation, 1)
+	lbs.mutex.Unlock()
 	return nil
 }
 
-func (lbs *logBasedStorage) rotateSegments() (err error) {
-	fullPath := filepath.Join(lbs.basePath, activeSegmentFilename)
-	if err := lbs.currentSegment.Rotate(); err != nil {
+// Seal rotates the active segment and value log when they hold any record,
+// so everything written so far is immutable, and returns the sealed segment
+// files by ID
+func (lbs *logBasedStorage) Seal() (map[int]string, error) {
+	if _, err := lbs.Rotate(); err != nil {
+		return nil, err
+	}
+	if lbs.activeValueLog != nil && lbs.activeValueLog.Size() > 0 {
+		if err := lbs.rotateValueLog(); err != nil {
+			return nil, err
+		}
+	}
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	sealed := make(map[int]string, len(lbs.dataFiles))
+	for _, segment := range lbs.dataFiles {
+		sealed[segment.ID()] = segment.Path()
+	}
+	return sealed, nil
+}
+
+// ReadLog opens the segments right away, so the cleaner cannot take them
+// away while they are read. The zero position stands for the oldest record
+// still in the log.
+func (lbs *logBasedStorage) ReadLog(from LogPosition) (*logReader, error) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	spans := make([]logSpan, 0, len(lbs.sealedIDs)+1)
+	for _, id := range lbs.sealedIDs {
+		spans = append(spans, logSpan{segmentID: id, path: lbs.dataFiles[id].Path(), end: lbs.dataFiles[id].Size()})
+	}
+	spans = append(spans, logSpan{
+		segmentID: lbs.currentSegment.ID(),
+		path:      lbs.currentSegment.Path(),
+		end:       lbs.currentSegment.Size(),
+	})
+	if from != (LogPosition{}) {
+		for len(spans) > 0 && spans[0].segmentID < from.SegmentID {
+			spans = spans[1:]
+		}
+		if len(spans) == 0 || spans[0].segmentID != from.SegmentID || from.Offset > spans[0].end {
+			return nil, fmt.Errorf("%w: %s", errPositionUnavailable, from)
+		}
+		spans[0].offset = from.Offset
+	}
+	return openLogReader(lbs.fs, spans)
+}
+
+func (lbs *logBasedStorage) Lookup(keyspace uint32, key []byte) (segments.KeyDirEntry, bool) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	if _, removed := lbs.tombstones[string(segments.QualifiedKey(keyspace, key))]; removed {
+		return segments.KeyDirEntry{}, false
+	}
+	// the newest segment holding the key has its latest record
+	for i := len(lbs.sealedIDs) - 1; i >= 0; i-- {
+		index, ok := lbs.indexes[lbs.sealedIDs[i]]
+		if !ok {
+			continue
+		}
+		if e, found := index.Lookup(keyspace, key); found {
+			if e.Tombstone {
+				return segments.KeyDirEntry{}, false
+			}
+			return segments.KeyDirEntry{FileID: index.SegmentID(), Offset: e.Offset, Size: e.Size}, true
+		}
+	}
+	return segments.KeyDirEntry{}, false
+}
+
+func (lbs *logBasedStorage) LiveKeys(keyspace uint32, kdt segments.KeyDir) []string {
+	live := make(map[string]struct{}, kdt.Len())
+	// the keydir is read first as its keys only leave it once sealed in an
+	// index, and never take the storage lock while holding a keydir stripe
+	kdt.ForEach(func(k string, _ segments.KeyDirEntry) bool {
+		live[k] = struct{}{}
+		return true
+	})
+	if !lbs.diskIndex {
+		return keysOf(live)
+	}
+	sealed := make(map[string]struct{})
+	lbs.mutex.RLock()
+	for _, id := range lbs.sealedIDs {
+		index, ok := lbs.indexes[id]
+		if !ok {
+			continue
+		}
+		index.ForEach(func(e segments.IndexEntry) error {
+			if e.Keyspace != keyspace {
+				return nil
+			}
+			if e.Tombstone {
+				delete(sealed, string(e.Key))
+			} else {
+				sealed[string(e.Key)] = struct{}{}
+			}
+			return nil
+		})
+	}
+	for k := range lbs.tombstones {
+		if ks, key := splitQualifiedKey(k); ks == keyspace {
+			delete(sealed, key)
+		}
+	}
+	lbs.mutex.RUnlock()
+	for k := range sealed {
+		live[k] = struct{}{}
+	}
+	return keysOf(live)
+}
+
+// splitQualifiedKey returns the keyspace and key of a qualified key
+func splitQualifiedKey(qualified string) (uint32, string) {
+	return binary.BigEndian.Uint32([]byte(qualified[:4])), qualified[4:]
+}
+
+func keysOf(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// indexSnapshot is a copy of the sealed segment indexes, which stay mapped
+// until the cleaner taking the snapshot drops them
+type indexSnapshot struct {
+	diskIndex  bool
+	sealedIDs  []int
+	indexes    map[int]*segments.SegmentIndex
+	tombstones map[string]struct{}
+}
+
+func (lbs *logBasedStorage) snapshotIndexes() *indexSnapshot {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	snapshot := &indexSnapshot{
+		diskIndex:  lbs.diskIndex,
+		sealedIDs:  append([]int{}, lbs.sealedIDs...),
+		indexes:    make(map[int]*segments.SegmentIndex, len(lbs.indexes)),
+		tombstones: make(map[string]struct{}, len(lbs.tombstones)),
+	}
+	for id, index := range lbs.indexes {
+		snapshot.indexes[id] = index
+	}
+	for k := range lbs.tombstones {
+		snapshot.tombstones[k] = struct{}{}
+	}
+	return snapshot
+}
+
+// ReclaimableSegments works on a snapshot of the indexes and reads the keydir
+// without holding the storage lock. Records only ever get superseded, so a
+// segment found without live records cannot get one back.
+func (lbs *logBasedStorage) ReclaimableSegments(keyDirs KeyDirs) []int {
+	snapshot := lbs.snapshotIndexes()
+	var reclaimable []int
+	reclaimed := make(map[int]bool)
+	for i, id := range snapshot.sealedIDs {
+		index, ok := snapshot.indexes[id]
+		if !ok {
+			continue
+		}
+		needed := false
+		for j := 0; j < index.Len() && !needed; j++ {
+			e := index.Entry(j)
+			kdt := keyDirs(e.Keyspace)
+			if kdt == nil {
+				// the keyspace was dropped along with its records
+				continue
+			}
+			if e.Tombstone {
+				needed = snapshot.shadowsOlderRecord(e.Keyspace, e.Key, snapshot.sealedIDs[:i], reclaimed)
+			} else {
+				needed = !snapshot.superseded(e.Keyspace, e.Key, id, snapshot.sealedIDs[i+1:], kdt)
+			}
+		}
+		if !needed {
+			reclaimable = append(reclaimable, id)
+			reclaimed[id] = true
+		}
+	}
+	return reclaimable
+}
+
+// superseded tells whether the record of key held by segment id was
+// overwritten or removed by a newer one. kdt is the keydir of keyspace.
+func (is *indexSnapshot) superseded(keyspace uint32, key []byte, id int, newer []int, kdt segments.KeyDir) bool {
+	entry, ok := kdt.Get(string(key))
+	if !is.diskIndex {
+		return !ok || entry.FileID != id
+	}
+	if ok && entry.FileID != id {
+		return true
+	}
+	if _, removed := is.tombstones[string(segments.QualifiedKey(keyspace, key))]; removed {
+		return true
+	}
+	for _, newerID := range newer {
+		if index, ok := is.indexes[newerID]; ok && index.MayContain(keyspace, key) {
+			if _, found := index.Lookup(keyspace, key); found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shadowsOlderRecord tells whether a tombstone of key must be kept because an
+// older segment not being reclaimed still holds a record of key
+func (is *indexSnapshot) shadowsOlderRecord(keyspace uint32, key []byte, older []int, reclaimed map[int]bool) bool {
+	for _, olderID := range older {
+		if reclaimed[olderID] {
+			continue
+		}
+		index, ok := is.indexes[olderID]
+		if !ok {
+			// nothing is known about the records of the segment
+			return true
+		}
+		if e, found := index.Lookup(keyspace, key); found && !e.Tombstone {
+			return true
+		}
+	}
+	return false
+}
+
+func (lbs *logBasedStorage) DropSegments(ids []int) error {
+	lbs.mutex.Lock()
+	defer lbs.mutex.Unlock()
+	// the files of segments removed from the manifest are deleted on open
+	if err := lbs.manifest.append(manifestEdit{Removed: ids}); err != nil {
 		return err
 	}
+	dropped := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		dropped[id] = true
+		if index, ok := lbs.indexes[id]; ok {
+			if err := index.Close(); err != nil {
+				return err
+			}
+			delete(lbs.indexes, id)
+		}
+		if segment, ok := lbs.dataFiles[id]; ok {
+			if err := segment.Remove(); err != nil {
+				return err
+			}
+			delete(lbs.dataFiles, id)
+		}
+	}
+	sealedIDs := make([]int, 0, len(lbs.sealedIDs))
+	for _, id := range lbs.sealedIDs {
+		if !dropped[id] {
+			sealedIDs = append(sealedIDs, id)
+		}
+	}
+	lbs.sealedIDs = sealedIDs
+	lbs.metrics.SetOpenSegments(len(lbs.dataFiles)+1, lbs.mappings.Mapped())
+	return nil
+}
 
-	segmentID := len(lbs.dataFiles) + 1
-	lbs.dataFiles[segmentID] = lbs.currentSegment
-	lbs.currentSegment, err = segments.NewLogSegment(fullPath, true)
-	return err
+func (lbs *logBasedStorage) IndexedSegments() (map[int]bool, uint64) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	indexed := make(map[int]bool, len(lbs.indexes))
+	for id := range lbs.indexes {
+		indexed[id] = true
+	}
+	return indexed, atomic.LoadUint64(&lbs.generation)
 }
 
+func (lbs *logBasedStorage) IndexGeneration() uint64 {
+	return atomic.LoadUint64(&lbs.generation)
+}
+
+// Close closes every file of the storage, including the ones left to close
+// after an error, and returns the first error
 func (lbs *logBasedStorage) Close() error {
+	lbs.mutex.Lock()
+	defer lbs.mutex.Unlock()
+	var errs []error
+	for _, index := range lbs.indexes {
+		errs = append(errs, index.Close())
+	}
 	for _, segment := range lbs.dataFiles {
-		if err := segment.Close(); err != nil {
+		errs = append(errs, segment.Close())
+	}
+	if lbs.currentSegment != nil {
+		errs = append(errs, lbs.currentSegment.Close())
+	}
+	for _, valueLog := range lbs.valueLogs {
+		errs = append(errs, valueLog.Close())
+	}
+	if lbs.activeValueLog != nil {
+		errs = append(errs, lbs.activeValueLog.Close())
+	}
+	errs = append(errs, lbs.manifest.Close())
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
 	}
-	if err := lbs.currentSegment.Close(); err != nil {
-		return err
-	}
 	return nil
 }
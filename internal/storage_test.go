@@ -2,16 +2,21 @@ package internal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"pingcap.com/kvs/internal/segments"
 	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
 )
 
 func emptyDataFolder(t *testing.T) string {
@@ -48,19 +53,20 @@ func TestLogBasedStorage(t *testing.T) {
 	assert.NoError(t, err)
 	kdt, err := lbs.BuildKeyDirTable()
 	assert.NoError(t, err)
-	assert.Equal(t, 50, len(*kdt))
+	assert.Equal(t, 50, kdt.Len())
 	t.Run("read the whole key dir structure", func(t *testing.T) {
-		for k, v := range *kdt {
+		kdt.ForEach(func(k string, v segments.KeyDirEntry) bool {
 			rv, err := lbs.ReadKeyDirEntry(v)
 			assert.NoError(t, err)
 			assert.Equal(t, fmt.Sprintf("value for key %s", k), string(rv))
-		}
+			return true
+		})
 	})
 
 	t.Run("append new data", func(t *testing.T) {
 		err := lbs.Append([]byte("9999"), []byte("value for key 9999"), kdt)
 		assert.NoError(t, err)
-		lastEntry := (*kdt)["9999"]
+		lastEntry, _ := kdt.Get("9999")
 		lastValue, err := lbs.ReadKeyDirEntry(lastEntry)
 		assert.NoError(t, err)
 		assert.Equal(t, "value for key 9999", string(lastValue))
@@ -69,9 +75,9 @@ func TestLogBasedStorage(t *testing.T) {
 	t.Run("close all resources", func(t *testing.T) {
 		assert.NoError(t, lbs.Close())
 		// storage closed cannot read values
-		entry := (*kdt)["10"]
+		entry, _ := kdt.Get("10")
 		_, err := lbs.ReadKeyDirEntry(entry)
-		assert.Nil(t, err)
+		assert.Error(t, err)
 	})
 }
 func TestSegmentsRotation(t *testing.T) {
@@ -83,7 +89,209 @@ func TestSegmentsRotation(t *testing.T) {
 	v := bytes.Repeat([]byte{0xb}, 1024)
 	kdt := make(segments.KeyDirTable)
 	for i := 0; i < 118000; i++ {
-		assert.NoError(t, lbs.Append(k, v, &kdt))
+		assert.NoError(t, lbs.Append(k, v, kdt))
 	}
 	assert.True(t, len(lbs.dataFiles) > 1)
 }
+
+func TestReclaimableSegmentsKeepTombstones(t *testing.T) {
+	for _, diskIndex := range []bool{false, true} {
+		basePath := emptyDataFolder(t)
+		opts := []Option{}
+		if diskIndex {
+			opts = append(opts, WithDiskIndex())
+		}
+		lbs, err := NewLogBasedStorage(basePath, opts...)
+		assert.NoError(t, err)
+		kdt, err := lbs.BuildKeyDirTable()
+		assert.NoError(t, err)
+		value := bytes.Repeat([]byte{0xb}, 64*1024)
+
+		// segment 1 holds the live record of "kept" and a record of "removed"
+		assert.NoError(t, lbs.Append([]byte("removed"), value, kdt))
+		assert.NoError(t, lbs.Append([]byte("kept"), value, kdt))
+		_, err = lbs.Seal()
+		assert.NoError(t, err)
+		// segment 2 only holds the tombstone of "removed"
+		assert.NoError(t, lbs.AppendTombstone([]byte("removed"), kdt))
+		_, err = lbs.Seal()
+		assert.NoError(t, err)
+
+		// dropping segment 2 alone would resurrect "removed"
+		assert.Empty(t, lbs.ReclaimableSegments(defaultKeyDirs(kdt)))
+
+		// once "kept" is overwritten both segments can go together
+		assert.NoError(t, lbs.Append([]byte("kept"), value, kdt))
+		_, err = lbs.Seal()
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 2}, lbs.ReclaimableSegments(defaultKeyDirs(kdt)))
+		assert.NoError(t, lbs.DropSegments([]int{1, 2}))
+		assert.Empty(t, lbs.ReclaimableSegments(defaultKeyDirs(kdt)))
+		assert.NoError(t, lbs.Close())
+		os.RemoveAll(basePath)
+	}
+}
+
+func TestMemFSStore(t *testing.T) {
+	fs := vfs.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/data", 0755))
+	opts := []Option{WithFS(fs), WithRotationPolicy(CountRotation(10))}
+
+	db, err := OpenBitCaskStore("/data", opts...)
+	assert.NoError(t, err)
+	_, err = OpenBitCaskStore("/data", opts...)
+	assert.True(t, errors.Is(err, errLockingFolder))
+	for i := 0; i < 35; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.NoError(t, db.Remove("0"))
+	assert.NoError(t, db.Close())
+
+	sealed, err := vfs.Glob(fs, "/data/"+segmentFilenameGlob)
+	assert.NoError(t, err)
+	assert.Len(t, sealed, 3)
+	assert.True(t, vfs.Exists(fs, "/data/"+manifestFilename))
+	// nothing reached the disk
+	_, err = os.Stat("/data")
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = OpenBitCaskStore("/data", opts...)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, ok, err := db.Get("0")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	for i := 1; i < 35; i++ {
+		value, ok, err := db.Get(strconv.Itoa(i))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(value))
+	}
+}
+
+func TestStoreFaults(t *testing.T) {
+	memFS := vfs.NewMemFS()
+	assert.NoError(t, memFS.MkdirAll("/data", 0755))
+	fs := vfs.NewFaultFS(memFS)
+	opts := []Option{WithFS(fs), WithRotationPolicy(CountRotation(5))}
+
+	db, err := OpenBitCaskStore("/data", opts...)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("1", []byte("walnuts")))
+
+	// failed writes leave the log as it was
+	fs.Inject(vfs.FailOn(vfs.OpWrite, activeSegmentFilename, syscall.ENOSPC))
+	err = db.Set("2", []byte("peanuts"))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+	fs.Inject(vfs.FailOn(vfs.OpWrite, activeSegmentFilename, io.ErrShortWrite))
+	assert.Error(t, db.Set("2", []byte("peanuts")))
+	fs.Inject(nil)
+	assert.NoError(t, db.Set("3", []byte("peas")))
+	_, ok, err := db.Get("2")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// a failed rotation fails the write without losing the acknowledged ones
+	assert.NoError(t, db.Set("4", []byte("hazelnuts")))
+	assert.NoError(t, db.Set("5", []byte("almonds")))
+	assert.NoError(t, db.Set("6", []byte("pecans")))
+	fs.Inject(vfs.FailOn(vfs.OpRename, activeSegmentFilename, syscall.EIO))
+	assert.True(t, errors.Is(db.Set("7", []byte("cashews")), syscall.EIO))
+	db.Close()
+
+	fs.Inject(nil)
+	db, err = OpenBitCaskStore("/data", opts...)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, []string{"1", "3", "4", "5", "6"}, db.Keys())
+	value, ok, err := db.Get("6")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "pecans", string(value))
+}
+
+// trackingFS counts the files left open and mapped
+type trackingFS struct {
+	vfs.FS
+	mutex  sync.Mutex
+	open   int
+	mapped int
+}
+
+type trackedFile struct {
+	vfs.File
+	fs     *trackingFS
+	closed bool
+}
+
+func (tfs *trackingFS) track(f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	tfs.mutex.Lock()
+	defer tfs.mutex.Unlock()
+	tfs.open++
+	return &trackedFile{File: f, fs: tfs}, nil
+}
+
+func (tfs *trackingFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	return tfs.track(tfs.FS.OpenFile(name, flag, perm))
+}
+
+func (tfs *trackingFS) TempFile(dir, pattern string) (vfs.File, error) {
+	return tfs.track(tfs.FS.TempFile(dir, pattern))
+}
+
+func (tfs *trackingFS) Mmap(f vfs.File, size int) ([]byte, error) {
+	data, err := tfs.FS.Mmap(f.(*trackedFile).File, size)
+	if err == nil {
+		tfs.mutex.Lock()
+		tfs.mapped++
+		tfs.mutex.Unlock()
+	}
+	return data, err
+}
+
+func (tfs *trackingFS) Munmap(data []byte) error {
+	tfs.mutex.Lock()
+	tfs.mapped--
+	tfs.mutex.Unlock()
+	return tfs.FS.Munmap(data)
+}
+
+// Close counts a file once, as files written atomically are closed again by
+// a deferred call
+func (f *trackedFile) Close() error {
+	f.fs.mutex.Lock()
+	if !f.closed {
+		f.closed = true
+		f.fs.open--
+	}
+	f.fs.mutex.Unlock()
+	return f.File.Close()
+}
+
+func TestOpenFailureClosesFiles(t *testing.T) {
+	memFS := vfs.NewMemFS()
+	assert.NoError(t, memFS.MkdirAll("/data", 0755))
+	faultFS := vfs.NewFaultFS(memFS)
+	fs := &trackingFS{FS: faultFS}
+	db, err := OpenBitCaskStore("/data", WithFS(fs))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), []byte("value")))
+		assert.NoError(t, db.Rotate())
+	}
+	assert.NoError(t, db.Close())
+	assert.Equal(t, 0, fs.open)
+	assert.Equal(t, 0, fs.mapped)
+
+	// the manifest, sealed segments and their indexes are open by then
+	for _, op := range []vfs.Op{vfs.OpOpen, vfs.OpStat} {
+		faultFS.Inject(vfs.FailOn(op, activeSegmentFilename, syscall.EIO))
+		_, err = OpenBitCaskStore("/data", WithFS(fs))
+		assert.Error(t, err, op)
+		assert.Equal(t, 0, fs.open, op)
+		assert.Equal(t, 0, fs.mapped, op)
+	}
+}
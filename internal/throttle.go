@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidTimeWindow = errors.New("error parsing time window")
+
+// TimeWindow is a daily period of local time, as offsets from midnight. It
+// wraps around midnight when End is before Start.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseTimeWindow parses a window such as "22:00-06:00"
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return TimeWindow{}, fmt.Errorf("%w: %q", errInvalidTimeWindow, s)
+	}
+	var offsets [2]time.Duration
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return TimeWindow{}, fmt.Errorf("%w: %q: %v", errInvalidTimeWindow, s, err)
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return TimeWindow{Start: offsets[0], End: offsets[1]}, nil
+}
+
+// Contains tells whether t falls within the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+func (w TimeWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+// CompactionThrottle paces the background work of the stores sharing it:
+// log cleaning and value log collection. It bounds their IO rate and how
+// many run at once, and confines the periodic runs to time windows. A nil
+// throttle lets everything through.
+type CompactionThrottle struct {
+	bucket  *tokenBucket
+	slots   chan struct{}
+	windows []TimeWindow
+}
+
+// NewCompactionThrottle limits the compactions to bytesPerSecond, 0 meaning
+// no limit, and to concurrency at once, 0 meaning no limit. Periodic runs
+// only start within one of windows, if any.
+func NewCompactionThrottle(bytesPerSecond int64, concurrency int, windows ...TimeWindow) *CompactionThrottle {
+	ct := &CompactionThrottle{windows: windows}
+	if bytesPerSecond > 0 {
+		ct.bucket = newTokenBucket(bytesPerSecond)
+	}
+	if concurrency > 0 {
+		ct.slots = make(chan struct{}, concurrency)
+	}
+	return ct
+}
+
+// inWindow tells whether periodic runs may start at t
+func (ct *CompactionThrottle) inWindow(t time.Time) bool {
+	if ct == nil || len(ct.windows) == 0 {
+		return true
+	}
+	for _, w := range ct.windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire waits for a compaction slot, returning the function releasing it
+func (ct *CompactionThrottle) acquire(ctx context.Context) (func(), error) {
+	if ct == nil || ct.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case ct.slots <- struct{}{}:
+		return func() { <-ct.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait blocks until n more bytes of IO fit in the rate limit, as told by clock
+func (ct *CompactionThrottle) wait(ctx context.Context, clock Clock, n int64) error {
+	if ct == nil || ct.bucket == nil {
+		return nil
+	}
+	return ct.bucket.wait(ctx, clock, n)
+}
+
+// tokenBucket refills rate tokens per second, holding at most a second
+// worth of them. Requests larger than that go into debt, which the next
+// ones wait for. It starts full on its first request.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate)}
+}
+
+func (tb *tokenBucket) wait(ctx context.Context, clock Clock, n int64) error {
+	tb.mutex.Lock()
+	now := clock.Now()
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	}
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	deficit := -tb.tokens
+	tb.mutex.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+	// the first tick of the clock is the end of the wait
+	ticker := clock.NewTicker(time.Duration(deficit / tb.rate * float64(time.Second)))
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	night, err := ParseTimeWindow("22:00-06:00")
+	assert.NoError(t, err)
+	assert.Equal(t, "22:00-06:00", night.String())
+	assert.True(t, night.Contains(at(23, 0)))
+	assert.True(t, night.Contains(at(5, 59)))
+	assert.False(t, night.Contains(at(6, 0)))
+	assert.False(t, night.Contains(at(12, 0)))
+
+	day, err := ParseTimeWindow("09:30 - 17:00")
+	assert.NoError(t, err)
+	assert.True(t, day.Contains(at(9, 30)))
+	assert.False(t, day.Contains(at(9, 29)))
+	assert.False(t, day.Contains(at(17, 0)))
+
+	for _, invalid := range []string{"", "22:00", "22:00-25:00", "10-12"} {
+		_, err := ParseTimeWindow(invalid)
+		assert.True(t, errors.Is(err, errInvalidTimeWindow), invalid)
+	}
+
+	throttle := NewCompactionThrottle(0, 0, day)
+	assert.True(t, throttle.inWindow(at(10, 0)))
+	assert.False(t, throttle.inWindow(at(20, 0)))
+	assert.True(t, NewCompactionThrottle(0, 0).inWindow(at(20, 0)))
+	var none *CompactionThrottle
+	assert.True(t, none.inWindow(at(20, 0)))
+}
+
+func TestCompactionThrottle(t *testing.T) {
+	t.Run("rate", func(t *testing.T) {
+		throttle := NewCompactionThrottle(1000, 0)
+		clock := newManualClock(time.Now())
+		// a second worth of bytes is available right away
+		assert.NoError(t, throttle.wait(context.Background(), clock, 1000))
+		done := make(chan error)
+		go func() { done <- throttle.wait(context.Background(), clock, 200) }()
+		clock.awaitTickers(1)
+		clock.Advance(150 * time.Millisecond)
+		select {
+		case <-done:
+			t.Fatal("wait returned before the bytes fit in the rate")
+		default:
+		}
+		clock.Advance(50 * time.Millisecond)
+		assert.NoError(t, <-done)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Equal(t, context.Canceled, throttle.wait(ctx, clock, 1000))
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		throttle := NewCompactionThrottle(0, 1)
+		release, err := throttle.acquire(context.Background())
+		assert.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = throttle.acquire(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		release()
+		release, err = throttle.acquire(context.Background())
+		assert.NoError(t, err)
+		release()
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var throttle *CompactionThrottle
+		release, err := throttle.acquire(context.Background())
+		assert.NoError(t, err)
+		release()
+		assert.NoError(t, throttle.wait(context.Background(), systemClock{}, 1<<40))
+	})
+}
+
+func TestCompact(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithValueLog(), WithCompactionThrottle(NewCompactionThrottle(1, 1)))
+	assert.NoError(t, err)
+
+	value := func(i, version int) []byte {
+		return []byte(strings.Repeat(strconv.Itoa(i*10+version), 100))
+	}
+	// the first segment only holds a value overwritten since, and the second
+	// version leaves two live values in the second value log
+	assert.NoError(t, db.Set("x", value(0, 0)))
+	_, err = db.logStore.Seal()
+	assert.NoError(t, err)
+	for version := 0; version < 2; version++ {
+		for i := 0; i < 10-2*version; i++ {
+			assert.NoError(t, db.Set(strconv.Itoa(i), value(i, version)))
+		}
+		_, err := db.logStore.Seal()
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, db.Set("x", value(0, 1)))
+	valueLog := filepath.Join(path, fmt.Sprintf(valueLogFilenameFmt, 2))
+
+	// the rate limit leaves the value log in place until the run is
+	// cancelled, while dropping segments reads and writes nothing
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	info, err := db.Compact(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, []int{1}, info.Deleted)
+	_, err = os.Stat(valueLog)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Close())
+	db, err = OpenBitCaskStore(path, WithValueLog(), WithCompactionThrottle(NewCompactionThrottle(0, 1)))
+	assert.NoError(t, err)
+	info, err = db.Compact(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, info.ReclaimedBytes > 0)
+	_, err = os.Stat(valueLog)
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 10; i++ {
+		v, ok, err := db.Get(strconv.Itoa(i))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, value(i, 1-i/8), v)
+	}
+	assert.NoError(t, db.Close())
+}
@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	activeValueLogFilename = "current_vlog.dat"
+	valueLogFilenameFmt    = "vlog_%05d.dat"
+	valueLogFilenameGlob   = "vlog_*.dat"
+	// value log files are collected once at most this fraction of their
+	// bytes is live
+	valueLogCollectRatio = 0.5
+)
+
+var errUnknownValueLog = errors.New("error reading unknown value log")
+
+// openValueLogs opens the value log files of the manifest. The active one is
+// only created by the first value appended to it.
+func (lbs *logBasedStorage) openValueLogs() error {
+	for id := range lbs.manifest.valueLogs {
+		path := filepath.Join(lbs.basePath, fmt.Sprintf(valueLogFilenameFmt, id))
+		valueLog, err := segments.OpenLogSegment(lbs.fs, path, id, false, lbs.mappings)
+		if err != nil {
+			return fmt.Errorf("error opening value log %s: %v", path, err)
+		}
+		lbs.valueLogs[id] = valueLog
+	}
+	if !vfs.Exists(lbs.fs, filepath.Join(lbs.basePath, activeValueLogFilename)) {
+		return nil
+	}
+	return lbs.openActiveValueLog()
+}
+
+// openActiveValueLog opens the active value log, dropping the damaged tail
+// left by a crash in the middle of a write. It fails on a damaged record
+// followed by valid ones, which are not dropped.
+func (lbs *logBasedStorage) openActiveValueLog() (err error) {
+	path := filepath.Join(lbs.basePath, activeValueLogFilename)
+	active, err := segments.OpenLogSegment(lbs.fs, path, lbs.manifest.activeValueLog, true, lbs.mappings)
+	if err != nil {
+		return fmt.Errorf("error opening active value log: %v", err)
+	}
+	if lbs.preallocate {
+		if err := active.Preallocate(segments.MaxSegmentSizeBytes); err != nil {
+			active.Close()
+			return err
+		}
+	}
+	if err := lbs.fs.SyncDir(lbs.basePath); err != nil {
+		active.Close()
+		return err
+	}
+	// scanning the value log finds its size
+	if _, err := active.Index(); err != nil {
+		var corrupt *segments.CorruptRecordError
+		if !errors.As(err, &corrupt) {
+			active.Close()
+			return err
+		}
+		data, err := vfs.ReadFile(lbs.fs, path)
+		if err != nil {
+			active.Close()
+			return err
+		}
+		if !tornTail(data, corrupt.Offset) {
+			active.Close()
+			return fmt.Errorf("%w: valid records follow it in %s", corrupt, path)
+		}
+		if err := active.Truncate(corrupt.Offset); err != nil {
+			active.Close()
+			return err
+		}
+		lbs.logger.Warnf("dropped the tail of %s after %v", path, corrupt)
+	}
+	active.ObserveSyncs(lbs.metrics.ObserveFsync)
+	lbs.activeValueLog = active
+	return nil
+}
+
+// AppendValue appends the value record of a key/value separated write to
+// the value log and returns its location
+func (lbs *logBasedStorage) AppendValue(record *encoding.Record) (segments.KeyDirEntry, error) {
+	if lbs.activeValueLog == nil {
+		lbs.mutex.Lock()
+		err := lbs.openActiveValueLog()
+		lbs.mutex.Unlock()
+		if err != nil {
+			return segments.KeyDirEntry{}, err
+		}
+	} else if lbs.activeValueLog.Size() > segments.MaxSegmentSizeBytes {
+		if err := lbs.rotateValueLog(); err != nil {
+			return segments.KeyDirEntry{}, err
+		}
+	}
+	entry, err := lbs.activeValueLog.WriteRecord(record)
+	if err != nil {
+		return segments.KeyDirEntry{}, err
+	}
+	if lbs.syncWrites {
+		if err := lbs.activeValueLog.Sync(); err != nil {
+			return segments.KeyDirEntry{}, fmt.Errorf("error syncing active value log: %w", err)
+		}
+	}
+	lbs.metrics.AddBytesAppended(entry.Size)
+	return *entry, nil
+}
+
+func (lbs *logBasedStorage) rotateValueLog() error {
+	lbs.mutex.Lock()
+	defer lbs.mutex.Unlock()
+	sealed := lbs.activeValueLog
+	id := sealed.ID()
+	if err := sealed.RotateTo(filepath.Join(lbs.basePath, fmt.Sprintf(valueLogFilenameFmt, id))); err != nil {
+		return err
+	}
+	if err := lbs.fs.SyncDir(lbs.basePath); err != nil {
+		return err
+	}
+	// a crash before the edit is recorded is reconciled on the next open
+	if err := lbs.manifest.append(manifestEdit{AddedValueLogs: []int{id}, ActiveValueLog: id + 1}); err != nil {
+		return err
+	}
+	lbs.valueLogs[id] = sealed
+	if err := lbs.openActiveValueLog(); err != nil {
+		return err
+	}
+	lbs.logger.Debugf("sealed active value log into %s", sealed.Path())
+	return nil
+}
+
+// ReadValue decodes the value record located by entry, as found in the
+// records flagged with encoding.FlagValuePointer
+func (lbs *logBasedStorage) ReadValue(entry segments.KeyDirEntry) (*encoding.Record, error) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	if valueLog, ok := lbs.valueLogs[entry.FileID]; ok {
+		return valueLog.ReadRecordAt(entry.Offset, entry.Size)
+	} else if lbs.activeValueLog != nil && entry.FileID == lbs.activeValueLog.ID() {
+		return lbs.activeValueLog.ReadRecordAt(entry.Offset, entry.Size)
+	}
+	return nil, fmt.Errorf("%w: %d", errUnknownValueLog, entry.FileID)
+}
+
+// SealedValueLogs returns the IDs and sizes of the sealed value log files,
+// the oldest first
+func (lbs *logBasedStorage) SealedValueLogs() ([]int, map[int]int64) {
+	lbs.mutex.RLock()
+	defer lbs.mutex.RUnlock()
+	ids := make([]int, 0, len(lbs.valueLogs))
+	sizes := make(map[int]int64, len(lbs.valueLogs))
+	for id, valueLog := range lbs.valueLogs {
+		ids = append(ids, id)
+		sizes[id] = valueLog.Size()
+	}
+	sort.Ints(ids)
+	return ids, sizes
+}
+
+// ValueLogIndex returns the latest value record of every key of a sealed
+// value log file, the only one of the file a key can point to
+func (lbs *logBasedStorage) ValueLogIndex(id int) ([]segments.IndexEntry, error) {
+	lbs.mutex.RLock()
+	valueLog, ok := lbs.valueLogs[id]
+	lbs.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", errUnknownValueLog, id)
+	}
+	return valueLog.Index()
+}
+
+// DropValueLogs forgets the given sealed value log files, whose files are
+// deleted once no reader holds them anymore
+func (lbs *logBasedStorage) DropValueLogs(ids []int) error {
+	lbs.mutex.Lock()
+	defer lbs.mutex.Unlock()
+	if err := lbs.manifest.append(manifestEdit{RemovedValueLogs: ids}); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if valueLog, ok := lbs.valueLogs[id]; ok {
+			if err := valueLog.Remove(); err != nil {
+				return err
+			}
+			delete(lbs.valueLogs, id)
+		}
+	}
+	return nil
+}
+
+// Sync makes the writes to the active segment and value log durable
+func (lbs *logBasedStorage) Sync() error {
+	if err := lbs.currentSegment.Sync(); err != nil {
+		return err
+	}
+	if lbs.activeValueLog != nil {
+		return lbs.activeValueLog.Sync()
+	}
+	return nil
+}
+
+// separateValue writes the value of record to the value log and returns the
+// record to append to the log in its place
+func (bcs *BitCaskStore) separateValue(record *encoding.Record) (*encoding.Record, error) {
+	entry, err := bcs.logStore.AppendValue(record)
+	if err != nil {
+		return nil, err
+	}
+	return &encoding.Record{
+		Keyspace:  record.Keyspace,
+		Key:       record.Key,
+		ExpiresAt: record.ExpiresAt,
+		Flags:     encoding.FlagValuePointer,
+		Value:     entry.Encode(),
+	}, nil
+}
+
+// resolveValue returns the value record pointed to by record, or record
+// itself when its value is stored along with it. Readers resolve pointers
+// holding the stripe of the key, so the value log file cannot be collected
+// in the meantime.
+func (bcs *BitCaskStore) resolveValue(record *encoding.Record) (*encoding.Record, error) {
+	if !record.ValuePointer() {
+		return record, nil
+	}
+	entry, err := segments.DecodeKeyDirEntry(record.Value)
+	if err != nil {
+		return nil, fmt.Errorf("error reading value of %q: %w", record.Key, err)
+	}
+	return bcs.logStore.ReadValue(entry)
+}
+
+// CollectValueLogs moves the live values of the sealed value log files with
+// at most ratio of their bytes live to the active value log, and deletes
+// them. It returns the number of bytes reclaimed.
+func (bcs *BitCaskStore) CollectValueLogs(ratio float64) (int64, error) {
+	return bcs.compactValueLogs(context.Background(), ratio)
+}
+
+// compactValueLogs collects the value log files, pacing the moves of the
+// live values with the compaction throttle
+func (bcs *BitCaskStore) compactValueLogs(ctx context.Context, ratio float64) (int64, error) {
+	bcs.collecting.Lock()
+	defer bcs.collecting.Unlock()
+	release, err := bcs.throttle.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	ids, sizes := bcs.logStore.SealedValueLogs()
+	var reclaimed int64
+	for _, id := range ids {
+		entries, err := bcs.logStore.ValueLogIndex(id)
+		if err != nil {
+			return reclaimed, err
+		}
+		var live []segments.IndexEntry
+		var liveBytes int64
+		for _, e := range entries {
+			ok, err := bcs.liveValue(id, e, false)
+			if err != nil {
+				return reclaimed, err
+			}
+			if ok {
+				live = append(live, e)
+				liveBytes += e.Size
+			}
+		}
+		if float64(liveBytes) > ratio*float64(sizes[id]) {
+			continue
+		}
+		var moved int64
+		for _, e := range live {
+			if err := bcs.throttle.wait(ctx, bcs.clock, e.Size); err != nil {
+				return reclaimed, err
+			}
+			// values superseded since are left behind
+			ok, err := bcs.liveValue(id, e, true)
+			if err != nil {
+				return reclaimed, err
+			}
+			if ok {
+				moved += e.Size
+			}
+		}
+		// the moved values must be durable before their old copy goes away
+		bcs.mutex.Lock()
+		err = bcs.logStore.Sync()
+		bcs.mutex.Unlock()
+		if err != nil {
+			return reclaimed, err
+		}
+		if err := bcs.logStore.DropValueLogs([]int{id}); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += sizes[id] - moved
+		bcs.logger.Debugf("collected value log %d, moving %d of its %d bytes", id, moved, sizes[id])
+	}
+	return reclaimed, nil
+}
+
+// liveValue tells whether the value record e of value log id is the value of
+// its key, in which case move appends it again along with the record
+// pointing to it
+func (bcs *BitCaskStore) liveValue(id int, e segments.IndexEntry, move bool) (live bool, err error) {
+	ks := bcs.keyspace(e.Keyspace)
+	if ks == nil || e.Tombstone {
+		return false, nil
+	}
+	key := string(e.Key)
+	check := func(kdt segments.KeyDir) error {
+		entry, ok := ks.lookup(kdt, key)
+		if !ok {
+			return nil
+		}
+		record, err := bcs.logStore.ReadRecord(entry)
+		if err != nil {
+			return err
+		}
+		if !record.ValuePointer() || record.Expired(time.Now().UnixNano()) {
+			return nil
+		}
+		pointer, err := segments.DecodeKeyDirEntry(record.Value)
+		if err != nil {
+			return err
+		}
+		live = pointer == segments.KeyDirEntry{FileID: id, Offset: e.Offset, Size: e.Size}
+		if !live || !move {
+			return nil
+		}
+		value, err := bcs.logStore.ReadValue(pointer)
+		if err != nil {
+			return err
+		}
+		return bcs.appendTo(ks, func() error {
+			return bcs.append(value, nil, kdt)
+		})
+	}
+	if move {
+		err = ks.keyDir.update(key, check)
+	} else {
+		err = ks.keyDir.view(key, check)
+	}
+	if err != nil {
+		return false, fmt.Errorf("error collecting value of %q from value log %d: %w", key, id, err)
+	}
+	return live, nil
+}
+
+// collectValueLogs collects the value log files on every tick within the
+// compaction windows until ctx is done
+func (bcs *BitCaskStore) collectValueLogs(ctx context.Context, ticker Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if !bcs.throttle.inWindow(bcs.clock.Now()) {
+				continue
+			}
+			if _, err := bcs.compactValueLogs(ctx, valueLogCollectRatio); err != nil && ctx.Err() == nil {
+				bcs.reportError(fmt.Errorf("error collecting value logs: %w", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+func TestValueLog(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path, WithValueLog())
+	assert.NoError(t, err)
+
+	value := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d|", i, version)), 100)
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("key%d", i), value(i, 0)))
+	}
+	info, err := os.Stat(filepath.Join(path, activeSegmentFilename))
+	assert.NoError(t, err)
+	assert.True(t, info.Size() < 1024)
+	info, err = os.Stat(filepath.Join(path, activeValueLogFilename))
+	assert.NoError(t, err)
+	assert.True(t, info.Size() > 4000)
+
+	assertValues := func(t *testing.T, db *BitCaskStore, version func(i int) int) {
+		for i := 0; i < 10; i++ {
+			key, expected := fmt.Sprintf("key%d", i), value(i, version(i))
+			v, ok, err := db.Get(key)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, expected, v)
+			ok, err = db.View(key, func(v []byte) error {
+				assert.Equal(t, expected, v)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			r, ok, err := db.GetReader(key)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			streamed, _ := ioutil.ReadAll(r)
+			assert.NoError(t, r.Close())
+			assert.Equal(t, expected, streamed)
+			values, _, err := db.MultiGet([]string{key})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, values[0])
+		}
+	}
+	assertValues(t, db, func(int) int { return 0 })
+
+	t.Run("collection moves the live values", func(t *testing.T) {
+		_, err := db.logStore.Seal()
+		assert.NoError(t, err)
+		for i := 0; i < 8; i++ {
+			assert.NoError(t, db.Set(fmt.Sprintf("key%d", i), value(i, 1)))
+		}
+		_, err = db.logStore.Seal()
+		assert.NoError(t, err)
+
+		reclaimed, err := db.CollectValueLogs(valueLogCollectRatio)
+		assert.NoError(t, err)
+		assert.True(t, reclaimed > 0)
+		_, err = os.Stat(filepath.Join(path, fmt.Sprintf(valueLogFilenameFmt, 1)))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(path, fmt.Sprintf(valueLogFilenameFmt, 2)))
+		assert.NoError(t, err)
+		assertValues(t, db, func(i int) int { return i/8 ^ 1 })
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		assert.NoError(t, db.Close())
+		db, err = OpenBitCaskStore(path, WithValueLog())
+		assert.NoError(t, err)
+		assertValues(t, db, func(i int) int { return i/8 ^ 1 })
+	})
+
+	t.Run("backup and restore carry the value logs", func(t *testing.T) {
+		backups, _ := ioutil.TempDir("/tmp", "backup_*")
+		defer os.RemoveAll(backups)
+		for _, dst := range []string{"folder", "archive.tar"} {
+			dst = filepath.Join(backups, dst)
+			report, err := db.Backup(dst, false)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, report.Manifest.ValueLogs)
+			restored, _ := ioutil.TempDir("/tmp", "restored_*")
+			_, err = Restore(dst, restored)
+			assert.NoError(t, err)
+			restoredDB, err := OpenBitCaskStore(restored, WithValueLog())
+			assert.NoError(t, err)
+			assertValues(t, restoredDB, func(i int) int { return i/8 ^ 1 })
+			assert.NoError(t, restoredDB.Close())
+			os.RemoveAll(restored)
+		}
+	})
+
+	t.Run("keyspace options", func(t *testing.T) {
+		ks, err := db.Keyspace("compressed", WithCompression(DeflateCompression), WithTTL(time.Hour))
+		assert.NoError(t, err)
+		assert.NoError(t, ks.Set("key", value(0, 2)))
+		v, ok, err := ks.Get("key")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, value(0, 2), v)
+	})
+	assert.NoError(t, db.Close())
+
+	t.Run("background error", func(t *testing.T) {
+		fs := vfs.NewFaultFS(vfs.NewMemFS())
+		assert.NoError(t, fs.MkdirAll("/data", 0755))
+		clock := newManualClock(time.Now())
+		errs := make(chan error, 1)
+		db, err := OpenBitCaskStore("/data", WithFS(fs), WithClock(clock), WithValueLog(),
+			WithEventListener(EventListener{OnBackgroundError: func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}}))
+		assert.NoError(t, err)
+		defer db.Close()
+
+		assert.NoError(t, db.Set("key0", value(0, 0)))
+		_, err = db.logStore.Seal()
+		assert.NoError(t, err)
+		assert.NoError(t, db.Set("key0", value(0, 1)))
+		fs.Inject(vfs.FailOn(vfs.OpRemove, "vlog_*", syscall.EIO))
+		clock.Advance(cleaningInterval)
+		assert.True(t, errors.Is(<-errs, syscall.EIO))
+		fs.Inject(nil)
+	})
+
+	t.Run("a damaged value followed by valid ones is kept", func(t *testing.T) {
+		path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+		defer os.RemoveAll(path)
+		db, err := OpenBitCaskStore(path, WithValueLog())
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, db.Set(fmt.Sprintf("key%d", i), value(i, 0)))
+		}
+		assert.NoError(t, db.Close())
+
+		active := filepath.Join(path, activeValueLogFilename)
+		data, err := ioutil.ReadFile(active)
+		assert.NoError(t, err)
+		data[30] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(active, data, 0644))
+		_, err = OpenBitCaskStore(path, WithValueLog())
+		assert.Error(t, err)
+		kept, err := ioutil.ReadFile(active)
+		assert.NoError(t, err)
+		assert.Equal(t, data, kept)
+	})
+}
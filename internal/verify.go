@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+const (
+	IssueInvalidMagic IssueKind = "invalid-magic"
+	IssueTruncated    IssueKind = "truncated-record"
+	IssueChecksum     IssueKind = "checksum-mismatch"
+	IssueOrphaned     IssueKind = "orphaned-file"
+	IssueDuplicate    IssueKind = "duplicate-segment"
+
+	corruptSuffix  = ".corrupt"
+	orphanedSuffix = ".orphan"
+	repairSuffix   = ".repair"
+)
+
+// IssueKind classifies the problems found by Verify
+type IssueKind string
+
+// VerifyIssue is a problem found in a data folder
+type VerifyIssue struct {
+	File string
+	// Offset of the damaged record, -1 for issues about the whole file
+	Offset int64
+	Kind   IssueKind
+	Detail string
+}
+
+func (vi VerifyIssue) String() string {
+	if vi.Offset < 0 {
+		return fmt.Sprintf("%s: %s: %s", vi.File, vi.Kind, vi.Detail)
+	}
+	return fmt.Sprintf("%s@%d: %s: %s", vi.File, vi.Offset, vi.Kind, vi.Detail)
+}
+
+// SegmentReport summarises the records found in a segment file
+type SegmentReport struct {
+	File    string
+	ID      int
+	Records int
+	Size    int64
+	// ValidBytes is the number of bytes held by records that could be decoded
+	ValidBytes int64
+	Issues     []VerifyIssue
+}
+
+// VerifyReport is the outcome of checking a data folder
+type VerifyReport struct {
+	Segments []SegmentReport
+	Issues   []VerifyIssue
+	// Repaired is the number of files rewritten or moved aside by Repair
+	Repaired int
+}
+
+// OK tells whether no issue was found
+func (vr *VerifyReport) OK() bool {
+	return len(vr.Issues) == 0
+}
+
+// Verify checks every segment of the data folder without modifying it
+func Verify(dataDir string) (*VerifyReport, error) {
+	return verify(dataDir, false)
+}
+
+// Repair checks the data folder like Verify, rewriting damaged segments with
+// the records that can be salvaged and moving aside orphaned and duplicate
+// files. Original files are kept with a .corrupt or .orphan suffix.
+func Repair(dataDir string) (*VerifyReport, error) {
+	lockFile, err := lockDirectory(vfs.Default, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lockFile.Close()
+	return verify(dataDir, true)
+}
+
+func verify(dataDir string, repair bool) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	sealed, activeID, err := classifySegmentFiles(dataDir, report)
+	if err != nil {
+		return nil, err
+	}
+	files := sealed
+	if _, err := os.Stat(filepath.Join(dataDir, activeSegmentFilename)); err == nil {
+		files = append(files, filepath.Join(dataDir, activeSegmentFilename))
+	}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading segment %s: %w", f, err)
+		}
+		active := filepath.Base(f) == activeSegmentFilename
+		id := activeID
+		if active {
+			data = segments.TrimPreallocated(data)
+		} else {
+			id = segments.SegmentID(f, false)
+		}
+		segment, salvaged := scanSegment(f, id, data)
+		report.Segments = append(report.Segments, segment)
+		report.Issues = append(report.Issues, segment.Issues...)
+		if repair && len(segment.Issues) > 0 {
+			if err := rewriteSegment(f, salvaged, active); err != nil {
+				return report, err
+			}
+			report.Repaired++
+		}
+	}
+
+	if repair {
+		for _, issue := range report.Issues {
+			if issue.Kind != IssueOrphaned && issue.Kind != IssueDuplicate {
+				continue
+			}
+			path := filepath.Join(dataDir, issue.File)
+			// staging folders only hold links to and copies of other files,
+			// and their links would keep the space of dropped segments
+			if stagingFolder(issue.File) {
+				if err := os.RemoveAll(path); err != nil {
+					return report, fmt.Errorf("error removing %s: %w", issue.File, err)
+				}
+				report.Repaired++
+				continue
+			}
+			if err := os.Rename(path, path+orphanedSuffix); err != nil {
+				return report, fmt.Errorf("error moving aside %s: %w", issue.File, err)
+			}
+			report.Repaired++
+		}
+	}
+	return report, nil
+}
+
+// classifySegmentFiles returns the sealed segments the store would load,
+// reporting the ones it would load with a wrong or clashing ID and the ones
+// dropped from the manifest, along with the ID of the active segment
+func classifySegmentFiles(dataDir string, report *VerifyReport) ([]string, int, error) {
+	m, _, err := readManifest(vfs.Default, dataDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	files, err := filepath.Glob(filepath.Join(dataDir, segmentFilenameGlob))
+	if err != nil {
+		return nil, 0, err
+	}
+	byID := make(map[int][]string)
+	for _, f := range files {
+		id := segments.SegmentID(f, false)
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case id < 0:
+			report.Issues = append(report.Issues, VerifyIssue{
+				File: filepath.Base(f), Offset: -1, Kind: IssueOrphaned, Detail: "no segment ID in file name"})
+		case info.Size() == 0:
+			report.Issues = append(report.Issues, VerifyIssue{
+				File: filepath.Base(f), Offset: -1, Kind: IssueOrphaned, Detail: "empty sealed segment"})
+		case !m.segments[id] && id < m.active:
+			report.Issues = append(report.Issues, VerifyIssue{
+				File: filepath.Base(f), Offset: -1, Kind: IssueOrphaned, Detail: "segment dropped from the manifest"})
+		default:
+			byID[id] = append(byID[id], f)
+		}
+	}
+
+	ids := make([]int, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	sealed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		candidates := byID[id]
+		// the canonical file name wins over any other file with the same ID
+		canonical := filepath.Join(dataDir, fmt.Sprintf(segmentFilenameFmt, id))
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i] == canonical || (candidates[j] != canonical && candidates[i] < candidates[j])
+		})
+		sealed = append(sealed, candidates[0])
+		for _, duplicate := range candidates[1:] {
+			report.Issues = append(report.Issues, VerifyIssue{
+				File:   filepath.Base(duplicate),
+				Offset: -1,
+				Kind:   IssueDuplicate,
+				Detail: fmt.Sprintf("segment ID %d already used by %s", id, filepath.Base(candidates[0])),
+			})
+		}
+	}
+
+	// leftovers of interrupted backups, restores and writes
+	leftovers, err := filepath.Glob(filepath.Join(dataDir, ".*_*"))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, f := range leftovers {
+		name := filepath.Base(f)
+		if stagingFolder(name) {
+			report.Issues = append(report.Issues, VerifyIssue{
+				File: name, Offset: -1, Kind: IssueOrphaned, Detail: "leftover staging folder"})
+		} else if strings.HasPrefix(name, blobStagingPrefix) {
+			report.Issues = append(report.Issues, VerifyIssue{
+				File: name, Offset: -1, Kind: IssueOrphaned, Detail: "leftover staged blob"})
+		}
+	}
+	return sealed, m.active, nil
+}
+
+// stagingFolder tells whether name is a staging folder of a backup or a
+// restore
+func stagingFolder(name string) bool {
+	return strings.HasPrefix(name, ".backup_") || strings.HasPrefix(name, ".restore_")
+}
+
+// scanSegment decodes every record of data, resynchronising on the next
+// valid record after a damaged one, and returns the records it could decode
+func scanSegment(path string, id int, data []byte) (SegmentReport, []*encoding.Record) {
+	segment := SegmentReport{
+		File: filepath.Base(path),
+		ID:   id,
+		Size: int64(len(data)),
+	}
+	var salvaged []*encoding.Record
+	walkSegment(data, func(offset int64, record *encoding.Record, err error) {
+		if err != nil {
+			segment.Issues = append(segment.Issues, VerifyIssue{
+				File:   segment.File,
+				Offset: offset,
+				Kind:   issueKind(err),
+				Detail: err.Error(),
+			})
+			return
+		}
+		salvaged = append(salvaged, record)
+		segment.Records++
+		segment.ValidBytes += record.Size
+	})
+	return segment, salvaged
+}
+
+// walkSegment calls fn with every record of data along with its offset. A
+// damaged record is reported with its decoding error and skipped up to the
+// next decodable one.
+func walkSegment(data []byte, fn func(offset int64, record *encoding.Record, err error)) {
+	var offset int64
+	for offset < int64(len(data)) {
+		record, err := encoding.DecodeRecord(data[offset:])
+		fn(offset, record, err)
+		if err != nil {
+			offset = encoding.NextRecordOffset(data, offset+1)
+			continue
+		}
+		offset += record.Size
+	}
+}
+
+func issueKind(err error) IssueKind {
+	switch {
+	case errors.Is(err, encoding.ErrInvalidMagicNumber):
+		return IssueInvalidMagic
+	case errors.Is(err, encoding.ErrChecksumMismatch):
+		return IssueChecksum
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return IssueTruncated
+	default:
+		return IssueKind(err.Error())
+	}
+}
+
+// rewriteSegment replaces path with a segment holding the salvaged records
+func rewriteSegment(path string, salvaged []*encoding.Record, active bool) error {
+	if err := os.Rename(path, path+corruptSuffix); err != nil {
+		return fmt.Errorf("error moving aside %s: %w", path, err)
+	}
+	// the index no longer matches the segment and is rebuilt on open
+	if err := segments.RemoveSegmentIndex(vfs.Default, path); err != nil {
+		return err
+	}
+	// an empty file cannot be mapped, so sealed segments with nothing to
+	// salvage are only moved aside
+	if len(salvaged) == 0 && !active {
+		return nil
+	}
+
+	tmp := path + repairSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := encoding.NewBitCaskEncoder(f)
+	for _, record := range salvaged {
+		// keyspace, expiry and flags are kept along with the key and value
+		if _, err = encoder.WriteRecord(record); err != nil {
+			return fmt.Errorf("error writing salvaged record: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
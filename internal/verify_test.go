@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyHealthyFolder(t *testing.T) {
+	path := existingDataFolderWithSegments(t, 3)
+	defer os.RemoveAll(path)
+
+	report, err := Verify(path)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Len(t, report.Segments, 3)
+	for _, segment := range report.Segments {
+		assert.Equal(t, 10, segment.Records)
+		assert.Equal(t, segment.Size, segment.ValidBytes)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	path := existingDataFolderWithSegments(t, 3)
+	defer os.RemoveAll(path)
+
+	// flip a byte in the value of the first record of the second segment,
+	// which starts past its 21 bytes header and 2 bytes key
+	second := filepath.Join(path, "segment_00002.dat")
+	data, err := ioutil.ReadFile(second)
+	assert.NoError(t, err)
+	data[21+2+3] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(second, data, 0644))
+	// cut the last record of the third segment short
+	third := filepath.Join(path, "segment_00003.dat")
+	data, err = ioutil.ReadFile(third)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(third, data[:len(data)-4], 0644))
+	// a stray copy clashing with the first segment ID
+	data, err = ioutil.ReadFile(filepath.Join(path, "segment_00001.dat"))
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(path, "segment_00001.dat.dat"), data, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(path, "segment_x.dat"), data, 0644))
+
+	report, err := Verify(path)
+	assert.NoError(t, err)
+	kinds := make(map[IssueKind]int)
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	assert.Equal(t, map[IssueKind]int{
+		IssueChecksum:  1,
+		IssueTruncated: 1,
+		IssueDuplicate: 1,
+		IssueOrphaned:  1,
+	}, kinds)
+
+	report, err = Repair(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Repaired)
+
+	report, err = Verify(path)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "issues after repair: %v", report.Issues)
+
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	// the damaged records are lost, every other one is salvaged
+	assert.Len(t, db.Keys(), 28)
+	_, ok, _ := db.Get("20")
+	assert.False(t, ok)
+	_, ok, _ = db.Get("39")
+	assert.False(t, ok)
+	value, ok, err := db.Get("21")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value for key 21", string(value))
+}
@@ -0,0 +1,381 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type changeKind int
+
+const (
+	changeMkdir changeKind = iota
+	changeCreate
+	changeWrite
+	changeTruncate
+	changeAllocate
+	changeSync
+	changeRename
+	changeRemove
+	changeSyncDir
+	changeLink
+)
+
+// change is a modification of the filesystem recorded by a CrashFS. Files
+// are told apart by inode, as their handles outlive renames and removals.
+type change struct {
+	kind    changeKind
+	inode   int
+	path    string
+	newPath string
+	offset  int64
+	size    int64
+	data    []byte
+}
+
+// CrashFS records the changes made through it to an empty FS, so that the
+// state left by a crash after any of them can be rebuilt with CrashAt. The
+// data written to a file is lost unless synced, and the creations, renames
+// and removals in a directory unless it is synced.
+type CrashFS struct {
+	FS
+	// mutex orders the changes as they were made to FS
+	mutex   sync.Mutex
+	changes []change
+	names   map[string]int
+	inodes  int
+}
+
+// NewCrashFS records the changes made to fs, which must be empty
+func NewCrashFS(fs FS) *CrashFS {
+	return &CrashFS{FS: fs, names: make(map[string]int)}
+}
+
+// Changes returns the number of changes recorded so far
+func (cfs *CrashFS) Changes() int {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	return len(cfs.changes)
+}
+
+// Describe tells what change i was, for reporting crashes
+func (cfs *CrashFS) Describe(i int) string {
+	cfs.mutex.Lock()
+	c := cfs.changes[i]
+	cfs.mutex.Unlock()
+	switch c.kind {
+	case changeMkdir:
+		return "mkdir " + c.path
+	case changeCreate:
+		return "create " + c.path
+	case changeWrite:
+		return fmt.Sprintf("write %d bytes at %d to %s", len(c.data), c.offset, c.path)
+	case changeTruncate:
+		return fmt.Sprintf("truncate %s to %d", c.path, c.size)
+	case changeAllocate:
+		return fmt.Sprintf("allocate %d bytes to %s", c.size, c.path)
+	case changeSync:
+		return "sync " + c.path
+	case changeRename:
+		return "rename " + c.path + " to " + c.newPath
+	case changeRemove:
+		return "remove " + c.path
+	case changeLink:
+		return "link " + c.path + " to " + c.newPath
+	default:
+		return "sync directory " + c.path
+	}
+}
+
+// changesData tells whether the change is to the data of a file
+func (c change) changesData() bool {
+	return c.kind == changeWrite || c.kind == changeTruncate || c.kind == changeAllocate
+}
+
+// dirs returns the directories whose entries the change modifies
+func (c change) dirs() []string {
+	switch c.kind {
+	case changeMkdir, changeCreate, changeRemove:
+		return []string{filepath.Dir(c.path)}
+	case changeRename:
+		return []string{filepath.Dir(c.path), filepath.Dir(c.newPath)}
+	case changeLink:
+		return []string{filepath.Dir(c.newPath)}
+	default:
+		return nil
+	}
+}
+
+func (cfs *CrashFS) record(c change) {
+	c.path = filepath.Clean(c.path)
+	if c.newPath != "" {
+		c.newPath = filepath.Clean(c.newPath)
+	}
+	cfs.changes = append(cfs.changes, c)
+}
+
+func (cfs *CrashFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	f, err := cfs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	inode, ok := cfs.names[filepath.Clean(name)]
+	if !ok {
+		cfs.inodes++
+		inode = cfs.inodes
+		cfs.names[filepath.Clean(name)] = inode
+		cfs.record(change{kind: changeCreate, inode: inode, path: name})
+	} else if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		cfs.record(change{kind: changeTruncate, inode: inode, path: name})
+	}
+	return &crashFile{File: f, fs: cfs, inode: inode, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (cfs *CrashFS) TempFile(dir, pattern string) (File, error) {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	f, err := cfs.FS.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	cfs.inodes++
+	cfs.names[filepath.Clean(f.Name())] = cfs.inodes
+	cfs.record(change{kind: changeCreate, inode: cfs.inodes, path: f.Name()})
+	return &crashFile{File: f, fs: cfs, inode: cfs.inodes}, nil
+}
+
+func (cfs *CrashFS) Rename(oldpath, newpath string) error {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	if err := cfs.FS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if inode, ok := cfs.names[filepath.Clean(oldpath)]; ok {
+		delete(cfs.names, filepath.Clean(oldpath))
+		cfs.names[filepath.Clean(newpath)] = inode
+	}
+	cfs.record(change{kind: changeRename, path: oldpath, newPath: newpath})
+	return nil
+}
+
+func (cfs *CrashFS) Link(oldname, newname string) error {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	if err := cfs.FS.Link(oldname, newname); err != nil {
+		return err
+	}
+	if inode, ok := cfs.names[filepath.Clean(oldname)]; ok {
+		cfs.names[filepath.Clean(newname)] = inode
+	}
+	cfs.record(change{kind: changeLink, path: oldname, newPath: newname})
+	return nil
+}
+
+func (cfs *CrashFS) Remove(name string) error {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	if err := cfs.FS.Remove(name); err != nil {
+		return err
+	}
+	delete(cfs.names, filepath.Clean(name))
+	cfs.record(change{kind: changeRemove, path: name})
+	return nil
+}
+
+func (cfs *CrashFS) MkdirAll(path string, perm os.FileMode) error {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	if err := cfs.FS.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	cfs.record(change{kind: changeMkdir, path: path})
+	return nil
+}
+
+func (cfs *CrashFS) SyncDir(dir string) error {
+	cfs.mutex.Lock()
+	defer cfs.mutex.Unlock()
+	if err := cfs.FS.SyncDir(dir); err != nil {
+		return err
+	}
+	cfs.record(change{kind: changeSyncDir, path: dir})
+	return nil
+}
+
+func (cfs *CrashFS) Mmap(f File, size int) ([]byte, error) {
+	if cf, ok := f.(*crashFile); ok {
+		f = cf.File
+	}
+	return cfs.FS.Mmap(f, size)
+}
+
+// CrashAt returns the filesystem left by a crash following the first n
+// changes, holding the data and directory entries synced by then
+func (cfs *CrashFS) CrashAt(n int) (*MemFS, error) {
+	cfs.mutex.Lock()
+	changes := cfs.changes[:n]
+	cfs.mutex.Unlock()
+
+	// the data of a file is the one it held when last synced, and the
+	// entries of a directory the ones it held when last synced
+	lastSync := make(map[int]int)
+	lastDirSync := make(map[string]int)
+	for i, c := range changes {
+		if c.kind == changeSync {
+			lastSync[c.inode] = i
+		} else if c.kind == changeSyncDir {
+			lastDirSync[c.path] = i
+		}
+	}
+	synced := func(i int, c change) bool {
+		for _, dir := range c.dirs() {
+			if last, ok := lastDirSync[dir]; !ok || last < i {
+				return false
+			}
+		}
+		return true
+	}
+	dirs := make(map[string]bool)
+	names := make(map[string]int)
+	data := make(map[int][]byte)
+	for i, c := range changes {
+		if last, ok := lastSync[c.inode]; c.changesData() && (!ok || i > last) {
+			continue
+		}
+		if !synced(i, c) {
+			continue
+		}
+		switch c.kind {
+		case changeMkdir:
+			dirs[c.path] = true
+		case changeCreate:
+			names[c.path] = c.inode
+			data[c.inode] = nil
+		case changeWrite:
+			if end := c.offset + int64(len(c.data)); end > int64(len(data[c.inode])) {
+				data[c.inode] = append(data[c.inode], make([]byte, end-int64(len(data[c.inode])))...)
+			}
+			copy(data[c.inode][c.offset:], c.data)
+		case changeTruncate:
+			if c.size > int64(len(data[c.inode])) {
+				data[c.inode] = append(data[c.inode], make([]byte, c.size-int64(len(data[c.inode])))...)
+			} else {
+				data[c.inode] = data[c.inode][:c.size:c.size]
+			}
+		case changeAllocate:
+			if c.size > int64(len(data[c.inode])) {
+				data[c.inode] = append(data[c.inode], make([]byte, c.size-int64(len(data[c.inode])))...)
+			}
+		case changeRename:
+			if id, ok := names[c.path]; ok {
+				delete(names, c.path)
+				names[c.newPath] = id
+			}
+		case changeRemove:
+			delete(names, c.path)
+			delete(dirs, c.path)
+		case changeLink:
+			if id, ok := names[c.path]; ok {
+				names[c.newPath] = id
+			}
+		}
+	}
+
+	fs := NewMemFS()
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+	for _, dir := range sortedDirs {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	for path, id := range names {
+		f, err := Create(fs, path)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(data[id])
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// crashFile records the changes made to an open file, tracking its offset
+// to locate the writes not given one
+type crashFile struct {
+	File
+	fs     *CrashFS
+	inode  int
+	append bool
+	offset int64
+}
+
+func (f *crashFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.append {
+		info, err := f.File.Stat()
+		if err != nil {
+			return 0, err
+		}
+		f.offset = info.Size()
+	}
+	n, err := f.File.Write(p)
+	f.fs.record(change{kind: changeWrite, inode: f.inode, path: f.Name(), offset: f.offset, data: append([]byte(nil), p[:n]...)})
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	n, err := f.File.WriteAt(p, off)
+	f.fs.record(change{kind: changeWrite, inode: f.inode, path: f.Name(), offset: off, data: append([]byte(nil), p[:n]...)})
+	return n, err
+}
+
+func (f *crashFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	f.fs.record(change{kind: changeSync, inode: f.inode, path: f.Name()})
+	return nil
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.fs.record(change{kind: changeTruncate, inode: f.inode, path: f.Name(), size: size})
+	return nil
+}
+
+func (f *crashFile) Allocate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.File.Allocate(size); err != nil {
+		return err
+	}
+	f.fs.record(change{kind: changeAllocate, inode: f.inode, path: f.Name(), size: size})
+	return nil
+}
@@ -0,0 +1,77 @@
+package vfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrashFS(t *testing.T) {
+	fs := NewCrashFS(NewMemFS())
+	assert.NoError(t, fs.MkdirAll("/data", 0755))
+	assert.NoError(t, fs.SyncDir("/"))
+	f, err := fs.OpenFile("/data/current.dat", os.O_WRONLY|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("coffee"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Sync())
+	assert.NoError(t, fs.SyncDir("/data"))
+	synced := fs.Changes()
+	_, err = f.WriteAt([]byte("tea"), 6)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Rename("/data/current.dat", "/data/sealed.dat"))
+	// the handle syncs the file under its new name
+	assert.NoError(t, f.Sync())
+	assert.NoError(t, f.Close())
+	assert.NoError(t, fs.SyncDir("/data"))
+	assert.Equal(t, "sync directory /data", fs.Describe(synced-1))
+
+	// the file is lost until its directory is synced
+	crashed, err := fs.CrashAt(3)
+	assert.NoError(t, err)
+	assert.True(t, Exists(crashed, "/data"))
+	assert.False(t, Exists(crashed, "/data/current.dat"))
+
+	crashed, err = fs.CrashAt(synced)
+	assert.NoError(t, err)
+	data, err := ReadFile(crashed, "/data/current.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffee"), data)
+
+	// the unsynced write and rename are lost
+	crashed, err = fs.CrashAt(synced + 2)
+	assert.NoError(t, err)
+	assert.False(t, Exists(crashed, "/data/sealed.dat"))
+	data, err = ReadFile(crashed, "/data/current.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffee"), data)
+
+	// the synced write is kept under the old name
+	crashed, err = fs.CrashAt(synced + 3)
+	assert.NoError(t, err)
+	assert.False(t, Exists(crashed, "/data/sealed.dat"))
+	data, err = ReadFile(crashed, "/data/current.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffeetea"), data)
+
+	crashed, err = fs.CrashAt(fs.Changes())
+	assert.NoError(t, err)
+	assert.False(t, Exists(crashed, "/data/current.dat"))
+	data, err = ReadFile(crashed, "/data/sealed.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffeetea"), data)
+
+	// appends land at the end of the file
+	f, err = fs.OpenFile("/data/sealed.dat", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Sync())
+	f.Close()
+	crashed, err = fs.CrashAt(fs.Changes())
+	assert.NoError(t, err)
+	data, err = ReadFile(crashed, "/data/sealed.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffeetea!"), data)
+}
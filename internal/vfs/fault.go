@@ -0,0 +1,219 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Op is an operation of a FS that faults can be injected into
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpWrite
+	OpSync
+	OpTruncate
+	OpAllocate
+	OpRename
+	OpRemove
+	OpSyncDir
+	OpLink
+	// OpStat is the Stat of an open file
+	OpStat
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpOpen:
+		return "open"
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpTruncate:
+		return "truncate"
+	case OpAllocate:
+		return "allocate"
+	case OpRename:
+		return "rename"
+	case OpRemove:
+		return "remove"
+	case OpSyncDir:
+		return "syncdir"
+	case OpLink:
+		return "link"
+	case OpStat:
+		return "stat"
+	default:
+		return "unknown"
+	}
+}
+
+// Injector returns the error op on path fails with, nil letting it through.
+// Renames and links are given their old path. Writes failing with io.ErrShortWrite
+// write half their bytes first.
+type Injector func(op Op, path string) error
+
+// FailOn fails op with err on the files whose name matches pattern, as with
+// filepath.Match
+func FailOn(op Op, pattern string, err error) Injector {
+	return func(o Op, path string) error {
+		if o != op {
+			return nil
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); !ok {
+			return nil
+		}
+		return err
+	}
+}
+
+// FaultFS wraps a FS, failing the operations its injector picks, such as
+// writes running out of space with syscall.ENOSPC or renames failing
+type FaultFS struct {
+	FS
+	mutex    sync.RWMutex
+	injector Injector
+}
+
+// NewFaultFS wraps fs, letting every operation through until Inject is called
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{FS: fs}
+}
+
+// Inject replaces the injector, nil letting every operation through
+func (ffs *FaultFS) Inject(injector Injector) {
+	ffs.mutex.Lock()
+	ffs.injector = injector
+	ffs.mutex.Unlock()
+}
+
+func (ffs *FaultFS) fault(op Op, path string) error {
+	ffs.mutex.RLock()
+	injector := ffs.injector
+	ffs.mutex.RUnlock()
+	if injector == nil {
+		return nil
+	}
+	if err := injector(op, path); err != nil {
+		if err == io.ErrShortWrite {
+			return err
+		}
+		return &os.PathError{Op: op.String(), Path: path, Err: err}
+	}
+	return nil
+}
+
+func (ffs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := ffs.fault(OpOpen, name); err != nil {
+		return nil, err
+	}
+	f, err := ffs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: ffs}, nil
+}
+
+func (ffs *FaultFS) TempFile(dir, pattern string) (File, error) {
+	if err := ffs.fault(OpOpen, filepath.Join(dir, pattern)); err != nil {
+		return nil, err
+	}
+	f, err := ffs.FS.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: ffs}, nil
+}
+
+func (ffs *FaultFS) Rename(oldpath, newpath string) error {
+	if err := ffs.fault(OpRename, oldpath); err != nil {
+		return err
+	}
+	return ffs.FS.Rename(oldpath, newpath)
+}
+
+func (ffs *FaultFS) Link(oldname, newname string) error {
+	if err := ffs.fault(OpLink, oldname); err != nil {
+		return err
+	}
+	return ffs.FS.Link(oldname, newname)
+}
+
+func (ffs *FaultFS) Remove(name string) error {
+	if err := ffs.fault(OpRemove, name); err != nil {
+		return err
+	}
+	return ffs.FS.Remove(name)
+}
+
+func (ffs *FaultFS) SyncDir(dir string) error {
+	if err := ffs.fault(OpSyncDir, dir); err != nil {
+		return err
+	}
+	return ffs.FS.SyncDir(dir)
+}
+
+func (ffs *FaultFS) Mmap(f File, size int) ([]byte, error) {
+	if ff, ok := f.(*faultFile); ok {
+		f = ff.File
+	}
+	return ffs.FS.Mmap(f, size)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.fault(OpWrite, f.Name()); err != nil {
+		if err != io.ErrShortWrite {
+			return 0, err
+		}
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.fault(OpWrite, f.Name()); err != nil {
+		if err != io.ErrShortWrite {
+			return 0, err
+		}
+		n, _ := f.File.WriteAt(p[:len(p)/2], off)
+		return n, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fs.fault(OpStat, f.Name()); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.fault(OpSync, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.fault(OpTruncate, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Allocate(size int64) error {
+	if err := f.fs.fault(OpAllocate, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Allocate(size)
+}
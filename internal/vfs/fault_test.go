@@ -0,0 +1,44 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	f, err := Create(fs, "/segment.dat")
+	assert.NoError(t, err)
+
+	fs.Inject(FailOn(OpWrite, "*.dat", syscall.ENOSPC))
+	_, err = f.Write([]byte("coffee"))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+	fs.Inject(FailOn(OpWrite, "*.dat", io.ErrShortWrite))
+	n, err := f.WriteAt([]byte("coffee"), 0)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, 3, n)
+
+	// other operations and files are let through
+	assert.NoError(t, f.Sync())
+	other, err := Create(fs, "/MANIFEST")
+	assert.NoError(t, err)
+	_, err = other.Write([]byte("tea"))
+	assert.NoError(t, err)
+	other.Close()
+
+	fs.Inject(FailOn(OpRename, "segment.dat", syscall.EIO))
+	assert.True(t, errors.Is(fs.Rename("/segment.dat", "/segment_00001.dat"), syscall.EIO))
+	assert.NoError(t, fs.Rename("/MANIFEST", "/MANIFEST.old"))
+
+	fs.Inject(nil)
+	data, err := fs.Mmap(f, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("cof"), data)
+	assert.NoError(t, fs.Rename("/segment.dat", "/segment_00001.dat"))
+	f.Close()
+}
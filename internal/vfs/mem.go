@@ -0,0 +1,421 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is a filesystem held in memory, for tests. Only the root folder
+// exists at first. Syncs are no-ops, and mappings are copies of the files,
+// which is enough for the files the store maps since they never change.
+type MemFS struct {
+	mutex sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]time.Time
+	locks map[string]bool
+	temps int
+}
+
+// memNode is the content of a file, shared by its open handles and kept by
+// them once the file is removed
+type memNode struct {
+	mutex   sync.RWMutex
+	data    []byte
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// NewMemFS returns an empty in-memory filesystem
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]time.Time{string(filepath.Separator): time.Now()},
+		locks: make(map[string]bool),
+	}
+}
+
+func pathError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+func (fs *MemFS) clean(name string) string {
+	return filepath.Clean(string(filepath.Separator) + name)
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.openLocked(name, flag, perm)
+}
+
+func (fs *MemFS) openLocked(name string, flag int, perm os.FileMode) (File, error) {
+	path := fs.clean(name)
+	if _, ok := fs.dirs[path]; ok {
+		return nil, pathError("open", name, syscall.EISDIR)
+	}
+	if _, ok := fs.dirs[filepath.Dir(path)]; !ok {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	node, ok := fs.files[path]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, os.ErrNotExist)
+	case !ok:
+		node = &memNode{modTime: time.Now(), mode: perm}
+		fs.files[path] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.mutex.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.mutex.Unlock()
+	}
+	return &memFile{node: node, name: name, flag: flag}, nil
+}
+
+func (fs *MemFS) TempFile(dir, pattern string) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for {
+		fs.temps++
+		name := filepath.Join(dir, prefix+strconv.Itoa(fs.temps)+suffix)
+		if _, ok := fs.files[fs.clean(name)]; !ok {
+			return fs.openLocked(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		}
+	}
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	from, to := fs.clean(oldpath), fs.clean(newpath)
+	node, ok := fs.files[from]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.dirs[filepath.Dir(to)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.dirs[to]; ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+	}
+	delete(fs.files, from)
+	fs.files[to] = node
+	return nil
+}
+
+// Link shares the content of oldname with newname, as a hard link does
+func (fs *MemFS) Link(oldname, newname string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	from, to := fs.clean(oldname), fs.clean(newname)
+	node, ok := fs.files[from]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.dirs[filepath.Dir(to)]; !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	_, file := fs.files[to]
+	if _, dir := fs.dirs[to]; file || dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	fs.files[to] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path := fs.clean(name)
+	if _, ok := fs.files[path]; ok {
+		delete(fs.files, path)
+		return nil
+	}
+	if _, ok := fs.dirs[path]; !ok {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	if len(fs.entriesLocked(path)) > 0 {
+		return pathError("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(fs.dirs, path)
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path := fs.clean(name)
+	if node, ok := fs.files[path]; ok {
+		return node.stat(filepath.Base(path)), nil
+	}
+	if modTime, ok := fs.dirs[path]; ok {
+		return &memFileInfo{name: filepath.Base(path), mode: os.ModeDir | 0755, modTime: modTime}, nil
+	}
+	return nil, pathError("stat", name, os.ErrNotExist)
+}
+
+func (fs *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path := fs.clean(dirname)
+	if _, ok := fs.dirs[path]; !ok {
+		return nil, pathError("open", dirname, os.ErrNotExist)
+	}
+	return fs.entriesLocked(path), nil
+}
+
+func (fs *MemFS) entriesLocked(dir string) []os.FileInfo {
+	var entries []os.FileInfo
+	for path, node := range fs.files {
+		if filepath.Dir(path) == dir {
+			entries = append(entries, node.stat(filepath.Base(path)))
+		}
+	}
+	for path, modTime := range fs.dirs {
+		if path != dir && filepath.Dir(path) == dir {
+			entries = append(entries, &memFileInfo{name: filepath.Base(path), mode: os.ModeDir | 0755, modTime: modTime})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for dir := fs.clean(path); ; dir = filepath.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return pathError("mkdir", path, syscall.ENOTDIR)
+		}
+		if _, ok := fs.dirs[dir]; ok {
+			return nil
+		}
+		fs.dirs[dir] = time.Now()
+	}
+}
+
+func (fs *MemFS) SyncDir(dir string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, ok := fs.dirs[fs.clean(dir)]; !ok {
+		return pathError("sync", dir, os.ErrNotExist)
+	}
+	return nil
+}
+
+func (fs *MemFS) Mmap(f File, size int) ([]byte, error) {
+	mf, ok := f.(*memFile)
+	if !ok {
+		return nil, pathError("mmap", f.Name(), syscall.EINVAL)
+	}
+	mf.node.mutex.RLock()
+	defer mf.node.mutex.RUnlock()
+	if size <= 0 || size > len(mf.node.data) {
+		return nil, pathError("mmap", f.Name(), syscall.EINVAL)
+	}
+	return append([]byte(nil), mf.node.data[:size]...), nil
+}
+
+func (fs *MemFS) Munmap(data []byte) error {
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path := fs.clean(name)
+	if fs.locks[path] {
+		return nil, pathError("lock", name, syscall.EWOULDBLOCK)
+	}
+	f, err := fs.openLocked(name, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	fs.locks[path] = true
+	return &memLock{fs: fs, path: path}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	path string
+	once sync.Once
+}
+
+func (ml *memLock) Close() error {
+	ml.once.Do(func() {
+		ml.fs.mutex.Lock()
+		delete(ml.fs.locks, ml.path)
+		ml.fs.mutex.Unlock()
+	})
+	return nil
+}
+
+func (n *memNode) stat(name string) os.FileInfo {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFile is an open handle of a memNode
+type memFile struct {
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return pathError(op, f.name, os.ErrClosed)
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return pathError(op, f.name, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.node.mutex.RLock()
+	defer f.node.mutex.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.node.mutex.RLock()
+		f.offset = int64(len(f.node.data))
+		f.node.mutex.RUnlock()
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.node.mutex.Lock()
+	defer f.node.mutex.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.grow(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+// grow extends the file with zeros up to size
+func (n *memNode) grow(size int64) {
+	if size <= int64(cap(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, n.data)
+	n.data = data
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return pathError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return f.node.stat(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", false)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.node.mutex.Lock()
+	defer f.node.mutex.Unlock()
+	if size > int64(len(f.node.data)) {
+		f.node.grow(size)
+	} else {
+		// the bytes past size read as zeros if the file grows again
+		tail := f.node.data[size:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		f.node.data = f.node.data[:size]
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Allocate(size int64) error {
+	if err := f.check("allocate", true); err != nil {
+		return err
+	}
+	f.node.mutex.Lock()
+	defer f.node.mutex.Unlock()
+	if size > int64(len(f.node.data)) {
+		f.node.grow(size)
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,111 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/data/store", 0755))
+	_, err := fs.OpenFile("/missing/file", os.O_RDWR|os.O_CREATE, 0644)
+	assert.True(t, os.IsNotExist(err))
+
+	f, err := Create(fs, "/data/store/b.dat")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("coffee"))
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("tea"), 10)
+	assert.NoError(t, err)
+	info, err := f.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(13), info.Size())
+	assert.NoError(t, f.Close())
+
+	data, err := ReadFile(fs, "/data/store/b.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffee\x00\x00\x00\x00tea"), data)
+
+	// appends go to the end whatever the offset
+	f, err = fs.OpenFile("/data/store/b.dat", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Truncate(6))
+	assert.NoError(t, f.Allocate(8))
+	assert.NoError(t, f.Close())
+	data, err = ReadFile(fs, "/data/store/b.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffee\x00\x00"), data)
+
+	_, err = fs.OpenFile("/data/store/b.dat", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	assert.True(t, os.IsExist(err))
+
+	// open handles keep reading renamed and removed files
+	r, err := Open(fs, "/data/store/b.dat")
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Rename("/data/store/b.dat", "/data/store/a.dat"))
+	assert.False(t, Exists(fs, "/data/store/b.dat"))
+	tmp, err := fs.TempFile("/data/store", ".tmp_")
+	assert.NoError(t, err)
+	tmp.Close()
+	entries, err := fs.ReadDir("/data/store")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, ".tmp_1", entries[0].Name())
+	assert.Equal(t, "a.dat", entries[1].Name())
+	matches, err := Glob(fs, "/data/store/*.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/data/store/a.dat"}, matches)
+
+	// links share the file and outlive its removal
+	assert.NoError(t, fs.Link("/data/store/a.dat", "/data/store/c.dat"))
+	assert.True(t, os.IsExist(fs.Link("/data/store/a.dat", "/data/store/c.dat")))
+	assert.NoError(t, fs.Remove("/data/store/a.dat"))
+	data, err = ReadFile(fs, "/data/store/c.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffee\x00\x00"), data)
+	buffer := make([]byte, 8)
+	n, err := r.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	_, err = r.Read(buffer)
+	assert.Equal(t, io.EOF, err)
+	_, err = r.Write(buffer)
+	assert.Error(t, err)
+	assert.NoError(t, r.Close())
+
+	assert.Error(t, fs.Remove("/data/store"))
+	_, err = fs.Stat("/data/store/a.dat")
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, RemoveAll(fs, "/data/store"))
+	assert.False(t, Exists(fs, "/data/store"))
+	assert.NoError(t, RemoveAll(fs, "/data/store"))
+}
+
+func TestMemFSMmapAndLock(t *testing.T) {
+	fs := NewMemFS()
+	f, err := Create(fs, "/segment.dat")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("coffee"))
+	assert.NoError(t, err)
+	data, err := fs.Mmap(f, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("coffee"), data)
+	_, err = fs.Mmap(f, 7)
+	assert.Error(t, err)
+	assert.NoError(t, fs.Munmap(data))
+	f.Close()
+
+	lock, err := fs.Lock("/.locked")
+	assert.NoError(t, err)
+	_, err = fs.Lock("/.locked")
+	assert.Error(t, err)
+	assert.NoError(t, lock.Close())
+	lock, err = fs.Lock("/.locked")
+	assert.NoError(t, err)
+	lock.Close()
+}
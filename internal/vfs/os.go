@@ -0,0 +1,101 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (osFS) TempFile(dir, pattern string) (File, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (osFS) Mmap(f File, size int) ([]byte, error) {
+	of, ok := f.(osFile)
+	if !ok {
+		return nil, fmt.Errorf("error mapping %s: not a file of the OS", f.Name())
+	}
+	data, err := syscall.Mmap(int(of.Fd()), 0, size, syscall.PROT_READ, mmapFlags)
+	if err != nil {
+		return nil, err
+	}
+	adviseWillNeed(data)
+	return data, nil
+}
+
+func (osFS) Munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f osFile) Sync() error {
+	return datasync(f.File)
+}
+
+func (f osFile) Allocate(size int64) error {
+	return fallocate(f.File, size)
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const mmapFlags = syscall.MAP_SHARED | syscall.MAP_POPULATE
+
+// datasync flushes the data of f along with the metadata needed to read it
+// back, skipping the timestamps fsync also writes
+func datasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// fallocate allocates the blocks of the first size bytes of f, growing it
+// with zeros up to size. Filesystems without support keep growing the file
+// on write.
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
+
+func adviseWillNeed(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(syscall.MADV_WILLNEED))
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapFlags = syscall.MAP_SHARED
+
+func datasync(f *os.File) error {
+	return f.Sync()
+}
+
+// fallocate is a no-op, the file growing on write
+func fallocate(f *os.File, size int64) error {
+	return nil
+}
+
+func adviseWillNeed(b []byte) {}
@@ -0,0 +1,131 @@
+// Package vfs abstracts the filesystem the store lives in, so that tests can
+// run it in memory or inject faults into it
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File is an open file of a FS
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	// Sync makes the data of the file durable, along with the metadata
+	// needed to read it back
+	Sync() error
+	Truncate(size int64) error
+	// Allocate reserves the blocks of the first size bytes of the file,
+	// growing it with zeros up to size
+	Allocate(size int64) error
+}
+
+// FS is the filesystem holding a data folder
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// TempFile creates a new file in dir, named after pattern as with
+	// ioutil.TempFile
+	TempFile(dir, pattern string) (File, error)
+	Rename(oldpath, newpath string) error
+	// Link creates newname as a hard link to the file oldname
+	Link(oldname, newname string) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of dirname sorted by name
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	// SyncDir makes the creations, renames and removals in dir durable
+	SyncDir(dir string) error
+	// Mmap maps the first size bytes of f read only, until unmapped with
+	// Munmap. The mapping outlives f.
+	Mmap(f File, size int) ([]byte, error)
+	Munmap(data []byte) error
+	// Lock takes an exclusive lock on the file name, created if missing,
+	// which is held until closed. It fails if the lock is already held.
+	Lock(name string) (io.Closer, error)
+}
+
+// Default is the filesystem of the operating system
+var Default FS = osFS{}
+
+// Open opens name for reading
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates name for writing
+func Create(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// ReadFile returns the content of name
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := Open(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// Exists tells whether name exists
+func Exists(fs FS, name string) bool {
+	_, err := fs.Stat(name)
+	return err == nil
+}
+
+// RemoveAll removes path along with everything it holds, succeeding when
+// it is missing as with os.RemoveAll
+func RemoveAll(fs FS, path string) error {
+	info, err := fs.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := RemoveAll(fs, filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Glob returns the files of the folder of pattern whose name matches the
+// last element of pattern, sorted, ignoring I/O errors like filepath.Glob
+func Glob(fs FS, pattern string) ([]string, error) {
+	dir, base := filepath.Split(pattern)
+	if _, err := filepath.Match(base, ""); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, nil
+	}
+	var matches []string
+	for _, entry := range entries {
+		if ok, _ := filepath.Match(base, entry.Name()); ok {
+			matches = append(matches, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return matches, nil
+}
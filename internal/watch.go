@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"pingcap.com/kvs/internal/segments"
+	"pingcap.com/kvs/internal/segments/encoding"
+	"pingcap.com/kvs/internal/vfs"
+)
+
+// watchBuffer is the number of changes a watcher can lag behind the writers
+// before it is failed with errWatchOverflow
+const watchBuffer = 1024
+
+var (
+	errPositionUnavailable = errors.New("error due to log position not in the log anymore")
+	errInvalidLogPosition  = errors.New("error due to invalid log position")
+	errWatchOverflow       = errors.New("error due to watcher lagging behind the writes")
+	errStoreClosed         = errors.New("error using a closed store")
+)
+
+// Watchable stores publish the changes of their keys
+type Watchable interface {
+	// Watch notifies the changes of the keys starting with prefix from now on
+	Watch(prefix string) *Watcher
+
+	// WatchFrom replays the changes of the keys starting with prefix found in
+	// the log from position from, before notifying the new ones
+	WatchFrom(prefix string, from LogPosition) (*Watcher, error)
+}
+
+// LogPosition locates a point of the log between two records
+type LogPosition struct {
+	SegmentID int
+	Offset    int64
+}
+
+func (lp LogPosition) String() string {
+	return fmt.Sprintf("%d:%d", lp.SegmentID, lp.Offset)
+}
+
+// ParseLogPosition parses a position formatted by LogPosition.String
+func ParseLogPosition(s string) (LogPosition, error) {
+	var lp LogPosition
+	if _, err := fmt.Sscanf(s, "%d:%d", &lp.SegmentID, &lp.Offset); err != nil || lp.SegmentID < 0 || lp.Offset < 0 {
+		return LogPosition{}, fmt.Errorf("%w: %q", errInvalidLogPosition, s)
+	}
+	return lp, nil
+}
+
+// ChangeOp is the kind of change applied to a key
+type ChangeOp uint8
+
+const (
+	ChangeSet ChangeOp = iota
+	ChangeRemove
+)
+
+func (op ChangeOp) String() string {
+	if op == ChangeRemove {
+		return "remove"
+	}
+	return "set"
+}
+
+// ChangeEvent describes a change committed to the log
+type ChangeEvent struct {
+	Key string
+	Op  ChangeOp
+	// Location is where the new value is stored, zero for removals
+	Location segments.KeyDirEntry
+	// Position follows the record of the change, so a watch resumed from it
+	// gets the changes committed after this one
+	Position LogPosition
+}
+
+func newChangeEvent(record *encoding.Record, entry segments.KeyDirEntry) ChangeEvent {
+	event := ChangeEvent{
+		Key:      string(record.Key),
+		Position: LogPosition{SegmentID: entry.FileID, Offset: entry.Offset + entry.Size},
+	}
+	if record.Tombstone() {
+		event.Op = ChangeRemove
+	} else {
+		event.Location = entry
+	}
+	return event
+}
+
+// Watcher delivers the changes of a watch in log order. A watcher falling
+// too far behind the writes is failed, and can be resumed from the position
+// of the last change it received.
+type Watcher struct {
+	hub      *watchHub
+	keyspace uint32
+	prefix   string
+	// live gets the changes from the writers, which never block on it
+	live   chan ChangeEvent
+	events chan ChangeEvent
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// Events returns the channel of changes, closed once the watch ends
+func (w *Watcher) Events() <-chan ChangeEvent {
+	return w.events
+}
+
+// Err tells why the watch ended once Events is closed, nil after Close
+func (w *Watcher) Err() error {
+	select {
+	case <-w.done:
+		return w.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the watch
+func (w *Watcher) Close() {
+	w.fail(nil)
+}
+
+func (w *Watcher) fail(err error) {
+	w.once.Do(func() {
+		w.err = err
+		close(w.done)
+		w.hub.unregister(w)
+	})
+}
+
+func (w *Watcher) matches(keyspace uint32, key []byte) bool {
+	return keyspace == w.keyspace && strings.HasPrefix(string(key), w.prefix)
+}
+
+func (w *Watcher) send(event ChangeEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// run replays history, if any, then forwards the live changes
+func (w *Watcher) run(history *logReader) {
+	defer close(w.events)
+	if history != nil {
+		err := w.replay(history)
+		history.Close()
+		if err != nil {
+			w.fail(err)
+			return
+		}
+	}
+	for {
+		select {
+		case event := <-w.live:
+			if !w.send(event) {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Watcher) replay(history *logReader) error {
+	for {
+		record, entry, err := history.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if w.matches(record.Keyspace, record.Key) && !w.send(newChangeEvent(record, entry)) {
+			return nil
+		}
+	}
+}
+
+// watchHub dispatches the changes to the watchers. Publishing happens under
+// the store write lock, so the changes are seen in log order.
+type watchHub struct {
+	mutex    sync.RWMutex
+	watchers map[*Watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*Watcher]struct{})}
+}
+
+// watch registers a watcher, which must be started once any history is known
+func (wh *watchHub) watch(keyspace uint32, prefix string) *Watcher {
+	w := &Watcher{
+		hub:      wh,
+		keyspace: keyspace,
+		prefix:   prefix,
+		live:     make(chan ChangeEvent, watchBuffer),
+		events:   make(chan ChangeEvent),
+		done:     make(chan struct{}),
+	}
+	wh.mutex.Lock()
+	wh.watchers[w] = struct{}{}
+	wh.mutex.Unlock()
+	return w
+}
+
+func (wh *watchHub) unregister(w *Watcher) {
+	wh.mutex.Lock()
+	delete(wh.watchers, w)
+	wh.mutex.Unlock()
+}
+
+func (wh *watchHub) publish(record *encoding.Record, entry segments.KeyDirEntry) {
+	wh.mutex.RLock()
+	var lagging []*Watcher
+	for w := range wh.watchers {
+		if !w.matches(record.Keyspace, record.Key) {
+			continue
+		}
+		select {
+		case w.live <- newChangeEvent(record, entry):
+		default:
+			lagging = append(lagging, w)
+		}
+	}
+	wh.mutex.RUnlock()
+	for _, w := range lagging {
+		w.fail(errWatchOverflow)
+	}
+}
+
+// closeAll ends the watches of keyspace, or every watch when all is set
+func (wh *watchHub) closeAll(keyspace uint32, all bool, err error) {
+	wh.mutex.RLock()
+	var closed []*Watcher
+	for w := range wh.watchers {
+		if all || w.keyspace == keyspace {
+			closed = append(closed, w)
+		}
+	}
+	wh.mutex.RUnlock()
+	for _, w := range closed {
+		w.fail(err)
+	}
+}
+
+// logSpan is the part of a segment file read by a logReader
+type logSpan struct {
+	segmentID int
+	path      string
+	offset    int64
+	end       int64
+	f         vfs.File
+}
+
+// logReader reads the records of a range of the log in order
+type logReader struct {
+	spans   []logSpan
+	decoder *encoding.BitCaskDecoder
+}
+
+// openLogReader opens every span, failing when one of the segments is gone
+func openLogReader(fs vfs.FS, spans []logSpan) (*logReader, error) {
+	lr := &logReader{spans: spans}
+	for i := range spans {
+		f, err := vfs.Open(fs, spans[i].path)
+		if err != nil {
+			lr.Close()
+			return nil, fmt.Errorf("%w: %v", errPositionUnavailable, err)
+		}
+		spans[i].f = f
+	}
+	return lr, nil
+}
+
+// Next returns the next record along with its location, or io.EOF
+func (lr *logReader) Next() (*encoding.Record, segments.KeyDirEntry, error) {
+	for len(lr.spans) > 0 {
+		span := &lr.spans[0]
+		if span.offset >= span.end {
+			span.f.Close()
+			lr.spans = lr.spans[1:]
+			lr.decoder = nil
+			continue
+		}
+		if lr.decoder == nil {
+			lr.decoder = encoding.NewBitCaskDecoder(bufio.NewReader(io.NewSectionReader(span.f, span.offset, span.end-span.offset)))
+		}
+		record, err := lr.decoder.ReadRecord()
+		if err != nil {
+			return nil, segments.KeyDirEntry{}, fmt.Errorf("error reading segment %s: %w", span.path,
+				&segments.CorruptRecordError{Offset: span.offset, Err: err})
+		}
+		entry := segments.KeyDirEntry{FileID: span.segmentID, Offset: span.offset, Size: record.Size}
+		span.offset += record.Size
+		return record, entry, nil
+	}
+	return nil, segments.KeyDirEntry{}, io.EOF
+}
+
+func (lr *logReader) Close() {
+	for _, span := range lr.spans {
+		if span.f != nil {
+			span.f.Close()
+		}
+	}
+	lr.spans = nil
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nextChange waits for the next change of w
+func nextChange(t *testing.T, w *Watcher) ChangeEvent {
+	select {
+	case event, ok := <-w.Events():
+		assert.True(t, ok, "watch ended: %v", w.Err())
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+		return ChangeEvent{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	sessions, err := db.Keyspace("sessions")
+	assert.NoError(t, err)
+
+	w := db.Watch("user/")
+	assert.NoError(t, db.Set("user/1", []byte("geisha")))
+	// other prefixes and keyspaces are filtered out
+	assert.NoError(t, db.Set("order/1", []byte("bourbon")))
+	assert.NoError(t, sessions.Set("user/1", []byte("token")))
+	assert.NoError(t, db.Remove("user/1"))
+
+	set := nextChange(t, w)
+	assert.Equal(t, "user/1", set.Key)
+	assert.Equal(t, ChangeSet, set.Op)
+	value, err := db.logStore.ReadKeyDirEntry(set.Location)
+	assert.NoError(t, err)
+	assert.Equal(t, "geisha", string(value))
+	removal := nextChange(t, w)
+	assert.Equal(t, ChangeRemove, removal.Op)
+	assert.True(t, set.Position.SegmentID == removal.Position.SegmentID && set.Position.Offset < removal.Position.Offset)
+	w.Close()
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+	assert.NoError(t, w.Err())
+
+	// resuming after the first change replays the following ones, across
+	// segments, before the live ones
+	value = bytes.Repeat([]byte{0xb}, 64*1024)
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Set("user/"+strconv.Itoa(i), value))
+	}
+	w, err = db.WatchFrom("user/", set.Position)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("user/live", nil))
+	assert.Equal(t, removal, nextChange(t, w))
+	for i := 0; i < 40; i++ {
+		event := nextChange(t, w)
+		assert.Equal(t, "user/"+strconv.Itoa(i), event.Key)
+	}
+	assert.Equal(t, "user/live", nextChange(t, w).Key)
+
+	// dropping a keyspace ends its watches
+	dropped := sessions.Watch("")
+	assert.NoError(t, db.DropKeyspace("sessions"))
+	_, ok = <-dropped.Events()
+	assert.False(t, ok)
+	assert.Equal(t, errKeyspaceDropped, dropped.Err())
+
+	// the store closes the watches left open
+	assert.NoError(t, db.Close())
+	_, ok = <-w.Events()
+	assert.False(t, ok)
+	assert.Equal(t, errStoreClosed, w.Err())
+
+	db, err = OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.WatchFrom("", LogPosition{SegmentID: 99})
+	assert.Error(t, err)
+	_, err = ParseLogPosition("1:-3")
+	assert.Error(t, err)
+	position, err := ParseLogPosition(set.Position.String())
+	assert.NoError(t, err)
+	assert.Equal(t, set.Position, position)
+}
+
+func TestWatchOverflow(t *testing.T) {
+	path, _ := ioutil.TempDir("/tmp", "kvstore_*")
+	defer os.RemoveAll(path)
+	db, err := OpenBitCaskStore(path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// a watcher nobody reads is failed instead of blocking the writes
+	w := db.Watch("")
+	for i := 0; i < watchBuffer+2; i++ {
+		assert.NoError(t, db.Set(strconv.Itoa(i), nil))
+	}
+	received := 0
+	for range w.Events() {
+		received++
+	}
+	assert.True(t, received <= watchBuffer+1)
+	assert.Equal(t, errWatchOverflow, w.Err())
+}